@@ -721,11 +721,11 @@ func iterate(filename string, prefix string) error {
 	}
 	defer vDecomp.Close()
 	gv := vDecomp.MakeGetter()
-	g := efDecomp.MakeGetter()
+	g := seg.NewReader(efDecomp.MakeGetter(), seg.CompressValsZstd)
 	for g.HasNext() {
-		key, _ := g.NextUncompressed()
+		key, _ := g.Next(nil)
 		if bytes.HasPrefix(key, pBytes) {
-			val, _ := g.NextUncompressed()
+			val, _ := g.Next(nil)
 			ef, _ := eliasfano32.ReadEliasFano(val)
 			efIt := ef.Iterator()
 			fmt.Printf("[%x] =>", key)
@@ -755,7 +755,7 @@ func iterate(filename string, prefix string) error {
 			}
 			fmt.Printf("\n")
 		} else {
-			g.SkipUncompressed()
+			g.Skip()
 		}
 	}
 	return nil
@@ -20,6 +20,7 @@ import (
 	"bufio"
 	"encoding/binary"
 	"fmt"
+	"math/bits"
 	"os"
 	"path/filepath"
 	"reflect"
@@ -61,12 +62,22 @@ func OpenFixedSizeBitmaps(filePath string) (*FixedSizeBitmaps, error) {
 	if err != nil {
 		return nil, fmt.Errorf("OpenFixedSizeBitmaps: %w", err)
 	}
+	defer func() {
+		if err != nil {
+			idx.Close()
+		}
+	}()
 	var stat os.FileInfo
 	if stat, err = idx.f.Stat(); err != nil {
 		return nil, err
 	}
 	idx.size = int(stat.Size())
 	idx.modTime = stat.ModTime()
+	// power-off may leave zero-length or torn file: report it as error - caller will treat it as missing and re-build
+	if idx.size < MetaHeaderSize {
+		err = fmt.Errorf("file is truncated: len=%d < header=%d, %s", idx.size, MetaHeaderSize, fName)
+		return nil, err
+	}
 	idx.m, err = mmap2.MapRegion(idx.f, idx.size, mmap2.RDONLY, 0, 0)
 	if err != nil {
 		return nil, err
@@ -83,7 +94,8 @@ func OpenFixedSizeBitmaps(filePath string) (*FixedSizeBitmaps, error) {
 	idx.bitsPerBitmap = int(binary.BigEndian.Uint16(idx.metaData[pos : pos+8]))
 	pos += 2 // nolint
 	if idx.bitsPerBitmap*int(idx.count)/8 > idx.size-MetaHeaderSize {
-		return nil, fmt.Errorf("file metadata doesn't match file length: bitsPerBitmap=%d, count=%d, len=%d, %s", idx.bitsPerBitmap, int(idx.count), idx.size, fName)
+		err = fmt.Errorf("file metadata doesn't match file length: bitsPerBitmap=%d, count=%d, len=%d, %s", idx.bitsPerBitmap, int(idx.count), idx.size, fName)
+		return nil, err
 	}
 	return idx, nil
 }
@@ -132,6 +144,29 @@ func (bm *FixedSizeBitmaps) At(item uint64) (res []uint64, err error) {
 	return res, nil
 }
 
+// CardinalityAt - amount of set bits in bitmap of `item`. Counts bits word-by-word - without materializing result of `At`
+func (bm *FixedSizeBitmaps) CardinalityAt(item uint64) (uint64, error) {
+	if item > bm.count {
+		return 0, fmt.Errorf("too big item number: %d > %d", item, bm.count)
+	}
+
+	from := bm.bitsPerBitmap * int(item)
+	to := from + bm.bitsPerBitmap
+
+	var cnt int
+	for n := from; n < to; {
+		blk, bit := n/64, n%64
+		width := min(64-bit, to-n)
+		word := bm.data[blk] >> bit
+		if width < 64 {
+			word &= (1 << width) - 1
+		}
+		cnt += bits.OnesCount64(word)
+		n += width
+	}
+	return uint64(cnt), nil
+}
+
 func (bm *FixedSizeBitmaps) LastAt(item uint64) (last uint64, ok bool, err error) {
 	if item > bm.count {
 		return 0, false, fmt.Errorf("too big item number: %d > %d", item, bm.count)
@@ -195,6 +230,90 @@ func (bm *FixedSizeBitmaps) First2At(item, after uint64) (fst uint64, snd uint64
 	return fst + bm.baseDataID, snd + bm.baseDataID, ok, ok2, err
 }
 
+type First2Result struct {
+	First, Second uint64
+	Ok, Ok2       bool
+}
+
+// First2AtBatch - First2At for many items: res[i] is result of keys[i]. `keys` must be sorted - then bitmaps are read
+// in file order, in one pass. Bitmaps are scanned word-by-word. Values less than `from` are skipped,
+// `after` has same meaning as in First2At.
+func (bm *FixedSizeBitmaps) First2AtBatch(keys []uint64, from, after uint64) ([]First2Result, error) {
+	skip := after
+	if from > bm.baseDataID {
+		skip = max(skip, from-bm.baseDataID)
+	}
+	skip = min(skip, uint64(bm.bitsPerBitmap))
+
+	res := make([]First2Result, len(keys))
+	for i, item := range keys {
+		if item > bm.count {
+			return nil, fmt.Errorf("too big item number: %d > %d", item, bm.count)
+		}
+		if i > 0 && item < keys[i-1] {
+			return nil, fmt.Errorf("keys are not sorted: %d after %d", item, keys[i-1])
+		}
+
+		start := bm.bitsPerBitmap * int(item)
+		end := start + bm.bitsPerBitmap
+		r := &res[i]
+		for n := start + int(skip); n < end && !r.Ok2; {
+			blk, bit := n/64, n%64
+			width := min(64-bit, end-n)
+			word := bm.data[blk] >> bit
+			if width < 64 {
+				word &= (1 << width) - 1
+			}
+			for ; word != 0 && !r.Ok2; word &= word - 1 {
+				v := uint64(n-start+bits.TrailingZeros64(word)) + bm.baseDataID
+				if !r.Ok {
+					r.First, r.Ok = v, true
+				} else {
+					r.Second, r.Ok2 = v, true
+				}
+			}
+			n += width
+		}
+	}
+	return res, nil
+}
+
+// Around - neighborhood of `at` in bitmap of `item`: last set position before `at` (prev),
+// first set position at/after `at` (cur) and the one after it (next)
+func (bm *FixedSizeBitmaps) Around(item, at uint64) (prev, cur, next uint64, okPrev, okCur, okNext bool, err error) {
+	if item > bm.count {
+		return 0, 0, 0, false, false, false, fmt.Errorf("too big item number: %d > %d", item, bm.count)
+	}
+	n := bm.bitsPerBitmap * int(item)
+	blkFrom, bitFrom := n/64, n%64
+	blkTo := (n+bm.bitsPerBitmap)/64 + 1
+	bitTo := 64
+
+	var j uint64
+	for i := blkFrom; i < blkTo; i++ {
+		if i == blkTo-1 {
+			bitTo = (n + bm.bitsPerBitmap) % 64
+		}
+		for bit := bitFrom; bit < bitTo; bit++ {
+			if bm.data[i]&(1<<bit) != 0 {
+				v := j + bm.baseDataID
+				switch {
+				case v < at:
+					prev, okPrev = v, true
+				case !okCur:
+					cur, okCur = v, true
+				default:
+					next, okNext = v, true
+					return
+				}
+			}
+			j++
+		}
+		bitFrom = 0
+	}
+	return
+}
+
 type FixedSizeBitmapsWriter struct {
 	f *os.File
 
@@ -350,6 +469,9 @@ func (w *FixedSizeBitmapsWriter) Build() error {
 	if err := os.Rename(w.tmpIdxFilePath, w.indexFile); err != nil {
 		return err
 	}
+	if err := w.fsyncDir(); err != nil {
+		return err
+	}
 	return nil
 }
 
@@ -368,3 +490,20 @@ func (w *FixedSizeBitmapsWriter) fsync() error {
 	}
 	return nil
 }
+
+// fsyncDir - `rename` is not durable until parent directory entry is fsynced
+func (w *FixedSizeBitmapsWriter) fsyncDir() error {
+	if w.noFsync {
+		return nil
+	}
+	d, err := os.Open(filepath.Dir(w.indexFile))
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	if err := d.Sync(); err != nil {
+		w.logger.Warn("couldn't fsync dir", "err", err, "file", w.indexFile)
+		return err
+	}
+	return nil
+}
@@ -92,6 +92,206 @@ func TestFixedSizeBitmaps(t *testing.T) {
 	require.Error(err)
 }
 
+func TestFixedSizeBitmapsCardinalityAt(t *testing.T) {
+	tmpDir, require := t.TempDir(), require.New(t)
+	idxPath := filepath.Join(tmpDir, "idx.tmp")
+	// 100 bits per bitmap: bitmaps cross uint64 boundaries
+	count := uint64(16)
+	wr, err := NewFixedSizeBitmapsWriter(idxPath, 100, 0, count, log.New())
+	require.NoError(err)
+	defer wr.Close()
+
+	for i := uint64(0); i < count; i++ {
+		var vals []uint64
+		for v := i % 3; v < 100; v += i + 1 {
+			vals = append(vals, v)
+		}
+		require.NoError(wr.AddArray(i, vals))
+	}
+	require.NoError(wr.Build())
+
+	bm, err := OpenFixedSizeBitmaps(idxPath)
+	require.NoError(err)
+	defer bm.Close()
+
+	for i := uint64(0); i < count; i++ {
+		all, err := bm.At(i)
+		require.NoError(err)
+		cnt, err := bm.CardinalityAt(i)
+		require.NoError(err)
+		require.Equal(uint64(len(all)), cnt, "item %d", i)
+	}
+
+	_, err = bm.At(count + 1)
+	require.Error(err)
+	_, err = bm.CardinalityAt(count + 1)
+	require.Error(err)
+}
+
+// fixedSizeBitmapsFixture - `count+1` bitmaps of 100 bits (cross uint64 boundaries), item `i` has every (i+1)-th bit set
+func fixedSizeBitmapsFixture(tb testing.TB, count uint64) *FixedSizeBitmaps {
+	tb.Helper()
+	idxPath := filepath.Join(tb.TempDir(), "idx.tmp")
+	wr, err := NewFixedSizeBitmapsWriter(idxPath, 100, 0, count, log.New())
+	require.NoError(tb, err)
+	defer wr.Close()
+	for i := uint64(0); i <= count; i++ {
+		var vals []uint64
+		for v := i % 3; v < 100; v += i%50 + 1 {
+			vals = append(vals, v)
+		}
+		require.NoError(tb, wr.AddArray(i, vals))
+	}
+	require.NoError(tb, wr.Build())
+
+	bm, err := OpenFixedSizeBitmaps(idxPath)
+	require.NoError(tb, err)
+	tb.Cleanup(bm.Close)
+	return bm
+}
+
+func TestFixedSizeBitmapsFirst2AtBatch(t *testing.T) {
+	require := require.New(t)
+	count := uint64(64)
+	bm := fixedSizeBitmapsFixture(t, count)
+
+	keys := make([]uint64, 0, count+1)
+	for i := uint64(0); i <= count; i++ {
+		keys = append(keys, i)
+	}
+	for _, after := range []uint64{0, 1, 2, 50, 63, 64, 98, 99, 100} {
+		res, err := bm.First2AtBatch(keys, 0, after)
+		require.NoError(err)
+		require.Len(res, len(keys))
+		for i, item := range keys {
+			fst, snd, ok, ok2, err := bm.First2At(item, after)
+			require.NoError(err)
+			require.Equal(First2Result{First: fst, Second: snd, Ok: ok, Ok2: ok2}, res[i], "item=%d, after=%d", item, after)
+		}
+	}
+
+	// `from` skips values, results are aligned with keys (including duplicates)
+	keys = []uint64{1, 1, 7, 30, 64}
+	res, err := bm.First2AtBatch(keys, 40, 0)
+	require.NoError(err)
+	for i, item := range keys {
+		all, err := bm.At(item)
+		require.NoError(err)
+		var expect []uint64
+		for _, v := range all {
+			if v >= 40 && len(expect) < 2 {
+				expect = append(expect, v)
+			}
+		}
+		var got []uint64
+		if res[i].Ok {
+			got = append(got, res[i].First)
+		}
+		if res[i].Ok2 {
+			got = append(got, res[i].Second)
+		}
+		require.Equal(expect, got, "item=%d", item)
+	}
+
+	_, err = bm.First2AtBatch([]uint64{3, 2}, 0, 0)
+	require.Error(err)
+	_, err = bm.First2AtBatch([]uint64{count + 1}, 0, 0)
+	require.Error(err)
+}
+
+func BenchmarkFixedSizeBitmapsFirst2At(b *testing.B) {
+	count := uint64(10_000)
+	bm := fixedSizeBitmapsFixture(b, count)
+	keys := make([]uint64, 0, count+1)
+	for i := uint64(0); i <= count; i++ {
+		keys = append(keys, i)
+	}
+
+	b.Run("First2At", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			for _, item := range keys {
+				_, _, _, _, err := bm.First2At(item, 10)
+				require.NoError(b, err)
+			}
+		}
+	})
+	b.Run("First2AtBatch", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			_, err := bm.First2AtBatch(keys, 0, 10)
+			require.NoError(b, err)
+		}
+	})
+}
+
+func TestFixedSizeBitmapsTruncated(t *testing.T) {
+	tmpDir, require := t.TempDir(), require.New(t)
+	idxPath := filepath.Join(tmpDir, "idx.tmp")
+
+	build := func() {
+		wr, err := NewFixedSizeBitmapsWriter(idxPath, 14, 0, 7, log.New())
+		require.NoError(err)
+		defer wr.Close()
+		require.NoError(wr.AddArray(0, []uint64{3, 9, 11}))
+		require.NoError(wr.AddArray(7, []uint64{7}))
+		require.NoError(wr.Build())
+	}
+
+	for _, size := range []int64{0, MetaHeaderSize / 2, MetaHeaderSize + 1} {
+		build()
+		require.NoError(os.Truncate(idxPath, size))
+		_, err := OpenFixedSizeBitmaps(idxPath)
+		require.Error(err, "size=%d", size)
+	}
+
+	// truncated file is treated as missing: re-build it
+	build()
+	bm, err := OpenFixedSizeBitmaps(idxPath)
+	require.NoError(err)
+	defer bm.Close()
+	res, err := bm.At(0)
+	require.NoError(err)
+	require.Equal([]uint64{3, 9, 11}, res)
+}
+
+func TestFixedSizeBitmapsAround(t *testing.T) {
+	tmpDir, require := t.TempDir(), require.New(t)
+	idxPath := filepath.Join(tmpDir, "idx.tmp")
+	wr, err := NewFixedSizeBitmapsWriter(idxPath, 14, 0, 7, log.New())
+	require.NoError(err)
+	defer wr.Close()
+	require.NoError(wr.AddArray(0, []uint64{3, 9, 11}))
+	require.NoError(wr.AddArray(1, []uint64{0, 13}))
+	require.NoError(wr.Build())
+
+	bm, err := OpenFixedSizeBitmaps(idxPath)
+	require.NoError(err)
+	defer bm.Close()
+
+	type res struct {
+		prev, cur, next       uint64
+		okPrev, okCur, okNext bool
+	}
+	around := func(item, at uint64) res {
+		var r res
+		r.prev, r.cur, r.next, r.okPrev, r.okCur, r.okNext, err = bm.Around(item, at)
+		require.NoError(err)
+		return r
+	}
+
+	require.Equal(res{cur: 3, next: 9, okCur: true, okNext: true}, around(0, 0)) // at=0: no prev
+	require.Equal(res{prev: 3, cur: 9, next: 11, okPrev: true, okCur: true, okNext: true}, around(0, 4))
+	require.Equal(res{prev: 3, cur: 9, next: 11, okPrev: true, okCur: true, okNext: true}, around(0, 9))
+	require.Equal(res{prev: 9, cur: 11, okPrev: true, okCur: true}, around(0, 10))
+	require.Equal(res{prev: 11, okPrev: true}, around(0, 12)) // past last set bit: no cur/next
+	require.Equal(res{cur: 0, next: 13, okCur: true, okNext: true}, around(1, 0))
+	require.Equal(res{}, around(2, 5)) // empty bitmap
+
+	_, _, _, _, _, _, err = bm.Around(8, 0)
+	require.Error(err)
+}
+
 func TestPageAlined(t *testing.T) {
 	tmpDir, require := t.TempDir(), require.New(t)
 	idxPath := filepath.Join(tmpDir, "idx.tmp")
@@ -102,9 +102,11 @@ func Union[T constraints.Ordered](x, y Uno[T], asc order.By, limit int) Uno[T] {
 		return x
 	}
 	if !x.HasNext() {
+		x.Close() // dropped: nobody else will close it
 		return y
 	}
 	if !y.HasNext() {
+		y.Close()
 		return x
 	}
 	m := &UnionUno[T]{x: x, y: y, asc: bool(asc), limit: limit}
@@ -0,0 +1,40 @@
+// Copyright 2024 The Erigon Authors
+// This file is part of Erigon.
+//
+// Erigon is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Erigon is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with Erigon. If not, see <http://www.gnu.org/licenses/>.
+
+package mmap
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+)
+
+// MmapOrRead - like Mmap for *os.File. Files of other fs.FS (embedded, in-memory, network) can't be mmaped:
+// they are read into memory, and returned handles are nil - Munmap of them is no-op.
+func MmapOrRead(f fs.File, size int) (data, mmapHandle1 []byte, mmapHandle2 *[MaxMapSize]byte, err error) {
+	if osFile, ok := f.(*os.File); ok {
+		if mmapHandle1, mmapHandle2, err = Mmap(osFile, size); err != nil {
+			return nil, nil, nil, err
+		}
+		return mmapHandle1[:size], mmapHandle1, mmapHandle2, nil
+	}
+	data = make([]byte, size)
+	if _, err = io.ReadFull(f, data); err != nil {
+		return nil, nil, nil, fmt.Errorf("read: %w", err)
+	}
+	return data, nil, nil, nil
+}
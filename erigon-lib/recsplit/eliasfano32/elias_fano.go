@@ -94,16 +94,22 @@ func (ef *EliasFano) jumpSizeWords() int {
 	return int(size)
 }
 
-func (ef *EliasFano) deriveFields() int {
+// deriveSizes - sets `l` and returns sizes (in words) of lowerBits, upperBits and jump parts of data
+func (ef *EliasFano) deriveSizes() (wordsLowerBits, wordsUpperBits, jumpWords int) {
 	if ef.u/(ef.count+1) == 0 {
 		ef.l = 0
 	} else {
 		ef.l = 63 ^ uint64(bits.LeadingZeros64(ef.u/(ef.count+1))) // pos of first non-zero bit
 	}
 	ef.lowerBitsMask = (uint64(1) << ef.l) - 1
-	wordsLowerBits := int(((ef.count+1)*ef.l+63)/64 + 1)
-	wordsUpperBits := int((ef.count + 1 + (ef.u >> ef.l) + 63) / 64)
-	jumpWords := ef.jumpSizeWords()
+	wordsLowerBits = int(((ef.count+1)*ef.l+63)/64 + 1)
+	wordsUpperBits = int((ef.count + 1 + (ef.u >> ef.l) + 63) / 64)
+	jumpWords = ef.jumpSizeWords()
+	return wordsLowerBits, wordsUpperBits, jumpWords
+}
+
+func (ef *EliasFano) deriveFields() int {
+	wordsLowerBits, wordsUpperBits, jumpWords := ef.deriveSizes()
 	totalWords := wordsLowerBits + wordsUpperBits + jumpWords
 	//fmt.Printf("EF: %d, %d,%d,%d\n", totalWords, wordsLowerBits, wordsUpperBits, jumpWords)
 	if ef.data == nil {
@@ -544,6 +550,24 @@ func (ef *EliasFano) Reset(r []byte) {
 	ef.deriveFields()
 }
 
+// Check - returns error if `r` can't be read by ReadEliasFano/Reset: shorter than header or than data declared by header.
+// ReadEliasFano doesn't validate input (it's on hot path) and panics on such data.
+func Check(r []byte) error {
+	if len(r) < 16 {
+		return fmt.Errorf("eliasfano32: len %d is less than header size 16", len(r))
+	}
+	ef := &EliasFano{count: binary.BigEndian.Uint64(r[:8]), u: binary.BigEndian.Uint64(r[8:16])}
+	// every item takes at least 1 bit of upperBits - it also protects from overflow of sizes below
+	if ef.u == 0 || ef.count >= uint64(len(r))*8 {
+		return fmt.Errorf("eliasfano32: invalid header count=%d, u=%d for len %d", ef.count+1, ef.u, len(r))
+	}
+	wordsLowerBits, wordsUpperBits, jumpWords := ef.deriveSizes()
+	if totalWords := wordsLowerBits + wordsUpperBits + jumpWords; totalWords > (len(r)-16)/uint64Size {
+		return fmt.Errorf("eliasfano32: header count=%d, u=%d needs %d words, but has %d", ef.count+1, ef.u, totalWords, (len(r)-16)/uint64Size)
+	}
+	return nil
+}
+
 func Max(r []byte) uint64   { return binary.BigEndian.Uint64(r[8:16]) - 1 }
 func Count(r []byte) uint64 { return binary.BigEndian.Uint64(r[:8]) + 1 }
 
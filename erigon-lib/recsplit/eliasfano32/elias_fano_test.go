@@ -202,6 +202,11 @@ func TestEliasFano(t *testing.T) {
 	assert.Equal(t, ef2.Max(), Max(buf.Bytes()))
 	assert.Equal(t, ef2.Min(), Min(buf.Bytes()))
 	assert.Equal(t, ef2.Count(), Count(buf.Bytes()))
+
+	require.NoError(t, Check(buf.Bytes()))
+	require.Error(t, Check(buf.Bytes()[:10]))
+	require.Error(t, Check(buf.Bytes()[:buf.Len()-8]))
+	require.Error(t, Check(make([]byte, 16)))
 }
 
 func TestIterator(t *testing.T) {
@@ -21,6 +21,7 @@ import (
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"io/fs"
 	"math"
 	"math/bits"
 	"os"
@@ -71,7 +72,7 @@ var IncompatibleErr = errors.New("incompatible. can re-build such files by comma
 // Index implements index lookup from the file created by the RecSplit
 type Index struct {
 	offsetEf           *eliasfano32.EliasFano
-	f                  *os.File
+	f                  fs.File
 	mmapHandle2        *[mmap.MaxMapSize]byte // mmap handle for windows (this is used to close mmap)
 	filePath, fileName string
 
@@ -110,7 +111,17 @@ func MustOpen(indexFile string) *Index {
 	return idx
 }
 
-func OpenIndex(indexFilePath string) (id *Index, err error) {
+func OpenIndex(indexFilePath string) (*Index, error) {
+	return openIndex(indexFilePath, func() (fs.File, error) { return os.Open(indexFilePath) })
+}
+
+// OpenIndexFS - like OpenIndex, but file `name` is read from `fsys`.
+// Files which are not *os.File (embedded, in-memory, network FS) are read into memory instead of mmap.
+func OpenIndexFS(fsys fs.FS, name string) (*Index, error) {
+	return openIndex(name, func() (fs.File, error) { return fsys.Open(name) })
+}
+
+func openIndex(indexFilePath string, open func() (fs.File, error)) (id *Index, err error) {
 	defer func() {
 		// recover from panic if one occurred. Set err to nil if no panic
 		if r := recover(); r != nil {
@@ -124,20 +135,19 @@ func OpenIndex(indexFilePath string) (id *Index, err error) {
 		filePath: indexFilePath,
 		fileName: fName,
 	}
-	idx.f, err = os.Open(indexFilePath)
+	idx.f, err = open()
 	if err != nil {
 		return nil, err
 	}
-	var stat os.FileInfo
+	var stat fs.FileInfo
 	if stat, err = idx.f.Stat(); err != nil {
 		return nil, err
 	}
 	idx.size = stat.Size()
 	idx.modTime = stat.ModTime()
-	if idx.mmapHandle1, idx.mmapHandle2, err = mmap.Mmap(idx.f, int(idx.size)); err != nil {
+	if idx.data, idx.mmapHandle1, idx.mmapHandle2, err = mmap.MmapOrRead(idx.f, int(idx.size)); err != nil {
 		return nil, err
 	}
-	idx.data = idx.mmapHandle1[:idx.size]
 	defer idx.EnableReadAhead().DisableReadAhead()
 
 	// Read number of keys and bytes per record
@@ -246,6 +256,8 @@ func (idx *Index) ModTime() time.Time { return idx.modTime }
 func (idx *Index) BaseDataID() uint64 { return idx.baseDataID }
 func (idx *Index) FilePath() string   { return idx.filePath }
 func (idx *Index) FileName() string   { return idx.fileName }
+func (idx *Index) BucketSize() int    { return idx.bucketSize }
+func (idx *Index) LeafSize() uint16   { return idx.leafSize }
 func (idx *Index) IsOpen() bool       { return idx != nil && idx.f != nil }
 
 func (idx *Index) Close() {
@@ -263,6 +275,13 @@ func (idx *Index) Close() {
 	}
 }
 
+// TakeOpened - re-opens closed `idx` by open file and data of `src` (opened from same file later), `src` must not be
+// used after it. Fields of file metadata (names, sizes, key count) are not written: they can be read concurrently.
+func (idx *Index) TakeOpened(src *Index) {
+	idx.f, idx.mmapHandle1, idx.mmapHandle2, idx.data = src.f, src.mmapHandle1, src.mmapHandle2, src.data
+	idx.offsetEf, idx.existence, idx.grData, idx.ef = src.offsetEf, src.existence, src.grData, src.ef
+}
+
 func (idx *Index) skipBits(m uint16) int {
 	return int(idx.golombRice[m] & 0xffff)
 }
@@ -25,6 +25,7 @@ import (
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"hash"
 	"io"
 	"math/bits"
 	"os"
@@ -118,7 +119,8 @@ type Compressor struct {
 	lvl              log.Lvl
 	trace            bool
 	logger           log.Logger
-	noFsync          bool // fsync is enabled by default, but tests can manually disable
+	noFsync          bool      // fsync is enabled by default, but tests can manually disable
+	outputHash       hash.Hash // receives all bytes of output file while they are written. nil - disabled
 }
 
 func NewCompressor(ctx context.Context, logPrefix, outputFile, tmpDir string, cfg Cfg, lvl log.Lvl, logger log.Logger) (*Compressor, error) {
@@ -265,8 +267,13 @@ func (c *Compressor) Compress() error {
 		return err
 	}
 	defer cf.Close()
+	var w io.Writer = cf
+	if c.outputHash != nil {
+		c.outputHash.Reset()
+		w = io.MultiWriter(cf, c.outputHash)
+	}
 	t := time.Now()
-	if err := compressWithPatternCandidates(c.ctx, c.trace, c.Cfg, c.logPrefix, c.tmpOutFilePath, cf, c.uncompressedFile, db, c.lvl, c.logger); err != nil {
+	if err := compressWithPatternCandidates(c.ctx, c.trace, c.Cfg, c.logPrefix, c.tmpOutFilePath, w, c.uncompressedFile, db, c.lvl, c.logger); err != nil {
 		return err
 	}
 	if err = c.fsync(cf); err != nil {
@@ -293,6 +300,10 @@ func (c *Compressor) Compress() error {
 
 func (c *Compressor) DisableFsync() { c.noFsync = true }
 
+// SetOutputHash - `h` will receive all bytes of output file while Compress writes it: allows to hash the file
+// without reading it again.
+func (c *Compressor) SetOutputHash(h hash.Hash) { c.outputHash = h }
+
 // fsync - other processes/goroutines must see only "fully-complete" (valid) files. No partial-writes.
 // To achieve it: write to .tmp file then `rename` when file is ready.
 // Machine may power-off right after `rename` - it means `fsync` must be before `rename`
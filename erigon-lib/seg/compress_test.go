@@ -184,6 +184,24 @@ func TestCompressDict1(t *testing.T) {
 	}
 }
 
+func TestCompressOutputHash(t *testing.T) {
+	logger := log.New()
+	tmpDir := t.TempDir()
+	file := filepath.Join(tmpDir, "compressed")
+	cfg := DefaultCfg
+	cfg.MinPatternScore = 1
+	c, err := NewCompressor(context.Background(), t.Name(), file, tmpDir, cfg, log.LvlDebug, logger)
+	require.NoError(t, err)
+	defer c.Close()
+	h := crc32.NewIEEE()
+	c.SetOutputHash(h)
+	for i := 0; i < 100; i++ {
+		require.NoError(t, c.AddWord([]byte(fmt.Sprintf("%d longlongword %d", i, i))))
+	}
+	require.NoError(t, c.Compress())
+	require.Equal(t, checksum(file), h.Sum32())
+}
+
 func TestCompressDictCmp(t *testing.T) {
 	d := prepareDict(t)
 	defer d.Close()
@@ -21,6 +21,8 @@ import (
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"io"
+	"io/fs"
 	"os"
 	"path/filepath"
 	"strconv"
@@ -119,9 +121,33 @@ func (e ErrCompressedFileCorrupted) Is(err error) bool {
 	return errors.As(err, &e1)
 }
 
+// FileAccess - how Decompressor reads words of file
+type FileAccess uint8
+
+const (
+	// AccessMmap - whole file is memory-mapped, Getter reads words from mapped memory (default)
+	AccessMmap FileAccess = iota
+	// AccessPread - only dictionaries are kept in memory, Getter reads words by pread into it's own small buffer.
+	// Mapped pages of huge files don't thrash page-cache of memory-constrained nodes, but each read is a syscall.
+	AccessPread
+)
+
+func (a FileAccess) String() string {
+	switch a {
+	case AccessMmap:
+		return "mmap"
+	case AccessPread:
+		return "pread"
+	default:
+		return fmt.Sprintf("FileAccess(%d)", uint8(a))
+	}
+}
+
 // Decompressor provides access to the superstrings in a file produced by a compressor
 type Decompressor struct {
-	f               *os.File
+	f               fs.File
+	access          FileAccess
+	reader          io.ReaderAt            // only for AccessPread
 	mmapHandle2     *[mmap.MaxMapSize]byte // mmap handle for windows (this is used to close mmap)
 	dict            *patternTable
 	posDict         *posTable
@@ -179,6 +205,21 @@ func SetDecompressionTableCondensity(fromBitSize int) {
 }
 
 func NewDecompressor(compressedFilePath string) (*Decompressor, error) {
+	return NewDecompressorWithAccess(compressedFilePath, AccessMmap)
+}
+
+// NewDecompressorWithAccess - like NewDecompressor, but words are read by `access` mode.
+func NewDecompressorWithAccess(compressedFilePath string, access FileAccess) (*Decompressor, error) {
+	return newDecompressor(compressedFilePath, func() (fs.File, error) { return os.Open(compressedFilePath) }, access)
+}
+
+// NewDecompressorFS - like NewDecompressor, but file `name` is read from `fsys`.
+// Files which are not *os.File (embedded, in-memory, network FS) are read into memory instead of mmap.
+func NewDecompressorFS(fsys fs.FS, name string) (*Decompressor, error) {
+	return newDecompressor(name, func() (fs.File, error) { return fsys.Open(name) }, AccessMmap)
+}
+
+func newDecompressor(compressedFilePath string, open func() (fs.File, error), access FileAccess) (*Decompressor, error) {
 	_, fName := filepath.Split(compressedFilePath)
 	var err error
 	var closeDecompressor = true
@@ -197,12 +238,12 @@ func NewDecompressor(compressedFilePath string) (*Decompressor, error) {
 		}
 	}()
 
-	d.f, err = os.Open(compressedFilePath)
+	d.f, err = open()
 	if err != nil {
 		return nil, err
 	}
 
-	var stat os.FileInfo
+	var stat fs.FileInfo
 	if stat, err = d.f.Stat(); err != nil {
 		return nil, err
 	}
@@ -215,11 +256,24 @@ func NewDecompressor(compressedFilePath string) (*Decompressor, error) {
 	}
 
 	d.modTime = stat.ModTime()
-	if d.mmapHandle1, d.mmapHandle2, err = mmap.Mmap(d.f, int(d.size)); err != nil {
-		return nil, err
+	switch access {
+	case AccessMmap:
+		if d.data, d.mmapHandle1, d.mmapHandle2, err = mmap.MmapOrRead(d.f, int(d.size)); err != nil {
+			return nil, err
+		}
+	case AccessPread:
+		var ok bool
+		if d.reader, ok = d.f.(io.ReaderAt); !ok {
+			return nil, fmt.Errorf("file %s: %s access is not supported by %T", fName, access, d.f)
+		}
+		if d.data, err = readHeader(d.reader, d.size); err != nil {
+			return nil, fmt.Errorf("file %s: read header: %w", fName, err)
+		}
+	default:
+		return nil, fmt.Errorf("file %s: unknown %s", fName, access)
 	}
+	d.access = access
 	// read patterns from file
-	d.data = d.mmapHandle1[:d.size]
 	defer d.EnableMadvNormal().DisableReadAhead() //speedup opening on slow drives
 
 	d.wordsCount = binary.BigEndian.Uint64(d.data[:8])
@@ -344,6 +398,27 @@ func NewDecompressor(compressedFilePath string) (*Decompressor, error) {
 	return d, nil
 }
 
+// readHeader - prefix of file before words: counters and dictionaries of patterns and positions.
+// Sizes in truncated/corrupted header are checked by caller.
+func readHeader(r io.ReaderAt, size int64) ([]byte, error) {
+	readPrefix := func(n uint64) ([]byte, error) {
+		buf := make([]byte, min(n, uint64(size)))
+		if _, err := r.ReadAt(buf, 0); err != nil {
+			return nil, err
+		}
+		return buf, nil
+	}
+	header, err := readPrefix(24)
+	if err != nil {
+		return nil, err
+	}
+	posDictAt := 24 + binary.BigEndian.Uint64(header[16:24])
+	if header, err = readPrefix(posDictAt + 8); err != nil || uint64(len(header)) < posDictAt+8 {
+		return header, err
+	}
+	return readPrefix(posDictAt + 8 + binary.BigEndian.Uint64(header[posDictAt:]))
+}
+
 func buildCondensedPatternTable(table *patternTable, depths []uint64, patterns [][]byte, code uint16, bits int, depth uint64, maxDepth uint64) (int, error) {
 	if maxDepth > maxAllowedDepth {
 		return 0, fmt.Errorf("buildCondensedPatternTable: maxDepth=%d is too deep", maxDepth)
@@ -437,6 +512,7 @@ func buildPosTable(depths []uint64, poss []uint64, table *posTable, code uint16,
 	return b0 + b1, err
 }
 
+// DataHandle - pointer to mapped file. AccessPread: pointer to header only
 func (d *Decompressor) DataHandle() unsafe.Pointer {
 	return unsafe.Pointer(&d.data[0])
 }
@@ -464,14 +540,24 @@ func (d *Decompressor) Close() {
 			log.Log(dbg.FileCloseLogLevel, "close", "err", err, "file", d.FileName(), "stack", dbg.Stack())
 		}
 		d.f = nil
+		d.reader = nil
 		d.data = nil
 		d.posDict = nil
 		d.dict = nil
 	}
 }
 
-func (d *Decompressor) FilePath() string { return d.filePath }
-func (d *Decompressor) FileName() string { return d.FileName1 }
+// TakeOpened - re-opens closed `d` by open file and data of `src` (opened from same file later), `src` must not be used
+// after it. Fields of file metadata (names, sizes, counts) are not written: they can be read concurrently.
+func (d *Decompressor) TakeOpened(src *Decompressor) {
+	d.f, d.reader = src.f, src.reader
+	d.mmapHandle1, d.mmapHandle2, d.data = src.mmapHandle1, src.mmapHandle2, src.data
+	d.dict, d.posDict = src.dict, src.posDict
+}
+
+func (d *Decompressor) FilePath() string   { return d.filePath }
+func (d *Decompressor) Access() FileAccess { return d.access }
+func (d *Decompressor) FileName() string   { return d.FileName1 }
 
 // WithReadAhead - Expect read in sequential order. (Hence, pages in the given range can be aggressively read ahead, and may be freed soon after they are accessed.)
 func (d *Decompressor) WithReadAhead(f func() error) error {
@@ -560,6 +646,113 @@ type Getter struct {
 	dataP       uint64
 	dataBit     int // Value 0..7 - position of the bit
 	trace       bool
+
+	pread *preadWindow // only for AccessPread: `data` is nil, words are decoded from window
+}
+
+// preadWindow - words of file read by pread for Getter of AccessPread. Each word is decoded by `w`: Getter over
+// `buf` - part of words [bufStart, bufStart+len(buf)) which contains whole word (or all words till end).
+type preadWindow struct {
+	r          io.ReaderAt
+	wordsStart uint64 // offset of words in file
+	size       uint64 // size of words
+	bufStart   uint64
+	buf        []byte
+	w          Getter
+}
+
+const preadMinWindow = 4 * 1024
+
+// window - Getter `w` positioned at word of current offset. Every op of Getter is done by `w`, then `sync` moves
+// offset of Getter to offset of `w`.
+func (g *Getter) window(uncompressed bool) *Getter {
+	p := g.pread
+	offset := g.dataP
+	if !(p.bufStart <= offset && offset < p.bufStart+uint64(len(p.buf)) && p.covers(offset, uncompressed)) {
+		for n := uint64(preadMinWindow); ; n *= 2 {
+			p.fill(offset, n, g.fName)
+			if p.covers(offset, uncompressed) {
+				break
+			}
+		}
+	}
+	p.w.dataP, p.w.dataBit = offset-p.bufStart, 0
+	return &p.w
+}
+
+func (g *Getter) sync(w *Getter) uint64 {
+	g.dataP, g.dataBit = g.pread.bufStart+w.dataP, w.dataBit
+	return g.dataP
+}
+
+// preadCodeMargin - bytes of `buf` from start of Huffman code which decoder may read: code is not longer than
+// maxAllowedDepth bits from any bit of start byte, and decoder peeks 1 byte after it
+const preadCodeMargin = (7+maxAllowedDepth)/8 + 2
+
+// covers - whole word at `offset` is in `buf` (with byte peeked by decoder after it). Also true if `buf` reaches end
+// of words, or length of word is invalid: then op fails same way as with mmap. Only length of word is decoded: end of
+// compressed word is estimated by maximal size of its codes, and only near end of `buf` its codes are walked.
+func (p *preadWindow) covers(offset uint64, uncompressed bool) bool {
+	bufLen := uint64(len(p.buf))
+	if p.bufStart+bufLen == p.size {
+		return true
+	}
+	w := &p.w
+	w.dataP, w.dataBit = offset-p.bufStart, 0
+	hasCode := func() bool { return w.dataP+preadCodeMargin <= bufLen }
+	if !hasCode() {
+		return false
+	}
+	l := w.nextPos(true)
+	if l == 0 { // terminator instead of length: invalid word
+		return true
+	}
+	wordLen := l - 1
+	if wordLen == 0 {
+		return true
+	}
+	if !uncompressed {
+		// each byte of word is stored as is, or is start of pattern: pair of position and pattern codes
+		codesSize := ((2*wordLen+1)*maxAllowedDepth+7)/8 + 1
+		if w.dataP+codesSize+wordLen+preadCodeMargin < bufLen {
+			return true
+		}
+		for {
+			if !hasCode() {
+				return false
+			}
+			if w.nextPos(false) == 0 {
+				break
+			}
+			if !hasCode() {
+				return false
+			}
+			w.nextPattern()
+		}
+	} else {
+		if !hasCode() {
+			return false
+		}
+		w.nextPos(false)
+	}
+	end := w.dataP + wordLen // uncovered bytes of compressed word are not more than wordLen
+	if w.dataBit > 0 {
+		end++
+	}
+	return end+1 < bufLen
+}
+
+// fill - read at least `n` bytes of words from `offset`. New buffer on each read: slices returned by
+// NextUncompressed stay valid.
+func (p *preadWindow) fill(offset, n uint64, fName string) {
+	if offset > p.size {
+		offset = p.size
+	}
+	buf := make([]byte, min(max(n, preadMinWindow), p.size-offset))
+	if _, err := p.r.ReadAt(buf, int64(p.wordsStart+offset)); err != nil {
+		panic(fmt.Sprintf("file: %s, pread at %d: %s", fName, p.wordsStart+offset, err))
+	}
+	p.bufStart, p.buf, p.w.data = offset, buf, buf
 }
 
 func (g *Getter) Trace(t bool)     { g.trace = t }
@@ -649,6 +842,9 @@ func buildCondensedWordDistances() [][]int {
 }
 
 func (g *Getter) Size() int {
+	if g.pread != nil {
+		return int(g.pread.size)
+	}
 	return len(g.data)
 }
 
@@ -659,6 +855,11 @@ func (d *Decompressor) EmptyWordsCount() int { return int(d.emptyWordsCount) }
 // Getter is not thread-safe, but there can be multiple getters used simultaneously and concurrently
 // for the same decompressor
 func (d *Decompressor) MakeGetter() *Getter {
+	if d.access == AccessPread {
+		g := &Getter{posDict: d.posDict, patternDict: d.dict, fName: d.FileName1}
+		g.pread = &preadWindow{r: d.reader, wordsStart: d.wordsStart, size: uint64(d.size) - d.wordsStart, w: *g}
+		return g
+	}
 	return &Getter{
 		posDict:     d.posDict,
 		data:        d.data[d.wordsStart:],
@@ -673,13 +874,18 @@ func (g *Getter) Reset(offset uint64) {
 }
 
 func (g *Getter) HasNext() bool {
-	return g.dataP < uint64(len(g.data))
+	return g.dataP < uint64(g.Size())
 }
 
 // Next extracts a compressed word from current offset in the file
 // and appends it to the given buf, returning the result of appending
 // After extracting next word, it moves to the beginning of the next one
 func (g *Getter) Next(buf []byte) ([]byte, uint64) {
+	if g.pread != nil {
+		w := g.window(false)
+		buf, _ = w.Next(buf)
+		return buf, g.sync(w)
+	}
 	defer func() {
 		if rec := recover(); rec != nil {
 			panic(fmt.Sprintf("file: %s, %s, %s", g.fName, rec, dbg.Stack()))
@@ -751,6 +957,11 @@ func (g *Getter) Next(buf []byte) ([]byte, uint64) {
 }
 
 func (g *Getter) NextUncompressed() ([]byte, uint64) {
+	if g.pread != nil {
+		w := g.window(true)
+		word, _ := w.NextUncompressed()
+		return word, g.sync(w)
+	}
 	defer func() {
 		if rec := recover(); rec != nil {
 			panic(fmt.Sprintf("file: %s, %s, %s", g.fName, rec, dbg.Stack()))
@@ -777,6 +988,11 @@ func (g *Getter) NextUncompressed() ([]byte, uint64) {
 
 // Skip moves offset to the next word and returns the new offset and the length of the word.
 func (g *Getter) Skip() (uint64, int) {
+	if g.pread != nil {
+		w := g.window(false)
+		_, wordLen := w.Skip()
+		return g.sync(w), wordLen
+	}
 	l := g.nextPos(true)
 	l-- // because when create huffman tree we do ++ , because 0 is terminator
 	if l == 0 {
@@ -814,6 +1030,11 @@ func (g *Getter) Skip() (uint64, int) {
 }
 
 func (g *Getter) SkipUncompressed() (uint64, int) {
+	if g.pread != nil {
+		w := g.window(true)
+		_, wordLen := w.SkipUncompressed()
+		return g.sync(w), wordLen
+	}
 	wordLen := g.nextPos(true)
 	wordLen-- // because when create huffman tree we do ++ , because 0 is terminator
 	if wordLen == 0 {
@@ -834,6 +1055,11 @@ func (g *Getter) SkipUncompressed() (uint64, int) {
 
 // MatchPrefix only checks if the word at the current offset has a buf prefix. Does not move offset to the next word.
 func (g *Getter) MatchPrefix(prefix []byte) bool {
+	if g.pread != nil {
+		w := g.window(false)
+		defer g.sync(w)
+		return w.MatchPrefix(prefix)
+	}
 	savePos := g.dataP
 	defer func() {
 		g.dataP, g.dataBit = savePos, 0
@@ -917,6 +1143,11 @@ func (g *Getter) MatchPrefix(prefix []byte) bool {
 // MatchCmp lexicographically compares given buf with the word at the current offset in the file.
 // returns 0 if buf == word, -1 if buf < word, 1 if buf > word
 func (g *Getter) MatchCmp(buf []byte) int {
+	if g.pread != nil {
+		w := g.window(false)
+		defer g.sync(w)
+		return w.MatchCmp(buf)
+	}
 	savePos := g.dataP
 	wordLen := g.nextPos(true)
 	wordLen-- // because when create huffman tree we do ++ , because 0 is terminator
@@ -977,6 +1208,11 @@ func (g *Getter) MatchCmp(buf []byte) int {
 }
 
 func (g *Getter) MatchPrefixUncompressed(prefix []byte) bool {
+	if g.pread != nil {
+		w := g.window(true)
+		defer g.sync(w)
+		return w.MatchPrefixUncompressed(prefix)
+	}
 	savePos := g.dataP
 	defer func() {
 		g.dataP, g.dataBit = savePos, 0
@@ -998,6 +1234,11 @@ func (g *Getter) MatchPrefixUncompressed(prefix []byte) bool {
 }
 
 func (g *Getter) MatchCmpUncompressed(buf []byte) int {
+	if g.pread != nil {
+		w := g.window(true)
+		defer g.sync(w)
+		return w.MatchCmpUncompressed(buf)
+	}
 	savePos := g.dataP
 	defer func() {
 		g.dataP, g.dataBit = savePos, 0
@@ -1023,6 +1264,11 @@ func (g *Getter) MatchCmpUncompressed(buf []byte) int {
 // It is important to allocate enough buf size. Could throw an error if word in file is larger then the buf size.
 // After extracting next word, it moves to the beginning of the next one
 func (g *Getter) FastNext(buf []byte) ([]byte, uint64) {
+	if g.pread != nil {
+		w := g.window(false)
+		buf, _ = w.FastNext(buf)
+		return buf, g.sync(w)
+	}
 	defer func() {
 		if rec := recover(); rec != nil {
 			panic(fmt.Sprintf("file: %s, %s, %s", g.fName, rec, dbg.Stack()))
@@ -17,11 +17,15 @@
 package seg
 
 import (
+	"context"
 	"fmt"
 	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/stretchr/testify/require"
+
+	"github.com/erigontech/erigon-lib/log/v3"
 )
 
 func BenchmarkDecompressNext(b *testing.B) {
@@ -37,6 +41,32 @@ func BenchmarkDecompressNext(b *testing.B) {
 	}
 }
 
+func BenchmarkDecompressNextPread(b *testing.B) {
+	// file of many pread windows
+	file := filepath.Join(b.TempDir(), "compressed")
+	cfg := DefaultCfg
+	cfg.MinPatternScore = 1
+	c, err := NewCompressor(context.Background(), b.Name(), file, b.TempDir(), cfg, log.LvlDebug, log.New())
+	require.NoError(b, err)
+	defer c.Close()
+	for i := 0; i < 100_000; i++ {
+		require.NoError(b, c.AddWord([]byte(fmt.Sprintf("%d longlongword %d", i, i*i))))
+	}
+	require.NoError(b, c.Compress())
+	d, err := NewDecompressorWithAccess(file, AccessPread)
+	require.NoError(b, err)
+	defer d.Close()
+
+	g := d.MakeGetter()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, _ = g.Next(nil)
+		if !g.HasNext() {
+			g.Reset(0)
+		}
+	}
+}
+
 func BenchmarkDecompressFastNext(b *testing.B) {
 	t := new(testing.T)
 	d := prepareDict(t)
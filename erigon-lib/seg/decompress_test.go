@@ -293,6 +293,192 @@ func TestUncompressed(t *testing.T) {
 	}
 }
 
+func TestReaderZstdValues(t *testing.T) {
+	logger := log.New()
+	rnd := rand.New(rand.NewSource(1))
+	random := make([]byte, 4096)
+	rnd.Read(random)
+	values := [][]byte{
+		{},
+		[]byte("small value"),
+		bytes.Repeat([]byte("compressible value "), 100),
+		random, // zstd can't make it smaller: stored as is
+	}
+
+	write := func(compression FileCompression, access FileAccess) *Decompressor {
+		file := filepath.Join(t.TempDir(), "kv")
+		c, err := NewCompressor(context.Background(), t.Name(), file, t.TempDir(), DefaultCfg, log.LvlDebug, logger)
+		require.NoError(t, err)
+		defer c.Close()
+		w := NewWriter(c, compression)
+		for i, v := range values {
+			require.NoError(t, w.AddWord([]byte(fmt.Sprintf("key %d", i))))
+			require.NoError(t, w.AddWord(v))
+		}
+		require.NoError(t, c.Compress())
+		d, err := NewDecompressorWithAccess(file, access)
+		require.NoError(t, err)
+		t.Cleanup(d.Close)
+		return d
+	}
+	plain, zstd := write(CompressNone, AccessMmap), write(CompressValsZstd, AccessMmap)
+	require.Less(t, zstd.Size(), plain.Size())
+
+	// files written without zstd are readable with it
+	for _, d := range []*Decompressor{plain, zstd, write(CompressNone, AccessPread), write(CompressValsZstd, AccessPread)} {
+		r := NewReader(d.MakeGetter(), CompressValsZstd)
+		for i, v := range values {
+			require.True(t, r.HasNext())
+			k, _ := r.Next(nil)
+			require.Equal(t, fmt.Sprintf("key %d", i), string(k))
+			got, _ := r.Next(nil)
+			require.Equal(t, v, got, i)
+		}
+		require.False(t, r.HasNext())
+
+		// values returned as is point to file data: passing them as `buf` doesn't overwrite data of this or other file
+		var k, v []byte
+		r.Reset(0)
+		for i := range values {
+			k, _ = r.Next(k[:0])
+			v, _ = r.Next(v[:0])
+			require.Equal(t, values[i], v, i)
+		}
+		pr := NewReader(plain.MakeGetter(), CompressValsZstd)
+		r.Reset(0)
+		for i := range values {
+			pr.Skip()
+			plainV, _ := pr.Next(nil)
+			r.Skip()
+			v, _ = r.Next(plainV[:0])
+			require.Equal(t, values[i], v, i)
+		}
+		r.Reset(0)
+		for i := range values {
+			r.Skip()
+			got, _ := r.Next(nil)
+			require.Equal(t, values[i], got, i)
+		}
+	}
+
+	fc, err := ParseFileCompression(CompressValsZstd.String())
+	require.NoError(t, err)
+	require.Equal(t, CompressValsZstd, fc)
+}
+
+func TestDecompressPread(t *testing.T) {
+	logger := log.New()
+	rnd := rand.New(rand.NewSource(1))
+	// words bigger than pread window: window grows
+	var words [][]byte
+	for i := 0; i < 2000; i++ {
+		n := rnd.Intn(64)
+		if i%100 == 0 {
+			n = rnd.Intn(5 * preadMinWindow)
+		}
+		w := make([]byte, n)
+		for j := range w {
+			w[j] = byte('a' + rnd.Intn(4))
+		}
+		words = append(words, w)
+	}
+
+	for _, uncompressed := range []bool{false, true} {
+		t.Run(fmt.Sprintf("uncompressed=%t", uncompressed), func(t *testing.T) {
+			tmpDir := t.TempDir()
+			file := filepath.Join(tmpDir, "compressed")
+			cfg := DefaultCfg
+			cfg.MinPatternScore = 1
+			cfg.Workers = 2
+			c, err := NewCompressor(context.Background(), t.Name(), file, tmpDir, cfg, log.LvlDebug, logger)
+			require.NoError(t, err)
+			defer c.Close()
+			for _, w := range words {
+				if uncompressed {
+					require.NoError(t, c.AddUncompressedWord(w))
+				} else {
+					require.NoError(t, c.AddWord(w))
+				}
+			}
+			require.NoError(t, c.Compress())
+
+			dm, err := NewDecompressor(file)
+			require.NoError(t, err)
+			defer dm.Close()
+			dp, err := NewDecompressorWithAccess(file, AccessPread)
+			require.NoError(t, err)
+			defer dp.Close()
+			require.Equal(t, AccessPread, dp.Access())
+			require.Equal(t, dm.Count(), dp.Count())
+
+			next := func(g *Getter) ([]byte, uint64) {
+				if uncompressed {
+					return g.NextUncompressed()
+				}
+				return g.Next(nil)
+			}
+			skip := func(g *Getter) (uint64, int) {
+				if uncompressed {
+					return g.SkipUncompressed()
+				}
+				return g.Skip()
+			}
+			match := func(g *Getter, prefix []byte) bool {
+				if uncompressed {
+					return g.MatchPrefixUncompressed(prefix)
+				}
+				return g.MatchPrefix(prefix)
+			}
+
+			gm, gp := dm.MakeGetter(), dp.MakeGetter()
+			require.Equal(t, gm.Size(), gp.Size())
+			offsets := make([]uint64, 0, len(words))
+			var prevWords [][]byte
+			for i := 0; gm.HasNext(); i++ {
+				require.True(t, gp.HasNext())
+				offsets = append(offsets, gp.dataP)
+				if i%3 == 0 {
+					om, lm := skip(gm)
+					op, lp := skip(gp)
+					require.Equal(t, om, op)
+					require.Equal(t, lm, lp)
+					continue
+				}
+				prefix := words[i][:len(words[i])/2]
+				require.Equal(t, match(gm, prefix), match(gp, prefix))
+				wm, om := next(gm)
+				wp, op := next(gp)
+				require.Equal(t, om, op)
+				require.Equal(t, wm, wp, i)
+				prevWords = append(prevWords, wp)
+			}
+			require.False(t, gp.HasNext())
+			// slices of words stay valid after next reads
+			for i, j := 0, 0; i < len(words); i++ {
+				if i%3 != 0 {
+					require.Equal(t, string(words[i]), string(prevWords[j]))
+					j++
+				}
+			}
+
+			// random access
+			for _, i := range rnd.Perm(len(offsets)) {
+				gm.Reset(offsets[i])
+				gp.Reset(offsets[i])
+				wm, om := next(gm)
+				wp, op := next(gp)
+				require.Equal(t, om, op)
+				require.Equal(t, wm, wp)
+				if !uncompressed {
+					gp.Reset(offsets[i])
+					require.Zero(t, gp.MatchCmp(words[i]))
+					require.Equal(t, om, gp.dataP)
+				}
+			}
+		})
+	}
+}
+
 func TestDecompressor_OpenCorrupted(t *testing.T) {
 	t.Helper()
 	logger := log.New()
@@ -17,7 +17,11 @@
 package seg
 
 import (
+	"bytes"
 	"fmt"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
 )
 
 //Reader and Writer - decorators on Getter and Compressor - which
@@ -32,6 +36,12 @@ const (
 	CompressNone FileCompression = 0b0  // no compression
 	CompressKeys FileCompression = 0b1  // compress keys only
 	CompressVals FileCompression = 0b10 // compress values only
+
+	// CompressValsZstd - Writer compresses each value by zstd (if it makes value smaller), Reader decompresses values
+	// which start with zstd magic number - other values are returned as is. So files written with and without this
+	// flag are readable with it. Only for values which never start with zstd magic number: like EliasFano (starts
+	// with count). Not combinable with CompressVals.
+	CompressValsZstd FileCompression = 0b100
 )
 
 func ParseFileCompression(s string) (FileCompression, error) {
@@ -44,6 +54,10 @@ func ParseFileCompression(s string) (FileCompression, error) {
 		return CompressVals, nil
 	case "kv":
 		return CompressKeys | CompressVals, nil
+	case "vz":
+		return CompressValsZstd, nil
+	case "kvz":
+		return CompressKeys | CompressValsZstd, nil
 	default:
 		return 0, fmt.Errorf("invalid file compression type: %s", s)
 	}
@@ -59,6 +73,10 @@ func (c FileCompression) String() string {
 		return "v"
 	case CompressKeys | CompressVals:
 		return "kv"
+	case CompressValsZstd:
+		return "vz"
+	case CompressKeys | CompressValsZstd:
+		return "kvz"
 	default:
 		return ""
 	}
@@ -90,6 +108,15 @@ func (g *Reader) Next(buf []byte) ([]byte, uint64) {
 		g.nextValue = true
 	}
 
+	if fl == CompressVals && g.c&CompressValsZstd != 0 {
+		// `buf` is ignored (as by NextUncompressed): it may point to data of some file
+		word, offset := g.Getter.NextUncompressed()
+		v, err := decodeZstdValue(word)
+		if err != nil {
+			panic(fmt.Sprintf("file: %s, value before offset %d: %s", g.FileName(), offset, err))
+		}
+		return v, offset
+	}
 	if g.c&fl != 0 {
 		return g.Getter.Next(buf)
 	}
@@ -100,6 +127,8 @@ func (g *Reader) Reset(offset uint64) {
 	g.nextValue = false
 	g.Getter.Reset(offset)
 }
+
+// Skip - returns length of stored word: of CompressValsZstd value it's compressed length
 func (g *Reader) Skip() (uint64, int) {
 	fl := CompressKeys
 	if g.nextValue {
@@ -109,6 +138,9 @@ func (g *Reader) Skip() (uint64, int) {
 		g.nextValue = true
 	}
 
+	if fl == CompressVals && g.c&CompressValsZstd != 0 {
+		return g.Getter.SkipUncompressed()
+	}
 	if g.c&fl != 0 {
 		return g.Getter.Skip()
 	}
@@ -120,10 +152,11 @@ type Writer struct {
 	*Compressor
 	keyWritten bool
 	c          FileCompression
+	zstdBuf    []byte
 }
 
 func NewWriter(kv *Compressor, compress FileCompression) *Writer {
-	return &Writer{kv, false, compress}
+	return &Writer{Compressor: kv, c: compress}
 }
 
 func (c *Writer) AddWord(word []byte) error {
@@ -135,12 +168,61 @@ func (c *Writer) AddWord(word []byte) error {
 		c.keyWritten = true
 	}
 
+	if fl == CompressVals && c.c&CompressValsZstd != 0 {
+		c.zstdBuf = encodeZstdValue(c.zstdBuf[:0], word)
+		return c.Compressor.AddUncompressedWord(c.zstdBuf)
+	}
 	if c.c&fl != 0 {
 		return c.Compressor.AddWord(word)
 	}
 	return c.Compressor.AddUncompressedWord(word)
 }
 
+// zstdMinValueSize - smaller values are not compressed by CompressValsZstd: zstd frame header eats the profit
+const zstdMinValueSize = 128
+
+var zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+
+// zstdCodecs - shared by all Readers and Writers: EncodeAll/DecodeAll are safe for concurrent use
+var zstdCodecs = sync.OnceValues(func() (*zstd.Encoder, *zstd.Decoder) {
+	enc, err := zstd.NewWriter(nil, zstd.WithEncoderCRC(false))
+	if err != nil {
+		panic(err)
+	}
+	dec, err := zstd.NewReader(nil, zstd.WithDecoderConcurrency(0))
+	if err != nil {
+		panic(err)
+	}
+	return enc, dec
+})
+
+// encodeZstdValue - appends to `buf` zstd frame of `v`, or `v` as is if it's small or zstd can't make it smaller
+func encodeZstdValue(buf, v []byte) []byte {
+	if len(v) >= zstdMinValueSize {
+		enc, _ := zstdCodecs()
+		start := len(buf)
+		if buf = enc.EncodeAll(v, buf); len(buf)-start < len(v) {
+			return buf
+		}
+		buf = buf[:start]
+	}
+	return append(buf, v...)
+}
+
+// decodeZstdValue - value stored by encodeZstdValue: not compressed value is returned as is (like by
+// NextUncompressed), compressed one is decoded to new slice
+func decodeZstdValue(word []byte) ([]byte, error) {
+	if !bytes.HasPrefix(word, zstdMagic) {
+		return word, nil
+	}
+	_, dec := zstdCodecs()
+	v, err := dec.DecodeAll(word, nil)
+	if err != nil {
+		return nil, fmt.Errorf("zstd: %w", err)
+	}
+	return v, nil
+}
+
 func (c *Writer) ReadFrom(r *Reader) error {
 	var v []byte
 	for r.HasNext() {
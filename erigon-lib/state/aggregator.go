@@ -21,6 +21,7 @@ import (
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"io/fs"
 	"math"
 	"os"
 	"path/filepath"
@@ -37,6 +38,7 @@ import (
 	rand2 "golang.org/x/exp/rand"
 	"golang.org/x/sync/errgroup"
 	"golang.org/x/sync/semaphore"
+	"golang.org/x/time/rate"
 
 	common2 "github.com/erigontech/erigon-lib/common"
 	"github.com/erigontech/erigon-lib/common/background"
@@ -75,6 +77,11 @@ type Aggregator struct {
 	buildingFiles           atomic.Bool
 	mergingFiles            atomic.Bool
 	buildingOptionalIndices atomic.Bool
+	folderOpened            atomic.Bool // OpenFolder was called: settings read by background goroutines are frozen
+
+	mergeThrottle mergeThrottle // foreground can limit IO of background merge or suspend it
+
+	filesLRU *filesLRU // nil - all files are open from OpenFolder till Close
 
 	//warmupWorking          atomic.Bool
 	ctx       context.Context
@@ -82,7 +89,8 @@ type Aggregator struct {
 
 	wg sync.WaitGroup // goroutines spawned by Aggregator, to ensure all of them are finish at agg.Close
 
-	onFreeze OnFreezeFunc
+	onFreeze        OnFreezeFunc
+	onMergeProgress OnMergeProgressFunc
 
 	ps *background.ProgressSet
 
@@ -97,6 +105,12 @@ type Aggregator struct {
 
 type OnFreezeFunc func(frozenFileNames []string)
 
+// OnMergeProgressFunc - `done` of `total` keys of input files are merged. Called by merge goroutine not more often
+// than `mergeProgressEvery`, and with done=total when merge succeeded.
+type OnMergeProgressFunc func(done, total uint64)
+
+var mergeProgressEvery = time.Second
+
 const AggregatorSqueezeCommitmentValues = true
 const MaxNonFuriousDirtySpacePerTx = 64 * datasize.MB
 
@@ -112,6 +126,7 @@ func NewAggregator(ctx context.Context, dirs datadir.Dirs, aggregationStep uint6
 		ctx:                    ctx,
 		ctxCancel:              ctxCancel,
 		onFreeze:               func(frozenFileNames []string) {},
+		onMergeProgress:        func(done, total uint64) {},
 		dirs:                   dirs,
 		tmpdir:                 tmpdir,
 		aggregationStep:        aggregationStep,
@@ -128,7 +143,7 @@ func NewAggregator(ctx context.Context, dirs datadir.Dirs, aggregationStep uint6
 	}
 	commitmentFileMustExist := func(fromStep, toStep uint64) bool {
 		fPath := filepath.Join(dirs.SnapDomain, fmt.Sprintf("v1-%s.%d-%d.kv", kv.CommitmentDomain, fromStep, toStep))
-		exists, err := dir.FileExist(fPath)
+		exists, err := a.d[kv.CommitmentDomain].filesFS.exists(fPath)
 		if err != nil {
 			panic(err)
 		}
@@ -223,6 +238,12 @@ func NewAggregator(ctx context.Context, dirs datadir.Dirs, aggregationStep uint6
 	if err := a.registerII(kv.TracesToIdxPos, salt, dirs, db, aggregationStep, kv.FileTracesToIdx, kv.TblTracesToKeys, kv.TblTracesToIdx, logger); err != nil {
 		return nil, err
 	}
+	for _, d := range a.d {
+		d.mergeThrottle = &a.mergeThrottle // shared with it's History and InvertedIndex
+	}
+	for _, ii := range a.iis {
+		ii.mergeThrottle = &a.mergeThrottle
+	}
 	a.KeepRecentTxnsOfHistoriesWithDisabledSnapshots(100_000) // ~1k blocks of history
 	a.recalcVisibleFiles(a.DirtyFilesEndTxNumMinimax())
 
@@ -287,7 +308,19 @@ func (a *Aggregator) registerII(idx kv.InvertedIdxPos, salt *uint32, dirs datadi
 	return nil
 }
 
-func (a *Aggregator) OnFreeze(f OnFreezeFunc) { a.onFreeze = f }
+func (a *Aggregator) OnFreeze(f OnFreezeFunc)               { a.onFreeze = f }
+func (a *Aggregator) OnMergeProgress(f OnMergeProgressFunc) { a.onMergeProgress = f }
+
+// mergedKeys - keys read by merges of all domains and indices since open
+func (a *Aggregator) mergedKeys() (res uint64) {
+	for _, d := range a.d {
+		res += d.mergedKeys.Load()
+	}
+	for _, ii := range a.iis {
+		res += ii.mergedKeys.Load()
+	}
+	return res
+}
 func (a *Aggregator) DisableFsync() {
 	for _, d := range a.d {
 		d.DisableFsync()
@@ -308,6 +341,7 @@ func (a *Aggregator) OpenFolder() error {
 func (a *Aggregator) openFolder() error {
 	a.dirtyFilesLock.Lock()
 	defer a.dirtyFilesLock.Unlock()
+	a.folderOpened.Store(true)
 	eg := &errgroup.Group{}
 	for _, d := range a.d {
 		d := d
@@ -359,7 +393,175 @@ func (a *Aggregator) closeDirtyFiles() {
 }
 
 func (a *Aggregator) SetCollateAndBuildWorkers(i int) { a.collateAndBuildWorkers = i }
-func (a *Aggregator) SetMergeWorkers(i int)           { a.mergeWorkers = i }
+
+// SetMergeWorkers - amount of concurrent merges: of different domains/indices, and of independent ranges of 1 standalone
+// inverted index
+func (a *Aggregator) SetMergeWorkers(i int) {
+	a.mergeWorkers = i
+	for _, ii := range a.iis {
+		ii.SetMergeWorkers(i)
+	}
+}
+
+// SetRecsplitParams - bucket/leaf size of recsplit accessors (.efi, .vi, .kvi) of `domain`, built after this call.
+// Existing accessors stay readable: parameters are stored in accessor file.
+// Must be called before OpenFolder: accessors are built by background goroutines which read parameters without lock.
+func (a *Aggregator) SetRecsplitParams(domain kv.Domain, bucketSize int, leafSize uint16) error {
+	if domain >= kv.DomainLen {
+		return fmt.Errorf("SetRecsplitParams: unknown domain %d", domain)
+	}
+	if a.folderOpened.Load() {
+		return fmt.Errorf("SetRecsplitParams(%s): must be called before OpenFolder", domain)
+	}
+	cfg := recsplitCfg{bucketSize: bucketSize, leafSize: leafSize}
+	if err := cfg.validate(); err != nil {
+		return fmt.Errorf("SetRecsplitParams(%s): %w", domain, err)
+	}
+	a.d[domain].accessor = cfg
+	return nil
+}
+
+// SetKeepRecentUncompressedSteps - .kv files of `domain` of latest `steps` steps are written without dictionary
+// (0 - disabled, default). Merge with older files produces file with dictionary.
+// Must be called before OpenFolder: collation and merge read it without lock.
+func (a *Aggregator) SetKeepRecentUncompressedSteps(domain kv.Domain, steps uint64) error {
+	if domain >= kv.DomainLen {
+		return fmt.Errorf("SetKeepRecentUncompressedSteps: unknown domain %d", domain)
+	}
+	if a.folderOpened.Load() {
+		return fmt.Errorf("SetKeepRecentUncompressedSteps(%s): must be called before OpenFolder", domain)
+	}
+	a.d[domain].keepRecentUncompressedSteps = steps
+	return nil
+}
+
+// SetEfZstd - values of new .ef files (of domain histories and standalone indices) are compressed by zstd.
+// Readers detect compressed values: can be enabled/disabled on existing files, merge rewrites values of merged files.
+// Must be called before OpenFolder: collation and merge read it without lock.
+func (a *Aggregator) SetEfZstd(enabled bool) error {
+	if a.folderOpened.Load() {
+		return errors.New("SetEfZstd: must be called before OpenFolder")
+	}
+	for _, d := range a.d {
+		d.History.InvertedIndex.efZstd = enabled
+	}
+	for _, ii := range a.iis {
+		ii.efZstd = enabled
+	}
+	return nil
+}
+
+// ReplaceFiles - swaps all files of standalone inverted index `idx` by externally rebuilt files from `newDir`
+// (see InvertedIndex.replaceFiles). Returns error if build or merge of files is running: they would integrate
+// files of old set.
+func (a *Aggregator) ReplaceFiles(ctx context.Context, idx kv.InvertedIdxPos, newDir string) error {
+	if int(idx) >= len(a.iis) || a.iis[idx] == nil {
+		return fmt.Errorf("ReplaceFiles: unknown inverted index %d", idx)
+	}
+	if ok := a.buildingFiles.CompareAndSwap(false, true); !ok {
+		return fmt.Errorf("ReplaceFiles(%s): files build is running", idx)
+	}
+	defer a.buildingFiles.Store(false)
+	if ok := a.mergingFiles.CompareAndSwap(false, true); !ok {
+		return fmt.Errorf("ReplaceFiles(%s): files merge is running", idx)
+	}
+	defer a.mergingFiles.Store(false)
+	if ok := a.buildingOptionalIndices.CompareAndSwap(false, true); !ok {
+		return fmt.Errorf("ReplaceFiles(%s): indices build is running", idx)
+	}
+	defer a.buildingOptionalIndices.Store(false)
+
+	a.dirtyFilesLock.Lock()
+	defer a.dirtyFilesLock.Unlock()
+	return a.iis[idx].replaceFiles(ctx, newDir)
+}
+
+// SetSquashDeletions - drop deleted keys from domain files merged from txNum 0 (default: enabled).
+// Readers of history are not affected: deletions stay in history files.
+func (a *Aggregator) SetSquashDeletions(enabled bool) {
+	for _, d := range a.d {
+		d.noSquashDeletions = !enabled
+	}
+}
+
+// SetFilesFS - read files of all domains and indices from `fsys` instead of OS filesystem (nil - OS filesystem).
+// Names in `fsys` are slash-separated paths relative to dirs.Snap: "domain/v1-accounts.0-16.kv", "idx/...".
+// Files are read into memory if `fsys` doesn't provide *os.File. Only OpenFolder reads from `fsys`: collation,
+// merge and building of missed accessors write to OS filesystem - don't run them with non-OS `fsys`.
+// Must be called before OpenFolder.
+func (a *Aggregator) SetFilesFS(fsys fs.FS) {
+	ffs := filesFS{fs: fsys, root: a.dirs.Snap}
+	for _, d := range a.d {
+		d.filesFS = ffs // shared with it's History and InvertedIndex
+	}
+	for _, ii := range a.iis {
+		ii.filesFS = ffs
+	}
+}
+
+// SetDataFileAccess - how words of data files (.kv, .v, .ef) are read: memory-mapped (default) or by pread.
+// Applied to files opened after this call - so must be called before OpenFolder. Accessors are always memory-mapped.
+func (a *Aggregator) SetDataFileAccess(access seg.FileAccess) {
+	for _, d := range a.d {
+		d.dataAccess = access // shared with it's History and InvertedIndex
+	}
+	for _, ii := range a.iis {
+		ii.dataAccess = access
+	}
+}
+
+// SetOpenFilesLimit - keep open at most `limit` files (data file with it's accessors) of all domains and indices.
+// Files which are not used by any RoTx are closed in least-recently-used order, and re-opened by next read.
+// File used by RoTx stays open until RoTx.Close - so limit is exceeded if open RoTx-s use more files. 0 - no limit.
+// Must be called before first BeginFilesRo.
+func (a *Aggregator) SetOpenFilesLimit(limit int) {
+	if a.filesLRU != nil {
+		a.filesLRU.setLimit(limit)
+		return
+	}
+	if limit <= 0 {
+		return
+	}
+	a.filesLRU = newFilesLRU(limit)
+
+	a.visibleFilesLock.RLock()
+	defer a.visibleFilesLock.RUnlock()
+	var visible []visibleFile
+	for _, d := range a.d {
+		d.filesLRU = a.filesLRU // shared with it's History and InvertedIndex
+		visible = append(visible, d._visible.files...)
+		visible = append(visible, d.History._visibleFiles...)
+		visible = append(visible, d.History.InvertedIndex._visible.files...)
+	}
+	for _, ii := range a.iis {
+		ii.filesLRU = a.filesLRU
+		visible = append(visible, ii._visible.files...)
+	}
+	for _, f := range visible {
+		a.filesLRU.add(f.src)
+	}
+}
+
+// SetMergeRateLimit - limits IO of background merge: bytes/sec of keys and values read from merge input files. 0 - unlimited.
+func (a *Aggregator) SetMergeRateLimit(bytesPerSec datasize.ByteSize) {
+	a.mergeThrottle.setRateLimit(bytesPerSec)
+}
+
+// PauseMerge - already started merge will finish, next merges will wait for ResumeMerge.
+// Finished merges are integrated - nothing is re-done after resume.
+func (a *Aggregator) PauseMerge()  { a.mergeThrottle.pause() }
+func (a *Aggregator) ResumeMerge() { a.mergeThrottle.resume() }
+
+// SetTempFiler - allocator of temporary files of collation and merge. Default: `dirs.Tmp`
+func (a *Aggregator) SetTempFiler(tf TempFiler) {
+	for _, d := range a.d {
+		d.tempFiler = tf
+	}
+	for _, ii := range a.iis {
+		ii.tempFiler = tf
+	}
+}
+
 func (a *Aggregator) SetCompressWorkers(i int) {
 	for _, d := range a.d {
 		d.compressCfg.Workers = i
@@ -782,16 +984,26 @@ func (a *Aggregator) BuildFiles2(ctx context.Context, fromStep, toStep uint64) e
 func (a *Aggregator) mergeLoopStep(ctx context.Context, toTxNum uint64) (somethingDone bool, err error) {
 	a.logger.Debug("[agg] merge", "collate_workers", a.collateAndBuildWorkers, "merge_workers", a.mergeWorkers, "compress_workers", a.d[kv.AccountsDomain].compressCfg.Workers)
 
-	aggTx := a.BeginFilesRo()
-	defer aggTx.Close()
+	if err := a.mergeThrottle.waitResumed(ctx); err != nil {
+		return false, err
+	}
+
 	mxRunningMerges.Inc()
 	defer mxRunningMerges.Dec()
 
-	closeAll := true
 	maxSpan := StepsInColdFile * a.StepSize()
+	iisMerged, err := a.mergeInvertedIndices(ctx, toTxNum, maxSpan)
+	if err != nil {
+		return true, err
+	}
+
+	aggTx := a.BeginFilesRo()
+	defer aggTx.Close()
+
+	closeAll := true
 	r := aggTx.findMergeRange(toTxNum, maxSpan)
 	if !r.any() {
-		return false, nil
+		return iisMerged, nil
 	}
 
 	outs, err := aggTx.staticFilesInRange(r)
@@ -803,7 +1015,6 @@ func (a *Aggregator) mergeLoopStep(ctx context.Context, toTxNum uint64) (somethi
 	if err != nil {
 		return false, err
 	}
-
 	in, err := aggTx.mergeFiles(ctx, outs, r)
 	if err != nil {
 		return true, err
@@ -822,6 +1033,52 @@ func (a *Aggregator) mergeLoopStep(ctx context.Context, toTxNum uint64) (somethi
 	return true, nil
 }
 
+// mergeInvertedIndices - standalone inverted indices merge all their independent ranges at once
+// (see InvertedIndexRoTx.mergeIndependentRanges), indices one by one. Ranges left after it are merged by regular path.
+func (a *Aggregator) mergeInvertedIndices(ctx context.Context, toTxNum, maxSpan uint64) (somethingMerged bool, err error) {
+	for _, ii := range a.iis {
+		merged, err := a.mergeInvertedIndex(ctx, ii, toTxNum, maxSpan)
+		if err != nil {
+			return true, err
+		}
+		somethingMerged = somethingMerged || merged
+	}
+	return somethingMerged, nil
+}
+
+func (a *Aggregator) mergeInvertedIndex(ctx context.Context, ii *InvertedIndex, toTxNum, maxSpan uint64) (somethingMerged bool, err error) {
+	iit := ii.BeginFilesRo()
+	defer iit.Close()
+	outs, ins, err := iit.mergeIndependentRanges(ctx, toTxNum, maxSpan, a.ps)
+	if err != nil {
+		return true, err
+	}
+	if len(ins) == 0 {
+		return false, nil
+	}
+
+	a.dirtyFilesLock.Lock()
+	for i := range ins {
+		ii.integrateMergedDirtyFiles(outs[i], ins[i])
+	}
+	a.dirtyFilesLock.Unlock()
+	a.recalcVisibleFiles(a.DirtyFilesEndTxNumMinimax())
+
+	after := ii.BeginFilesRo()
+	defer after.Close()
+	var frozen []string
+	a.dirtyFilesLock.Lock()
+	for _, in := range ins {
+		after.cleanAfterMerge(in)
+		if in.frozen {
+			frozen = append(frozen, in.decompressor.FileName())
+		}
+	}
+	a.dirtyFilesLock.Unlock()
+	a.onFreeze(frozen)
+	return true, nil
+}
+
 func (a *Aggregator) MergeLoop(ctx context.Context) error {
 	for {
 		somethingMerged, err := a.mergeLoopStep(ctx, a.visibleFilesMinimaxTxNum.Load())
@@ -834,6 +1091,105 @@ func (a *Aggregator) MergeLoop(ctx context.Context) error {
 	}
 }
 
+type mergeThrottle struct {
+	limiter  atomic.Pointer[rate.Limiter] // nil - unlimited
+	consumed atomic.Uint64                // input bytes of merges which passed throttle
+
+	pauseLock sync.Mutex
+	resumed   chan struct{} // nil - not paused
+}
+
+func (t *mergeThrottle) setRateLimit(bytesPerSec datasize.ByteSize) {
+	if bytesPerSec == 0 {
+		t.limiter.Store(nil)
+		return
+	}
+	burst := int(min(bytesPerSec, math.MaxInt32))
+	l := rate.NewLimiter(rate.Limit(bytesPerSec), burst)
+	l.AllowN(time.Now(), burst) // start with empty bucket: no burst above limit
+	t.limiter.Store(l)
+}
+
+// waitN - blocks until `n` bytes of merge IO fit into rate limit
+func (t *mergeThrottle) waitN(ctx context.Context, n int64) error {
+	if l := t.limiter.Load(); l != nil {
+		for left := n; left > 0; {
+			chunk := min(left, int64(l.Burst()))
+			if err := l.WaitN(ctx, int(chunk)); err != nil {
+				return err
+			}
+			left -= chunk
+		}
+	}
+	t.consumed.Add(uint64(n))
+	return nil
+}
+
+// mergeReadChargeBatch - words read by merge are charged to limiter by batches of this size: not per word
+const mergeReadChargeBatch = 64 * 1024
+
+// mergeReadCharge - charges keys and values read from input files of 1 merge to mergeThrottle. Waits happen inside
+// merge loop: bigger merges don't sleep upfront while holding their input files.
+type mergeReadCharge struct {
+	t       *mergeThrottle // nil - unlimited
+	pending int64
+}
+
+func (c *mergeReadCharge) read(ctx context.Context, words ...[]byte) error {
+	if c.t == nil {
+		return nil
+	}
+	for _, w := range words {
+		c.pending += int64(len(w))
+	}
+	if c.pending < mergeReadChargeBatch {
+		return nil
+	}
+	return c.flush(ctx)
+}
+
+// flush - charges rest of batch, must be called at end of merge loop
+func (c *mergeReadCharge) flush(ctx context.Context) error {
+	if c.t == nil || c.pending == 0 {
+		return nil
+	}
+	n := c.pending
+	c.pending = 0
+	return c.t.waitN(ctx, n)
+}
+
+func (t *mergeThrottle) pause() {
+	t.pauseLock.Lock()
+	defer t.pauseLock.Unlock()
+	if t.resumed == nil {
+		t.resumed = make(chan struct{})
+	}
+}
+
+func (t *mergeThrottle) resume() {
+	t.pauseLock.Lock()
+	defer t.pauseLock.Unlock()
+	if t.resumed != nil {
+		close(t.resumed)
+		t.resumed = nil
+	}
+}
+
+func (t *mergeThrottle) waitResumed(ctx context.Context) error {
+	t.pauseLock.Lock()
+	resumed := t.resumed
+	t.pauseLock.Unlock()
+	if resumed == nil {
+		return nil
+	}
+	select {
+	case <-resumed:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
 func (a *Aggregator) integrateDirtyFiles(sf AggV3StaticFiles, txNumFrom, txNumTo uint64) {
 	a.dirtyFilesLock.Lock()
 	defer a.dirtyFilesLock.Unlock()
@@ -1205,7 +1561,7 @@ func (ac *AggregatorRoTx) Prune(ctx context.Context, tx kv.RwTx, limit uint64, l
 	txTo := ac.a.visibleFilesMinimaxTxNum.Load()
 	if txTo > 0 {
 		// txTo is first txNum in next step, has to go 1 tx behind to get correct step number
-		step = (txTo - 1) / ac.a.StepSize()
+		step = StepOfTxNum(txTo-1, ac.a.StepSize())
 	}
 
 	if txFrom == txTo || !ac.CanPrune(tx, txTo) {
@@ -1539,7 +1895,7 @@ func (ac *AggregatorRoTx) mergeFiles(ctx context.Context, files SelectedStaticFi
 		})
 	}
 
-	err := g.Wait()
+	err := ac.a.waitMerge(g, files.keyCount())
 	if err == nil {
 		closeFiles = false
 		ac.a.logger.Info(fmt.Sprintf("[snapshots] state merge done %s", r.String()))
@@ -1549,6 +1905,27 @@ func (ac *AggregatorRoTx) mergeFiles(ctx context.Context, files SelectedStaticFi
 	return mf, err
 }
 
+// waitMerge - waits for merge goroutines and reports progress of `total` keys
+func (a *Aggregator) waitMerge(g *errgroup.Group, total uint64) error {
+	start := a.mergedKeys()
+	waitErr := make(chan error, 1)
+	go func() { waitErr <- g.Wait() }()
+
+	progressEvery := time.NewTicker(mergeProgressEvery)
+	defer progressEvery.Stop()
+	for {
+		select {
+		case err := <-waitErr:
+			if err == nil {
+				a.onMergeProgress(total, total)
+			}
+			return err
+		case <-progressEvery.C:
+			a.onMergeProgress(min(a.mergedKeys()-start, total), total)
+		}
+	}
+}
+
 func (a *Aggregator) integrateMergedDirtyFiles(outs SelectedStaticFilesV3, in MergedFilesV3) {
 	a.dirtyFilesLock.Lock()
 	defer a.dirtyFilesLock.Unlock()
@@ -1619,7 +1996,7 @@ func (a *Aggregator) BuildFilesInBackground(txNum uint64) chan struct{} {
 		return fin
 	}
 
-	step := a.visibleFilesMinimaxTxNum.Load() / a.StepSize()
+	step := StepOfTxNum(a.visibleFilesMinimaxTxNum.Load(), a.StepSize())
 	a.wg.Add(1)
 	go func() {
 		defer a.wg.Done()
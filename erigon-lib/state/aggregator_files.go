@@ -56,18 +56,43 @@ func (sf SelectedStaticFilesV3) Close() {
 	}
 }
 
+// keyCount - amount of keys in data files selected for merge, which merge will read: .kv and .ef (history values are read by keys of .ef)
+func (sf SelectedStaticFilesV3) keyCount() (count uint64) {
+	for id := range sf.d {
+		for _, group := range [][]*filesItem{sf.d[id], sf.dIdx[id]} {
+			for _, item := range group {
+				if item != nil && item.decompressor != nil {
+					count += uint64(item.decompressor.Count() / 2)
+				}
+			}
+		}
+	}
+	for _, group := range sf.ii {
+		for _, item := range group {
+			if item != nil && item.decompressor != nil {
+				count += uint64(item.decompressor.Count() / 2)
+			}
+		}
+	}
+	return count
+}
+
 func (ac *AggregatorRoTx) staticFilesInRange(r RangesV3) (sf SelectedStaticFilesV3, err error) {
 	for id := range ac.d {
 		if !r.domain[id].any() {
 			continue
 		}
-		sf.d[id], sf.dIdx[id], sf.dHist[id] = ac.d[id].staticFilesInRange(r.domain[id])
+		if sf.d[id], sf.dIdx[id], sf.dHist[id], err = ac.d[id].staticFilesInRange(r.domain[id]); err != nil {
+			return sf, err
+		}
 	}
 	for id, rng := range r.invertedIndex {
 		if rng == nil || !rng.needMerge {
 			continue
 		}
-		sf.ii[id] = ac.iis[id].staticFilesInRange(rng.from, rng.to)
+		if sf.ii[id], err = ac.iis[id].staticFilesInRange(rng.from, rng.to); err != nil {
+			return sf, err
+		}
 	}
 	return sf, err
 }
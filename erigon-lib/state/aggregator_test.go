@@ -27,6 +27,7 @@ import (
 	"os"
 	"path"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"testing"
 	"time"
@@ -257,6 +258,288 @@ func TestAggregatorV3_MergeValTransform(t *testing.T) {
 	require.NoError(t, err)
 }
 
+func TestAggregatorV3_MergeProgress(t *testing.T) { // not parallel: changes mergeProgressEvery
+	defer func(was time.Duration) { mergeProgressEvery = was }(mergeProgressEvery)
+	mergeProgressEvery = time.Microsecond
+
+	aggStep := uint64(10)
+	db, agg := testDbAndAggregatorv3(t, aggStep)
+	ctx := context.Background()
+
+	tx, err := db.BeginRw(ctx)
+	require.NoError(t, err)
+	defer tx.Rollback()
+	ac := agg.BeginFilesRo()
+	domains, err := NewSharedDomains(WrapTxWithCtx(tx, ac), log.New())
+	require.NoError(t, err)
+
+	maxTx := aggStep * 8
+	rnd := rand.New(rand.NewSource(0))
+	generateSharedDomainsUpdates(t, domains, maxTx, rnd, 20, 10, aggStep/2)
+	require.NoError(t, domains.Flush(ctx, tx))
+	domains.Close()
+	ac.Close()
+	require.NoError(t, tx.Commit())
+
+	for step := uint64(0); step < maxTx/aggStep; step++ {
+		require.NoError(t, agg.buildFiles(ctx, step))
+	}
+
+	type call struct{ done, total uint64 }
+	var calls []call
+	agg.OnMergeProgress(func(done, total uint64) { calls = append(calls, call{done, total}) })
+	keysBefore := agg.mergedKeys()
+	require.NoError(t, agg.MergeLoop(ctx))
+
+	// every merge reports non-decreasing progress and ends at total
+	require.NotEmpty(t, calls)
+	require.Equal(t, calls[len(calls)-1].done, calls[len(calls)-1].total)
+	for i, c := range calls {
+		require.Positive(t, c.total)
+		require.LessOrEqual(t, c.done, c.total)
+		if i > 0 && calls[i-1].done != calls[i-1].total { // same merge
+			require.Equal(t, calls[i-1].total, c.total)
+			require.GreaterOrEqual(t, c.done, calls[i-1].done)
+		}
+	}
+	require.Greater(t, agg.mergedKeys(), keysBefore)
+}
+
+func TestAggregatorV3_MergeRateLimit(t *testing.T) {
+	t.Parallel()
+	aggStep := uint64(10)
+	db, agg := testDbAndAggregatorv3(t, aggStep)
+	ctx := context.Background()
+
+	tx, err := db.BeginRw(ctx)
+	require.NoError(t, err)
+	defer tx.Rollback()
+	ac := agg.BeginFilesRo()
+	domains, err := NewSharedDomains(WrapTxWithCtx(tx, ac), log.New())
+	require.NoError(t, err)
+
+	maxTx := aggStep * 8
+	rnd := rand.New(rand.NewSource(0))
+	generateSharedDomainsUpdates(t, domains, maxTx, rnd, 20, 10, aggStep/2)
+	require.NoError(t, domains.Flush(ctx, tx))
+	domains.Close()
+	ac.Close()
+	require.NoError(t, tx.Commit())
+
+	// build small files without background merge
+	for step := uint64(0); step < maxTx/aggStep; step++ {
+		require.NoError(t, agg.buildFiles(ctx, step))
+	}
+
+	var filesSize int64
+	ac = agg.BeginFilesRo()
+	for _, d := range ac.d {
+		for _, f := range d.files {
+			filesSize += f.src.decompressor.Size()
+		}
+	}
+	ac.Close()
+	limit := datasize.ByteSize(filesSize) // merge reads every file at least once: takes more than 1 second
+	start := time.Now()                   // limiter accumulates tokens from here, also while paused
+	agg.SetMergeRateLimit(limit)
+
+	// paused: nothing merged until resume
+	agg.PauseMerge()
+	mergeErr := make(chan error, 1)
+	go func() { mergeErr <- agg.MergeLoop(ctx) }()
+	time.Sleep(100 * time.Millisecond)
+	require.Zero(t, agg.mergeThrottle.consumed.Load())
+
+	agg.ResumeMerge()
+	require.NoError(t, <-mergeErr)
+	took := time.Since(start)
+
+	merged := agg.mergeThrottle.consumed.Load()
+	require.Positive(t, merged)
+	throughput := float64(merged) / took.Seconds()
+	t.Logf("merged %s in %s: %s/sec, limit %s/sec", datasize.ByteSize(merged).HR(), took, datasize.ByteSize(throughput).HR(), limit.HR())
+	require.LessOrEqual(t, throughput, float64(limit))
+
+	// completed merges are not re-done
+	require.NoError(t, agg.MergeLoop(ctx))
+	require.Equal(t, merged, agg.mergeThrottle.consumed.Load())
+}
+
+func TestAggregatorV3_MergeInvertedIndexRanges(t *testing.T) {
+	t.Parallel()
+	aggStep := uint64(10)
+	db, agg := testDbAndAggregatorv3(t, aggStep)
+	ctx := context.Background()
+	agg.SetMergeWorkers(2)
+	for _, ii := range agg.iis {
+		require.Equal(t, 2, ii.mergeWorkers)
+	}
+
+	tx, err := db.BeginRw(ctx)
+	require.NoError(t, err)
+	defer tx.Rollback()
+	ac := agg.BeginFilesRo()
+	domains, err := NewSharedDomains(WrapTxWithCtx(tx, ac), log.New())
+	require.NoError(t, err)
+	maxTx := aggStep * 4
+	for txNum := uint64(1); txNum <= maxTx; txNum++ {
+		domains.SetTxNum(txNum)
+		require.NoError(t, domains.IndexAdd(kv.TblLogAddressIdx, []byte{byte(txNum % 7)}))
+	}
+	require.NoError(t, domains.Flush(ctx, tx))
+	domains.Close()
+	ac.Close()
+	require.NoError(t, tx.Commit())
+	for step := uint64(0); step < maxTx/aggStep; step++ {
+		require.NoError(t, agg.buildFiles(ctx, step))
+	}
+
+	// independent ranges 0-2 and 2-4 are merged by 1 step
+	merged, err := agg.mergeInvertedIndices(ctx, maxTx, 2*aggStep)
+	require.NoError(t, err)
+	require.True(t, merged)
+	ac = agg.BeginFilesRo()
+	require.Equal(t, []string{"v1-logaddrs.0-2.ef", "v1-logaddrs.2-4.ef"}, ac.iis[kv.LogAddrIdxPos].Files())
+	ac.Close()
+	merged, err = agg.mergeInvertedIndices(ctx, maxTx, 2*aggStep)
+	require.NoError(t, err)
+	require.False(t, merged)
+}
+
+type countingTempFiler struct {
+	TempFiler
+	mu      sync.Mutex
+	created map[string]int // name -> amount
+	removed map[string]bool
+	dirs    []string
+}
+
+func (f *countingTempFiler) Create(name string) (string, error) {
+	dir, err := f.TempFiler.Create(name)
+	if err != nil {
+		return "", err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.created[name]++
+	f.dirs = append(f.dirs, dir)
+	return dir, nil
+}
+
+func (f *countingTempFiler) Remove(dir string) error {
+	f.mu.Lock()
+	f.removed[dir] = true
+	f.mu.Unlock()
+	return f.TempFiler.Remove(dir)
+}
+
+func TestAggregatorV3_TempFiler(t *testing.T) {
+	t.Parallel()
+	aggStep := uint64(10)
+	db, agg := testDbAndAggregatorv3(t, aggStep)
+	ctx := context.Background()
+	tf := &countingTempFiler{TempFiler: NewTempFiler(t.TempDir()), created: map[string]int{}, removed: map[string]bool{}}
+	agg.SetTempFiler(tf)
+
+	tx, err := db.BeginRw(ctx)
+	require.NoError(t, err)
+	defer tx.Rollback()
+	ac := agg.BeginFilesRo()
+	domains, err := NewSharedDomains(WrapTxWithCtx(tx, ac), log.New())
+	require.NoError(t, err)
+
+	maxTx := aggStep * 4
+	generateSharedDomainsUpdates(t, domains, maxTx, rand.New(rand.NewSource(0)), 20, 10, aggStep/2)
+	require.NoError(t, domains.Flush(ctx, tx))
+	domains.Close()
+	ac.Close()
+	require.NoError(t, tx.Commit())
+
+	require.NoError(t, agg.BuildFiles(maxTx))
+
+	tf.mu.Lock()
+	defer tf.mu.Unlock()
+	for _, name := range []string{"accounts.domain.collate", "accounts.collate.hist", "logaddrs.collate.ii", "accounts.domain.merge", "accounts.merge.hist", "accounts.merge.ii"} {
+		require.Positive(t, tf.created[name], name)
+	}
+	for _, dir := range tf.dirs {
+		require.True(t, tf.removed[dir], dir)
+		require.NoDirExists(t, dir)
+	}
+}
+
+func TestAggregatorV3_SetRecsplitParams(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+	dirs := datadir.New(t.TempDir())
+	agg, err := NewAggregator(context.Background(), dirs, 16, nil, log.New())
+	require.NoError(err)
+	t.Cleanup(agg.Close)
+
+	require.NoError(agg.SetRecsplitParams(kv.AccountsDomain, 16, 4))
+	require.Equal(recsplitCfg{bucketSize: 16, leafSize: 4}, agg.d[kv.AccountsDomain].accessor)
+	require.Error(agg.SetRecsplitParams(kv.DomainLen, 16, 4))
+	require.Error(agg.SetRecsplitParams(kv.AccountsDomain, 0, 4))
+
+	require.NoError(agg.OpenFolder())
+	require.Error(agg.SetRecsplitParams(kv.StorageDomain, 16, 4))
+	require.Equal(defaultRecsplitCfg, agg.d[kv.StorageDomain].accessor)
+}
+
+func TestAggregatorV3_KeepRecentUncompressedSteps(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+	agg, err := NewAggregator(context.Background(), datadir.New(t.TempDir()), 16, nil, log.New())
+	require.NoError(err)
+	t.Cleanup(agg.Close)
+
+	require.NoError(agg.SetKeepRecentUncompressedSteps(kv.StorageDomain, 2))
+	require.EqualValues(2, agg.d[kv.StorageDomain].keepRecentUncompressedSteps)
+	require.Zero(agg.d[kv.AccountsDomain].keepRecentUncompressedSteps)
+	require.Error(agg.SetKeepRecentUncompressedSteps(kv.DomainLen, 2))
+
+	require.NoError(agg.OpenFolder())
+	require.Error(agg.SetKeepRecentUncompressedSteps(kv.AccountsDomain, 2))
+}
+
+func TestAggregatorV3_SetEfZstd(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+	agg, err := NewAggregator(context.Background(), datadir.New(t.TempDir()), 16, nil, log.New())
+	require.NoError(err)
+	t.Cleanup(agg.Close)
+
+	require.NoError(agg.SetEfZstd(true))
+	require.True(agg.d[kv.StorageDomain].History.InvertedIndex.efZstd)
+	require.True(agg.iis[kv.LogAddrIdxPos].efZstd)
+	require.Equal(seg.CompressValsZstd, agg.iis[kv.LogAddrIdxPos].efWriterCompression())
+
+	require.NoError(agg.OpenFolder())
+	require.Error(agg.SetEfZstd(false))
+	require.True(agg.iis[kv.LogAddrIdxPos].efZstd)
+}
+
+func TestAggregatorV3_ReplaceFilesExclusion(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+	agg, err := NewAggregator(context.Background(), datadir.New(t.TempDir()), 16, nil, log.New())
+	require.NoError(err)
+	t.Cleanup(agg.Close)
+	require.NoError(agg.OpenFolder())
+	ctx := context.Background()
+
+	require.ErrorContains(agg.ReplaceFiles(ctx, kv.StandaloneIdxLen, t.TempDir()), "unknown inverted index")
+
+	agg.mergingFiles.Store(true)
+	require.ErrorContains(agg.ReplaceFiles(ctx, kv.LogAddrIdxPos, t.TempDir()), "merge is running")
+	require.False(agg.buildingFiles.Load())
+	agg.mergingFiles.Store(false)
+
+	// not excluded: fails only on content of empty dir
+	require.ErrorContains(agg.ReplaceFiles(ctx, kv.LogAddrIdxPos, t.TempDir()), "don't cover")
+	require.False(agg.buildingFiles.Load() || agg.mergingFiles.Load() || agg.buildingOptionalIndices.Load())
+}
+
 func TestAggregatorV3_RestartOnDatadir(t *testing.T) {
 	t.Parallel()
 	//t.Skip()
@@ -23,6 +23,8 @@ import (
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"io"
+	"io/fs"
 	"math"
 	"os"
 	"path"
@@ -733,12 +735,13 @@ type BtIndex struct {
 	m        mmap.MMap
 	data     []byte
 	ef       *eliasfano32.EliasFano
-	file     *os.File
+	file     fs.File
 	alloc    *btAlloc // pointless?
 	bplus    *BpsTree
 	size     int64
 	modTime  time.Time
 	filePath string
+	keyCount uint64 // of `ef`: readable while file is closed
 }
 
 // Decompressor should be managed by caller (could be closed after index is built). When index is built, external getter should be passed to seekInFiles function
@@ -826,6 +829,16 @@ func BuildBtreeIndexWithDecompressor(indexPath string, kv *seg.Decompressor, com
 
 // For now, M is not stored inside index file.
 func OpenBtreeIndexWithDecompressor(indexPath string, M uint64, kv *seg.Decompressor, compress seg.FileCompression) (bt *BtIndex, err error) {
+	return openBtreeIndex(indexPath, func() (fs.File, error) { return os.Open(indexPath) }, M, kv, compress)
+}
+
+// OpenBtreeIndexWithDecompressorFS - like OpenBtreeIndexWithDecompressor, but file `name` is read from `fsys`.
+// Files which are not *os.File (embedded, in-memory, network FS) are read into memory instead of mmap.
+func OpenBtreeIndexWithDecompressorFS(fsys fs.FS, name string, M uint64, kv *seg.Decompressor, compress seg.FileCompression) (bt *BtIndex, err error) {
+	return openBtreeIndex(name, func() (fs.File, error) { return fsys.Open(name) }, M, kv, compress)
+}
+
+func openBtreeIndex(indexPath string, open func() (fs.File, error), M uint64, kv *seg.Decompressor, compress seg.FileCompression) (bt *BtIndex, err error) {
 	defer func() {
 		// recover from panic if one occurred. Set err to nil if no panic
 		if r := recover(); r != nil {
@@ -834,30 +847,33 @@ func OpenBtreeIndexWithDecompressor(indexPath string, M uint64, kv *seg.Decompre
 		}
 	}()
 
-	s, err := os.Stat(indexPath)
+	idx := &BtIndex{filePath: indexPath}
+	idx.file, err = open()
 	if err != nil {
 		return nil, err
 	}
-
-	idx := &BtIndex{
-		filePath: indexPath,
-		size:     s.Size(),
-		modTime:  s.ModTime(),
-	}
-
-	idx.file, err = os.Open(indexPath)
+	s, err := idx.file.Stat()
 	if err != nil {
+		idx.Close()
 		return nil, err
 	}
+	idx.size, idx.modTime = s.Size(), s.ModTime()
 	if idx.size == 0 {
 		return idx, nil
 	}
 
-	idx.m, err = mmap.MapRegion(idx.file, int(idx.size), mmap.RDONLY, 0, 0)
-	if err != nil {
-		return nil, err
+	if osFile, ok := idx.file.(*os.File); ok {
+		if idx.m, err = mmap.MapRegion(osFile, int(idx.size), mmap.RDONLY, 0, 0); err != nil {
+			return nil, err
+		}
+		idx.data = idx.m[:idx.size]
+	} else {
+		idx.data = make([]byte, idx.size)
+		if _, err = io.ReadFull(idx.file, idx.data); err != nil {
+			idx.Close()
+			return nil, fmt.Errorf("read %s: %w", indexPath, err)
+		}
 	}
-	idx.data = idx.m[:idx.size]
 
 	var pos int
 	if len(idx.data[pos:]) == 0 {
@@ -865,6 +881,7 @@ func OpenBtreeIndexWithDecompressor(indexPath string, M uint64, kv *seg.Decompre
 	}
 
 	idx.ef, pos = eliasfano32.ReadEliasFano(idx.data[pos:])
+	idx.keyCount = idx.ef.Count()
 
 	defer kv.EnableMadvNormal().DisableReadAhead()
 	kvGetter := seg.NewReader(kv.MakeGetter(), compress)
@@ -953,13 +970,20 @@ func (b *BtIndex) FilePath() string { return b.filePath }
 
 func (b *BtIndex) FileName() string { return path.Base(b.filePath) }
 
-func (b *BtIndex) Empty() bool { return b == nil || b.ef == nil || b.ef.Count() == 0 }
+func (b *BtIndex) Empty() bool { return b == nil || b.keyCount == 0 }
 
 func (b *BtIndex) KeyCount() uint64 {
 	if b.Empty() {
 		return 0
 	}
-	return b.ef.Count()
+	return b.keyCount
+}
+
+// takeOpened - re-opens closed `b` by `src` (opened from same file later), `src` must not be used after it.
+// Fields of file metadata (path, size, key count) are not written: they can be read concurrently.
+func (b *BtIndex) takeOpened(src *BtIndex) {
+	b.m, b.file, b.data, b.ef = src.m, src.file, src.data, src.ef
+	b.alloc, b.bplus = src.alloc, src.bplus // lookups of them read `src`: it has same data
 }
 
 func (b *BtIndex) Close() {
@@ -983,6 +1007,46 @@ func (b *BtIndex) Close() {
 	}
 }
 
+// ValueLen - exact match of key, like Get, but returns only length of value: value is skipped, not decompressed
+func (b *BtIndex) ValueLen(lookup []byte, gr *seg.Reader) (vLen int, found bool, err error) {
+	if b.Empty() {
+		return 0, false, nil
+	}
+
+	var index uint64
+	if UseBpsTree {
+		if b.bplus == nil {
+			panic(fmt.Errorf("ValueLen: `b.bplus` is nil: %s", gr.FileName()))
+		}
+		_, found, index, err = b.bplus.Get(gr, lookup)
+	} else {
+		if b.alloc == nil {
+			return 0, false, nil
+		}
+		_, found, index, err = b.alloc.Get(gr, lookup)
+	}
+	if err != nil || !found {
+		if errors.Is(err, ErrBtIndexLookupBounds) {
+			return 0, false, nil
+		}
+		return 0, false, err
+	}
+	if index >= b.ef.Count() {
+		return 0, false, nil
+	}
+
+	gr.Reset(b.ef.Get(index))
+	if !gr.HasNext() {
+		return 0, false, fmt.Errorf("pair %d/%d key not found, file: %s/%s", index, b.ef.Count(), b.FileName(), gr.FileName())
+	}
+	gr.Skip()
+	if !gr.HasNext() {
+		return 0, false, fmt.Errorf("pair %d/%d value not found, file: %s/%s", index, b.ef.Count(), b.FileName(), gr.FileName())
+	}
+	_, vLen = gr.Skip()
+	return vLen, true, nil
+}
+
 // Get - exact match of key. `k == nil` - means not found
 func (b *BtIndex) Get(lookup []byte, gr *seg.Reader) (k, v []byte, offsetInFile uint64, found bool, err error) {
 	// TODO: optimize by "push-down" - instead of using seek+compare, alloc can have method Get which will return nil if key doesn't exists
@@ -0,0 +1,132 @@
+// Copyright 2024 The Erigon Authors
+// This file is part of Erigon.
+//
+// Erigon is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Erigon is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with Erigon. If not, see <http://www.gnu.org/licenses/>.
+
+package state
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+
+	"github.com/erigontech/erigon-lib/common/dbg"
+)
+
+// Data files (.kv, .v, .ef) have sidecar file `<data file>.crc32` with CRC-32 (Castagnoli) of data file - written when file is built,
+// merged or rewritten. It's not a trailer of data file: seg.Decompressor treats all bytes after header as data.
+
+// VerifyChecksumOnOpen - verify checksum of data files when they are opened (reads whole file). Corrupted files are excluded.
+var VerifyChecksumOnOpen = dbg.EnvBool("AGG_VERIFY_CHECKSUM", false)
+
+const checksumFileExt = ".crc32"
+
+var checksumTable = crc32.MakeTable(crc32.Castagnoli)
+
+// newChecksum - checksum of data file is calculated by its compressor while file is written (no re-read of file).
+// Must be called before Compress, sum is written by writeChecksum after it.
+func newChecksum(comp interface{ SetOutputHash(hash.Hash) }) hash.Hash32 {
+	h := crc32.New(checksumTable)
+	comp.SetOutputHash(h)
+	return h
+}
+
+func readerChecksum(r io.Reader) (uint32, error) {
+	h := crc32.New(checksumTable)
+	if _, err := io.Copy(h, r); err != nil {
+		return 0, err
+	}
+	return h.Sum32(), nil
+}
+
+// writeChecksum - must be called after data file `fPath` is fully written. Sidecar is written atomically
+// (like data files): .tmp, fsync, rename - truncated .crc32 would exclude valid data file on open.
+func writeChecksum(fPath string, sum uint32) error {
+	var buf [4]byte
+	binary.BigEndian.PutUint32(buf[:], sum)
+	tmpPath := fPath + checksumFileExt + ".tmp"
+	if err := writeFileSync(tmpPath, buf[:]); err != nil {
+		_ = os.Remove(tmpPath)
+		return fmt.Errorf("checksum %s: %w", filepath.Base(fPath), err)
+	}
+	if err := os.Rename(tmpPath, fPath+checksumFileExt); err != nil {
+		_ = os.Remove(tmpPath)
+		return fmt.Errorf("checksum %s: %w", filepath.Base(fPath), err)
+	}
+	return nil
+}
+
+// removeChecksum - must be called before data file `fPath` is replaced by in-place rewrite: crash before new sidecar
+// is written leaves file without checksum (not verified), instead of file with checksum of old data
+func removeChecksum(fPath string) error {
+	if err := os.Remove(fPath + checksumFileExt); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("checksum %s: %w", filepath.Base(fPath), err)
+	}
+	return nil
+}
+
+func writeFileSync(fPath string, data []byte) error {
+	f, err := os.Create(fPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err = f.Write(data); err != nil {
+		return err
+	}
+	if err = f.Sync(); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// verifyChecksum - files without checksum (built before checksums, or downloaded) are not verified
+func verifyChecksum(fPath string) error {
+	return verifyChecksumFS(os.DirFS(filepath.Dir(fPath)), filepath.Base(fPath))
+}
+
+// verifyChecksumFS - same as verifyChecksum, `name` is slash-separated path inside `fsys`
+func verifyChecksumFS(fsys fs.FS, name string) error {
+	fName := path.Base(name)
+	want, err := fs.ReadFile(fsys, name+checksumFileExt)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		return fmt.Errorf("checksum %s: %w", fName, err)
+	}
+	if len(want) != 4 {
+		return fmt.Errorf("checksum %s: invalid %s file size %d", fName, checksumFileExt, len(want))
+	}
+	f, err := fsys.Open(name)
+	if err != nil {
+		return fmt.Errorf("checksum %s: %w", fName, err)
+	}
+	defer f.Close()
+	got, err := readerChecksum(f)
+	if err != nil {
+		return fmt.Errorf("checksum %s: %w", fName, err)
+	}
+	if got != binary.BigEndian.Uint32(want) {
+		return fmt.Errorf("checksum %s: mismatch %08x, expected %08x", fName, got, binary.BigEndian.Uint32(want))
+	}
+	return nil
+}
@@ -24,15 +24,17 @@ import (
 	"errors"
 	"fmt"
 	"math"
+	"math/bits"
 	"path/filepath"
 	"regexp"
-	"sort"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 
+	"github.com/c2h5oh/datasize"
 	"github.com/erigontech/erigon-lib/metrics"
 	btree2 "github.com/tidwall/btree"
 	"golang.org/x/sync/errgroup"
@@ -56,6 +58,14 @@ import (
 // files of smaller size are also immutable, but can be removed after merge to bigger files.
 const StepsInColdFile = 64
 
+// StepOfTxNum - step which `txNum` belongs to
+func StepOfTxNum(txNum, aggregationStep uint64) uint64 { return txNum / aggregationStep }
+
+// TxNumRangeOfStep - txNums of `step`: [from, to)
+func TxNumRangeOfStep(step, aggregationStep uint64) (from, to uint64) {
+	return step * aggregationStep, (step + 1) * aggregationStep
+}
+
 var (
 	asserts          = dbg.EnvBool("AGG_ASSERTS", false)
 	traceFileLife    = dbg.EnvString("AGG_TRACE_FILE_LIFE", "")
@@ -64,6 +74,18 @@ var (
 )
 var traceGetLatest, _ = kv.String2Domain(dbg.EnvString("AGG_TRACE_GET_LATEST", ""))
 
+// TrackLookupHistogram - count how many files each GetAsOf touched: see DomainRoTx.LookupHistogram
+var TrackLookupHistogram = dbg.EnvBool("AGG_LOOKUP_HISTOGRAM", false)
+
+const lookupHistogramBuckets = 8
+
+// lookupHistogram - bucket `i` counts lookups which touched [2^(i-1), 2^i) files, bucket 0 - no files, last bucket - all bigger
+type lookupHistogram [lookupHistogramBuckets]atomic.Uint64
+
+func (h *lookupHistogram) observe(filesTouched int) {
+	h[min(bits.Len(uint(filesTouched)), len(h)-1)].Add(1)
+}
+
 // Domain is a part of the state (examples are Accounts, Storage, Code)
 // Domain should not have any go routines or locks
 //
@@ -102,10 +124,20 @@ type Domain struct {
 
 	compressCfg seg.Cfg
 	compression seg.FileCompression
+	// collateETLRAM - RAM limit of collate's sorting buffer (for `largeVals`). Sorted runs spill to `dirs.Tmp` above it
+	collateETLRAM datasize.ByteSize
+	// keepRecentUncompressedSteps - .kv files of latest N steps are written without dictionary. They are compressed
+	// when merged with older files
+	keepRecentUncompressedSteps uint64
+	// noSquashDeletions - keep deleted keys (empty values) in files merged from txNum 0. By default they are dropped:
+	// there is no older file which may have value of such key, so absence of key means the same as deletion
+	noSquashDeletions bool
 
 	valsTable string // key -> inverted_step + values (Dupsort)
 	stats     DomainStats
 	indexList idxList
+
+	lookupHist lookupHistogram // only if TrackLookupHistogram
 }
 
 type domainCfg struct {
@@ -115,6 +147,7 @@ type domainCfg struct {
 	largeVals                   bool
 	replaceKeysInValues         bool
 	restrictSubsetFileDeletions bool
+	keepRecentUncompressedSteps uint64
 }
 
 type domainVisible struct {
@@ -133,6 +166,8 @@ var DomainCompressCfg = seg.Cfg{
 	Workers:              1,
 }
 
+var DomainCollateETLRAM = dbg.EnvDataSize("AGG_DOMAIN_COLLATE_RAM", etl.BufferOptimalSize)
+
 func NewDomain(cfg domainCfg, aggregationStep uint64, name kv.Domain, valsTable, indexKeysTable, historyValsTable, indexTable string, integrityCheck func(name kv.Domain, fromStep, toStep uint64) bool, logger log.Logger) (*Domain, error) {
 	if cfg.hist.iiCfg.dirs.SnapDomain == "" {
 		panic("empty `dirs` variable")
@@ -142,8 +177,9 @@ func NewDomain(cfg domainCfg, aggregationStep uint64, name kv.Domain, valsTable,
 		name:      name,
 		valsTable: valsTable,
 
-		compressCfg: DomainCompressCfg,
-		compression: cfg.compress,
+		compressCfg:   DomainCompressCfg,
+		compression:   cfg.compress,
+		collateETLRAM: DomainCollateETLRAM,
 
 		dirtyFiles: btree2.NewBTreeGOptions[*filesItem](filesItemLess, btree2.Options{Degree: 128, NoLocks: false}),
 		stats:      DomainStats{FilesQueries: &atomic.Uint64{}, TotalQueries: &atomic.Uint64{}},
@@ -152,6 +188,7 @@ func NewDomain(cfg domainCfg, aggregationStep uint64, name kv.Domain, valsTable,
 		replaceKeysInValues:         cfg.replaceKeysInValues,         // for commitment domain only
 		restrictSubsetFileDeletions: cfg.restrictSubsetFileDeletions, // to prevent not merged 'garbage' to delete on start
 		largeVals:                   cfg.largeVals,
+		keepRecentUncompressedSteps: cfg.keepRecentUncompressedSteps,
 		integrityCheck:              integrityCheck,
 	}
 
@@ -164,6 +201,22 @@ func NewDomain(cfg domainCfg, aggregationStep uint64, name kv.Domain, valsTable,
 
 	return d, nil
 }
+
+// compressCfgOfRange - file of [fromTxNum, ...) is "recent" if it's within `keepRecentUncompressedSteps` before `lastTxNum`.
+// Recent files are written without dictionary: words encoding is the same (reads don't depend on it), but pattern
+// search - most of compression CPU - is skipped.
+func (d *Domain) compressCfgOfRange(fromTxNum, lastTxNum uint64) seg.Cfg {
+	if d.keepRecentUncompressedSteps == 0 {
+		return d.compressCfg
+	}
+	if recentFromTxNum, _ := TxNumRangeOfStep(StepOfTxNum(fromTxNum, d.aggregationStep)+d.keepRecentUncompressedSteps, d.aggregationStep); recentFromTxNum < lastTxNum {
+		return d.compressCfg
+	}
+	cfg := d.compressCfg
+	cfg.MinPatternScore, cfg.SamplingFactor = math.MaxUint64, math.MaxUint64
+	return cfg
+}
+
 func (d *Domain) kvFilePath(fromStep, toStep uint64) string {
 	return filepath.Join(d.dirs.SnapDomain, fmt.Sprintf("v1-%s.%d-%d.kv", d.filenameBase, fromStep, toStep))
 }
@@ -183,14 +236,14 @@ func (d *Domain) maxStepInDB(tx kv.Tx) (lstInDb uint64) {
 	if len(lstIdx) == 0 {
 		return 0
 	}
-	return binary.BigEndian.Uint64(lstIdx) / d.aggregationStep
+	return StepOfTxNum(binary.BigEndian.Uint64(lstIdx), d.aggregationStep)
 }
 func (d *Domain) minStepInDB(tx kv.Tx) (lstInDb uint64) {
 	lstIdx, _ := kv.FirstKey(tx, d.History.indexKeysTable)
 	if len(lstIdx) == 0 {
 		return 0
 	}
-	return binary.BigEndian.Uint64(lstIdx) / d.aggregationStep
+	return StepOfTxNum(binary.BigEndian.Uint64(lstIdx), d.aggregationStep)
 }
 
 func (dt *DomainRoTx) NewWriter() *domainBufferedWriter { return dt.newWriter(dt.d.dirs.Tmp, false) }
@@ -217,7 +270,7 @@ func (d *Domain) OpenList(idxFiles, histFiles, domainFiles []string) error {
 //   - `kill -9` in the middle of `buildFiles()`, then `rm -f db` (restore from backup)
 //   - `kill -9` in the middle of `buildFiles()`, then `stage_exec --reset` (drop progress - as a hot-fix)
 func (d *Domain) protectFromHistoryFilesAheadOfDomainFiles() {
-	d.closeFilesAfterStep(d.dirtyFilesEndTxNumMinimax() / d.aggregationStep)
+	d.closeFilesAfterStep(StepOfTxNum(d.dirtyFilesEndTxNumMinimax(), d.aggregationStep))
 }
 
 func (d *Domain) openFolder() error {
@@ -351,7 +404,7 @@ func (d *Domain) openDirtyFiles() (err error) {
 			fromStep, toStep := item.startTxNum/d.aggregationStep, item.endTxNum/d.aggregationStep
 			if item.decompressor == nil {
 				fPath := d.kvFilePath(fromStep, toStep)
-				exists, err := dir.FileExist(fPath)
+				exists, err := d.filesFS.exists(fPath)
 				if err != nil {
 					_, fName := filepath.Split(fPath)
 					d.logger.Debug("[agg] Domain.openDirtyFiles: FileExist err", "f", fName, "err", err)
@@ -368,8 +421,26 @@ func (d *Domain) openDirtyFiles() (err error) {
 					invalidFileItemsLock.Unlock()
 					continue
 				}
+				if d.filesFS.isEmpty(fPath) {
+					_, fName := filepath.Split(fPath)
+					d.logger.Warn("[agg] Domain.openDirtyFiles: skip empty file", "f", fName)
+					invalidFileItemsLock.Lock()
+					invalidFileItems = append(invalidFileItems, item)
+					invalidFileItemsLock.Unlock()
+					continue
+				}
 
-				if item.decompressor, err = seg.NewDecompressor(fPath); err != nil {
+				if VerifyChecksumOnOpen {
+					if err := d.filesFS.verifyChecksum(fPath); err != nil {
+						d.logger.Warn("[agg] Domain.openDirtyFiles: file excluded", "err", err)
+						invalidFileItemsLock.Lock()
+						invalidFileItems = append(invalidFileItems, item)
+						invalidFileItemsLock.Unlock()
+						continue
+					}
+				}
+				item.fsys = d.filesFS
+				if item.decompressor, err = d.filesFS.openDecompressor(fPath, d.dataAccess); err != nil {
 					_, fName := filepath.Split(fPath)
 					if errors.Is(err, &seg.ErrCompressedFileCorrupted{}) {
 						d.logger.Debug("[agg] Domain.openDirtyFiles", "err", err, "f", fName)
@@ -386,13 +457,13 @@ func (d *Domain) openDirtyFiles() (err error) {
 
 			if item.index == nil && !UseBpsTree {
 				fPath := d.kvAccessorFilePath(fromStep, toStep)
-				exists, err := dir.FileExist(fPath)
+				exists, err := d.filesFS.exists(fPath)
 				if err != nil {
 					_, fName := filepath.Split(fPath)
 					d.logger.Warn("[agg] Domain.openDirtyFiles", "err", err, "f", fName)
 				}
 				if exists {
-					if item.index, err = recsplit.OpenIndex(fPath); err != nil {
+					if item.index, err = d.filesFS.openIndex(fPath); err != nil {
 						_, fName := filepath.Split(fPath)
 						d.logger.Warn("[agg] Domain.openDirtyFiles", "err", err, "f", fName)
 						// don't interrupt on error. other files may be good
@@ -401,13 +472,13 @@ func (d *Domain) openDirtyFiles() (err error) {
 			}
 			if item.bindex == nil {
 				fPath := d.kvBtFilePath(fromStep, toStep)
-				exists, err := dir.FileExist(fPath)
+				exists, err := d.filesFS.exists(fPath)
 				if err != nil {
 					_, fName := filepath.Split(fPath)
 					d.logger.Warn("[agg] Domain.openDirtyFiles", "err", err, "f", fName)
 				}
 				if exists {
-					if item.bindex, err = OpenBtreeIndexWithDecompressor(fPath, DefaultBtreeM, item.decompressor, d.compression); err != nil {
+					if item.bindex, err = d.filesFS.openBtreeIndex(fPath, DefaultBtreeM, item.decompressor, d.compression); err != nil {
 						_, fName := filepath.Split(fPath)
 						d.logger.Warn("[agg] Domain.openDirtyFiles", "err", err, "f", fName)
 						// don't interrupt on error. other files may be good
@@ -416,13 +487,13 @@ func (d *Domain) openDirtyFiles() (err error) {
 			}
 			if item.existence == nil {
 				fPath := d.kvExistenceIdxFilePath(fromStep, toStep)
-				exists, err := dir.FileExist(fPath)
+				exists, err := d.filesFS.exists(fPath)
 				if err != nil {
 					_, fName := filepath.Split(fPath)
 					d.logger.Warn("[agg] Domain.openDirtyFiles", "err", err, "f", fName)
 				}
 				if exists {
-					if item.existence, err = OpenExistenceFilter(fPath); err != nil {
+					if item.existence, err = d.filesFS.openExistenceFilter(fPath); err != nil {
 						_, fName := filepath.Split(fPath)
 						d.logger.Warn("[agg] Domain.openDirtyFiles", "err", err, "f", fName)
 						// don't interrupt on error. other files may be good
@@ -505,7 +576,7 @@ func (w *domainBufferedWriter) DeleteWithPrev(key1, key2, prev []byte, prevStep
 func (w *domainBufferedWriter) SetTxNum(v uint64) {
 	w.setTxNumOnce = true
 	w.h.SetTxNum(v)
-	binary.BigEndian.PutUint64(w.stepBytes[:], ^(v / w.h.ii.aggregationStep))
+	binary.BigEndian.PutUint64(w.stepBytes[:], ^StepOfTxNum(v, w.h.ii.aggregationStep))
 }
 
 func (dt *DomainRoTx) newWriter(tmpdir string, discard bool) *domainBufferedWriter {
@@ -736,6 +807,11 @@ type DomainRoTx struct {
 	valsC kv.Cursor
 
 	getFromFileCache *DomainGetFromFileCache
+
+	filesTouched int // accessors of files read by getFromFiles: for lookupHistogram
+
+	check  roTxCheck // not last field: zero-size last field is padded
+	pinned filesPins
 }
 
 func domainReadMetric(name kv.Domain, level int) metrics.Summary {
@@ -750,9 +826,15 @@ func (dt *DomainRoTx) getLatestFromFile(i int, filekey []byte) (v []byte, ok boo
 		defer domainReadMetric(dt.name, i).ObserveDuration(time.Now())
 	}
 
-	g := dt.statelessGetter(i)
+	g, err := dt.statelessGetter(i)
+	if err != nil {
+		return nil, false, 0, err
+	}
 	if !(UseBtree || UseBpsTree) {
-		reader := dt.statelessIdxReader(i)
+		reader, err := dt.statelessIdxReader(i)
+		if err != nil {
+			return nil, false, 0, err
+		}
 		if reader.Empty() {
 			return nil, false, 0, nil
 		}
@@ -767,10 +849,14 @@ func (dt *DomainRoTx) getLatestFromFile(i int, filekey []byte) (v []byte, ok boo
 			return nil, false, 0, nil
 		}
 		v, _ := g.Next(nil)
-		return v, true, 0, nil
+		return v, true, offset, nil
 	}
 
-	_, v, offset, ok, err = dt.statelessBtree(i).Get(filekey, g)
+	bt, err := dt.statelessBtree(i)
+	if err != nil {
+		return nil, false, 0, err
+	}
+	_, v, offset, ok, err = bt.Get(filekey, g)
 	if err != nil || !ok {
 		return nil, false, 0, err
 	}
@@ -778,6 +864,79 @@ func (dt *DomainRoTx) getLatestFromFile(i int, filekey []byte) (v []byte, ok boo
 	return v, true, offset, nil
 }
 
+// valueLenInFile - like getLatestFromFile, but value is skipped (not decompressed)
+func (dt *DomainRoTx) valueLenInFile(i int, filekey []byte) (vLen int, ok bool, err error) {
+	g, err := dt.statelessGetter(i)
+	if err != nil {
+		return 0, false, err
+	}
+	if !(UseBtree || UseBpsTree) {
+		reader, err := dt.statelessIdxReader(i)
+		if err != nil {
+			return 0, false, err
+		}
+		if reader.Empty() {
+			return 0, false, nil
+		}
+		offset, ok := reader.Lookup(filekey)
+		if !ok {
+			return 0, false, nil
+		}
+		g.Reset(offset)
+
+		k, _ := g.Next(nil)
+		if !bytes.Equal(filekey, k) {
+			return 0, false, nil
+		}
+		_, vLen = g.Skip()
+		return vLen, true, nil
+	}
+	bt, err := dt.statelessBtree(i)
+	if err != nil {
+		return 0, false, err
+	}
+	return bt.ValueLen(filekey, g)
+}
+
+// hasInFiles - like getFromFiles, but only checks that latest value in files is not empty
+func (dt *DomainRoTx) hasInFiles(filekey []byte) (bool, error) {
+	if len(dt.files) == 0 {
+		return false, nil
+	}
+	useExistenceFilter := dt.d.indexList&withExistence != 0
+
+	hi, _ := dt.ht.iit.hashKey(filekey)
+	if dt.getFromFileCache != nil {
+		if cv, ok := dt.getFromFileCache.Get(hi); ok {
+			if !cv.exists {
+				return false, nil
+			}
+			g, err := dt.statelessGetter(int(cv.lvl))
+			if err != nil {
+				return false, err
+			}
+			g.Reset(cv.offset)
+			g.Skip()
+			_, vLen := g.Skip()
+			return vLen > 0, nil
+		}
+	}
+
+	for i := len(dt.files) - 1; i >= 0; i-- {
+		if useExistenceFilter && dt.files[i].src.existence != nil && !dt.files[i].src.existence.ContainsHash(hi) {
+			continue
+		}
+		vLen, found, err := dt.valueLenInFile(i, filekey)
+		if err != nil {
+			return false, err
+		}
+		if found {
+			return vLen > 0, nil
+		}
+	}
+	return false, nil
+}
+
 func (dt *DomainRoTx) DebugKVFilesWithKey(k []byte) (res []string, err error) {
 	for i := len(dt.files) - 1; i >= 0; i-- {
 		_, ok, _, err := dt.getLatestFromFile(i, k)
@@ -796,6 +955,10 @@ func (dt *DomainRoTx) DebugEFKey(k []byte) error {
 			if item.decompressor == nil {
 				continue
 			}
+			if err := dt.ht.iit.openFileOf(item); err != nil {
+				dt.d.logger.Warn("[agg] DebugEFKey: can't open file", "err", err)
+				continue
+			}
 			accessor := item.index
 			if accessor == nil {
 				fPath := dt.d.efAccessorFilePath(item.startTxNum/dt.d.aggregationStep, item.endTxNum/dt.d.aggregationStep)
@@ -823,13 +986,13 @@ func (dt *DomainRoTx) DebugEFKey(k []byte) error {
 			if !ok {
 				continue
 			}
-			g := item.decompressor.MakeGetter()
+			g := seg.NewReader(item.decompressor.MakeGetter(), dt.ht.iit.ii.compression)
 			g.Reset(offset)
-			key, _ := g.NextUncompressed()
+			key, _ := g.Next(nil)
 			if !bytes.Equal(k, key) {
 				continue
 			}
-			eliasVal, _ := g.NextUncompressed()
+			eliasVal, _ := g.Next(nil)
 			ef, _ := eliasfano32.ReadEliasFano(eliasVal)
 
 			last2 := uint64(0)
@@ -891,21 +1054,52 @@ func (d *Domain) BeginFilesRo() *DomainRoTx {
 		ht:      d.History.BeginFilesRo(),
 		visible: d._visible,
 		files:   d._visible.files,
+		check:   newRoTxCheck(),
+	}
+}
+
+// BeginFilesRoAt - like BeginFilesRo, but pins only files with endTxNum <= txNum (in Domain and it's History).
+// Pinned files are ref-counted: concurrent merge can't remove them until DomainRoTx.Close,
+// so reads through this DomainRoTx stay stable.
+func (d *Domain) BeginFilesRoAt(txNum uint64) *DomainRoTx {
+	v := d._visible
+	files := visibleFilesTo(v.files, txNum)
+	if len(files) != len(v.files) {
+		// caches of `v` may point to files which are not in `files`
+		v = &domainVisible{name: v.name, files: files, caches: &sync.Pool{New: NewDomainGetFromFileCacheAny}}
+	}
+	for i := 0; i < len(files); i++ {
+		if !files[i].src.frozen {
+			files[i].src.refcount.Add(1)
+		}
+	}
+
+	return &DomainRoTx{
+		name:    d.name,
+		d:       d,
+		ht:      d.History.BeginFilesRoAt(txNum),
+		visible: v,
+		files:   files,
+		check:   newRoTxCheck(),
 	}
 }
 
 // Collation is the set of compressors created after aggregation
 type Collation struct {
 	HistoryCollation
-	valuesComp  *seg.Compressor
-	valuesPath  string
-	valuesCount int
+	valuesComp      *seg.Compressor
+	valuesPath      string
+	valuesCount     int
+	removeValuesTmp func() // temp files of `valuesComp`
 }
 
 func (c Collation) Close() {
 	if c.valuesComp != nil {
 		c.valuesComp.Close()
 	}
+	if c.removeValuesTmp != nil {
+		c.removeValuesTmp()
+	}
 	c.HistoryCollation.Close()
 }
 
@@ -940,8 +1134,15 @@ func (d *Domain) collate(ctx context.Context, step, txFrom, txTo uint64, roTx kv
 		}
 	}()
 
+	var tmpDir string
+	if tmpDir, coll.removeValuesTmp, err = d.createTmpDir(d.filenameBase + ".domain.collate"); err != nil {
+		return Collation{}, fmt.Errorf("create %s tmp dir: %w", d.filenameBase, err)
+	}
 	coll.valuesPath = d.kvFilePath(step, step+1)
-	if coll.valuesComp, err = seg.NewCompressor(ctx, d.filenameBase+".domain.collate", coll.valuesPath, d.dirs.Tmp, d.compressCfg, log.LvlTrace, d.logger); err != nil {
+	if _, err = removeEmptyFile(coll.valuesPath, d.logger); err != nil {
+		return Collation{}, fmt.Errorf("remove %s empty values file: %w", d.filenameBase, err)
+	}
+	if coll.valuesComp, err = seg.NewCompressor(ctx, d.filenameBase+".domain.collate", coll.valuesPath, tmpDir, d.compressCfgOfRange(txFrom, txTo), log.LvlTrace, d.logger); err != nil {
 		return Collation{}, fmt.Errorf("create %s values compressor: %w", d.filenameBase, err)
 	}
 
@@ -967,9 +1168,12 @@ func (d *Domain) collate(ctx context.Context, step, txFrom, txTo uint64, roTx kv
 	}
 	defer valsCursor.Close()
 
-	kvs := make([]struct {
-		k, v []byte
-	}, 0, 128)
+	// in `largeVals` table keys are sorted by `key+^step` - to get file's order need re-sort only `key`
+	var collector *etl.Collector
+	if d.largeVals {
+		collector = etl.NewCollector(d.filenameBase+".domain.collate", tmpDir, etl.NewSortableBuffer(d.collateETLRAM), d.logger).LogLvl(log.LvlTrace)
+		defer collector.Close()
+	}
 
 	var stepInDB []byte
 	for k, v, err := valsCursor.First(); k != nil; {
@@ -988,9 +1192,9 @@ func (d *Domain) collate(ctx context.Context, step, txFrom, txTo uint64, roTx kv
 		}
 
 		if d.largeVals {
-			kvs = append(kvs, struct {
-				k, v []byte
-			}{k[:len(k)-8], v})
+			if err = collector.Collect(k[:len(k)-8], v); err != nil {
+				return coll, fmt.Errorf("collect %s values key [%x]: %w", d.filenameBase, k, err)
+			}
 			k, v, err = valsCursor.Next()
 		} else {
 			if err = comp.AddWord(k); err != nil {
@@ -1003,21 +1207,24 @@ func (d *Domain) collate(ctx context.Context, step, txFrom, txTo uint64, roTx kv
 		}
 	}
 
-	sort.Slice(kvs, func(i, j int) bool {
-		return bytes.Compare(kvs[i].k, kvs[j].k) < 0
-	})
-	// check if any key is duplicated
-	for i := 1; i < len(kvs); i++ {
-		if bytes.Equal(kvs[i].k, kvs[i-1].k) {
-			return coll, fmt.Errorf("duplicate key [%x]", kvs[i].k)
-		}
-	}
-	for _, kv := range kvs {
-		if err = comp.AddWord(kv.k); err != nil {
-			return coll, fmt.Errorf("add %s values key [%x]: %w", d.filenameBase, kv.k, err)
+	if d.largeVals {
+		var prevKey []byte
+		loadFunc := func(k, v []byte, _ etl.CurrentTableReader, _ etl.LoadNextFunc) error {
+			// check if any key is duplicated
+			if prevKey != nil && bytes.Equal(k, prevKey) {
+				return fmt.Errorf("duplicate key [%x]", k)
+			}
+			prevKey = append(prevKey[:0], k...)
+			if err := comp.AddWord(k); err != nil {
+				return fmt.Errorf("add %s values key [%x]: %w", d.filenameBase, k, err)
+			}
+			if err := comp.AddWord(v); err != nil {
+				return fmt.Errorf("add %s values [%x]=>[%x]: %w", d.filenameBase, k, v, err)
+			}
+			return nil
 		}
-		if err = comp.AddWord(kv.v); err != nil {
-			return coll, fmt.Errorf("add %s values [%x]=>[%x]: %w", d.filenameBase, kv.k, kv.v, err)
+		if err = collector.Load(nil, "", loadFunc, etl.TransformArgs{Quit: ctx.Done()}); err != nil {
+			return coll, err
 		}
 	}
 
@@ -1103,12 +1310,21 @@ func (d *Domain) buildFiles(ctx context.Context, step uint64, collation Collatio
 	if d.noFsync {
 		valuesComp.DisableFsync()
 	}
+	valuesSum := newChecksum(valuesComp)
 	if err = valuesComp.Compress(); err != nil {
 		return StaticFiles{}, fmt.Errorf("compress %s values: %w", d.filenameBase, err)
 	}
 	valuesComp.Close()
 	valuesComp = nil
-	if valuesDecomp, err = seg.NewDecompressor(collation.valuesPath); err != nil {
+	if removed, err := removeEmptyFile(collation.valuesPath, d.logger); err != nil {
+		return StaticFiles{}, err
+	} else if removed {
+		return StaticFiles{}, fmt.Errorf("compress %s values: empty file %s", d.filenameBase, filepath.Base(collation.valuesPath))
+	}
+	if err = writeChecksum(collation.valuesPath, valuesSum.Sum32()); err != nil {
+		return StaticFiles{}, err
+	}
+	if valuesDecomp, err = seg.NewDecompressorWithAccess(collation.valuesPath, d.dataAccess); err != nil {
 		return StaticFiles{}, fmt.Errorf("open %s values decompressor: %w", d.filenameBase, err)
 	}
 
@@ -1158,8 +1374,8 @@ func (d *Domain) buildAccessor(ctx context.Context, fromStep, toStep uint64, dat
 		Enums:              false,
 		LessFalsePositives: false,
 
-		BucketSize: 2000,
-		LeafSize:   8,
+		BucketSize: d.accessor.bucketSize,
+		LeafSize:   d.accessor.leafSize,
 		TmpDir:     d.dirs.Tmp,
 		IndexFile:  idxPath,
 		Salt:       d.salt,
@@ -1168,6 +1384,71 @@ func (d *Domain) buildAccessor(ctx context.Context, fromStep, toStep uint64, dat
 	return buildAccessor(ctx, data, d.compression, idxPath, false, cfg, ps, d.logger)
 }
 
+// rebuildAccessorSpotChecks - how many keys of data file RebuildRecsplitIndex resolves through rebuilt index
+const rebuildAccessorSpotChecks = 128
+
+// RebuildRecsplitIndex - regenerates missing or corrupted .kvi of given .kv file in place and validates it
+// by spot-checking that sample of keys resolve to their offsets. If .kv is opened by `d` and has no index - attaches rebuilt one.
+func (d *Domain) RebuildRecsplitIndex(ctx context.Context, kvPath string) error {
+	_, fName := filepath.Split(kvPath)
+	fromStep, toStep, err := ParseStepsFromFileName(fName)
+	if err != nil {
+		return fmt.Errorf("RebuildRecsplitIndex %s: %w", fName, err)
+	}
+	data, err := seg.NewDecompressor(kvPath)
+	if err != nil {
+		return fmt.Errorf("RebuildRecsplitIndex %s: %w", fName, err)
+	}
+	defer data.Close()
+
+	if err := d.buildAccessor(ctx, fromStep, toStep, data, background.NewProgressSet()); err != nil {
+		return fmt.Errorf("RebuildRecsplitIndex %s: %w", fName, err)
+	}
+	idxPath := d.kvAccessorFilePath(fromStep, toStep)
+	idx, err := recsplit.OpenIndex(idxPath)
+	if err != nil {
+		return fmt.Errorf("RebuildRecsplitIndex %s: %w", fName, err)
+	}
+	if err := checkKeysAccessor(data, d.compression, idx, rebuildAccessorSpotChecks); err != nil {
+		idx.Close()
+		return fmt.Errorf("RebuildRecsplitIndex %s: %w", fName, err)
+	}
+
+	startTxNum, _ := TxNumRangeOfStep(fromStep, d.aggregationStep)
+	endTxNum, _ := TxNumRangeOfStep(toStep, d.aggregationStep)
+	if item, ok := d.dirtyFiles.Get(&filesItem{startTxNum: startTxNum, endTxNum: endTxNum}); ok && item.index == nil {
+		item.index = idx
+		return nil
+	}
+	idx.Close()
+	return nil
+}
+
+// checkKeysAccessor - resolves every n-th key of key/value `data` file through `idx` and compares offsets
+func checkKeysAccessor(data *seg.Decompressor, compression seg.FileCompression, idx *recsplit.Index, samples int) error {
+	keysCount := data.Count() / 2
+	if uint64(keysCount) != idx.KeyCount() {
+		return fmt.Errorf("index %s has %d keys, data file has %d", idx.FileName(), idx.KeyCount(), keysCount)
+	}
+	every := max(1, keysCount/samples)
+	r := idx.GetReaderFromPool()
+	defer r.Close()
+	g := seg.NewReader(data.MakeGetter(), compression)
+	var key []byte
+	var keyPos uint64
+	for i := 0; g.HasNext(); i++ {
+		key, _ = g.Next(key[:0])
+		if i%every == 0 {
+			offset, ok := r.Lookup(key)
+			if !ok || offset != keyPos {
+				return fmt.Errorf("index %s: key %x resolved to offset %d (found=%t), expected %d", idx.FileName(), key, offset, ok, keyPos)
+			}
+		}
+		keyPos, _ = g.Skip()
+	}
+	return nil
+}
+
 func (d *Domain) missedBtreeAccessors() (l []*filesItem) {
 	d.dirtyFiles.Walk(func(items []*filesItem) bool { // don't run slow logic while iterating on btree
 		for _, item := range items {
@@ -1433,7 +1714,10 @@ func (dt *DomainRoTx) getFromFiles(filekey []byte) (v []byte, found bool, fileSt
 			if !cv.exists {
 				return nil, true, dt.files[cv.lvl].startTxNum, dt.files[cv.lvl].endTxNum, nil
 			}
-			g := dt.statelessGetter(int(cv.lvl))
+			g, err := dt.statelessGetter(int(cv.lvl))
+			if err != nil {
+				return nil, false, 0, 0, err
+			}
 			g.Reset(cv.offset)
 			g.Skip()
 			v, _ = g.Next(nil) // can be compressed
@@ -1462,6 +1746,7 @@ func (dt *DomainRoTx) getFromFiles(filekey []byte) (v []byte, found bool, fileSt
 		}
 
 		var offset uint64
+		dt.filesTouched++
 		v, found, offset, err = dt.getLatestFromFile(i, filekey)
 		if err != nil {
 			return nil, false, 0, 0, err
@@ -1494,6 +1779,10 @@ func (dt *DomainRoTx) getFromFiles(filekey []byte) (v []byte, found bool, fileSt
 // GetAsOf does not always require usage of roTx. If it is possible to determine
 // historical value based only on static files, roTx will not be used.
 func (dt *DomainRoTx) GetAsOf(key []byte, txNum uint64, roTx kv.Tx) ([]byte, bool, error) {
+	if TrackLookupHistogram {
+		dt.filesTouched, dt.ht.iit.filesTouched = 0, 0
+		defer func() { dt.d.lookupHist.observe(dt.filesTouched + dt.ht.iit.filesTouched) }()
+	}
 	v, hOk, err := dt.ht.HistorySeek(key, txNum, roTx)
 	if err != nil {
 		return nil, false, err
@@ -1517,8 +1806,126 @@ func (dt *DomainRoTx) GetAsOf(key []byte, txNum uint64, roTx kv.Tx) ([]byte, boo
 	return v, v != nil, nil
 }
 
+// Locate - debugging aid for GetAsOf: name of file and offset of record which GetAsOf(key, txNum) resolves to in files.
+// History record (offset of value in .v file) if key changed after txNum, otherwise latest record (offset of key in
+// .kv file). step - of history record, or last step of .kv file (exact step of latest value is not stored in files).
+// DB is not read: for txNum after end of files result may be shadowed by DB.
+func (dt *DomainRoTx) Locate(key []byte, txNum uint64) (file string, offset uint64, step uint64, found bool, err error) {
+	if !dt.d.historyDisabled {
+		ok, histTxNum, err := dt.ht.iit.seekInFiles(key, txNum)
+		if err != nil {
+			return "", 0, 0, false, err
+		}
+		if ok {
+			historyItem, ok := dt.ht.getFile(histTxNum)
+			if !ok {
+				return "", 0, 0, false, fmt.Errorf("Locate(%s, %x, %d): hist file not found, histTxNum=%d", dt.d.filenameBase, key, txNum, histTxNum)
+			}
+			reader, err := dt.ht.statelessIdxReader(historyItem.i)
+			if err != nil {
+				return "", 0, 0, false, err
+			}
+			if reader.Empty() {
+				return "", 0, 0, false, nil
+			}
+			if offset, ok = reader.Lookup(dt.ht.encodeTs(histTxNum, key)); !ok {
+				return "", 0, 0, false, nil
+			}
+			return historyItem.src.decompressor.FileName(), offset, StepOfTxNum(histTxNum, dt.d.aggregationStep), true, nil
+		}
+	}
+	for i := len(dt.files) - 1; i >= 0; i-- {
+		_, ok, offset, err := dt.getLatestFromFile(i, key)
+		if err != nil {
+			return "", 0, 0, false, fmt.Errorf("Locate(%s, %x, %d): %w", dt.d.filenameBase, key, txNum, err)
+		}
+		if ok {
+			return dt.files[i].src.decompressor.FileName(), offset, StepOfTxNum(dt.files[i].endTxNum-1, dt.d.aggregationStep), true, nil
+		}
+	}
+	return "", 0, 0, false, nil
+}
+
+// LookupHistogram - how many files GetAsOf calls touched (only if TrackLookupHistogram), shared by all RoTx of Domain.
+// res[i] - amount of calls which touched [2^(i-1), 2^i) files, res[0] - no files, last - all bigger.
+func (dt *DomainRoTx) LookupHistogram() []uint64 {
+	res := make([]uint64, len(dt.d.lookupHist))
+	for i := range dt.d.lookupHist {
+		res[i] = dt.d.lookupHist[i].Load()
+	}
+	return res
+}
+
+// HasAsOf - like GetAsOf, but doesn't read (decompress) value from files: only reports if key had non-empty value before txNum
+func (dt *DomainRoTx) HasAsOf(key []byte, txNum uint64, roTx kv.Tx) (bool, error) {
+	exists, hOk, err := dt.ht.historyHas(key, txNum, roTx)
+	if err != nil {
+		return false, fmt.Errorf("HasAsOf(%s, %x, %d): %w", dt.d.filenameBase, key, txNum, err)
+	}
+	if hOk {
+		return exists, nil
+	}
+	v, _, found, err := dt.getLatestFromDb(key, roTx)
+	if err != nil {
+		return false, fmt.Errorf("getLatestFromDb: %w", err)
+	}
+	if found {
+		return len(v) > 0, nil
+	}
+	exists, err = dt.hasInFiles(key)
+	if err != nil {
+		return false, fmt.Errorf("hasInFiles: %w", err)
+	}
+	return exists, nil
+}
+
+// GetAsOfBatch - GetAsOf for many keys at same txNum. res[i] is value of keys[i] (nil if not found).
+// Keys are processed in sorted order: each inverted index file is walked once (by lookups or
+// by sequential scan - whatever is cheaper for given amount of keys), db cursors move forward only.
+func (dt *DomainRoTx) GetAsOfBatch(keys [][]byte, txNum uint64, roTx kv.Tx) (res [][]byte, err error) {
+	sorted := make([]int, len(keys))
+	for i := range sorted {
+		sorted[i] = i
+	}
+	slices.SortFunc(sorted, func(i, j int) int { return bytes.Compare(keys[i], keys[j]) })
+	uniq := make([][]byte, 0, len(keys))
+	for n, i := range sorted {
+		if n == 0 || !bytes.Equal(uniq[len(uniq)-1], keys[i]) {
+			uniq = append(uniq, keys[i])
+		}
+	}
+
+	vals, hOk, err := dt.ht.historySeekBatch(uniq, txNum, roTx)
+	if err != nil {
+		return nil, fmt.Errorf("GetAsOfBatch(%s, %d): %w", dt.d.filenameBase, txNum, err)
+	}
+	for i := range uniq {
+		if hOk[i] {
+			if len(vals[i]) == 0 { // history successfuly found marker of key creation
+				vals[i] = nil
+			}
+			continue
+		}
+		if vals[i], _, _, err = dt.GetLatest(uniq[i], nil, roTx); err != nil {
+			return nil, fmt.Errorf("GetAsOfBatch(%s, %x, %d): %w", dt.d.filenameBase, uniq[i], txNum, err)
+		}
+	}
+
+	res = make([][]byte, len(keys))
+	u := -1
+	for n, i := range sorted {
+		if n == 0 || !bytes.Equal(uniq[u], keys[i]) {
+			u++
+		}
+		res[i] = vals[u]
+	}
+	return res, nil
+}
+
 func (dt *DomainRoTx) Close() {
-	if dt.files == nil { // invariant: it's safe to call Close multiple times
+	dt.check.close("DomainRoTx", dt.d.filenameBase)
+	if dt.files == nil { // invariant: it's safe to call Close multiple times (except `assert` build: roTxCheck)
+		dt.pinned.unpinAll(dt.d.filesLRU, nil) // dirty files pinned by openFileOf
 		return
 	}
 	files := dt.files
@@ -1537,45 +1944,65 @@ func (dt *DomainRoTx) Close() {
 			src.closeFilesAndRemove()
 		}
 	}
+	dt.pinned.unpinAll(dt.d.filesLRU, files)
 	dt.ht.Close()
 
 	dt.visible.returnGetFromFileCache(dt.getFromFileCache)
 }
 
-func (dt *DomainRoTx) statelessGetter(i int) *seg.Reader {
+// openFile - file `i` is open until Close: re-opens it if it was closed by filesLRU
+func (dt *DomainRoTx) openFile(i int) error {
+	return dt.pinned.pin(dt.d.filesLRU, dt.files, i, dt.d.compression)
+}
+
+// openFileOf - like openFile, but `item` can be not visible in this RoTx (dirty file)
+func (dt *DomainRoTx) openFileOf(item *filesItem) error {
+	return dt.pinned.pinItem(dt.d.filesLRU, dt.files, item, dt.d.compression)
+}
+
+func (dt *DomainRoTx) statelessGetter(i int) (*seg.Reader, error) {
 	if dt.getters == nil {
 		dt.getters = make([]*seg.Reader, len(dt.files))
 	}
 	r := dt.getters[i]
 	if r == nil {
+		if err := dt.openFile(i); err != nil {
+			return nil, err
+		}
 		r = seg.NewReader(dt.files[i].src.decompressor.MakeGetter(), dt.d.compression)
 		dt.getters[i] = r
 	}
-	return r
+	return r, nil
 }
 
-func (dt *DomainRoTx) statelessIdxReader(i int) *recsplit.IndexReader {
+func (dt *DomainRoTx) statelessIdxReader(i int) (*recsplit.IndexReader, error) {
 	if dt.idxReaders == nil {
 		dt.idxReaders = make([]*recsplit.IndexReader, len(dt.files))
 	}
 	r := dt.idxReaders[i]
 	if r == nil {
+		if err := dt.openFile(i); err != nil {
+			return nil, err
+		}
 		r = dt.files[i].src.index.GetReaderFromPool()
 		dt.idxReaders[i] = r
 	}
-	return r
+	return r, nil
 }
 
-func (dt *DomainRoTx) statelessBtree(i int) *BtIndex {
+func (dt *DomainRoTx) statelessBtree(i int) (*BtIndex, error) {
 	if dt.readers == nil {
 		dt.readers = make([]*BtIndex, len(dt.files))
 	}
 	r := dt.readers[i]
 	if r == nil {
+		if err := dt.openFile(i); err != nil {
+			return nil, err
+		}
 		r = dt.files[i].src.bindex
 		dt.readers[i] = r
 	}
-	return r
+	return r, nil
 }
 
 func (dt *DomainRoTx) valsCursor(tx kv.Tx) (c kv.Cursor, err error) {
@@ -1666,7 +2093,31 @@ func (dt *DomainRoTx) GetLatest(key1, key2 []byte, roTx kv.Tx) ([]byte, uint64,
 	if err != nil {
 		return nil, 0, false, fmt.Errorf("getFromFiles: %w", err)
 	}
-	return v, endTxNum / dt.d.aggregationStep, foundInFile, nil
+	return v, StepOfTxNum(endTxNum, dt.d.aggregationStep), foundInFile, nil
+}
+
+// GetLatestTxNum - same value as GetAsOf(key, math.MaxUint64), plus txNum at which this value became valid
+// (last change of key: value=nil if it was deletion). txNum=0 if key never changed or history is disabled.
+// Newest changes are read first: db, then files from newest to oldest - stops on first found.
+func (dt *DomainRoTx) GetLatestTxNum(key []byte, roTx kv.Tx) (v []byte, txNum uint64, err error) {
+	v, _, _, err = dt.GetLatest(key, nil, roTx)
+	if err != nil {
+		return nil, 0, err
+	}
+	if dt.d.historyDisabled {
+		return v, 0, nil
+	}
+	it, err := dt.ht.IdxRange(key, -1, -1, order.Desc, 1, roTx)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer it.Close()
+	if it.HasNext() {
+		if txNum, err = it.Next(); err != nil {
+			return nil, 0, err
+		}
+	}
+	return v, txNum, nil
 }
 
 func (dt *DomainRoTx) DomainRange(ctx context.Context, tx kv.Tx, fromKey, toKey []byte, ts uint64, asc order.By, limit int) (it stream.KV, err error) {
@@ -1685,6 +2136,8 @@ func (dt *DomainRoTx) DomainRange(ctx context.Context, tx kv.Tx, fromKey, toKey
 	if err != nil {
 		return nil, err
 	}
+	// WalkAsOf is Union itself. Union of Union holds K, V for more than 2 .Next() calls of underlying stream (Invariant 2)
+	histStateIt = stream.TransformKV(histStateIt, func(k, v []byte) ([]byte, []byte, error) { return common.Copy(k), common.Copy(v), nil })
 	lastestStateIt, err := dt.DomainRangeLatest(tx, fromKey, toKey, limit)
 	if err != nil {
 		return nil, err
@@ -1693,7 +2146,7 @@ func (dt *DomainRoTx) DomainRange(ctx context.Context, tx kv.Tx, fromKey, toKey
 }
 
 func (dt *DomainRoTx) DomainRangeLatest(roTx kv.Tx, fromKey, toKey []byte, limit int) (stream.KV, error) {
-	s := &DomainLatestIterFile{from: fromKey, to: toKey, limit: limit, dc: dt,
+	s := &DomainLatestIterFile{from: fromKey, to: toKey, limit: limit, dc: dt, check: dt.check.iterOpened(),
 		roTx:      roTx,
 		valsTable: dt.d.valsTable,
 		h:         &CursorHeap{},
@@ -1705,6 +2158,134 @@ func (dt *DomainRoTx) DomainRangeLatest(roTx kv.Tx, fromKey, toKey []byte, limit
 	return s, nil
 }
 
+// SeekPrefix - key-values with given `prefix` in key order, with latest value at or before `txNum`.
+// Merges history (files and DB) and latest values (files and DB). Deleted (and not-yet-created) keys are skipped.
+func (dt *DomainRoTx) SeekPrefix(ctx context.Context, prefix []byte, txNum uint64, roTx kv.Tx) (stream.KV, error) {
+	toKey, _ := kv.NextSubtree(prefix) // nil - means till the end
+	return dt.existingKeysAsOf(ctx, prefix, toKey, txNum+1, roTx)
+}
+
+// StateAt - all keys in key order with their values as of `txNum` (same as GetAsOf): state before `txNum` is applied.
+// Deleted (and not-yet-created) keys are skipped.
+func (dt *DomainRoTx) StateAt(ctx context.Context, txNum uint64, roTx kv.Tx) (stream.KV, error) {
+	return dt.existingKeysAsOf(ctx, nil, nil, txNum, roTx)
+}
+
+// existingKeysAsOf - DomainRange without deleted keys
+func (dt *DomainRoTx) existingKeysAsOf(ctx context.Context, fromKey, toKey []byte, ts uint64, roTx kv.Tx) (stream.KV, error) {
+	it, err := dt.DomainRange(ctx, roTx, fromKey, toKey, ts, order.Asc, -1)
+	if err != nil {
+		return nil, err
+	}
+	// copy: FilterKV reads ahead and may skip many deleted keys - it's more than 2 .Next() calls of Invariant 2
+	it = stream.TransformKV(it, func(k, v []byte) ([]byte, []byte, error) { return common.Copy(k), common.Copy(v), nil })
+	return stream.FilterKV(it, func(k, v []byte) bool { return len(v) > 0 }), nil
+}
+
+// KeyIterator - stream of keys, every key is returned once
+type KeyIterator = stream.Uno[[]byte]
+
+// ChangedKeys - keys which have changed in [fromTxNum, toTxNum), in lexicographic order.
+// Uses InvertedIndex of domain's history files and history values in DB - domain values are not scanned.
+func (dt *DomainRoTx) ChangedKeys(fromTxNum, toTxNum uint64, roTx kv.Tx) KeyIterator {
+	files := dt.ht.iit.IterateChangedKeys(fromTxNum, toTxNum, roTx)
+	s := &changedKeysIter{files: &files}
+	// history of domain has no `key -> txNums` table in DB (see History), recent keys are taken from history values
+	if s.recent, s.err = dt.ht.iterateChangedRecent(int(fromTxNum), int(toTxNum), order.Asc, -1, roTx); s.err != nil {
+		return s
+	}
+	s.advanceFiles()
+	s.advanceRecent()
+	return s
+}
+
+// changedKeysIter - union of keys from files and DB
+type changedKeysIter struct {
+	files              *InvertedIterator1
+	recent             stream.KVS
+	fileKey, recentKey []byte // nil - no more keys
+	err                error
+}
+
+func (s *changedKeysIter) advanceFiles() {
+	s.fileKey = nil
+	if s.files.HasNext() {
+		s.fileKey = s.files.Next(nil)
+	}
+	if err := s.files.Err(); err != nil {
+		s.err = err
+	}
+}
+
+func (s *changedKeysIter) advanceRecent() {
+	s.recentKey = nil
+	if !s.recent.HasNext() {
+		return
+	}
+	k, _, _, err := s.recent.Next()
+	if err != nil {
+		s.err = err
+		return
+	}
+	s.recentKey = common.Copy(k)
+}
+
+func (s *changedKeysIter) HasNext() bool {
+	if s.err != nil { // always true, then .Next() call will return this error
+		return true
+	}
+	return s.fileKey != nil || s.recentKey != nil
+}
+
+func (s *changedKeysIter) Next() (k []byte, err error) {
+	if s.err != nil {
+		return nil, s.err
+	}
+	if s.recentKey == nil || (s.fileKey != nil && bytes.Compare(s.fileKey, s.recentKey) <= 0) {
+		k = s.fileKey
+		if bytes.Equal(s.fileKey, s.recentKey) {
+			s.advanceRecent()
+		}
+		s.advanceFiles()
+		return k, nil
+	}
+	k = s.recentKey
+	s.advanceRecent()
+	return k, nil
+}
+
+func (s *changedKeysIter) Close() {
+	s.files.Close()
+	if s.recent != nil {
+		s.recent.Close()
+	}
+}
+
+// StreamSortedKV - feeds keys changed in [fromTxNum, toTxNum) to `fn` in lexicographic order, with their values as of `toTxNum`
+// (empty value - key was deleted). Keys come from 1 merged pass over InvertedIndex files and DB, values are read key-by-key:
+// nothing is materialized. Stops and returns first error of `fn`.
+func (dt *DomainRoTx) StreamSortedKV(ctx context.Context, fromTxNum, toTxNum uint64, roTx kv.Tx, fn func(key, value []byte) error) error {
+	it := dt.ChangedKeys(fromTxNum, toTxNum, roTx)
+	defer it.Close()
+	for it.HasNext() {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		k, err := it.Next()
+		if err != nil {
+			return fmt.Errorf("StreamSortedKV %s: %w", dt.d.filenameBase, err)
+		}
+		v, _, err := dt.GetAsOf(k, toTxNum, roTx)
+		if err != nil {
+			return fmt.Errorf("StreamSortedKV %s: key %x: %w", dt.d.filenameBase, k, err)
+		}
+		if err := fn(k, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // CanPruneUntil returns true if domain OR history tables can be pruned until txNum
 func (dt *DomainRoTx) CanPruneUntil(tx kv.Tx, untilTx uint64) bool {
 	canDomain, _ := dt.canPruneDomainTables(tx, untilTx)
@@ -1713,7 +2294,7 @@ func (dt *DomainRoTx) CanPruneUntil(tx kv.Tx, untilTx uint64) bool {
 }
 
 func (dt *DomainRoTx) canBuild(dbtx kv.Tx) bool { //nolint
-	maxStepInFiles := dt.files.EndTxNum() / dt.d.aggregationStep
+	maxStepInFiles := StepOfTxNum(dt.files.EndTxNum(), dt.d.aggregationStep)
 	return maxStepInFiles < dt.d.maxStepInDB(dbtx)
 }
 
@@ -1722,11 +2303,11 @@ func (dt *DomainRoTx) canBuild(dbtx kv.Tx) bool { //nolint
 // history.CanPrune should be called separately because it responsible for different tables
 func (dt *DomainRoTx) canPruneDomainTables(tx kv.Tx, untilTx uint64) (can bool, maxStepToPrune uint64) {
 	if m := dt.files.EndTxNum(); m > 0 {
-		maxStepToPrune = (m - 1) / dt.d.aggregationStep
+		maxStepToPrune = StepOfTxNum(m-1, dt.d.aggregationStep)
 	}
 	var untilStep uint64
 	if untilTx > 0 {
-		untilStep = (untilTx - 1) / dt.d.aggregationStep
+		untilStep = StepOfTxNum(untilTx-1, dt.d.aggregationStep)
 	}
 	sm, err := GetExecV3PrunableProgress(tx, []byte(dt.d.valsTable))
 	if err != nil {
@@ -1911,7 +2492,8 @@ func (dt *DomainRoTx) Prune(ctx context.Context, rwTx kv.RwTx, step, txFrom, txT
 }
 
 type DomainLatestIterFile struct {
-	dc *DomainRoTx
+	dc    *DomainRoTx
+	check roTxIterCheck
 
 	roTx      kv.Tx
 	valsTable string
@@ -1929,6 +2511,7 @@ type DomainLatestIterFile struct {
 }
 
 func (hi *DomainLatestIterFile) Close() {
+	hi.check.close()
 }
 func (hi *DomainLatestIterFile) init(dc *DomainRoTx) error {
 	// Implementation:
@@ -1955,9 +2538,9 @@ func (hi *DomainLatestIterFile) init(dc *DomainRoTx) error {
 			k := key[:len(key)-8]
 			stepBytes := key[len(key)-8:]
 			step := ^binary.BigEndian.Uint64(stepBytes)
-			endTxNum := step * dc.d.aggregationStep // DB can store not-finished step, it means - then set first txn in step - it anyway will be ahead of files
+			stepFromTxNum, _ := TxNumRangeOfStep(step, dc.d.aggregationStep) // DB can store not-finished step, it means - then set first txn in step - it anyway will be ahead of files
 
-			heap.Push(hi.h, &CursorItem{t: DB_CURSOR, key: common.Copy(k), val: common.Copy(value), cNonDup: valsCursor, endTxNum: endTxNum, reverse: true})
+			heap.Push(hi.h, &CursorItem{t: DB_CURSOR, key: common.Copy(k), val: common.Copy(value), cNonDup: valsCursor, endTxNum: stepFromTxNum, reverse: true})
 		}
 	} else {
 		valsCursor, err := hi.roTx.CursorDupSort(dc.d.valsTable)
@@ -1972,15 +2555,23 @@ func (hi *DomainLatestIterFile) init(dc *DomainRoTx) error {
 			stepBytes := value[:8]
 			value = value[8:]
 			step := ^binary.BigEndian.Uint64(stepBytes)
-			endTxNum := step * dc.d.aggregationStep // DB can store not-finished step, it means - then set first txn in step - it anyway will be ahead of files
+			stepFromTxNum, _ := TxNumRangeOfStep(step, dc.d.aggregationStep) // DB can store not-finished step, it means - then set first txn in step - it anyway will be ahead of files
 
-			heap.Push(hi.h, &CursorItem{t: DB_CURSOR, key: common.Copy(key), val: common.Copy(value), cDup: valsCursor, endTxNum: endTxNum, reverse: true})
+			heap.Push(hi.h, &CursorItem{t: DB_CURSOR, key: common.Copy(key), val: common.Copy(value), cDup: valsCursor, endTxNum: stepFromTxNum, reverse: true})
 		}
 	}
 
 	for i, item := range dc.files {
 		// todo release btcursor when iter over/make it truly stateless
-		btCursor, err := dc.statelessBtree(i).Seek(dc.statelessGetter(i), hi.from)
+		bt, err := dc.statelessBtree(i)
+		if err != nil {
+			return err
+		}
+		g, err := dc.statelessGetter(i)
+		if err != nil {
+			return err
+		}
+		btCursor, err := bt.Seek(g, hi.from)
 		if err != nil {
 			return err
 		}
@@ -2038,8 +2629,8 @@ func (hi *DomainLatestIterFile) advanceInFiles() error {
 						k = k[:len(k)-8]
 						ci1.key = common.Copy(k)
 						step := ^binary.BigEndian.Uint64(stepBytes)
-						endTxNum := step * hi.dc.d.aggregationStep // DB can store not-finished step, it means - then set first txn in step - it anyway will be ahead of files
-						ci1.endTxNum = endTxNum
+						stepFromTxNum, _ := TxNumRangeOfStep(step, hi.dc.d.aggregationStep) // DB can store not-finished step, it means - then set first txn in step - it anyway will be ahead of files
+						ci1.endTxNum = stepFromTxNum
 
 						ci1.val = common.Copy(v)
 						heap.Push(hi.h, ci1)
@@ -2056,8 +2647,8 @@ func (hi *DomainLatestIterFile) advanceInFiles() error {
 						v := stepBytesWithValue[8:]
 						ci1.key = common.Copy(k)
 						step := ^binary.BigEndian.Uint64(stepBytes)
-						endTxNum := step * hi.dc.d.aggregationStep // DB can store not-finished step, it means - then set first txn in step - it anyway will be ahead of files
-						ci1.endTxNum = endTxNum
+						stepFromTxNum, _ := TxNumRangeOfStep(step, hi.dc.d.aggregationStep) // DB can store not-finished step, it means - then set first txn in step - it anyway will be ahead of files
+						ci1.endTxNum = stepFromTxNum
 
 						ci1.val = common.Copy(v)
 						heap.Push(hi.h, ci1)
@@ -2109,6 +2700,77 @@ func (dt *DomainRoTx) Files() (res []string) {
 	return append(res, dt.ht.Files()...)
 }
 
+// FileStat - metadata of .kv file visible by DomainRoTx
+type FileStat struct {
+	Name             string
+	FromStep, ToStep uint64 // [FromStep, ToStep)
+	Size             int64  // .kv size on disk
+	Keys             uint64
+
+	HasBtIndex    bool // .bt
+	HasHashMap    bool // .kvi
+	HasExistence  bool // .kvei
+	AccessorsSize int64
+}
+
+// FileStats - per-file metadata of .kv files. Reads only already-open files metadata.
+func (dt *DomainRoTx) FileStats() []FileStat {
+	res := make([]FileStat, 0, len(dt.files))
+	for _, item := range dt.files {
+		src := item.src
+		if src.decompressor == nil {
+			continue
+		}
+		st := FileStat{
+			Name:     src.decompressor.FileName(),
+			FromStep: StepOfTxNum(item.startTxNum, dt.d.aggregationStep),
+			ToStep:   StepOfTxNum(item.endTxNum, dt.d.aggregationStep),
+			Size:     src.decompressor.Size(),
+			Keys:     uint64(src.decompressor.Count() / 2),
+		}
+		if src.bindex != nil {
+			st.HasBtIndex = true
+			st.AccessorsSize += src.bindex.Size()
+		}
+		if src.index != nil {
+			st.HasHashMap = true
+			st.AccessorsSize += src.index.Size()
+		}
+		if src.existence != nil {
+			st.HasExistence = true
+		}
+		res = append(res, st)
+	}
+	return res
+}
+
+// StepSize - disk usage of 1 file. Merged file covers [FromStep, ToStep) range of steps.
+type StepSize struct {
+	FromStep, ToStep uint64
+	DataBytes        int64 // data file and its checksum
+	IndexBytes       int64 // accessors of data file
+}
+
+// StepSizes - sizes of all on-disk .kv files and their accessors (including not-visible ones: merged-but-not-removed-yet, ...).
+// Sizes are read from filesystem.
+func (d *Domain) StepSizes() []StepSize {
+	var res []StepSize
+	d.dirtyFiles.Walk(func(items []*filesItem) bool {
+		for _, item := range items {
+			fromStep, toStep := StepOfTxNum(item.startTxNum, d.aggregationStep), StepOfTxNum(item.endTxNum, d.aggregationStep)
+			dataPath := d.kvFilePath(fromStep, toStep)
+			res = append(res, StepSize{
+				FromStep:   fromStep,
+				ToStep:     toStep,
+				DataBytes:  filesSizeOnDisk(dataPath, dataPath+checksumFileExt),
+				IndexBytes: filesSizeOnDisk(d.kvAccessorFilePath(fromStep, toStep), d.kvBtFilePath(fromStep, toStep), d.kvExistenceIdxFilePath(fromStep, toStep)),
+			})
+		}
+		return true
+	})
+	return res
+}
+
 type SelectedStaticFiles struct {
 	accounts       []*filesItem
 	accountsIdx    []*filesItem
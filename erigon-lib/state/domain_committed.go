@@ -149,8 +149,12 @@ func (dt *DomainRoTx) findShortenedKey(fullKey []byte, itemGetter *seg.Reader, i
 
 func (dt *DomainRoTx) lookupVisibleFileByItsRange(txFrom uint64, txTo uint64) *filesItem {
 	var item *filesItem
-	for _, f := range dt.files {
+	for i, f := range dt.files {
 		if f.startTxNum == txFrom && f.endTxNum == txTo {
+			if err := dt.openFile(i); err != nil {
+				dt.d.logger.Warn("[agg] lookupVisibleFileByItsRange: can't open file", "err", err)
+				return nil
+			}
 			item = f.src
 			break
 		}
@@ -173,6 +177,7 @@ func (dt *DomainRoTx) lookupVisibleFileByItsRange(txFrom uint64, txTo uint64) *f
 	return item
 }
 
+// lookupDirtyFileByItsRange - returned file is pinned in filesLRU until Close of `dt`
 func (dt *DomainRoTx) lookupDirtyFileByItsRange(txFrom uint64, txTo uint64) *filesItem {
 	var item *filesItem
 	if item == nil {
@@ -202,6 +207,10 @@ func (dt *DomainRoTx) lookupDirtyFileByItsRange(txFrom uint64, txTo uint64) *fil
 
 		return nil
 	}
+	if err := dt.openFileOf(item); err != nil {
+		dt.d.logger.Warn("[agg] lookupDirtyFileByItsRange: can't open file", "err", err)
+		return nil
+	}
 	return item
 }
 
@@ -255,7 +264,11 @@ func (dt *DomainRoTx) commitmentValTransformDomain(rng MergeRange, accounts, sto
 
 	dr := DomainRanges{values: rng}
 	accountFileMap := make(map[uint64]map[uint64]*seg.Reader)
-	if accountList, _, _ := accounts.staticFilesInRange(dr); accountList != nil {
+	accountList, _, _, err := accounts.staticFilesInRange(dr)
+	if err != nil {
+		return nil, err
+	}
+	if accountList != nil {
 		for _, f := range accountList {
 			if _, ok := accountFileMap[f.startTxNum]; !ok {
 				accountFileMap[f.startTxNum] = make(map[uint64]*seg.Reader)
@@ -264,7 +277,11 @@ func (dt *DomainRoTx) commitmentValTransformDomain(rng MergeRange, accounts, sto
 		}
 	}
 	storageFileMap := make(map[uint64]map[uint64]*seg.Reader)
-	if storageList, _, _ := storage.staticFilesInRange(dr); storageList != nil {
+	storageList, _, _, err := storage.staticFilesInRange(dr)
+	if err != nil {
+		return nil, err
+	}
+	if storageList != nil {
 		for _, f := range storageList {
 			if _, ok := storageFileMap[f.startTxNum]; !ok {
 				storageFileMap[f.startTxNum] = make(map[uint64]*seg.Reader)
@@ -0,0 +1,219 @@
+// Copyright 2024 The Erigon Authors
+// This file is part of Erigon.
+//
+// Erigon is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Erigon is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with Erigon. If not, see <http://www.gnu.org/licenses/>.
+
+package state
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/erigontech/erigon-lib/log/v3"
+	"github.com/erigontech/erigon-lib/recsplit/eliasfano32"
+	"github.com/erigontech/erigon-lib/seg"
+)
+
+// DeleteKeyHistory - physically removes `key` from all visible files: .kv of Domain, .v and .ef of it's History.
+// Files which have the key are re-written in-place (all other keys/values are preserved), their accessors
+// (.bt/.kvi/.kvei/.vi/.efi) and .torrent files are removed.
+// Returns amount of removed values: 1 per .kv file plus 1 per txNum in history.
+//
+// Should be called only when NO EXECUTION is running. Suppose following re-open of files (closeWhatNotInList+openFolder)
+// and BuildMissedAccessors - same as after Sqeeze. DB (not yet collated) data is not touched.
+//
+// Not supported for domains which commitment references (restrictSubsetFileDeletions): commitment branches store
+// offsets of keys in their .kv files, re-written file shifts offsets of all keys after `key`.
+func (dt *DomainRoTx) DeleteKeyHistory(ctx context.Context, key []byte) (removed uint64, err error) {
+	d, h, ii := dt.d, dt.ht.h, dt.ht.h.InvertedIndex
+	if d.restrictSubsetFileDeletions {
+		return 0, fmt.Errorf("DeleteKeyHistory %s: files are referenced by commitment", d.filenameBase)
+	}
+
+	for i, item := range dt.files {
+		_, found, _, err := dt.getLatestFromFile(i, key)
+		if err != nil {
+			return removed, err
+		}
+		if !found {
+			continue
+		}
+		fromStep, toStep := StepOfTxNum(item.startTxNum, d.aggregationStep), StepOfTxNum(item.endTxNum, d.aggregationStep)
+		r := seg.NewReader(item.src.decompressor.MakeGetter(), d.compression)
+		n, err := rewriteKVFileWithoutKey(ctx, r, key, d.kvFilePath(fromStep, toStep), d.dirs.Tmp, d.compressCfg, d.compression, d.logger)
+		if err != nil {
+			return removed, fmt.Errorf("DeleteKeyHistory %s: %w", item.src.decompressor.FileName(), err)
+		}
+		removed += n
+		_ = os.Remove(d.kvFilePath(fromStep, toStep) + ".torrent")
+		removeFilesAndTorrents(d.kvBtFilePath(fromStep, toStep), d.kvAccessorFilePath(fromStep, toStep), d.kvExistenceIdxFilePath(fromStep, toStep))
+	}
+
+	iit := dt.ht.iit
+	for i, item := range iit.files {
+		hi, lo := iit.hashKey(key)
+		reader, err := iit.statelessIdxReader(i)
+		if err != nil {
+			return removed, err
+		}
+		offset, ok := reader.TwoLayerLookupByHash(hi, lo)
+		if !ok {
+			continue
+		}
+		g, err := iit.statelessGetter(i)
+		if err != nil {
+			return removed, err
+		}
+		g.Reset(offset)
+		if k, _ := g.Next(nil); !bytes.Equal(k, key) {
+			continue
+		}
+
+		histItem, ok := h.dirtyFiles.Get(&filesItem{startTxNum: item.startTxNum, endTxNum: item.endTxNum})
+		if !ok || histItem.decompressor == nil {
+			return removed, fmt.Errorf("DeleteKeyHistory: history file not found for %s", item.src.decompressor.FileName())
+		}
+		if err := dt.ht.openFileOf(histItem); err != nil {
+			return removed, err
+		}
+		fromStep, toStep := StepOfTxNum(item.startTxNum, ii.aggregationStep), StepOfTxNum(item.endTxNum, ii.aggregationStep)
+		n, err := h.rewriteHistoryFilesWithoutKey(ctx, item.src.decompressor, histItem.decompressor, key, fromStep, toStep)
+		if err != nil {
+			return removed, fmt.Errorf("DeleteKeyHistory %s: %w", histItem.decompressor.FileName(), err)
+		}
+		removed += n
+		_ = os.Remove(ii.efFilePath(fromStep, toStep) + ".torrent")
+		_ = os.Remove(h.vFilePath(fromStep, toStep) + ".torrent")
+		removeFilesAndTorrents(ii.efAccessorFilePath(fromStep, toStep), h.vAccessorFilePath(fromStep, toStep))
+	}
+	return removed, nil
+}
+
+// rewriteKVFileWithoutKey - writes all key-value pairs of `r` to `to`, except pairs of `key`
+func rewriteKVFileWithoutKey(ctx context.Context, r *seg.Reader, key []byte, to, tmpDir string, compressCfg seg.Cfg, compression seg.FileCompression, logger log.Logger) (removed uint64, err error) {
+	comp, err := seg.NewCompressor(ctx, "delete key", to, tmpDir, compressCfg, log.LvlTrace, logger)
+	if err != nil {
+		return 0, err
+	}
+	defer comp.Close()
+	w := seg.NewWriter(comp, compression)
+	sum := newChecksum(w)
+
+	var k, v []byte
+	r.Reset(0)
+	for r.HasNext() {
+		k, _ = r.Next(k[:0])
+		if bytes.Equal(k, key) {
+			r.Skip()
+			removed++
+			continue
+		}
+		v, _ = r.Next(v[:0])
+		if err = w.AddWord(k); err != nil {
+			return 0, err
+		}
+		if err = w.AddWord(v); err != nil {
+			return 0, err
+		}
+	}
+	if err = removeChecksum(to); err != nil {
+		return 0, err
+	}
+	if err = w.Compress(); err != nil {
+		return 0, err
+	}
+	return removed, writeChecksum(to, sum.Sum32())
+}
+
+// rewriteHistoryFilesWithoutKey - removes `key` from pair of .ef and .v files. .v has no keys:
+// it's values are in order of .ef keys and txNums, so .ef is used to find values of `key`
+func (h *History) rewriteHistoryFilesWithoutKey(ctx context.Context, ef, hist *seg.Decompressor, key []byte, fromStep, toStep uint64) (removed uint64, err error) {
+	ii := h.InvertedIndex
+	efReader := seg.NewReader(ef.MakeGetter(), ii.compression)
+	histReader := seg.NewReader(hist.MakeGetter(), h.compression)
+
+	efComp, err := seg.NewCompressor(ctx, "delete key", ii.efFilePath(fromStep, toStep), ii.dirs.Tmp, ii.compressCfg, log.LvlTrace, h.logger)
+	if err != nil {
+		return 0, err
+	}
+	defer efComp.Close()
+	efWriter := seg.NewWriter(efComp, ii.efWriterCompression())
+	histComp, err := seg.NewCompressor(ctx, "delete key", h.vFilePath(fromStep, toStep), h.dirs.Tmp, h.compressCfg, log.LvlTrace, h.logger)
+	if err != nil {
+		return 0, err
+	}
+	defer histComp.Close()
+	histWriter := seg.NewWriter(histComp, h.compression)
+	efSum, histSum := newChecksum(efWriter), newChecksum(histWriter)
+
+	var k, v, hv []byte
+	for efReader.HasNext() {
+		k, _ = efReader.Next(k[:0])
+		v, _ = efReader.Next(v[:0])
+		count := eliasfano32.Count(v)
+		if bytes.Equal(k, key) {
+			for i := uint64(0); i < count; i++ {
+				histReader.Skip()
+			}
+			removed += count
+			continue
+		}
+		if err = efWriter.AddWord(k); err != nil {
+			return 0, err
+		}
+		if err = efWriter.AddWord(v); err != nil {
+			return 0, err
+		}
+		for i := uint64(0); i < count; i++ {
+			if !histReader.HasNext() {
+				return 0, fmt.Errorf("%s has less values than %s", hist.FileName(), ef.FileName())
+			}
+			hv, _ = histReader.Next(hv[:0])
+			if err = histWriter.AddWord(hv); err != nil {
+				return 0, err
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		default:
+		}
+	}
+	if err = removeChecksum(ii.efFilePath(fromStep, toStep)); err != nil {
+		return 0, err
+	}
+	if err = removeChecksum(h.vFilePath(fromStep, toStep)); err != nil {
+		return 0, err
+	}
+	if err = efWriter.Compress(); err != nil {
+		return 0, err
+	}
+	if err = histWriter.Compress(); err != nil {
+		return 0, err
+	}
+	if err = writeChecksum(ii.efFilePath(fromStep, toStep), efSum.Sum32()); err != nil {
+		return 0, err
+	}
+	return removed, writeChecksum(h.vFilePath(fromStep, toStep), histSum.Sum32())
+}
+
+func removeFilesAndTorrents(paths ...string) {
+	for _, p := range paths {
+		_ = os.Remove(p)
+		_ = os.Remove(p + ".torrent")
+	}
+}
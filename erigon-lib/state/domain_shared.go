@@ -179,7 +179,7 @@ func (sd *SharedDomains) AggTx() any { return sd.aggTx }
 
 // aggregator context should call aggTx.Unwind before this one.
 func (sd *SharedDomains) Unwind(ctx context.Context, rwTx kv.RwTx, blockUnwindTo, txUnwindTo uint64, changeset *[kv.DomainLen][]DomainEntryDiff) error {
-	step := txUnwindTo / sd.aggTx.a.StepSize()
+	step := StepOfTxNum(txUnwindTo, sd.aggTx.a.StepSize())
 	logEvery := time.NewTicker(30 * time.Second)
 	defer logEvery.Stop()
 	sd.aggTx.a.logger.Info("aggregator unwind", "step", step,
@@ -315,7 +315,7 @@ func (sd *SharedDomains) ClearRam(resetCommitment bool) {
 func (sd *SharedDomains) put(domain kv.Domain, key string, val []byte) {
 	// disable mutex - because work on parallel execution postponed after E3 release.
 	//sd.muMaps.Lock()
-	valWithPrevStep := dataWithPrevStep{data: val, prevStep: sd.txNum / sd.aggTx.a.StepSize()}
+	valWithPrevStep := dataWithPrevStep{data: val, prevStep: StepOfTxNum(sd.txNum, sd.aggTx.a.StepSize())}
 	if domain == kv.StorageDomain {
 		if old, ok := sd.storage.Set(key, valWithPrevStep); ok {
 			sd.estSize += len(val) - len(old.data)
@@ -381,7 +381,7 @@ func (sd *SharedDomains) LatestCommitment(prefix []byte) ([]byte, uint64, error)
 	}
 
 	if !sd.aggTx.a.commitmentValuesTransform || bytes.Equal(prefix, keyCommitmentState) {
-		return v, endTx / sd.aggTx.a.StepSize(), nil
+		return v, StepOfTxNum(endTx, sd.aggTx.a.StepSize()), nil
 	}
 
 	// replace shortened keys in the branch with full keys to allow HPH work seamlessly
@@ -389,7 +389,7 @@ func (sd *SharedDomains) LatestCommitment(prefix []byte) ([]byte, uint64, error)
 	if err != nil {
 		return nil, 0, err
 	}
-	return rv, endTx / sd.aggTx.a.StepSize(), nil
+	return rv, StepOfTxNum(endTx, sd.aggTx.a.StepSize()), nil
 }
 
 // replaceShortenedKeysInBranch replaces shortened keys in the branch with full keys
@@ -694,17 +694,25 @@ func (sd *SharedDomains) IterateStoragePrefix(prefix []byte, it func(k []byte, v
 	if len(k) > 0 && bytes.HasPrefix(k, prefix) {
 		step := ^binary.BigEndian.Uint64(v[:8])
 		val := v[8:]
-		endTxNum := step * sd.StepSize() // DB can store not-finished step, it means - then set first txn in step - it anyway will be ahead of files
-		if haveRamUpdates && endTxNum >= sd.txNum {
-			return fmt.Errorf("probably you didn't set SharedDomains.SetTxNum(). ram must be ahead of db: %d, %d", sd.txNum, endTxNum)
+		stepFromTxNum, _ := TxNumRangeOfStep(step, sd.StepSize()) // DB can store not-finished step, it means - then set first txn in step - it anyway will be ahead of files
+		if haveRamUpdates && stepFromTxNum >= sd.txNum {
+			return fmt.Errorf("probably you didn't set SharedDomains.SetTxNum(). ram must be ahead of db: %d, %d", sd.txNum, stepFromTxNum)
 		}
 
-		heap.Push(cpPtr, &CursorItem{t: DB_CURSOR, key: common.Copy(k), val: common.Copy(val), step: step, cDup: valsCursor, endTxNum: endTxNum, reverse: true})
+		heap.Push(cpPtr, &CursorItem{t: DB_CURSOR, key: common.Copy(k), val: common.Copy(val), step: step, cDup: valsCursor, endTxNum: stepFromTxNum, reverse: true})
 	}
 
 	sctx := sd.aggTx.d[kv.StorageDomain]
 	for i, item := range sctx.files {
-		cursor, err := item.src.bindex.Seek(sctx.statelessGetter(i), prefix)
+		bt, err := sctx.statelessBtree(i)
+		if err != nil {
+			return err
+		}
+		g, err := sctx.statelessGetter(i)
+		if err != nil {
+			return err
+		}
+		cursor, err := bt.Seek(g, prefix)
 		if err != nil {
 			return err
 		}
@@ -767,11 +775,11 @@ func (sd *SharedDomains) IterateStoragePrefix(prefix []byte, it func(k []byte, v
 				if len(k) > 0 && bytes.HasPrefix(k, prefix) {
 					ci1.key = common.Copy(k)
 					step := ^binary.BigEndian.Uint64(v[:8])
-					endTxNum := step * sd.StepSize() // DB can store not-finished step, it means - then set first txn in step - it anyway will be ahead of files
-					if haveRamUpdates && endTxNum >= sd.txNum {
-						return fmt.Errorf("probably you didn't set SharedDomains.SetTxNum(). ram must be ahead of db: %d, %d", sd.txNum, endTxNum)
+					stepFromTxNum, _ := TxNumRangeOfStep(step, sd.StepSize()) // DB can store not-finished step, it means - then set first txn in step - it anyway will be ahead of files
+					if haveRamUpdates && stepFromTxNum >= sd.txNum {
+						return fmt.Errorf("probably you didn't set SharedDomains.SetTxNum(). ram must be ahead of db: %d, %d", sd.txNum, stepFromTxNum)
 					}
-					ci1.endTxNum = endTxNum
+					ci1.endTxNum = stepFromTxNum
 					ci1.val = common.Copy(v[8:])
 					ci1.step = step
 					heap.Push(cpPtr, ci1)
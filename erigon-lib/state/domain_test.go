@@ -21,25 +21,30 @@ import (
 	"context"
 	"encoding/binary"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"io/fs"
 	"math"
 	"math/rand"
 	"os"
 	"path/filepath"
+	"slices"
 	"sort"
 	"strconv"
 	"strings"
 	"testing"
+	"testing/fstest"
 	"time"
 
 	"github.com/holiman/uint256"
 	"github.com/stretchr/testify/require"
 	btree2 "github.com/tidwall/btree"
+	"golang.org/x/sync/errgroup"
 
 	"github.com/erigontech/erigon-lib/common"
 	"github.com/erigontech/erigon-lib/common/background"
 	datadir2 "github.com/erigontech/erigon-lib/common/datadir"
+	"github.com/erigontech/erigon-lib/common/dir"
 	"github.com/erigontech/erigon-lib/common/hexutility"
 	"github.com/erigontech/erigon-lib/common/length"
 	"github.com/erigontech/erigon-lib/kv"
@@ -47,6 +52,7 @@ import (
 	"github.com/erigontech/erigon-lib/kv/order"
 	"github.com/erigontech/erigon-lib/kv/stream"
 	"github.com/erigontech/erigon-lib/log/v3"
+	"github.com/erigontech/erigon-lib/recsplit"
 	"github.com/erigontech/erigon-lib/seg"
 	"github.com/erigontech/erigon-lib/types"
 )
@@ -56,7 +62,7 @@ func testDbAndDomain(t *testing.T, logger log.Logger) (kv.RwDB, *Domain) {
 	return testDbAndDomainOfStep(t, 16, logger)
 }
 
-func testDbAndDomainOfStep(t *testing.T, aggStep uint64, logger log.Logger) (kv.RwDB, *Domain) {
+func testDbAndDomainOfStep(t testing.TB, aggStep uint64, logger log.Logger) (kv.RwDB, *Domain) {
 	t.Helper()
 	dirs := datadir2.New(t.TempDir())
 	keysTable := "Keys"
@@ -92,6 +98,36 @@ func testDbAndDomainOfStep(t *testing.T, aggStep uint64, logger log.Logger) (kv.
 	return db, d
 }
 
+func TestStepOfTxNum(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		aggStep, step, from, to uint64
+	}{
+		{aggStep: 1, step: 0, from: 0, to: 1},
+		{aggStep: 1, step: 7, from: 7, to: 8},
+		{aggStep: 16, step: 0, from: 0, to: 16},
+		{aggStep: 16, step: 3, from: 48, to: 64},
+		{aggStep: 16, step: StepsInColdFile, from: 16 * StepsInColdFile, to: 16*StepsInColdFile + 16},
+		{aggStep: 1_562_500, step: 1, from: 1_562_500, to: 3_125_000},
+		{aggStep: 1_562_500, step: 2048, from: 3_200_000_000, to: 3_201_562_500},
+	}
+	for _, tt := range tests {
+		label := fmt.Sprintf("aggStep=%d, step=%d", tt.aggStep, tt.step)
+		from, to := TxNumRangeOfStep(tt.step, tt.aggStep)
+		require.Equal(t, tt.from, from, label)
+		require.Equal(t, tt.to, to, label)
+
+		// every txNum of range belongs to step, neighbours don't
+		require.Equal(t, tt.step, StepOfTxNum(from, tt.aggStep), label)
+		require.Equal(t, tt.step, StepOfTxNum(to-1, tt.aggStep), label)
+		require.Equal(t, tt.step+1, StepOfTxNum(to, tt.aggStep), label)
+		if from > 0 {
+			require.Equal(t, tt.step-1, StepOfTxNum(from-1, tt.aggStep), label)
+		}
+	}
+}
+
 func TestDomain_CollationBuild(t *testing.T) {
 	t.Parallel()
 
@@ -103,6 +139,51 @@ func TestDomain_CollationBuild(t *testing.T) {
 	})
 }
 
+func TestDomain_CollateSpillToDisk(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	db, agg := testDbAndAggregatorv3(t, 16)
+	d := agg.d[kv.CodeDomain]
+	require.True(t, d.largeVals)
+
+	tx, err := db.BeginRw(ctx)
+	require.NoError(t, err)
+	defer tx.Rollback()
+	dc := d.BeginFilesRo()
+	writer := dc.NewWriter()
+	defer writer.close()
+
+	rnd := rand.New(rand.NewSource(0))
+	for txNum := uint64(0); txNum < d.aggregationStep; txNum++ {
+		writer.SetTxNum(txNum)
+		for i := 0; i < 64; i++ {
+			k, v := make([]byte, length.Addr), make([]byte, 1+rnd.Intn(128))
+			rnd.Read(k)
+			rnd.Read(v)
+			require.NoError(t, writer.PutWithPrev(k, nil, v, nil, 0))
+		}
+	}
+	require.NoError(t, writer.Flush(ctx, tx))
+	dc.Close()
+
+	collateToBytes := func() []byte {
+		c, err := d.collate(ctx, 0, 0, d.aggregationStep, tx)
+		require.NoError(t, err)
+		defer c.Close()
+		require.Equal(t, 64*int(d.aggregationStep), c.valuesCount)
+		require.NoError(t, c.valuesComp.Compress())
+		data, err := os.ReadFile(c.valuesPath)
+		require.NoError(t, err)
+		return data
+	}
+
+	inMem := collateToBytes()
+	d.collateETLRAM = 4 * 1024 // much smaller than collated data: force spill of sorted runs to disk
+	spilled := collateToBytes()
+	require.Equal(t, inMem, spilled)
+}
+
 func TestDomain_OpenFolder(t *testing.T) {
 	t.Parallel()
 
@@ -126,6 +207,53 @@ func TestDomain_OpenFolder(t *testing.T) {
 	d.Close()
 }
 
+func TestDomain_OpenFolderEmptyFile(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	db, d, txs := filledDomain(t, log.New())
+	collateAndMerge(t, db, nil, d, txs)
+
+	dc := d.BeginFilesRo()
+	filesCount, endStep := len(dc.files), dc.files.EndTxNum()/d.aggregationStep
+	dc.Close()
+	d.Close()
+
+	// leftover of interrupted collation of next step
+	emptyPath := d.kvFilePath(endStep, endStep+1)
+	require.NoError(t, os.WriteFile(emptyPath, nil, 0644))
+
+	require.NoError(t, d.openFolder())
+	dc = d.BeginFilesRo()
+	require.Len(t, dc.files, filesCount)
+	require.Equal(t, endStep*d.aggregationStep, dc.files.EndTxNum())
+	tx, err := db.BeginRw(ctx)
+	require.NoError(t, err)
+	defer tx.Rollback()
+	var k [8]byte
+	binary.BigEndian.PutUint64(k[:], 1)
+	_, _, found, err := dc.GetLatest(k[:], nil, tx)
+	require.NoError(t, err)
+	require.True(t, found)
+	dc.Close()
+
+	// collation of this step replaces empty file
+	c, err := d.collate(ctx, endStep, endStep*d.aggregationStep, (endStep+1)*d.aggregationStep, tx)
+	require.NoError(t, err)
+	exists, err := dir.FileExist(emptyPath)
+	require.NoError(t, err)
+	require.False(t, exists)
+	sf, err := d.buildFiles(ctx, endStep, c, background.NewProgressSet())
+	require.NoError(t, err)
+	d.integrateDirtyFiles(sf, endStep*d.aggregationStep, (endStep+1)*d.aggregationStep)
+	d.reCalcVisibleFiles(d.dirtyFilesEndTxNumMinimax())
+
+	dc = d.BeginFilesRo()
+	defer dc.Close()
+	require.Len(t, dc.files, filesCount+1)
+	require.Equal(t, (endStep+1)*d.aggregationStep, dc.files.EndTxNum())
+}
+
 func testCollationBuild(t *testing.T, compressDomainVals bool) {
 	t.Helper()
 
@@ -143,7 +271,6 @@ func testCollationBuild(t *testing.T, compressDomainVals bool) {
 	require.NoError(t, err)
 	defer tx.Rollback()
 	dc := d.BeginFilesRo()
-	defer dc.Close()
 	writer := dc.NewWriter()
 	defer writer.close()
 
@@ -471,7 +598,421 @@ func TestHistory(t *testing.T) {
 	checkHistory(t, db, d, txs)
 }
 
-func collateAndMerge(t *testing.T, db kv.RwDB, tx kv.RwTx, d *Domain, txs uint64) {
+func TestDomain_OpenFilesLimit(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+	db, d, txs := filledDomain(t, log.New())
+	collateAndMerge(t, db, nil, d, txs)
+
+	roTx, err := db.BeginRo(context.Background())
+	require.NoError(err)
+	defer roTx.Rollback()
+
+	read := func(txNum uint64) (res [][]byte) {
+		dc := d.BeginFilesRo()
+		defer dc.Close()
+		for keyNum := uint64(1); keyNum <= 31; keyNum++ {
+			v, _, err := dc.GetAsOf(hexutility.EncodeTs(keyNum), txNum, roTx)
+			require.NoError(err)
+			res = append(res, common.Copy(v)) // values of files are valid only until RoTx.Close
+		}
+		return res
+	}
+	var expect [][][]byte
+	for txNum := uint64(1); txNum <= txs; txNum += 7 {
+		expect = append(expect, read(txNum))
+	}
+
+	var visible []visibleFile
+	visible = append(visible, d._visible.files...)
+	visible = append(visible, d.History._visibleFiles...)
+	visible = append(visible, d.History.InvertedIndex._visible.files...)
+	opened := func() (n int) {
+		for _, f := range visible {
+			if f.src.decompressor.IsOpen() {
+				n++
+			}
+		}
+		return n
+	}
+	const limit = 2
+	require.Greater(len(visible), limit)
+	require.Equal(len(visible), opened())
+
+	d.filesLRU = newFilesLRU(limit)
+	for _, f := range visible {
+		d.filesLRU.add(f.src)
+	}
+	require.Equal(limit, opened())
+
+	for i, txNum := 0, uint64(1); txNum <= txs; i, txNum = i+1, txNum+7 {
+		require.Equal(expect[i], read(txNum), txNum)
+		require.LessOrEqual(d.filesLRU.openedCount(), limit)
+		require.LessOrEqual(opened(), limit)
+	}
+
+	// pinned files are not closed until RoTx.Close
+	dc := d.BeginFilesRo()
+	for txNum := uint64(1); txNum <= txs; txNum += 50 {
+		_, _, err := dc.GetAsOf(hexutility.EncodeTs(1), txNum, roTx)
+		require.NoError(err)
+	}
+	pinned := opened()
+	require.Greater(pinned, limit)
+	require.Equal(pinned, d.filesLRU.openedCount())
+	dc.Close()
+	require.Equal(limit, opened())
+
+	// dirty file (not visible in RoTx) is pinned by openFileOf
+	iit := d.History.InvertedIndex.BeginFilesRoAt(0)
+	require.Empty(iit.files)
+	var dirty *filesItem
+	for _, f := range d.History.InvertedIndex._visible.files {
+		if !f.src.decompressor.IsOpen() {
+			dirty = f.src
+		}
+	}
+	require.NotNil(dirty)
+	require.NoError(iit.openFileOf(dirty))
+	require.True(dirty.decompressor.IsOpen())
+	for i, txNum := 0, uint64(1); txNum <= txs; i, txNum = i+1, txNum+7 {
+		require.Equal(expect[i], read(txNum), txNum)
+		require.True(dirty.decompressor.IsOpen())
+	}
+	iit.Close()
+	require.Equal(expect[1], read(8))
+	require.Equal(limit, opened())
+}
+
+func TestDomain_OpenFilesLimitReopenError(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+	db, d, txs := filledDomain(t, log.New())
+	collateAndMerge(t, db, nil, d, txs)
+
+	efFiles := d.History.InvertedIndex._visible.files
+	require.Greater(len(efFiles), 1)
+	d.filesLRU = newFilesLRU(1)
+	for _, f := range efFiles {
+		d.filesLRU.add(f.src)
+	}
+	d.filesLRU.add(d._visible.files[0].src)
+	item := efFiles[0].src
+	require.False(item.decompressor.IsOpen())
+
+	// file disappeared while closed by lru: readers get error
+	fPath := item.decompressor.FilePath()
+	require.NoError(os.Rename(fPath, fPath+".bak"))
+	iit := d.History.InvertedIndex.BeginFilesRo()
+	_, err := iit.KeyCount()
+	require.ErrorContains(err, "reopen")
+	iit.Close()
+
+	require.NoError(os.Rename(fPath+".bak", fPath))
+	iit = d.History.InvertedIndex.BeginFilesRo()
+	defer iit.Close()
+	_, err = iit.KeyCount()
+	require.NoError(err)
+}
+
+func TestDomain_OpenFilesLimitDirtyReads(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+	db, d, txs := filledDomain(t, log.New())
+	collateAndMerge(t, db, nil, d, txs)
+
+	var dirty []*filesItem
+	dirty = append(dirty, d.dirtyFiles.Items()...)
+	dirty = append(dirty, d.History.dirtyFiles.Items()...)
+	dirty = append(dirty, d.History.InvertedIndex.dirtyFiles.Items()...)
+	for _, item := range dirty {
+		item.frozen = true // for MakeSteps
+	}
+	readSteps := func() (res [][]uint64) {
+		steps, err := d.MakeSteps(txs + 1)
+		require.NoError(err)
+		require.NotEmpty(steps)
+		for _, step := range steps {
+			var txNums []uint64
+			for it := step.Clone().iterateTxs(); it.HasNext(); {
+				txNum, err := it.Next()
+				require.NoError(err)
+				txNums = append(txNums, txNum)
+			}
+			res = append(res, txNums)
+			step.Close()
+		}
+		return res
+	}
+	expectSteps := readSteps()
+
+	d.filesLRU = newFilesLRU(1)
+	for _, item := range dirty {
+		d.filesLRU.add(item)
+	}
+	require.Equal(1, d.filesLRU.openedCount())
+	// pin and release of `other` closes all other not pinned files
+	other := d._visible.files[len(d._visible.files)-1].src
+	touchOther := func() {
+		require.NoError(d.filesLRU.acquire(other, d.compression))
+		d.filesLRU.release(other)
+	}
+	item := d._visible.files[0].src
+	require.NotSame(other, item)
+	touchOther()
+	require.False(item.decompressor.IsOpen())
+
+	// commitment: dirty file found by it's range is pinned until RoTx.Close
+	dc := d.BeginFilesRoAt(0)
+	require.Empty(dc.files)
+	require.Same(item, dc.lookupDirtyFileByItsRange(item.startTxNum, item.endTxNum))
+	touchOther()
+	require.True(item.decompressor.IsOpen())
+	g := seg.NewReader(item.decompressor.MakeGetter(), d.compression)
+	keys := 0
+	for g.HasNext() {
+		g.Skip()
+		g.Skip()
+		keys++
+	}
+	require.Equal(item.decompressor.Count()/2, keys)
+
+	// debug helper: all dirty .ef files are pinned while read
+	require.NoError(dc.DebugEFKey(hexutility.EncodeTs(1)))
+	for _, ef := range d.History.InvertedIndex.dirtyFiles.Items() {
+		require.True(ef.decompressor.IsOpen())
+	}
+	dc.Close()
+	touchOther()
+	require.False(item.decompressor.IsOpen())
+	require.Equal(1, d.filesLRU.openedCount())
+
+	// steps of reconstitution (and their clones) read files pinned until HistoryStep.Close
+	require.Equal(expectSteps, readSteps())
+	touchOther()
+	require.Equal(1, d.filesLRU.openedCount())
+}
+
+func TestDomain_Locate(t *testing.T) {
+	t.Parallel()
+
+	logger := log.New()
+	db, d, txs := filledDomain(t, logger)
+	collateAndMerge(t, db, nil, d, txs)
+
+	roTx, err := db.BeginRo(context.Background())
+	require.NoError(t, err)
+	defer roTx.Rollback()
+	dc := d.BeginFilesRo()
+	defer dc.Close()
+	filesEnd := dc.files.EndTxNum()
+
+	valueAt := func(fName string, offset uint64) []byte {
+		for i, item := range dc.ht.files {
+			if item.src.decompressor.FileName() == fName {
+				g, err := dc.ht.statelessGetter(i)
+				require.NoError(t, err)
+				g.Reset(offset)
+				v, _ := g.Next(nil)
+				return v
+			}
+		}
+		for i, item := range dc.files {
+			if item.src.decompressor.FileName() == fName {
+				g, err := dc.statelessGetter(i)
+				require.NoError(t, err)
+				g.Reset(offset)
+				g.Skip()
+				v, _ := g.Next(nil)
+				return v
+			}
+		}
+		t.Fatalf("file %s not found", fName)
+		return nil
+	}
+
+	var k [8]byte
+	for keyNum := uint64(1); keyNum <= 31; keyNum++ {
+		binary.BigEndian.PutUint64(k[:], keyNum)
+		for txNum := uint64(1); txNum < filesEnd; txNum += 7 {
+			label := fmt.Sprintf("key %d, txNum %d", keyNum, txNum)
+			fName, offset, step, found, err := dc.Locate(k[:], txNum)
+			require.NoError(t, err, label)
+			require.True(t, found, label)
+
+			// history record of next change of key, if it's in files
+			if histTxNum := (txNum + keyNum - 1) / keyNum * keyNum; histTxNum < filesEnd {
+				require.Equal(t, histTxNum/d.aggregationStep, step, label)
+				require.True(t, strings.HasSuffix(fName, ".v"), label)
+			} else { // latest record in files: in newest file which has last change of key
+				lastChange := (filesEnd - 1) / keyNum * keyNum
+				i := slices.IndexFunc(dc.files, func(f visibleFile) bool { return f.src.decompressor.FileName() == fName })
+				require.GreaterOrEqual(t, i, 0, label)
+				require.True(t, dc.files[i].startTxNum <= lastChange && lastChange < dc.files[i].endTxNum, label)
+				require.Equal(t, dc.files[i].endTxNum/d.aggregationStep-1, step, label)
+			}
+
+			v, ok, err := dc.GetAsOf(k[:], txNum, roTx)
+			require.NoError(t, err, label)
+			if !ok { // before first change of key
+				require.Empty(t, valueAt(fName, offset), label)
+				continue
+			}
+			require.Equal(t, v, valueAt(fName, offset), label)
+		}
+	}
+
+	_, _, _, found, err := dc.Locate([]byte("no such key"), 1)
+	require.NoError(t, err)
+	require.False(t, found)
+}
+
+func TestDomain_OpenFolderFS(t *testing.T) {
+	t.Parallel()
+
+	logger := log.New()
+	db, d, txs := filledDomain(t, logger)
+	collateAndMerge(t, db, nil, d, txs)
+
+	roTx, err := db.BeginRo(context.Background())
+	require.NoError(t, err)
+	defer roTx.Rollback()
+
+	type asOf struct {
+		v  []byte
+		ok bool
+	}
+	read := func() (res []asOf, filesEnd uint64) {
+		dc := d.BeginFilesRo()
+		defer dc.Close()
+		filesEnd = dc.files.EndTxNum()
+		var k [8]byte
+		for keyNum := uint64(1); keyNum <= 31; keyNum++ {
+			binary.BigEndian.PutUint64(k[:], keyNum)
+			for txNum := uint64(1); txNum < filesEnd; txNum += 5 {
+				v, ok, err := dc.GetAsOf(k[:], txNum, roTx)
+				require.NoError(t, err)
+				res = append(res, asOf{common.Copy(v), ok})
+			}
+		}
+		return res, filesEnd
+	}
+	want, wantEnd := read()
+	require.NotZero(t, wantEnd)
+	d.Close()
+
+	// move files from disk to in-memory FS
+	mapFS := fstest.MapFS{}
+	err = filepath.WalkDir(d.dirs.Snap, func(path string, e fs.DirEntry, err error) error {
+		if err != nil || e.IsDir() {
+			return err
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(d.dirs.Snap, path)
+		if err != nil {
+			return err
+		}
+		mapFS[filepath.ToSlash(rel)] = &fstest.MapFile{Data: data}
+		return os.Remove(path)
+	})
+	require.NoError(t, err)
+	require.NotEmpty(t, mapFS)
+
+	d.filesFS = filesFS{fs: mapFS, root: d.dirs.Snap}
+	require.NoError(t, d.openFolder())
+	d.reCalcVisibleFiles(d.dirtyFilesEndTxNumMinimax())
+	got, gotEnd := read()
+	require.Equal(t, wantEnd, gotEnd)
+	require.Equal(t, want, got)
+}
+
+func TestDomain_DataFileAccessPread(t *testing.T) {
+	t.Parallel()
+
+	logger := log.New()
+	db, d, txs := filledDomain(t, logger)
+	collateAndMerge(t, db, nil, d, txs)
+
+	roTx, err := db.BeginRo(context.Background())
+	require.NoError(t, err)
+	defer roTx.Rollback()
+
+	read := func() (res [][]byte) {
+		dc := d.BeginFilesRo()
+		defer dc.Close()
+		var k [8]byte
+		for keyNum := uint64(1); keyNum <= 31; keyNum++ {
+			binary.BigEndian.PutUint64(k[:], keyNum)
+			for txNum := uint64(1); txNum <= txs; txNum += 5 {
+				v, _, err := dc.GetAsOf(k[:], txNum, roTx)
+				require.NoError(t, err)
+				res = append(res, common.Copy(v))
+			}
+			v, _, _, err := dc.GetLatest(k[:], nil, roTx)
+			require.NoError(t, err)
+			res = append(res, common.Copy(v))
+		}
+		return res
+	}
+	want := read()
+	d.Close()
+
+	d.dataAccess = seg.AccessPread
+	require.NoError(t, d.openFolder())
+	d.reCalcVisibleFiles(d.dirtyFilesEndTxNumMinimax())
+	dc := d.BeginFilesRo()
+	require.NotEmpty(t, dc.files)
+	for _, f := range dc.files {
+		require.Equal(t, seg.AccessPread, f.src.decompressor.Access())
+	}
+	for _, f := range dc.ht.iit.files {
+		require.Equal(t, seg.AccessPread, f.src.decompressor.Access())
+	}
+	dc.Close()
+	require.Equal(t, want, read())
+}
+
+func TestDomain_GetLatestTxNum(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+	db, d, txs := filledDomain(t, log.New())
+	collateAndMerge(t, db, nil, d, txs) // last steps stay in db
+
+	roTx, err := db.BeginRo(context.Background())
+	require.NoError(err)
+	defer roTx.Rollback()
+	dc := d.BeginFilesRo()
+	defer dc.Close()
+	require.NotEmpty(dc.files)
+
+	for keyNum := uint64(1); keyNum <= 31; keyNum++ {
+		k := hexutility.EncodeTs(keyNum)
+		label := fmt.Sprintf("keyNum=%d", keyNum)
+
+		v, txNum, err := dc.GetLatestTxNum(k, roTx)
+		require.NoError(err, label)
+		expect, ok, err := dc.GetAsOf(k, math.MaxUint64, roTx)
+		require.NoError(err, label)
+		require.True(ok, label)
+		require.Equal(expect, v, label)
+		require.Equal(hexutility.EncodeTs(txs/keyNum), v, label)
+		require.Equal(txs/keyNum*keyNum, txNum, label) // key changes on every txNum which is multiple of the key
+	}
+
+	v, txNum, err := dc.GetLatestTxNum(hexutility.EncodeTs(100), roTx)
+	require.NoError(err)
+	require.Nil(v)
+	require.Zero(txNum)
+}
+
+func collateAndMerge(t testing.TB, db kv.RwDB, tx kv.RwTx, d *Domain, txs uint64) {
 	t.Helper()
 
 	logEvery := time.NewTicker(30 * time.Second)
@@ -509,7 +1050,8 @@ func collateAndMerge(t *testing.T, db kv.RwDB, tx kv.RwTx, d *Domain, txs uint64
 			if !r.any() {
 				return true
 			}
-			valuesOuts, indexOuts, historyOuts := dc.staticFilesInRange(r)
+			valuesOuts, indexOuts, historyOuts, err := dc.staticFilesInRange(r)
+			require.NoError(t, err)
 			valuesIn, indexIn, historyIn, err := dc.mergeFiles(ctx, valuesOuts, indexOuts, historyOuts, r, nil, background.NewProgressSet())
 			require.NoError(t, err)
 			if valuesIn != nil && valuesIn.decompressor != nil {
@@ -559,172 +1101,1265 @@ func collateAndMergeOnce(t *testing.T, d *Domain, tx kv.RwTx, step uint64, prune
 			dc.Close()
 			break
 		}
-		valuesOuts, indexOuts, historyOuts := dc.staticFilesInRange(r)
+		valuesOuts, indexOuts, historyOuts, err := dc.staticFilesInRange(r)
+		require.NoError(t, err)
 		valuesIn, indexIn, historyIn, err := dc.mergeFiles(ctx, valuesOuts, indexOuts, historyOuts, r, nil, background.NewProgressSet())
 		require.NoError(t, err)
 
-		d.integrateMergedDirtyFiles(valuesOuts, indexOuts, historyOuts, valuesIn, indexIn, historyIn)
-		d.reCalcVisibleFiles(d.dirtyFilesEndTxNumMinimax())
-		dc.Close()
+		d.integrateMergedDirtyFiles(valuesOuts, indexOuts, historyOuts, valuesIn, indexIn, historyIn)
+		d.reCalcVisibleFiles(d.dirtyFilesEndTxNumMinimax())
+		dc.Close()
+	}
+}
+
+func TestDomain_MergeFiles(t *testing.T) {
+	t.Parallel()
+
+	logger := log.New()
+	db, d, txs := filledDomain(t, logger)
+	rwTx, err := db.BeginRw(context.Background())
+	require.NoError(t, err)
+
+	collateAndMerge(t, db, rwTx, d, txs)
+	err = rwTx.Commit()
+	require.NoError(t, err)
+	checkHistory(t, db, d, txs)
+}
+
+func TestDomain_FileStats(t *testing.T) {
+	t.Parallel()
+
+	logger, require := log.New(), require.New(t)
+	logEvery := time.NewTicker(30 * time.Second)
+	defer logEvery.Stop()
+	ctx := context.Background()
+	db, d, txs := filledDomain(t, logger)
+	tx, err := db.BeginRw(ctx)
+	require.NoError(err)
+	defer tx.Rollback()
+
+	steps := txs/d.aggregationStep - 1
+	for step := uint64(0); step < steps; step++ {
+		c, err := d.collate(ctx, step, step*d.aggregationStep, (step+1)*d.aggregationStep, tx)
+		require.NoError(err)
+		sf, err := d.buildFiles(ctx, step, c, background.NewProgressSet())
+		require.NoError(err)
+		d.integrateDirtyFiles(sf, step*d.aggregationStep, (step+1)*d.aggregationStep)
+		d.reCalcVisibleFiles(d.dirtyFilesEndTxNumMinimax())
+	}
+
+	dc := d.BeginFilesRo()
+	before := dc.FileStats()
+	dc.Close()
+	require.Len(before, int(steps))
+	for i, st := range before {
+		require.Equal(uint64(i), st.FromStep)
+		require.Equal(uint64(i+1), st.ToStep)
+		require.Positive(st.Size)
+		require.Positive(st.Keys)
+		require.True(st.HasBtIndex, st.Name)
+		require.True(st.HasExistence, st.Name)
+		require.Positive(st.AccessorsSize)
+	}
+
+	maxSpan := d.aggregationStep * StepsInColdFile
+	for {
+		dc := d.BeginFilesRo()
+		r := dc.findMergeRange(dc.files.EndTxNum(), maxSpan)
+		if !r.any() {
+			dc.Close()
+			break
+		}
+		valuesOuts, indexOuts, historyOuts, err := dc.staticFilesInRange(r)
+		require.NoError(err)
+		valuesIn, indexIn, historyIn, err := dc.mergeFiles(ctx, valuesOuts, indexOuts, historyOuts, r, nil, background.NewProgressSet())
+		require.NoError(err)
+		d.integrateMergedDirtyFiles(valuesOuts, indexOuts, historyOuts, valuesIn, indexIn, historyIn)
+		d.reCalcVisibleFiles(d.dirtyFilesEndTxNumMinimax())
+		dc.Close()
+	}
+
+	dc = d.BeginFilesRo()
+	after := dc.FileStats()
+	dc.Close()
+	require.Less(len(after), len(before))
+	var toStep uint64
+	for _, st := range after {
+		require.Equal(toStep, st.FromStep, st.Name)
+		require.Less(st.FromStep, st.ToStep, st.Name)
+		require.Contains(st.Name, fmt.Sprintf(".%d-%d.kv", st.FromStep, st.ToStep))
+		toStep = st.ToStep
+	}
+	require.Equal(steps, toStep)
+	require.Greater(after[0].ToStep-after[0].FromStep, uint64(1))
+}
+
+func TestDomain_StepSizes(t *testing.T) {
+	t.Parallel()
+
+	logger, require := log.New(), require.New(t)
+	db, d, txs := filledDomain(t, logger)
+	rwTx, err := db.BeginRw(context.Background())
+	require.NoError(err)
+	defer rwTx.Rollback()
+	collateAndMerge(t, db, rwTx, d, txs)
+
+	sizes := d.StepSizes()
+	require.NotEmpty(sizes)
+	var total int64
+	for _, st := range sizes {
+		require.Less(st.FromStep, st.ToStep)
+		require.Positive(st.DataBytes)
+		require.Positive(st.IndexBytes)
+		total += st.DataBytes + st.IndexBytes
+	}
+
+	entries, err := os.ReadDir(d.dirs.SnapDomain)
+	require.NoError(err)
+	var dirSize int64
+	for _, e := range entries {
+		if !strings.HasPrefix(e.Name(), "v1-"+d.filenameBase+".") {
+			continue
+		}
+		info, err := e.Info()
+		require.NoError(err)
+		dirSize += info.Size()
+	}
+	require.Equal(dirSize, total)
+}
+
+func TestDomain_PlanMerge(t *testing.T) {
+	t.Parallel()
+
+	logger, require := log.New(), require.New(t)
+	ctx := context.Background()
+	db, d, txs := filledDomain(t, logger)
+	tx, err := db.BeginRw(ctx)
+	require.NoError(err)
+	defer tx.Rollback()
+
+	steps := txs/d.aggregationStep - 1
+	for step := uint64(0); step < steps; step++ {
+		c, err := d.collate(ctx, step, step*d.aggregationStep, (step+1)*d.aggregationStep, tx)
+		require.NoError(err)
+		sf, err := d.buildFiles(ctx, step, c, background.NewProgressSet())
+		require.NoError(err)
+		d.integrateDirtyFiles(sf, step*d.aggregationStep, (step+1)*d.aggregationStep)
+		d.reCalcVisibleFiles(d.dirtyFilesEndTxNumMinimax())
+	}
+
+	maxSpan := d.aggregationStep * StepsInColdFile
+	dc := d.BeginFilesRo()
+	plan := dc.PlanMerge(dc.files.EndTxNum(), maxSpan)
+	dc.Close()
+	require.NotEmpty(plan)
+	require.Equal("v1-accounts.0-2.kv", plan[0].Output)
+	require.Equal([]string{"v1-accounts.0-1.kv", "v1-accounts.1-2.kv"}, plan[0].Inputs)
+	var planned []string
+	var kvRanges [][2]uint64
+	for _, p := range plan {
+		require.Positive(p.EstimatedSize, p.Output)
+		planned = append(planned, p.Output)
+		if filepath.Ext(p.Output) == ".kv" {
+			kvRanges = append(kvRanges, [2]uint64{p.FromStep, p.ToStep})
+		}
+	}
+	require.Contains(kvRanges, [2]uint64{0, 32})
+
+	var merged []string
+	for {
+		dc := d.BeginFilesRo()
+		r := dc.findMergeRange(dc.files.EndTxNum(), maxSpan)
+		if !r.any() {
+			dc.Close()
+			break
+		}
+		valuesOuts, indexOuts, historyOuts, err := dc.staticFilesInRange(r)
+		require.NoError(err)
+		valuesIn, indexIn, historyIn, err := dc.mergeFiles(ctx, valuesOuts, indexOuts, historyOuts, r, nil, background.NewProgressSet())
+		require.NoError(err)
+		for _, in := range []*filesItem{valuesIn, historyIn, indexIn} {
+			if in != nil && in.decompressor != nil {
+				merged = append(merged, in.decompressor.FileName())
+			}
+		}
+		d.integrateMergedDirtyFiles(valuesOuts, indexOuts, historyOuts, valuesIn, indexIn, historyIn)
+		d.reCalcVisibleFiles(d.dirtyFilesEndTxNumMinimax())
+		dc.Close()
+	}
+	require.Equal(planned, merged)
+}
+
+func TestDomain_Verify(t *testing.T) {
+	t.Parallel()
+
+	logger, require := log.New(), require.New(t)
+	ctx := context.Background()
+	db, d, txs := filledDomain(t, logger)
+	collateAndMerge(t, db, nil, d, txs)
+	require.NoError(d.Verify(ctx))
+
+	// corrupt offset of first record in .vi accessor
+	dc := d.BeginFilesRo()
+	item := dc.ht.files[0]
+	viPath := d.vAccessorFilePath(item.startTxNum/d.aggregationStep, item.endTxNum/d.aggregationStep)
+	dc.Close()
+	data, err := os.ReadFile(viPath)
+	require.NoError(err)
+	bytesPerRec := int(data[16])
+	data[16+bytesPerRec] ^= 0xff
+	require.NoError(os.WriteFile(viPath, data, 0644))
+
+	d.Close()
+	require.NoError(d.openFolder())
+	d.reCalcVisibleFiles(d.dirtyFilesEndTxNumMinimax())
+
+	err = d.Verify(ctx)
+	var verr *VerifyError
+	require.ErrorAs(err, &verr)
+	require.Positive(verr.Total)
+	require.NotEmpty(verr.Mismatches)
+	require.LessOrEqual(len(verr.Mismatches), verifyMaxMismatches)
+	require.Contains(verr.Mismatches[0], ".v: key")
+}
+
+func TestDomain_RebuildRecsplitIndex(t *testing.T) {
+	t.Parallel()
+
+	logger, require := log.New(), require.New(t)
+	ctx := context.Background()
+	db, d, txs := filledDomain(t, logger)
+	collateAndMerge(t, db, nil, d, txs)
+
+	dc := d.BeginFilesRo()
+	item := dc.files[0]
+	fromStep, toStep := item.startTxNum/d.aggregationStep, item.endTxNum/d.aggregationStep
+	dc.Close()
+	kvPath, kviPath := d.kvFilePath(fromStep, toStep), d.kvAccessorFilePath(fromStep, toStep)
+
+	// missing .kvi
+	_ = os.Remove(kviPath)
+	require.NoError(d.RebuildRecsplitIndex(ctx, kvPath))
+	require.FileExists(kviPath)
+	require.NotNil(item.src.index)
+
+	// corrupted .kvi
+	d.Close()
+	require.NoError(os.WriteFile(kviPath, []byte("not a recsplit index"), 0644))
+	require.NoError(d.RebuildRecsplitIndex(ctx, kvPath))
+
+	require.NoError(d.openFolder())
+	d.reCalcVisibleFiles(d.dirtyFilesEndTxNumMinimax())
+	idx, err := recsplit.OpenIndex(kviPath)
+	require.NoError(err)
+	defer idx.Close()
+	data, err := seg.NewDecompressor(kvPath)
+	require.NoError(err)
+	defer data.Close()
+	require.NoError(checkKeysAccessor(data, d.compression, idx, data.Count()/2))
+
+	checkHistory(t, db, d, txs)
+
+	require.Error(d.RebuildRecsplitIndex(ctx, filepath.Join(d.dirs.SnapDomain, "v1-accounts.1000-1001.kv")))
+}
+
+func TestDomain_ScanFiles(t *testing.T) {
+	t.Parallel()
+
+	logger := log.New()
+	db, d, txs := filledDomain(t, logger)
+	collateAndMerge(t, db, nil, d, txs)
+	// Recreate domain and re-scan the files
+	dc := d.BeginFilesRo()
+	defer dc.Close()
+	d.closeWhatNotInList([]string{})
+	require.NoError(t, d.openFolder())
+
+	// Check the history
+	checkHistory(t, db, d, txs)
+}
+
+func TestDomain_Delete(t *testing.T) {
+	t.Parallel()
+
+	logger := log.New()
+	db, d := testDbAndDomain(t, logger)
+	ctx, require := context.Background(), require.New(t)
+	tx, err := db.BeginRw(ctx)
+	require.NoError(err)
+	defer tx.Rollback()
+	dc := d.BeginFilesRo()
+	defer dc.Close()
+	writer := dc.NewWriter()
+	defer writer.close()
+
+	// Put on even txNum, delete on odd txNum
+	for txNum := uint64(0); txNum < uint64(1000); txNum++ {
+		writer.SetTxNum(txNum)
+		original, originalStep, _, err := dc.GetLatest([]byte("key1"), nil, tx)
+		require.NoError(err)
+		if txNum%2 == 0 {
+			err = writer.PutWithPrev([]byte("key1"), nil, []byte("value1"), original, originalStep)
+		} else {
+			err = writer.DeleteWithPrev([]byte("key1"), nil, original, originalStep)
+		}
+		require.NoError(err)
+	}
+	err = writer.Flush(ctx, tx)
+	require.NoError(err)
+	collateAndMerge(t, db, tx, d, 1000)
+	dc.Close()
+
+	// Check the history
+	dc = d.BeginFilesRo()
+	defer dc.Close()
+	for txNum := uint64(0); txNum < 1000; txNum++ {
+		label := fmt.Sprintf("txNum=%d", txNum)
+		//val, ok, err := dc.GetLatestBeforeTxNum([]byte("key1"), txNum+1, tx)
+		//require.NoError(err)
+		//require.True(ok)
+		//if txNum%2 == 0 {
+		//	require.Equal([]byte("value1"), val, label)
+		//} else {
+		//	require.Nil(val, label)
+		//}
+		//if txNum == 976 {
+		val, _, err := dc.GetAsOf([]byte("key2"), txNum+1, tx)
+		require.NoError(err)
+		//require.False(ok, label)
+		require.Nil(val, label)
+		//}
+	}
+}
+
+// firstly we write all the data to domain
+// then we collate-merge-prune
+// then check.
+// in real life we periodically do collate-merge-prune without stopping adding data
+func TestDomain_Prune_AfterAllWrites(t *testing.T) {
+	t.Parallel()
+
+	logger := log.New()
+	keyCount, txCount := uint64(4), uint64(64)
+	db, dom, data := filledDomainFixedSize(t, keyCount, txCount, 16, logger)
+	collateAndMerge(t, db, nil, dom, txCount)
+	maxFrozenFiles := (txCount / dom.aggregationStep) / StepsInColdFile
+
+	ctx := context.Background()
+	roTx, err := db.BeginRo(ctx)
+	require.NoError(t, err)
+	defer roTx.Rollback()
+
+	// Check the history
+	dc := dom.BeginFilesRo()
+	defer dc.Close()
+	var k, v [8]byte
+
+	for txNum := uint64(1); txNum <= txCount; txNum++ {
+		for keyNum := uint64(0); keyNum < keyCount; keyNum++ {
+			step := txNum / dom.aggregationStep
+			frozenFileNum := step / 32
+			if frozenFileNum < maxFrozenFiles { // frozen data
+				if keyNum != frozenFileNum {
+					continue
+				}
+				continue
+				//fmt.Printf("put frozen: %d, step=%d, %d\n", keyNum, step, frozenFileNum)
+			} else { //warm data
+				if keyNum == 0 || keyNum == 1 {
+					continue
+				}
+				if keyNum == txNum%dom.aggregationStep {
+					continue
+				}
+				//fmt.Printf("put: %d, step=%d\n", keyNum, step)
+			}
+
+			label := fmt.Sprintf("txNum=%d, keyNum=%d\n", txNum, keyNum)
+			binary.BigEndian.PutUint64(k[:], keyNum)
+			binary.BigEndian.PutUint64(v[:], txNum)
+
+			val, _, err := dc.GetAsOf(k[:], txNum+1, roTx)
+			// during generation such keys are skipped so value should be nil for this call
+			require.NoError(t, err, label)
+			if !data[keyNum][txNum] {
+				if txNum > 1 {
+					binary.BigEndian.PutUint64(v[:], txNum-1)
+				} else {
+					require.Nil(t, val, label)
+					continue
+				}
+			}
+			require.EqualValues(t, v[:], val)
+		}
+	}
+
+	//warm keys
+	binary.BigEndian.PutUint64(v[:], txCount)
+	for keyNum := uint64(2); keyNum < keyCount; keyNum++ {
+		label := fmt.Sprintf("txNum=%d, keyNum=%d\n", txCount-1, keyNum)
+		binary.BigEndian.PutUint64(k[:], keyNum)
+
+		storedV, _, found, err := dc.GetLatest(k[:], nil, roTx)
+		require.Truef(t, found, label)
+		require.NoError(t, err, label)
+		require.EqualValues(t, v[:], storedV, label)
+	}
+}
+
+func TestDomain_ChangedKeys(t *testing.T) {
+	t.Parallel()
+
+	logger := log.New()
+	keyCount, txCount := uint64(16), uint64(128)
+	db, dom, data := filledDomainFixedSize(t, keyCount, txCount, 16, logger)
+	collateAndMerge(t, db, nil, dom, txCount)
+
+	ctx := context.Background()
+	roTx, err := db.BeginRo(ctx)
+	require.NoError(t, err)
+	defer roTx.Rollback()
+
+	dc := dom.BeginFilesRo()
+	defer dc.Close()
+	require.Greater(t, dc.files.EndTxNum(), uint64(0))
+
+	// sub-ranges: inside one step, across steps, across files and DB, only DB, single txNum where key `txNum%aggStep` is skipped
+	for _, r := range [][2]uint64{{0, 20}, {37, 38}, {40, 60}, {90, 113}, {100, txCount + 1}, {120, 125}, {0, txCount + 1}} {
+		fromTxNum, toTxNum := r[0], r[1]
+		label := fmt.Sprintf("[%d, %d)", fromTxNum, toTxNum)
+
+		var expect []string
+		var k [8]byte
+		for keyNum := uint64(0); keyNum < keyCount; keyNum++ {
+			for txNum := fromTxNum; txNum < toTxNum && txNum <= txCount; txNum++ {
+				if data[keyNum] != nil && data[keyNum][txNum] {
+					binary.BigEndian.PutUint64(k[:], keyNum)
+					expect = append(expect, fmt.Sprintf("%x", k))
+					break
+				}
+			}
+		}
+
+		it := dc.ChangedKeys(fromTxNum, toTxNum, roTx)
+		var got []string
+		for it.HasNext() {
+			key, err := it.Next()
+			require.NoError(t, err, label)
+			got = append(got, fmt.Sprintf("%x", key))
+		}
+		it.Close()
+		require.Equal(t, expect, got, label)
+	}
+}
+
+func TestDomain_StreamSortedKV(t *testing.T) {
+	t.Parallel()
+
+	logger, require := log.New(), require.New(t)
+	ctx := context.Background()
+	db, d, txs := filledDomain(t, logger)
+	collateAndMerge(t, db, nil, d, txs)
+
+	roTx, err := db.BeginRo(ctx)
+	require.NoError(err)
+	defer roTx.Rollback()
+	dc := d.BeginFilesRo()
+	defer dc.Close()
+	require.Less(dc.files.EndTxNum(), txs)
+
+	for _, r := range [][2]uint64{{1, 20}, {37, 38}, {100, 517}, {dc.files.EndTxNum() - 3, txs + 1}, {0, txs + 1}} {
+		fromTxNum, toTxNum := r[0], r[1]
+		label := fmt.Sprintf("[%d, %d)", fromTxNum, toTxNum)
+
+		// full scan of state as of toTxNum, only keys changed in range: key changes on every txNum which is multiple of key
+		it, err := dc.DomainRange(ctx, roTx, nil, nil, toTxNum, order.Asc, -1)
+		require.NoError(err, label)
+		var expect []string
+		for it.HasNext() {
+			k, v, err := it.Next()
+			require.NoError(err, label)
+			keyNum := binary.BigEndian.Uint64(k)
+			if (toTxNum-1)/keyNum*keyNum >= max(fromTxNum, keyNum) {
+				expect = append(expect, fmt.Sprintf("%x=%x", k, v))
+			}
+		}
+		it.Close()
+
+		var got []string
+		err = dc.StreamSortedKV(ctx, fromTxNum, toTxNum, roTx, func(k, v []byte) error {
+			got = append(got, fmt.Sprintf("%x=%x", k, v))
+			return nil
+		})
+		require.NoError(err, label)
+		require.NotEmpty(got, label)
+		require.Equal(expect, got, label)
+	}
+
+	// stops on first callback error
+	errStop := errors.New("stop")
+	calls := 0
+	err = dc.StreamSortedKV(ctx, 0, txs+1, roTx, func(k, v []byte) error {
+		calls++
+		if calls == 3 {
+			return errStop
+		}
+		return nil
+	})
+	require.ErrorIs(err, errStop)
+	require.Equal(3, calls)
+}
+
+func TestDomain_SquashDeletions(t *testing.T) {
+	t.Parallel()
+
+	logger := log.New()
+	ctx := context.Background()
+	keyCount, txs := uint64(1000), uint64(64)
+
+	// keys are written in step 0, even keys are deleted in step 1
+	build := func(squash bool) (kv.RwDB, *Domain) {
+		db, d := testDbAndDomainOfStep(t, 16, logger)
+		d.noSquashDeletions = !squash
+
+		tx, err := db.BeginRw(ctx)
+		require.NoError(t, err)
+		defer tx.Rollback()
+		dc := d.BeginFilesRo()
+		defer dc.Close()
+		writer := dc.NewWriter()
+		defer writer.close()
+
+		var k, v [8]byte
+		writer.SetTxNum(1)
+		for keyNum := uint64(0); keyNum < keyCount; keyNum++ {
+			binary.BigEndian.PutUint64(k[:], keyNum)
+			binary.BigEndian.PutUint64(v[:], keyNum)
+			require.NoError(t, writer.PutWithPrev(k[:], nil, v[:], nil, 0))
+		}
+		writer.SetTxNum(d.aggregationStep + 1)
+		for keyNum := uint64(0); keyNum < keyCount; keyNum += 2 {
+			binary.BigEndian.PutUint64(k[:], keyNum)
+			binary.BigEndian.PutUint64(v[:], keyNum)
+			require.NoError(t, writer.DeleteWithPrev(k[:], nil, v[:], 0))
+		}
+		require.NoError(t, writer.Flush(ctx, tx))
+		require.NoError(t, tx.Commit())
+
+		collateAndMerge(t, db, nil, d, txs)
+		return db, d
+	}
+
+	// first file is merged from txNum 0, and contains deletions
+	firstFile := func(d *Domain) *filesItem {
+		dc := d.BeginFilesRo()
+		defer dc.Close()
+		require.Equal(t, uint64(0), dc.files[0].startTxNum)
+		require.Greater(t, dc.files[0].endTxNum, d.aggregationStep+1)
+		return dc.files[0].src
+	}
+
+	db, d := build(true)
+	_, dNoSquash := build(false)
+	squashed, notSquashed := firstFile(d), firstFile(dNoSquash)
+	require.Equal(t, int(keyCount/2), squashed.decompressor.Count()/2)
+	require.Equal(t, int(keyCount), notSquashed.decompressor.Count()/2)
+	require.Less(t, squashed.decompressor.Size(), notSquashed.decompressor.Size())
+
+	roTx, err := db.BeginRo(ctx)
+	require.NoError(t, err)
+	defer roTx.Rollback()
+	dc := d.BeginFilesRo()
+	defer dc.Close()
+	var k [8]byte
+	for keyNum := uint64(0); keyNum < keyCount; keyNum++ {
+		binary.BigEndian.PutUint64(k[:], keyNum)
+		_, _, found, err := dc.GetLatest(k[:], nil, roTx)
+		require.NoError(t, err)
+		require.Equal(t, keyNum%2 == 1, found, keyNum)
+
+		// value before deletion is still in history
+		v, ok, err := dc.GetAsOf(k[:], 2, roTx)
+		require.NoError(t, err)
+		require.True(t, ok)
+		require.Len(t, v, 8)
+	}
+}
+
+func TestDomain_SeekPrefix(t *testing.T) {
+	t.Parallel()
+
+	logger := log.New()
+	// keys 0..255 have prefix 00000000000000, keys 256..299 have prefix 00000000000001
+	keyCount, txCount := uint64(300), uint64(64)
+	db, dom, data := filledDomainFixedSize(t, keyCount, txCount, 16, logger)
+	collateAndMerge(t, db, nil, dom, txCount)
+
+	ctx := context.Background()
+	var k [8]byte
+	deletedKey := uint64(257)
+	{ // delete 1 key after all writes
+		tx, err := db.BeginRw(ctx)
+		require.NoError(t, err)
+		defer tx.Rollback()
+		dc := dom.BeginFilesRo()
+		writer := dc.NewWriter()
+		binary.BigEndian.PutUint64(k[:], deletedKey)
+		prev, step, _, err := dc.GetLatest(k[:], nil, tx)
+		require.NoError(t, err)
+		writer.SetTxNum(txCount + 1)
+		require.NoError(t, writer.DeleteWithPrev(k[:], nil, prev, step))
+		require.NoError(t, writer.Flush(ctx, tx))
+		writer.close()
+		dc.Close()
+		require.NoError(t, tx.Commit())
+	}
+
+	roTx, err := db.BeginRo(ctx)
+	require.NoError(t, err)
+	defer roTx.Rollback()
+	dc := dom.BeginFilesRo()
+	defer dc.Close()
+
+	prefix := []byte{0, 0, 0, 0, 0, 0, 1}
+	for _, txNum := range []uint64{5, 17, 40, txCount - 1, txCount, txCount + 1} {
+		label := fmt.Sprintf("txNum=%d", txNum)
+
+		var expectKeys, expectVals []string
+		for keyNum := uint64(256); keyNum < keyCount; keyNum++ {
+			if keyNum == deletedKey && txNum > txCount {
+				continue
+			}
+			for tx := min(txNum, txCount); tx > 0; tx-- {
+				if data[keyNum] != nil && data[keyNum][tx] {
+					var v [8]byte
+					binary.BigEndian.PutUint64(k[:], keyNum)
+					binary.BigEndian.PutUint64(v[:], tx)
+					expectKeys = append(expectKeys, fmt.Sprintf("%x", k))
+					expectVals = append(expectVals, fmt.Sprintf("%x", v))
+					break
+				}
+			}
+		}
+		require.NotEmpty(t, expectKeys, label)
+
+		it, err := dc.SeekPrefix(ctx, prefix, txNum, roTx)
+		require.NoError(t, err, label)
+		var gotKeys, gotVals []string
+		for it.HasNext() {
+			key, val, err := it.Next()
+			require.NoError(t, err, label)
+			gotKeys = append(gotKeys, fmt.Sprintf("%x", key))
+			gotVals = append(gotVals, fmt.Sprintf("%x", val))
+		}
+		it.Close()
+		require.Equal(t, expectKeys, gotKeys, label)
+		require.Equal(t, expectVals, gotVals, label)
+	}
+}
+
+// fillDomainWithDeletions - key `k` changes on every txNum which is multiple of `k`, keys multiple of 5 are deleted on every 3rd change
+func fillDomainWithDeletions(t testing.TB, db kv.RwDB, d *Domain, keyCount, txCount uint64, valueSize int) {
+	t.Helper()
+	require := require.New(t)
+	ctx := context.Background()
+	tx, err := db.BeginRw(ctx)
+	require.NoError(err)
+	defer tx.Rollback()
+	dc := d.BeginFilesRo()
+	writer := dc.NewWriter()
+	prev, prevStep := map[uint64][]byte{}, map[uint64]uint64{}
+	var k [8]byte
+	for txNum := uint64(1); txNum <= txCount; txNum++ {
+		writer.SetTxNum(txNum)
+		for keyNum := uint64(1); keyNum < keyCount; keyNum++ {
+			if txNum%keyNum != 0 {
+				continue
+			}
+			binary.BigEndian.PutUint64(k[:], keyNum)
+			if keyNum%5 == 0 && txNum%(3*keyNum) == 0 {
+				require.NoError(writer.DeleteWithPrev(k[:], nil, prev[keyNum], prevStep[keyNum]))
+				prev[keyNum] = nil
+			} else {
+				v := bytes.Repeat(hexutility.EncodeTs(txNum), max(1, valueSize/8))
+				require.NoError(writer.PutWithPrev(k[:], nil, v, prev[keyNum], prevStep[keyNum]))
+				prev[keyNum] = v
+			}
+			prevStep[keyNum] = txNum / d.aggregationStep
+		}
+	}
+	require.NoError(writer.Flush(ctx, tx))
+	writer.close()
+	dc.Close()
+	require.NoError(tx.Commit())
+}
+
+func TestDomain_StateAt(t *testing.T) {
+	t.Parallel()
+
+	logger, require := log.New(), require.New(t)
+	ctx := context.Background()
+	db, d := testDbAndDomain(t, logger)
+	const keyCount, txCount = 20, 200
+	fillDomainWithDeletions(t, db, d, keyCount, txCount, 8)
+	collateAndMerge(t, db, nil, d, txCount)
+
+	roTx, err := db.BeginRo(ctx)
+	require.NoError(err)
+	defer roTx.Rollback()
+	dc := d.BeginFilesRo()
+	defer dc.Close()
+	require.Less(dc.files.EndTxNum(), uint64(txCount))
+
+	for _, txNum := range []uint64{1, 37, 46, 100, dc.files.EndTxNum() + 1, 190, txCount + 1} {
+		label := fmt.Sprintf("txNum=%d", txNum)
+
+		var expect []string
+		var k [8]byte
+		for keyNum := uint64(1); keyNum < keyCount; keyNum++ {
+			binary.BigEndian.PutUint64(k[:], keyNum)
+			v, _, err := dc.GetAsOf(k[:], txNum, roTx)
+			require.NoError(err, label)
+			if len(v) > 0 {
+				expect = append(expect, fmt.Sprintf("%x=%x", k, v))
+			}
+		}
+
+		it, err := dc.StateAt(ctx, txNum, roTx)
+		require.NoError(err, label)
+		var got []string
+		for it.HasNext() {
+			k, v, err := it.Next()
+			require.NoError(err, label)
+			got = append(got, fmt.Sprintf("%x=%x", k, v))
+		}
+		it.Close()
+		require.Equal(expect, got, label)
+	}
+
+	// key 5 is deleted at txNum 15 and written again at 20
+	it, err := dc.StateAt(ctx, 16, roTx)
+	require.NoError(err)
+	keys, _, err := stream.ToArrayKV(it)
+	require.NoError(err)
+	require.NotContains(keys, hexutility.EncodeTs(5))
+	require.Contains(keys, hexutility.EncodeTs(4))
+}
+
+func TestDomain_HasAsOf(t *testing.T) {
+	t.Parallel()
+
+	logger, require := log.New(), require.New(t)
+	db, d := testDbAndDomain(t, logger)
+	const keyCount, txCount = 20, 200
+	fillDomainWithDeletions(t, db, d, keyCount, txCount, 8)
+	collateAndMerge(t, db, nil, d, txCount)
+
+	roTx, err := db.BeginRo(context.Background())
+	require.NoError(err)
+	defer roTx.Rollback()
+	dc := d.BeginFilesRo()
+	defer dc.Close()
+
+	var k [8]byte
+	for txNum := uint64(1); txNum <= txCount+1; txNum++ {
+		for keyNum := uint64(0); keyNum <= keyCount; keyNum++ {
+			binary.BigEndian.PutUint64(k[:], keyNum)
+			v, _, err := dc.GetAsOf(k[:], txNum, roTx)
+			require.NoError(err)
+			has, err := dc.HasAsOf(k[:], txNum, roTx)
+			require.NoError(err)
+			require.Equal(len(v) > 0, has, "txNum=%d, key=%d", txNum, keyNum)
+		}
+	}
+
+	// key 5 is deleted at txNum 15 and written again at 20
+	has, err := dc.HasAsOf(hexutility.EncodeTs(5), 16, roTx)
+	require.NoError(err)
+	require.False(has)
+	has, err = dc.HasAsOf(hexutility.EncodeTs(5), 21, roTx)
+	require.NoError(err)
+	require.True(has)
+}
+
+func TestDomain_GetAsOfPruned(t *testing.T) {
+	t.Parallel()
+
+	logger, require := log.New(), require.New(t)
+	db, d := testDbAndDomain(t, logger)
+	const keyCount, txCount = 20, 200
+	fillDomainWithDeletions(t, db, d, keyCount, txCount, 8)
+	collateAndMerge(t, db, nil, d, txCount)
+
+	// prune early steps: drop first history and index files
+	for _, dirtyFiles := range []*btree2.BTreeG[*filesItem]{d.History.dirtyFiles, d.History.InvertedIndex.dirtyFiles} {
+		var early []*filesItem
+		dirtyFiles.Walk(func(items []*filesItem) bool {
+			for _, item := range items {
+				if item.startTxNum == 0 {
+					early = append(early, item)
+				}
+			}
+			return true
+		})
+		require.NotEmpty(early)
+		for _, item := range early {
+			dirtyFiles.Delete(item)
+			item.closeFiles()
+		}
+	}
+	d.reCalcVisibleFiles(d.dirtyFilesEndTxNumMinimax())
+
+	roTx, err := db.BeginRo(context.Background())
+	require.NoError(err)
+	defer roTx.Rollback()
+	dc := d.BeginFilesRo()
+	defer dc.Close()
+	earliest := dc.ht.files[0].startTxNum
+	require.NotZero(earliest)
+
+	k := hexutility.EncodeTs(5)
+	_, _, err = dc.GetAsOf(k, earliest-1, roTx)
+	require.ErrorIs(err, ErrTxNumPruned)
+	var prunedErr *TxNumPrunedError
+	require.ErrorAs(err, &prunedErr)
+	require.Equal(earliest, prunedErr.EarliestTxNum)
+	_, err = dc.HasAsOf(k, 1, roTx)
+	require.ErrorIs(err, ErrTxNumPruned)
+	_, err = dc.GetAsOfBatch([][]byte{k}, 1, roTx)
+	require.ErrorIs(err, ErrTxNumPruned)
+
+	_, _, err = dc.GetAsOf(k, earliest, roTx)
+	require.NoError(err)
+}
+
+func TestDomain_LookupHistogram(t *testing.T) { // not parallel: changes TrackLookupHistogram
+	defer func(was bool) { TrackLookupHistogram = was }(TrackLookupHistogram)
+
+	logger, require := log.New(), require.New(t)
+	db, d := testDbAndDomain(t, logger)
+	const keyCount, txCount = 20, 200
+	fillDomainWithDeletions(t, db, d, keyCount, txCount, 8)
+	collateAndMerge(t, db, nil, d, txCount)
+
+	roTx, err := db.BeginRo(context.Background())
+	require.NoError(err)
+	defer roTx.Rollback()
+	dc := d.BeginFilesRo()
+	defer dc.Close()
+	require.Greater(len(dc.ht.iit.files), 1)
+
+	lookups := func() (n int) {
+		for txNum := uint64(1); txNum <= txCount; txNum++ {
+			for keyNum := uint64(0); keyNum <= keyCount; keyNum++ {
+				_, _, err := dc.GetAsOf(hexutility.EncodeTs(keyNum), txNum, roTx)
+				require.NoError(err)
+				n++
+			}
+		}
+		return n
+	}
+	sum := func(histogram []uint64) (res uint64) {
+		for _, v := range histogram {
+			res += v
+		}
+		return res
+	}
+
+	TrackLookupHistogram = false
+	lookups()
+	require.Zero(sum(dc.LookupHistogram()))
+
+	TrackLookupHistogram = true
+	n := lookups()
+	histogram := dc.LookupHistogram()
+	require.Len(histogram, lookupHistogramBuckets)
+	require.Equal(uint64(n), sum(histogram))
+	require.Positive(histogram[1], "lookups which read 1 file") // found in first file of history
+	var multiFile uint64
+	for _, v := range histogram[2:] {
+		multiFile += v
+	}
+	require.Positive(multiFile, "lookups which read 2+ files")
+}
+
+func TestDomain_RecsplitParams(t *testing.T) {
+	t.Parallel()
+
+	const keyCount, txCount = 20, 200
+	readAll := func(t *testing.T, accessor recsplitCfg) (res [][]byte) {
+		t.Helper()
+		logger, require := log.New(), require.New(t)
+		db, d := testDbAndDomain(t, logger)
+		d.accessor = accessor
+		fillDomainWithDeletions(t, db, d, keyCount, txCount, 8)
+		collateAndMerge(t, db, nil, d, txCount)
+
+		// parameters are recorded in accessors
+		for _, dirtyFiles := range []*btree2.BTreeG[*filesItem]{d.History.dirtyFiles, d.History.InvertedIndex.dirtyFiles} {
+			require.Positive(dirtyFiles.Len())
+			dirtyFiles.Walk(func(items []*filesItem) bool {
+				for _, item := range items {
+					require.Equal(accessor.bucketSize, item.index.BucketSize(), item.index.FileName())
+					require.Equal(accessor.leafSize, item.index.LeafSize(), item.index.FileName())
+				}
+				return true
+			})
+		}
+
+		roTx, err := db.BeginRo(context.Background())
+		require.NoError(err)
+		defer roTx.Rollback()
+		dc := d.BeginFilesRo()
+		defer dc.Close()
+		for txNum := uint64(1); txNum <= txCount; txNum++ {
+			for keyNum := uint64(0); keyNum <= keyCount; keyNum++ {
+				v, _, err := dc.GetAsOf(hexutility.EncodeTs(keyNum), txNum, roTx)
+				require.NoError(err)
+				res = append(res, common.Copy(v))
+			}
+		}
+		return res
+	}
+
+	var byDefault, tuned [][]byte
+	t.Run("default", func(t *testing.T) { byDefault = readAll(t, defaultRecsplitCfg) })
+	t.Run("small buckets", func(t *testing.T) { tuned = readAll(t, recsplitCfg{bucketSize: 16, leafSize: 4}) })
+	require.NotEmpty(t, byDefault)
+	require.Equal(t, byDefault, tuned)
+
+	require.Error(t, recsplitCfg{bucketSize: 2000, leafSize: recsplit.MaxLeafSize + 1}.validate())
+	require.Error(t, recsplitCfg{bucketSize: math.MaxUint16 + 1, leafSize: 8}.validate())
+}
+
+func BenchmarkDomain_HasAsOf(b *testing.B) {
+	logger := log.New()
+	db, d := testDbAndDomainOfStep(b, 16, logger)
+	d.compression = seg.CompressVals
+	const keyCount, txCount = 32, 512
+	fillDomainWithDeletions(b, db, d, keyCount, txCount, 1024)
+	collateAndMerge(b, db, nil, d, txCount)
+
+	roTx, err := db.BeginRo(context.Background())
+	require.NoError(b, err)
+	defer roTx.Rollback()
+	keys := make([][]byte, keyCount)
+	for i := range keys {
+		keys[i] = hexutility.EncodeTs(uint64(i))
+	}
+	txNum := func(i int) uint64 { return uint64(i)%txCount + 1 }
+
+	b.Run("GetAsOf", func(b *testing.B) {
+		dc := d.BeginFilesRo()
+		defer dc.Close()
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			for _, k := range keys {
+				_, _, err := dc.GetAsOf(k, txNum(i), roTx)
+				require.NoError(b, err)
+			}
+		}
+	})
+	b.Run("HasAsOf", func(b *testing.B) {
+		dc := d.BeginFilesRo()
+		defer dc.Close()
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			for _, k := range keys {
+				_, err := dc.HasAsOf(k, txNum(i), roTx)
+				require.NoError(b, err)
+			}
+		}
+	})
+}
+
+func BenchmarkDomain_GetAsOfDataFileAccess(b *testing.B) {
+	logger := log.New()
+	keyCount, txCount := uint64(1000), uint64(512)
+	db, dom, _ := filledDomainFixedSize(b, keyCount, txCount, 16, logger)
+	collateAndMerge(b, db, nil, dom, txCount)
+
+	roTx, err := db.BeginRo(context.Background())
+	require.NoError(b, err)
+	defer roTx.Rollback()
+
+	rnd := rand.New(rand.NewSource(1))
+	keys := make([][]byte, keyCount)
+	for i := range keys {
+		keys[i] = make([]byte, 8)
+		binary.BigEndian.PutUint64(keys[i], rnd.Uint64()%keyCount)
+	}
+	txNum := func(i int) uint64 { return uint64(i*7)%(txCount/2) + 1 }
+
+	for _, access := range []seg.FileAccess{seg.AccessMmap, seg.AccessPread} {
+		b.Run(access.String(), func(b *testing.B) {
+			dom.Close()
+			dom.dataAccess = access
+			require.NoError(b, dom.openFolder())
+			dom.reCalcVisibleFiles(dom.dirtyFilesEndTxNumMinimax())
+			dc := dom.BeginFilesRo()
+			defer dc.Close()
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				_, _, err := dc.GetAsOf(keys[i%len(keys)], txNum(i), roTx)
+				require.NoError(b, err)
+			}
+		})
+	}
+}
+
+func TestDomain_GetAsOfBatch(t *testing.T) {
+	t.Parallel()
+
+	logger := log.New()
+	keyCount, txCount := uint64(64), uint64(256)
+	db, dom, _ := filledDomainFixedSize(t, keyCount, txCount, 16, logger)
+	collateAndMerge(t, db, nil, dom, txCount)
+
+	roTx, err := db.BeginRo(context.Background())
+	require.NoError(t, err)
+	defer roTx.Rollback()
+	dc := dom.BeginFilesRo()
+	defer dc.Close()
+
+	// unsorted, with duplicates and with key which never existed
+	var keys [][]byte
+	for _, keyNum := range []uint64{7, 2, 15, 3, 2, keyCount + 1, 0, 9, 7, 63, 40} {
+		var k [8]byte
+		binary.BigEndian.PutUint64(k[:], keyNum)
+		keys = append(keys, k[:])
+	}
+	for txNum := uint64(1); txNum <= txCount; txNum += 5 {
+		res, err := dc.GetAsOfBatch(keys, txNum, roTx)
+		require.NoError(t, err)
+		require.Len(t, res, len(keys))
+		for i, k := range keys {
+			v, _, err := dc.GetAsOf(k, txNum, roTx)
+			require.NoError(t, err)
+			require.Equal(t, v, res[i], "txNum=%d, key=%x", txNum, k)
+
+			// small batch: lookups by accessor instead of files scan
+			single, err := dc.GetAsOfBatch(keys[i:i+1], txNum, roTx)
+			require.NoError(t, err)
+			require.Equal(t, v, single[0], "txNum=%d, key=%x", txNum, k)
+		}
 	}
 }
 
-func TestDomain_MergeFiles(t *testing.T) {
-	t.Parallel()
-
+func BenchmarkDomain_GetAsOfBatch(b *testing.B) {
 	logger := log.New()
-	db, d, txs := filledDomain(t, logger)
-	rwTx, err := db.BeginRw(context.Background())
-	require.NoError(t, err)
+	keyCount, txCount := uint64(1000), uint64(512)
+	db, dom, _ := filledDomainFixedSize(b, keyCount, txCount, 16, logger)
+	collateAndMerge(b, db, nil, dom, txCount)
 
-	collateAndMerge(t, db, rwTx, d, txs)
-	err = rwTx.Commit()
-	require.NoError(t, err)
-	checkHistory(t, db, d, txs)
+	roTx, err := db.BeginRo(context.Background())
+	require.NoError(b, err)
+	defer roTx.Rollback()
+
+	keys := make([][]byte, keyCount)
+	for i, keyNum := range rand.New(rand.NewSource(1)).Perm(int(keyCount)) {
+		keys[i] = make([]byte, 8)
+		binary.BigEndian.PutUint64(keys[i], uint64(keyNum))
+	}
+	// different txNum on each iteration: to not measure IISeekInFilesCache hits
+	txNum := func(i int) uint64 { return uint64(i)%(txCount/2) + 1 }
+
+	b.Run("GetAsOf", func(b *testing.B) {
+		dc := dom.BeginFilesRo()
+		defer dc.Close()
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			for _, k := range keys {
+				_, _, err := dc.GetAsOf(k, txNum(i), roTx)
+				require.NoError(b, err)
+			}
+		}
+	})
+	b.Run("GetAsOfBatch", func(b *testing.B) {
+		dc := dom.BeginFilesRo()
+		defer dc.Close()
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			_, err := dc.GetAsOfBatch(keys, txNum(i), roTx)
+			require.NoError(b, err)
+		}
+	})
 }
 
-func TestDomain_ScanFiles(t *testing.T) {
+func TestDomain_KeepRecentUncompressedSteps(t *testing.T) {
 	t.Parallel()
 
-	logger := log.New()
+	logger, require := log.New(), require.New(t)
 	db, d, txs := filledDomain(t, logger)
-	collateAndMerge(t, db, nil, d, txs)
-	// Recreate domain and re-scan the files
-	dc := d.BeginFilesRo()
-	defer dc.Close()
-	d.closeWhatNotInList([]string{})
-	require.NoError(t, d.openFolder())
+	d.compression, d.keepRecentUncompressedSteps = seg.CompressKeys|seg.CompressVals, 2
+
+	step := d.aggregationStep
+	require.Equal(d.compressCfg, d.compressCfgOfRange(0, 4*step))
+	require.Equal(d.compressCfg, d.compressCfgOfRange(step, 4*step))
+	for _, fromTxNum := range []uint64{2 * step, 3 * step} {
+		cfg := d.compressCfgOfRange(fromTxNum, 4*step)
+		require.Equal(uint64(math.MaxUint64), cfg.MinPatternScore)
+		require.Equal(d.compressCfg.MaxPatternLen, cfg.MaxPatternLen)
+	}
 
-	// Check the history
+	// mixed set of files with and without dictionary is read as usual
+	collateAndMerge(t, db, nil, d, txs)
 	checkHistory(t, db, d, txs)
 }
 
-func TestDomain_Delete(t *testing.T) {
-	t.Parallel()
-
+func BenchmarkDomain_KeepRecentUncompressedSteps(b *testing.B) {
 	logger := log.New()
-	db, d := testDbAndDomain(t, logger)
-	ctx, require := context.Background(), require.New(t)
-	tx, err := db.BeginRw(ctx)
-	require.NoError(err)
-	defer tx.Rollback()
-	dc := d.BeginFilesRo()
-	defer dc.Close()
-	writer := dc.NewWriter()
-	defer writer.close()
+	ctx := context.Background()
+	const keyCount, txCount, aggStep = 256, 512, 16
 
-	// Put on even txNum, delete on odd txNum
-	for txNum := uint64(0); txNum < uint64(1000); txNum++ {
-		writer.SetTxNum(txNum)
-		original, originalStep, _, err := dc.GetLatest([]byte("key1"), nil, tx)
-		require.NoError(err)
-		if txNum%2 == 0 {
-			err = writer.PutWithPrev([]byte("key1"), nil, []byte("value1"), original, originalStep)
-		} else {
-			err = writer.DeleteWithPrev([]byte("key1"), nil, original, originalStep)
+	fill := func(db kv.RwDB, d *Domain) {
+		tx, err := db.BeginRw(ctx)
+		require.NoError(b, err)
+		defer tx.Rollback()
+		dc := d.BeginFilesRo()
+		defer dc.Close()
+		writer := dc.NewWriter()
+		defer writer.close()
+
+		prev := map[uint64][]byte{}
+		var k [8]byte
+		for txNum := uint64(1); txNum <= txCount; txNum++ {
+			writer.SetTxNum(txNum)
+			for keyNum := txNum % 8; keyNum < keyCount; keyNum += 8 {
+				binary.BigEndian.PutUint64(k[:], keyNum)
+				// compressible values: repeated key and txNum
+				v := bytes.Repeat(append(common.Copy(k[:]), hexutility.EncodeTs(txNum)...), 8)
+				require.NoError(b, writer.PutWithPrev(k[:], nil, v, prev[keyNum], 0))
+				prev[keyNum] = v
+			}
 		}
-		require.NoError(err)
+		require.NoError(b, writer.Flush(ctx, tx))
+		require.NoError(b, tx.Commit())
 	}
-	err = writer.Flush(ctx, tx)
-	require.NoError(err)
-	collateAndMerge(t, db, tx, d, 1000)
-	dc.Close()
 
-	// Check the history
-	dc = d.BeginFilesRo()
-	defer dc.Close()
-	for txNum := uint64(0); txNum < 1000; txNum++ {
-		label := fmt.Sprintf("txNum=%d", txNum)
-		//val, ok, err := dc.GetLatestBeforeTxNum([]byte("key1"), txNum+1, tx)
-		//require.NoError(err)
-		//require.True(ok)
-		//if txNum%2 == 0 {
-		//	require.Equal([]byte("value1"), val, label)
-		//} else {
-		//	require.Nil(val, label)
-		//}
-		//if txNum == 976 {
-		val, _, err := dc.GetAsOf([]byte("key2"), txNum+1, tx)
-		require.NoError(err)
-		//require.False(ok, label)
-		require.Nil(val, label)
-		//}
+	for _, keep := range []uint64{0, 2} {
+		b.Run(fmt.Sprintf("keep=%d", keep), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				db, d := testDbAndDomainOfStep(b, aggStep, logger)
+				d.compression, d.keepRecentUncompressedSteps = seg.CompressVals, keep
+				d.compressCfg = seg.DefaultCfg
+				d.compressCfg.MinPatternScore = 8 // small dataset: patterns must be found to build dictionary
+				fill(db, d)
+				b.StartTimer()
+
+				collateAndMerge(b, db, nil, d, txCount)
+			}
+		})
 	}
 }
 
-// firstly we write all the data to domain
-// then we collate-merge-prune
-// then check.
-// in real life we periodically do collate-merge-prune without stopping adding data
-func TestDomain_Prune_AfterAllWrites(t *testing.T) {
+func TestDomain_DeleteKeyHistory(t *testing.T) {
 	t.Parallel()
 
-	logger := log.New()
-	keyCount, txCount := uint64(4), uint64(64)
-	db, dom, data := filledDomainFixedSize(t, keyCount, txCount, 16, logger)
+	logger, require := log.New(), require.New(t)
+	ctx := context.Background()
+	keyCount, txCount := uint64(8), uint64(256)
+	db, dom, _ := filledDomainFixedSize(t, keyCount, txCount, 16, logger)
 	collateAndMerge(t, db, nil, dom, txCount)
-	maxFrozenFiles := (txCount / dom.aggregationStep) / StepsInColdFile
 
-	ctx := context.Background()
 	roTx, err := db.BeginRo(ctx)
-	require.NoError(t, err)
+	require.NoError(err)
 	defer roTx.Rollback()
 
-	// Check the history
+	key := func(keyNum uint64) []byte {
+		var k [8]byte
+		binary.BigEndian.PutUint64(k[:], keyNum)
+		return k[:]
+	}
+	expect := map[uint64][][]byte{}
 	dc := dom.BeginFilesRo()
-	defer dc.Close()
-	var k, v [8]byte
+	for keyNum := uint64(0); keyNum < keyCount; keyNum++ {
+		for txNum := uint64(0); txNum <= txCount; txNum++ {
+			v, _, err := dc.GetAsOf(key(keyNum), txNum, roTx)
+			require.NoError(err)
+			expect[keyNum] = append(expect[keyNum], common.Copy(v))
+		}
+	}
 
-	for txNum := uint64(1); txNum <= txCount; txNum++ {
-		for keyNum := uint64(0); keyNum < keyCount; keyNum++ {
-			step := txNum / dom.aggregationStep
-			frozenFileNum := step / 32
-			if frozenFileNum < maxFrozenFiles { // frozen data
-				if keyNum != frozenFileNum {
-					continue
-				}
-				continue
-				//fmt.Printf("put frozen: %d, step=%d, %d\n", keyNum, step, frozenFileNum)
-			} else { //warm data
-				if keyNum == 0 || keyNum == 1 {
-					continue
-				}
-				if keyNum == txNum%dom.aggregationStep {
-					continue
-				}
-				//fmt.Printf("put: %d, step=%d\n", keyNum, step)
-			}
+	var torrents, dataFiles []string
+	for _, item := range dc.files {
+		torrents = append(torrents, item.src.decompressor.FilePath()+".torrent")
+		dataFiles = append(dataFiles, item.src.decompressor.FilePath())
+	}
+	for _, item := range dc.ht.files {
+		torrents = append(torrents, item.src.decompressor.FilePath()+".torrent")
+		dataFiles = append(dataFiles, item.src.decompressor.FilePath())
+	}
+	for _, item := range dc.ht.iit.files {
+		torrents = append(torrents, item.src.decompressor.FilePath()+".torrent", item.src.index.FilePath()+".torrent")
+		dataFiles = append(dataFiles, item.src.decompressor.FilePath())
+	}
+	for _, fPath := range torrents {
+		require.NoError(os.WriteFile(fPath, nil, 0644))
+	}
 
-			label := fmt.Sprintf("txNum=%d, keyNum=%d\n", txNum, keyNum)
-			binary.BigEndian.PutUint64(k[:], keyNum)
-			binary.BigEndian.PutUint64(v[:], txNum)
+	deleted := key(5)
+	_, found, _, _, err := dc.getFromFiles(deleted)
+	require.NoError(err)
+	require.True(found)
 
-			val, _, err := dc.GetAsOf(k[:], txNum+1, roTx)
-			// during generation such keys are skipped so value should be nil for this call
-			require.NoError(t, err, label)
-			if !data[keyNum][txNum] {
-				if txNum > 1 {
-					binary.BigEndian.PutUint64(v[:], txNum-1)
-				} else {
-					require.Nil(t, val, label)
-					continue
-				}
-			}
-			require.EqualValues(t, v[:], val)
-		}
+	// commitment references keys of files by offsets
+	dom.restrictSubsetFileDeletions = true
+	_, err = dc.DeleteKeyHistory(ctx, deleted)
+	require.ErrorContains(err, "commitment")
+	dom.restrictSubsetFileDeletions = false
+
+	removed, err := dc.DeleteKeyHistory(ctx, deleted)
+	require.NoError(err)
+	require.Positive(removed)
+	dc.Close()
+	for _, fPath := range torrents {
+		require.NoFileExists(fPath)
+	}
+	for _, fPath := range dataFiles { // re-written in place: checksum of new data
+		require.FileExists(fPath + checksumFileExt)
+		require.NoError(verifyChecksum(fPath))
 	}
 
-	//warm keys
-	binary.BigEndian.PutUint64(v[:], txCount)
-	for keyNum := uint64(2); keyNum < keyCount; keyNum++ {
-		label := fmt.Sprintf("txNum=%d, keyNum=%d\n", txCount-1, keyNum)
-		binary.BigEndian.PutUint64(k[:], keyNum)
+	// re-open all files: Domain, History and InvertedIndex
+	dom.Close()
+	require.NoError(dom.openFolder())
+	g := &errgroup.Group{}
+	dom.BuildMissedAccessors(ctx, g, background.NewProgressSet())
+	require.NoError(g.Wait())
+	require.NoError(dom.openFolder())
+	dom.reCalcVisibleFiles(dom.dirtyFilesEndTxNumMinimax())
 
-		storedV, _, found, err := dc.GetLatest(k[:], nil, roTx)
-		require.Truef(t, found, label)
-		require.NoError(t, err, label)
-		require.EqualValues(t, v[:], storedV, label)
+	dc = dom.BeginFilesRo()
+	defer dc.Close()
+	_, found, _, _, err = dc.getFromFiles(deleted)
+	require.NoError(err)
+	require.False(found)
+	for txNum := uint64(0); txNum < dc.ht.files.EndTxNum(); txNum++ {
+		_, found, err := dc.ht.historySeekInFiles(deleted, txNum)
+		require.NoError(err)
+		require.False(found, txNum)
+	}
+	for keyNum := uint64(0); keyNum < keyCount; keyNum++ {
+		if keyNum == 5 {
+			continue
+		}
+		for txNum := uint64(0); txNum <= txCount; txNum++ {
+			v, _, err := dc.GetAsOf(key(keyNum), txNum, roTx)
+			require.NoError(err)
+			require.Equal(expect[keyNum][txNum], v, "keyNum=%d, txNum=%d", keyNum, txNum)
+		}
 	}
+
+	removed, err = dc.DeleteKeyHistory(ctx, deleted)
+	require.NoError(err)
+	require.Zero(removed)
 }
 
 func TestDomain_PruneOnWrite(t *testing.T) {
@@ -1092,7 +2727,6 @@ func TestDomainContext_getFromFiles(t *testing.T) {
 	}
 	err = writer.Flush(context.Background(), tx)
 	require.NoError(t, err)
-	defer dc.Close()
 
 	ctx := context.Background()
 	ps := background.NewProgressSet()
@@ -1120,7 +2754,8 @@ func TestDomainContext_getFromFiles(t *testing.T) {
 		require.NoError(t, err)
 
 		ranges := dc.findMergeRange(txFrom, txTo)
-		vl, il, hl := dc.staticFilesInRange(ranges)
+		vl, il, hl, err := dc.staticFilesInRange(ranges)
+		require.NoError(t, err)
 
 		dv, di, dh, err := dc.mergeFiles(ctx, vl, il, hl, ranges, nil, ps)
 		require.NoError(t, err)
@@ -1155,7 +2790,108 @@ type upd struct {
 	value []byte
 }
 
-func filledDomainFixedSize(t *testing.T, keysCount, txCount, aggStep uint64, logger log.Logger) (kv.RwDB, *Domain, map[uint64][]bool) {
+func TestDomain_BeginFilesRoAt(t *testing.T) {
+	t.Parallel()
+
+	logger, require := log.New(), require.New(t)
+	logEvery := time.NewTicker(30 * time.Second)
+	defer logEvery.Stop()
+	ctx := context.Background()
+	db, d, _ := filledDomain(t, logger)
+	tx, err := db.BeginRw(ctx)
+	require.NoError(err)
+	defer tx.Rollback()
+
+	steps := uint64(4)
+	for step := uint64(0); step < steps; step++ {
+		c, err := d.collate(ctx, step, step*d.aggregationStep, (step+1)*d.aggregationStep, tx)
+		require.NoError(err)
+		sf, err := d.buildFiles(ctx, step, c, background.NewProgressSet())
+		require.NoError(err)
+		d.integrateDirtyFiles(sf, step*d.aggregationStep, (step+1)*d.aggregationStep)
+		d.reCalcVisibleFiles(d.dirtyFilesEndTxNumMinimax())
+
+		dc := d.BeginFilesRo()
+		_, err = dc.Prune(ctx, tx, step, step*d.aggregationStep, (step+1)*d.aggregationStep, math.MaxUint64, logEvery)
+		dc.Close()
+		require.NoError(err)
+	}
+
+	partial := d.BeginFilesRoAt(2*d.aggregationStep + 1)
+	require.Len(partial.files, 2)
+	require.Len(partial.ht.files, 2)
+	require.Len(partial.ht.iit.files, 2)
+	partial.Close()
+
+	pinnedTo := steps * d.aggregationStep
+	pinned := d.BeginFilesRoAt(pinnedTo)
+	defer pinned.Close()
+	require.Len(pinned.files, int(steps))
+	var pinnedFiles []string
+	for _, item := range pinned.files {
+		pinnedFiles = append(pinnedFiles, item.src.decompressor.FilePath())
+	}
+	for _, item := range pinned.ht.files {
+		pinnedFiles = append(pinnedFiles, item.src.decompressor.FilePath())
+	}
+	for _, item := range pinned.ht.iit.files {
+		pinnedFiles = append(pinnedFiles, item.src.decompressor.FilePath())
+	}
+
+	maxSpan := d.aggregationStep * StepsInColdFile
+	for {
+		dc := d.BeginFilesRo()
+		r := dc.findMergeRange(dc.files.EndTxNum(), maxSpan)
+		if !r.any() {
+			dc.Close()
+			break
+		}
+		valuesOuts, indexOuts, historyOuts, err := dc.staticFilesInRange(r)
+		require.NoError(err)
+		valuesIn, indexIn, historyIn, err := dc.mergeFiles(ctx, valuesOuts, indexOuts, historyOuts, r, nil, background.NewProgressSet())
+		require.NoError(err)
+		d.integrateMergedDirtyFiles(valuesOuts, indexOuts, historyOuts, valuesIn, indexIn, historyIn)
+		d.reCalcVisibleFiles(d.dirtyFilesEndTxNumMinimax())
+		dc.Close()
+
+		dc = d.BeginFilesRo()
+		dc.cleanAfterMerge(valuesIn, historyIn, indexIn)
+		dc.Close()
+	}
+	dc := d.BeginFilesRo()
+	require.Len(dc.files, 1)
+	dc.Close()
+
+	// pinned files are not removed by merge and still serve pre-merge data
+	for _, fPath := range pinnedFiles {
+		_, err := os.Stat(fPath)
+		require.NoError(err, fPath)
+	}
+	for txNum := uint64(0); txNum < pinnedTo-1; txNum++ {
+		for keyNum := uint64(1); keyNum <= uint64(31); keyNum++ {
+			var k, v [8]byte
+			binary.BigEndian.PutUint64(k[:], keyNum)
+			binary.BigEndian.PutUint64(v[:], txNum/keyNum)
+			label := fmt.Sprintf("txNum=%d, keyNum=%d", txNum, keyNum)
+			val, _, err := pinned.GetAsOf(k[:], txNum+1, tx)
+			require.NoError(err, label)
+			if txNum >= keyNum {
+				require.Equal(v[:], val, label)
+			} else {
+				require.Nil(val, label)
+			}
+		}
+	}
+
+	// last reader removes merged files
+	pinned.Close()
+	for _, fPath := range pinnedFiles {
+		_, err := os.Stat(fPath)
+		require.ErrorIs(err, fs.ErrNotExist, fPath)
+	}
+}
+
+func filledDomainFixedSize(t testing.TB, keysCount, txCount, aggStep uint64, logger log.Logger) (kv.RwDB, *Domain, map[uint64][]bool) {
 	t.Helper()
 	db, d := testDbAndDomainOfStep(t, aggStep, logger)
 	ctx := context.Background()
@@ -1441,7 +3177,6 @@ func TestDomain_CanPruneAfterAggregation(t *testing.T) {
 	d.filenameBase = kv.FileCommitmentDomain
 
 	dc := d.BeginFilesRo()
-	defer dc.Close()
 	writer := dc.NewWriter()
 	defer writer.close()
 
@@ -1853,7 +3588,6 @@ func TestDomain_Unwind(t *testing.T) {
 		defer tx.Rollback()
 
 		dc := d.BeginFilesRo()
-		defer dc.Close()
 		writer := dc.NewWriter()
 		defer writer.close()
 
@@ -1990,6 +3724,8 @@ func TestDomain_Unwind(t *testing.T) {
 
 func compareIterators(t *testing.T, et, ut stream.KV) {
 	t.Helper()
+	defer et.Close()
+	defer ut.Close()
 
 	/* uncomment when mismatches amount of keys in expectedIter and unwindedIter*/
 	//i := 0
@@ -2025,6 +3761,8 @@ func compareIterators(t *testing.T, et, ut stream.KV) {
 }
 func compareIteratorsS(t *testing.T, et, ut stream.KVS) {
 	t.Helper()
+	defer et.Close()
+	defer ut.Close()
 	for {
 		ek, ev, estep, err1 := et.Next()
 		uk, uv, ustep, err2 := ut.Next()
@@ -0,0 +1,234 @@
+// Copyright 2024 The Erigon Authors
+// This file is part of Erigon.
+//
+// Erigon is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Erigon is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with Erigon. If not, see <http://www.gnu.org/licenses/>.
+
+package state
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"strings"
+
+	"github.com/erigontech/erigon-lib/common"
+	"github.com/erigontech/erigon-lib/recsplit/eliasfano32"
+	"github.com/erigontech/erigon-lib/seg"
+)
+
+const verifyMaxMismatches = 10
+
+// VerifyError - problems found by Domain.Verify
+type VerifyError struct {
+	Mismatches []string // first `verifyMaxMismatches` problems
+	Total      int      // amount of all found problems
+}
+
+func (e *VerifyError) Error() string {
+	return fmt.Sprintf("verify: %d mismatches, first %d: %s", e.Total, len(e.Mismatches), strings.Join(e.Mismatches, "; "))
+}
+
+func (e *VerifyError) add(format string, args ...any) {
+	e.Total++
+	if len(e.Mismatches) < verifyMaxMismatches {
+		e.Mismatches = append(e.Mismatches, fmt.Sprintf(format, args...))
+	}
+}
+
+// Verify - cross-checks visible files of Domain, it's History and InvertedIndex:
+//   - every key of history has entry in domain files (if domain files cover history file)
+//   - every txNum of inverted index is in [startTxNum, endTxNum) of it's file
+//   - every key of .ef/.v/.kv resolves to it's own offset by accessors (.efi/.vi/.kvi/.bt) and existence filter has it
+//
+// Returns *VerifyError if found problems.
+func (d *Domain) Verify(ctx context.Context) error {
+	dt := d.BeginFilesRo()
+	defer dt.Close()
+
+	verr := &VerifyError{}
+	if err := dt.verifyDomainFiles(ctx, verr); err != nil {
+		return err
+	}
+	if err := dt.verifyHistoryFiles(ctx, verr); err != nil {
+		return err
+	}
+	if err := dt.ht.iit.verifyFiles(ctx, verr); err != nil {
+		return err
+	}
+	if verr.Total > 0 {
+		return verr
+	}
+	return nil
+}
+
+func (dt *DomainRoTx) verifyDomainFiles(ctx context.Context, verr *VerifyError) error {
+	for i, item := range dt.files {
+		fName := item.src.decompressor.FileName()
+		if err := dt.openFile(i); err != nil {
+			return fmt.Errorf("%s: %w", fName, err)
+		}
+		r := seg.NewReader(item.src.decompressor.MakeGetter(), dt.d.compression)
+		var k []byte
+		var offset uint64
+		for r.HasNext() {
+			k, _ = r.Next(k[:0])
+			nextOffset, _ := r.Skip()
+
+			if item.src.existence != nil {
+				if hi, _ := dt.ht.iit.hashKey(k); !item.src.existence.ContainsHash(hi) {
+					verr.add("%s: key %x not in existence filter", fName, k)
+				}
+			}
+			if item.src.index != nil {
+				idxReader, err := dt.statelessIdxReader(i)
+				if err != nil {
+					return fmt.Errorf("%s: %w", fName, err)
+				}
+				if got, ok := idxReader.Lookup(k); !ok || got != offset {
+					verr.add("%s: key %x accessor offset %d (found=%t) != %d", fName, k, got, ok, offset)
+				}
+			}
+			if item.src.bindex != nil {
+				bt, err := dt.statelessBtree(i)
+				if err != nil {
+					return fmt.Errorf("%s: %w", fName, err)
+				}
+				g, err := dt.statelessGetter(i)
+				if err != nil {
+					return fmt.Errorf("%s: %w", fName, err)
+				}
+				_, _, got, ok, err := bt.Get(k, g)
+				if err != nil {
+					return fmt.Errorf("%s: %w", fName, err)
+				}
+				if !ok || got != offset {
+					verr.add("%s: key %x btree offset %d (found=%t) != %d", fName, k, got, ok, offset)
+				}
+			}
+			offset = nextOffset
+
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			default:
+			}
+		}
+	}
+	return nil
+}
+
+func (dt *DomainRoTx) verifyHistoryFiles(ctx context.Context, verr *VerifyError) error {
+	ht := dt.ht
+	domainEndTxNum := dt.files.EndTxNum()
+	var historyKey []byte
+	var txKey [8]byte
+	for i, item := range ht.files {
+		efItem, ok := ht.h.InvertedIndex.dirtyFiles.Get(&filesItem{startTxNum: item.startTxNum, endTxNum: item.endTxNum})
+		if !ok || efItem.decompressor == nil {
+			verr.add("%s: has no .ef file", item.src.decompressor.FileName())
+			continue
+		}
+		fName := item.src.decompressor.FileName()
+		if err := ht.openFile(i); err != nil {
+			return fmt.Errorf("%s: %w", fName, err)
+		}
+		if err := ht.iit.openFileOf(efItem); err != nil {
+			return fmt.Errorf("%s: %w", efItem.decompressor.FileName(), err)
+		}
+		efReader := seg.NewReader(efItem.decompressor.MakeGetter(), ht.h.InvertedIndex.compression)
+		histReader := seg.NewReader(item.src.decompressor.MakeGetter(), ht.h.compression)
+		idxReader, err := ht.statelessIdxReader(i)
+		if err != nil {
+			return fmt.Errorf("%s: %w", fName, err)
+		}
+
+		var k, v []byte
+		var valOffset uint64
+		for efReader.HasNext() {
+			k, _ = efReader.Next(k[:0])
+			v, _ = efReader.Next(v[:0])
+
+			if item.endTxNum <= domainEndTxNum {
+				if _, found, _, _, err := dt.getFromFiles(k); err != nil {
+					return err
+				} else if !found {
+					verr.add("%s: key %x has no domain entry", fName, k)
+				}
+			}
+
+			ef, _ := eliasfano32.ReadEliasFano(v)
+			efIt := ef.Iterator()
+			for efIt.HasNext() {
+				txNum, err := efIt.Next()
+				if err != nil {
+					return err
+				}
+				if !histReader.HasNext() {
+					verr.add("%s: has less values than %s", fName, efItem.decompressor.FileName())
+					break
+				}
+				binary.BigEndian.PutUint64(txKey[:], txNum)
+				historyKey = append(append(historyKey[:0], txKey[:]...), k...)
+				if got, ok := idxReader.Lookup(historyKey); !ok || got != valOffset {
+					verr.add("%s: key %x txNum %d accessor offset %d (found=%t) != %d", fName, k, txNum, got, ok, valOffset)
+				}
+				valOffset, _ = histReader.Skip()
+			}
+
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			default:
+			}
+		}
+	}
+	return nil
+}
+
+func (iit *InvertedIndexRoTx) verifyFiles(ctx context.Context, verr *VerifyError) error {
+	for i, item := range iit.files {
+		fName := item.src.decompressor.FileName()
+		if err := iit.openFile(i); err != nil {
+			return fmt.Errorf("%s: %w", fName, err)
+		}
+		g := seg.NewReader(item.src.decompressor.MakeGetter(), iit.ii.compression)
+		idxReader, err := iit.statelessIdxReader(i)
+		if err != nil {
+			return fmt.Errorf("%s: %w", fName, err)
+		}
+		var k, v []byte
+		var offset uint64
+		for g.HasNext() {
+			k, _ = g.Next(k[:0])
+			var nextOffset uint64
+			v, nextOffset = g.Next(v[:0])
+
+			if got, ok := idxReader.TwoLayerLookup(k); !ok || got != offset {
+				verr.add("%s: key %x accessor offset %d (found=%t) != %d", fName, k, got, ok, offset)
+			}
+			ef, _ := eliasfano32.ReadEliasFano(v)
+			if ef.Count() > 0 && (ef.Min() < item.startTxNum || ef.Max() >= item.endTxNum) {
+				verr.add("%s: key %x has txNums [%d, %d] out of file range [%d, %d)", fName, common.Shorten(k, 8), ef.Min(), ef.Max(), item.startTxNum, item.endTxNum)
+			}
+			offset = nextOffset
+
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			default:
+			}
+		}
+	}
+	return nil
+}
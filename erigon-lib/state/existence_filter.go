@@ -17,14 +17,15 @@
 package state
 
 import (
+	"errors"
 	"fmt"
 	"hash"
+	"io/fs"
 	"os"
 	"path/filepath"
 
 	bloomfilter "github.com/holiman/bloomfilter/v2"
 
-	"github.com/erigontech/erigon-lib/common/dir"
 	"github.com/erigontech/erigon-lib/log/v3"
 )
 
@@ -122,6 +123,15 @@ func (b *ExistenceFilter) fsync(f *os.File) error {
 }
 
 func OpenExistenceFilter(filePath string) (exFilder *ExistenceFilter, err error) {
+	return openExistenceFilter(filePath, func() (fs.File, error) { return os.Open(filePath) })
+}
+
+// OpenExistenceFilterFS - like OpenExistenceFilter, but file `name` is read from `fsys`
+func OpenExistenceFilterFS(fsys fs.FS, name string) (exFilder *ExistenceFilter, err error) {
+	return openExistenceFilter(name, func() (fs.File, error) { return fsys.Open(name) })
+}
+
+func openExistenceFilter(filePath string, open func() (fs.File, error)) (exFilder *ExistenceFilter, err error) {
 	defer func() {
 		if recover() != nil {
 			err = fmt.Errorf("OpenExistenceFilter: panic, %s", filePath)
@@ -130,29 +140,22 @@ func OpenExistenceFilter(filePath string) (exFilder *ExistenceFilter, err error)
 
 	_, fileName := filepath.Split(filePath)
 	f := &ExistenceFilter{FilePath: filePath, FileName: fileName}
-	exists, err := dir.FileExist(filePath)
+	ff, err := open()
 	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, fmt.Errorf("file doesn't exists: %s", fileName)
+		}
 		return nil, err
 	}
-	if !exists {
-		return nil, fmt.Errorf("file doesn't exists: %s", fileName)
-	}
-	{
-		ff, err := os.Open(filePath)
-		if err != nil {
-			return nil, err
-		}
-		defer ff.Close()
-		stat, err := ff.Stat()
-		if err != nil {
-			return nil, err
-		}
-		f.empty = stat.Size() == 0
+	defer ff.Close()
+	stat, err := ff.Stat()
+	if err != nil {
+		return nil, err
 	}
+	f.empty = stat.Size() == 0
 
 	if !f.empty {
-		var err error
-		f.filter, _, err = bloomfilter.ReadFile(filePath)
+		f.filter, _, err = bloomfilter.ReadFrom(ff)
 		if err != nil {
 			return nil, fmt.Errorf("OpenExistenceFilter: %w, %s", err, fileName)
 		}
@@ -0,0 +1,121 @@
+// Copyright 2024 The Erigon Authors
+// This file is part of Erigon.
+//
+// Erigon is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Erigon is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with Erigon. If not, see <http://www.gnu.org/licenses/>.
+
+package state
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"path/filepath"
+
+	"github.com/erigontech/erigon-lib/common/dir"
+	"github.com/erigontech/erigon-lib/recsplit"
+	"github.com/erigontech/erigon-lib/seg"
+)
+
+// filesFS - where openFolder reads files from: OS filesystem if `fs` is nil (default), otherwise `fs` (embedded,
+// in-memory, remote, ...) with slash-separated names relative to `root` (dirs.Snap). Files opened from `fs` are read
+// into memory if `fs` doesn't return *os.File (no mmap).
+//
+// Only reading goes through `fs`: collation, merge, building of missed accessors and removal of files work with OS
+// filesystem - don't run them for files opened from non-OS `fs`.
+type filesFS struct {
+	fs   fs.FS
+	root string
+}
+
+// name - path of file inside `fs`. Paths which are not under `root` are treated as already relative (FilePath() of
+// files opened from `fs`).
+func (f filesFS) name(fPath string) string {
+	rel, err := filepath.Rel(f.root, fPath)
+	if err != nil {
+		return filepath.ToSlash(fPath)
+	}
+	return filepath.ToSlash(rel)
+}
+
+func (f filesFS) filesFromDir(dirPath string) ([]string, error) {
+	if f.fs == nil {
+		return filesFromDir(dirPath)
+	}
+	allFiles, err := fs.ReadDir(f.fs, f.name(dirPath))
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("filesFromDir: %w, %s", err, dirPath)
+	}
+	return filterFileNames(allFiles), nil
+}
+
+func (f filesFS) exists(fPath string) (bool, error) {
+	if f.fs == nil {
+		return dir.FileExist(fPath)
+	}
+	st, err := fs.Stat(f.fs, f.name(fPath))
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return false, nil
+		}
+		return false, err
+	}
+	return st.Mode().IsRegular(), nil
+}
+
+func (f filesFS) isEmpty(fPath string) bool {
+	if f.fs == nil {
+		return isEmptyFile(fPath)
+	}
+	st, err := fs.Stat(f.fs, f.name(fPath))
+	return err == nil && st.Size() == 0
+}
+
+func (f filesFS) verifyChecksum(fPath string) error {
+	if f.fs == nil {
+		return verifyChecksum(fPath)
+	}
+	return verifyChecksumFS(f.fs, f.name(fPath))
+}
+
+// openDecompressor - `access` is only for OS filesystem: files of `fs` are mmaped (if *os.File) or read into memory
+func (f filesFS) openDecompressor(fPath string, access seg.FileAccess) (*seg.Decompressor, error) {
+	if f.fs == nil {
+		return seg.NewDecompressorWithAccess(fPath, access)
+	}
+	return seg.NewDecompressorFS(f.fs, f.name(fPath))
+}
+
+func (f filesFS) openIndex(fPath string) (*recsplit.Index, error) {
+	if f.fs == nil {
+		return recsplit.OpenIndex(fPath)
+	}
+	return recsplit.OpenIndexFS(f.fs, f.name(fPath))
+}
+
+func (f filesFS) openBtreeIndex(fPath string, M uint64, kv *seg.Decompressor, compress seg.FileCompression) (*BtIndex, error) {
+	if f.fs == nil {
+		return OpenBtreeIndexWithDecompressor(fPath, M, kv, compress)
+	}
+	return OpenBtreeIndexWithDecompressorFS(f.fs, f.name(fPath), M, kv, compress)
+}
+
+func (f filesFS) openExistenceFilter(fPath string) (*ExistenceFilter, error) {
+	if f.fs == nil {
+		return OpenExistenceFilter(fPath)
+	}
+	return OpenExistenceFilterFS(f.fs, f.name(fPath))
+}
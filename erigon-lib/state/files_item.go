@@ -17,7 +17,9 @@
 package state
 
 import (
+	"container/list"
 	"os"
+	"path/filepath"
 	"sync/atomic"
 
 	btree2 "github.com/tidwall/btree"
@@ -57,6 +59,15 @@ type filesItem struct {
 	// file can be deleted in 2 cases: 1. when `refcount == 0 && canDelete == true` 2. on app startup when `file.isSubsetOfFrozenFile()`
 	// other processes (which also reading files, may have same logic)
 	canDelete atomic.Bool
+	replaced  atomic.Bool // files on disk are replaced by other files (maybe with same names): never remove them, only close
+
+	// only if Aggregator.SetOpenFilesLimit: see files_lru.go. Fields are guarded by `lru.mu`
+	lru        atomic.Pointer[filesLRU]
+	lruElem    *list.Element // in lru.idle
+	lruPins    int
+	lruEvicted bool
+
+	fsys filesFS // where files were opened from: reopenFiles uses same one
 }
 
 func newFilesItem(startTxNum, endTxNum, stepSize uint64) *filesItem {
@@ -80,6 +91,9 @@ func filesItemLess(i, j *filesItem) bool {
 }
 
 func (i *filesItem) closeFiles() {
+	if lru := i.lru.Load(); lru != nil {
+		lru.remove(i)
+	}
 	if i.decompressor != nil {
 		i.decompressor.Close()
 		i.decompressor = nil
@@ -103,6 +117,13 @@ func (i *filesItem) closeFiles() {
 }
 
 func (i *filesItem) closeFilesAndRemove() {
+	if lru := i.lru.Load(); lru != nil {
+		lru.remove(i)
+	}
+	if i.replaced.Load() {
+		i.closeFiles()
+		return
+	}
 	if i.decompressor != nil {
 		i.decompressor.Close()
 		// paranoic-mode on: don't delete frozen files
@@ -113,6 +134,9 @@ func (i *filesItem) closeFilesAndRemove() {
 			if err := os.Remove(i.decompressor.FilePath() + ".torrent"); err != nil {
 				log.Trace("remove after close", "err", err, "file", i.decompressor.FileName()+".torrent")
 			}
+			if err := os.Remove(i.decompressor.FilePath() + checksumFileExt); err != nil {
+				log.Trace("remove after close", "err", err, "file", i.decompressor.FileName()+checksumFileExt)
+			}
 		}
 		i.decompressor = nil
 	}
@@ -185,6 +209,51 @@ func deleteMergeFile(dirtyFiles *btree2.BTreeG[*filesItem], outs []*filesItem, f
 	}
 }
 
+// removeFromDisk - unlinks files of item, but doesn't close them: opened (mmaped) files stay readable
+func (i *filesItem) removeFromDisk() {
+	var paths []string
+	if i.decompressor != nil {
+		paths = append(paths, i.decompressor.FilePath(), i.decompressor.FilePath()+".torrent", i.decompressor.FilePath()+checksumFileExt)
+	}
+	if i.index != nil {
+		paths = append(paths, i.index.FilePath(), i.index.FilePath()+".torrent")
+	}
+	if i.bindex != nil {
+		paths = append(paths, i.bindex.FilePath(), i.bindex.FilePath()+".torrent")
+	}
+	if i.bm != nil {
+		paths = append(paths, i.bm.FilePath(), i.bm.FilePath()+".torrent")
+	}
+	if i.existence != nil {
+		paths = append(paths, i.existence.FilePath, i.existence.FilePath+".torrent")
+	}
+	for _, fPath := range paths {
+		if err := os.Remove(fPath); err != nil {
+			log.Trace("remove from disk", "err", err, "file", fPath)
+		}
+	}
+}
+
+// isEmptyFile - zero-length data file is leftover of interrupted write: there is no data for it's steps, and it can't be indexed
+func isEmptyFile(fPath string) bool {
+	st, err := os.Stat(fPath)
+	return err == nil && st.Size() == 0
+}
+
+// removeEmptyFile - removes zero-length file (and it's checksum). true if file was removed
+func removeEmptyFile(fPath string, logger log.Logger) (bool, error) {
+	if !isEmptyFile(fPath) {
+		return false, nil
+	}
+	_, fName := filepath.Split(fPath)
+	logger.Warn("[agg] remove empty file", "f", fName)
+	if err := os.Remove(fPath); err != nil {
+		return false, err
+	}
+	_ = os.Remove(fPath + checksumFileExt)
+	return true, nil
+}
+
 // visibleFile is like filesItem but only for good/visible files (indexed, not overlaped, not marked for deletion, etc...)
 // it's ok to store visibleFile in array
 type visibleFile struct {
@@ -277,6 +346,16 @@ func calcVisibleFiles(files *btree2.BTreeG[*filesItem], l idxList, trace bool, t
 // visibleFiles have no garbage (overlaps, unindexed, etc...)
 type visibleFiles []visibleFile
 
+// visibleFilesTo - prefix of `files` which has endTxNum <= txNum
+func visibleFilesTo(files []visibleFile, txNum uint64) []visibleFile {
+	for i := range files {
+		if files[i].endTxNum > txNum {
+			return files[:i]
+		}
+	}
+	return files
+}
+
 // EndTxNum return txNum which not included in file - it will be first txNum in future file
 func (files visibleFiles) EndTxNum() uint64 {
 	if len(files) == 0 {
@@ -0,0 +1,241 @@
+// Copyright 2024 The Erigon Authors
+// This file is part of Erigon.
+//
+// Erigon is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Erigon is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with Erigon. If not, see <http://www.gnu.org/licenses/>.
+
+package state
+
+import (
+	"container/list"
+	"fmt"
+	"slices"
+	"sync"
+
+	"github.com/erigontech/erigon-lib/recsplit"
+	"github.com/erigontech/erigon-lib/seg"
+)
+
+// filesLRU - bounds amount of opened files (data file with it's accessors) of all Domains/Histories/InvertedIndices of Aggregator.
+// RoTx pins file on first read from it (see filesPins) - pinned file is never closed, until RoTx.Close.
+// Not pinned files are in `idle` list, least-recently-used of them are closed when amount of opened files > limit.
+// Closed file keeps it's objects (names, sizes, counts stay readable) - they are re-opened in place on next pin.
+type filesLRU struct {
+	mu     sync.Mutex
+	limit  int        // 0 - unlimited
+	opened int        // managed files which are open: pinned or idle
+	idle   *list.List // of *filesItem: open and not pinned. front - most recently used
+}
+
+func newFilesLRU(limit int) *filesLRU { return &filesLRU{limit: limit, idle: list.New()} }
+
+func (l *filesLRU) setLimit(limit int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.limit = limit
+	l.evict()
+}
+
+// add - start managing already opened file (by OpenFolder, build or merge)
+func (l *filesLRU) add(item *filesItem) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if item.decompressor == nil || !l.manage(item) {
+		return
+	}
+	item.lruElem = l.idle.PushFront(item)
+	l.evict()
+}
+
+// manage - under `mu`. false if file is already managed
+func (l *filesLRU) manage(item *filesItem) bool {
+	if item.lru.Load() == l {
+		return false
+	}
+	item.lru.Store(l)
+	l.opened++
+	return true
+}
+
+// acquire - re-open file if it was closed by lru, and keep it open until release
+func (l *filesLRU) acquire(item *filesItem, compression seg.FileCompression) error {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if item.decompressor == nil {
+		return fmt.Errorf("filesLRU: acquire of closed file %d-%d", item.startTxNum, item.endTxNum)
+	}
+	l.manage(item)
+	if item.lruEvicted {
+		if err := item.reopenFiles(compression); err != nil {
+			return fmt.Errorf("filesLRU: reopen %s: %w", item.decompressor.FileName(), err)
+		}
+		item.lruEvicted = false
+		l.opened++
+	}
+	if item.lruElem != nil {
+		l.idle.Remove(item.lruElem)
+		item.lruElem = nil
+	}
+	item.lruPins++
+	l.evict()
+	return nil
+}
+
+func (l *filesLRU) release(item *filesItem) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if item.lru.Load() != l { // removed while pinned
+		return
+	}
+	item.lruPins--
+	if item.lruPins == 0 {
+		item.lruElem = l.idle.PushFront(item)
+	}
+	l.evict()
+}
+
+// remove - stop managing file: it's going to be closed by owner
+func (l *filesLRU) remove(item *filesItem) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if item.lru.Load() != l {
+		return
+	}
+	if item.lruElem != nil {
+		l.idle.Remove(item.lruElem)
+		item.lruElem = nil
+	}
+	if !item.lruEvicted {
+		l.opened--
+	}
+	item.lru.Store(nil)
+	item.lruPins, item.lruEvicted = 0, false
+}
+
+// evict - under `mu`
+func (l *filesLRU) evict() {
+	for l.limit > 0 && l.opened > l.limit && l.idle.Len() > 0 {
+		item := l.idle.Remove(l.idle.Back()).(*filesItem)
+		item.lruElem = nil
+		item.closeOpenedFiles()
+		item.lruEvicted = true
+		l.opened--
+	}
+}
+
+func (l *filesLRU) openedCount() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.opened
+}
+
+// closeOpenedFiles - like closeFiles, but keeps objects. Existence filter is in RAM - stays usable.
+func (i *filesItem) closeOpenedFiles() {
+	if i.decompressor != nil {
+		i.decompressor.Close()
+	}
+	i.index.Close()
+	i.bindex.Close()
+}
+
+// reopenFiles - re-opens objects closed by closeOpenedFiles (same paths). Objects are not replaced: readers of files
+// metadata (names, sizes, counts) don't pin files and don't take filesLRU lock.
+func (i *filesItem) reopenFiles(compression seg.FileCompression) (err error) {
+	decompressor, err := i.fsys.openDecompressor(i.decompressor.FilePath(), i.decompressor.Access())
+	if err != nil {
+		return err
+	}
+	var index *recsplit.Index
+	if i.index != nil {
+		if index, err = i.fsys.openIndex(i.index.FilePath()); err != nil {
+			decompressor.Close()
+			return err
+		}
+	}
+	i.decompressor.TakeOpened(decompressor)
+	if i.bindex != nil {
+		bindex, err := i.fsys.openBtreeIndex(i.bindex.FilePath(), DefaultBtreeM, i.decompressor, compression)
+		if err != nil {
+			index.Close()
+			i.decompressor.Close()
+			return err
+		}
+		i.bindex.takeOpened(bindex)
+	}
+	if index != nil {
+		i.index.TakeOpened(index)
+	}
+	return nil
+}
+
+// filesPins - files of RoTx pinned in filesLRU: visible by index in RoTx.files, and not visible ones (dirty files used
+// by merge). Released by RoTx.Close.
+type filesPins struct {
+	visible []bool
+	dirty   []*filesItem
+}
+
+func (p *filesPins) pin(lru *filesLRU, files []visibleFile, i int, compression seg.FileCompression) error {
+	if lru == nil {
+		return nil
+	}
+	if p.visible == nil {
+		p.visible = make([]bool, len(files))
+	}
+	if p.visible[i] {
+		return nil
+	}
+	if err := lru.acquire(files[i].src, compression); err != nil {
+		return err
+	}
+	p.visible[i] = true
+	return nil
+}
+
+// pinItem - pin of `item`: one of `files` or dirty file
+func (p *filesPins) pinItem(lru *filesLRU, files []visibleFile, item *filesItem, compression seg.FileCompression) error {
+	if lru == nil {
+		return nil
+	}
+	for i := range files {
+		if files[i].src == item {
+			return p.pin(lru, files, i, compression)
+		}
+	}
+	if slices.Contains(p.dirty, item) {
+		return nil
+	}
+	if err := lru.acquire(item, compression); err != nil {
+		return err
+	}
+	p.dirty = append(p.dirty, item)
+	return nil
+}
+
+func (p *filesPins) unpinAll(lru *filesLRU, files []visibleFile) {
+	for i, pinned := range p.visible {
+		if pinned {
+			lru.release(files[i].src)
+		}
+	}
+	for _, item := range p.dirty {
+		lru.release(item)
+	}
+	*p = filesPins{}
+}
@@ -125,7 +125,7 @@ func NewHistory(cfg histCfg, aggregationStep uint64, filenameBase, indexKeysTabl
 	h._visibleFiles = []visibleFile{}
 	var err error
 	h.InvertedIndex, err = NewInvertedIndex(cfg.iiCfg, aggregationStep, filenameBase, indexKeysTable, indexTable, func(fromStep, toStep uint64) bool {
-		exists, err := dir.FileExist(h.vFilePath(fromStep, toStep))
+		exists, err := h.filesFS.exists(h.vFilePath(fromStep, toStep))
 		if err != nil {
 			panic(err)
 		}
@@ -134,6 +134,7 @@ func NewHistory(cfg histCfg, aggregationStep uint64, filenameBase, indexKeysTabl
 	if err != nil {
 		return nil, fmt.Errorf("NewHistory: %s, %w", filenameBase, err)
 	}
+	h.InvertedIndex.ownedByHistory = true
 
 	return &h, nil
 }
@@ -220,7 +221,7 @@ func (h *History) openDirtyFiles() error {
 			fromStep, toStep := item.startTxNum/h.aggregationStep, item.endTxNum/h.aggregationStep
 			if item.decompressor == nil {
 				fPath := h.vFilePath(fromStep, toStep)
-				exists, err := dir.FileExist(fPath)
+				exists, err := h.filesFS.exists(fPath)
 				if err != nil {
 					_, fName := filepath.Split(fPath)
 					h.logger.Debug("[agg] History.openDirtyFiles: FileExist", "f", fName, "err", err)
@@ -237,7 +238,25 @@ func (h *History) openDirtyFiles() error {
 					invalidFilesMu.Unlock()
 					continue
 				}
-				if item.decompressor, err = seg.NewDecompressor(fPath); err != nil {
+				if h.filesFS.isEmpty(fPath) {
+					_, fName := filepath.Split(fPath)
+					h.logger.Warn("[agg] History.openDirtyFiles: skip empty file", "f", fName)
+					invalidFilesMu.Lock()
+					invalidFileItems = append(invalidFileItems, item)
+					invalidFilesMu.Unlock()
+					continue
+				}
+				if VerifyChecksumOnOpen {
+					if err := h.filesFS.verifyChecksum(fPath); err != nil {
+						h.logger.Warn("[agg] History.openDirtyFiles: file excluded", "err", err)
+						invalidFilesMu.Lock()
+						invalidFileItems = append(invalidFileItems, item)
+						invalidFilesMu.Unlock()
+						continue
+					}
+				}
+				item.fsys = h.filesFS
+				if item.decompressor, err = h.filesFS.openDecompressor(fPath, h.dataAccess); err != nil {
 					_, fName := filepath.Split(fPath)
 					if errors.Is(err, &seg.ErrCompressedFileCorrupted{}) {
 						h.logger.Debug("[agg] History.openDirtyFiles", "err", err, "f", fName)
@@ -267,13 +286,13 @@ func (h *History) openDirtyFiles() error {
 
 			if item.index == nil {
 				fPath := h.vAccessorFilePath(fromStep, toStep)
-				exists, err := dir.FileExist(fPath)
+				exists, err := h.filesFS.exists(fPath)
 				if err != nil {
 					_, fName := filepath.Split(fPath)
 					h.logger.Warn("[agg] History.openDirtyFiles", "err", err, "f", fName)
 				}
 				if exists {
-					if item.index, err = recsplit.OpenIndex(fPath); err != nil {
+					if item.index, err = h.filesFS.openIndex(fPath); err != nil {
 						_, fName := filepath.Split(fPath)
 						h.logger.Warn("[agg] History.openDirtyFiles", "err", err, "f", fName)
 						// don't interrupt on error. other files may be good
@@ -374,8 +393,8 @@ func (h *History) buildVI(ctx context.Context, historyIdxPath string, hist, efHi
 	rs, err := recsplit.NewRecSplit(recsplit.RecSplitArgs{
 		KeyCount:   hist.Count(),
 		Enums:      false,
-		BucketSize: 2000,
-		LeafSize:   8,
+		BucketSize: h.accessor.bucketSize,
+		LeafSize:   h.accessor.leafSize,
 		TmpDir:     h.dirs.Tmp,
 		IndexFile:  historyIdxPath,
 		Salt:       h.salt,
@@ -583,7 +602,8 @@ type HistoryCollation struct {
 	efHistoryComp *seg.Writer
 	historyPath   string
 	efHistoryPath string
-	historyCount  int // same as historyComp.Count()
+	historyCount  int    // same as historyComp.Count()
+	removeTmp     func() // temp files of `historyComp` and `efHistoryComp`
 }
 
 func (c HistoryCollation) Close() {
@@ -593,6 +613,9 @@ func (c HistoryCollation) Close() {
 	if c.efHistoryComp != nil {
 		c.efHistoryComp.Close()
 	}
+	if c.removeTmp != nil {
+		c.removeTmp()
+	}
 }
 
 // [txFrom; txTo)
@@ -612,6 +635,10 @@ func (h *History) collate(ctx context.Context, step, txFrom, txTo uint64, roTx k
 		startAt       = time.Now()
 		closeComp     = true
 	)
+	tmpDir, removeTmp, err := h.createTmpDir(h.filenameBase + ".collate.hist")
+	if err != nil {
+		return HistoryCollation{}, fmt.Errorf("create %s tmp dir: %w", h.filenameBase, err)
+	}
 	defer func() {
 		mxCollateTookHistory.ObserveDuration(startAt)
 		if closeComp {
@@ -621,10 +648,17 @@ func (h *History) collate(ctx context.Context, step, txFrom, txTo uint64, roTx k
 			if efHistoryComp != nil {
 				efHistoryComp.Close()
 			}
+			removeTmp()
 		}
 	}()
 
-	comp, err := seg.NewCompressor(ctx, "collate hist "+h.filenameBase, historyPath, h.dirs.Tmp, h.compressCfg, log.LvlTrace, h.logger)
+	for _, fPath := range []string{historyPath, efHistoryPath} {
+		if _, err = removeEmptyFile(fPath, h.logger); err != nil {
+			return HistoryCollation{}, fmt.Errorf("remove %s empty history file: %w", h.filenameBase, err)
+		}
+	}
+
+	comp, err := seg.NewCompressor(ctx, "collate hist "+h.filenameBase, historyPath, tmpDir, h.compressCfg, log.LvlTrace, h.logger)
 	if err != nil {
 		return HistoryCollation{}, fmt.Errorf("create %s history compressor: %w", h.filenameBase, err)
 	}
@@ -637,7 +671,7 @@ func (h *History) collate(ctx context.Context, step, txFrom, txTo uint64, roTx k
 	defer keysCursor.Close()
 
 	binary.BigEndian.PutUint64(txKey[:], txFrom)
-	collector := etl.NewCollector(h.filenameBase+".collate.hist", h.iiCfg.dirs.Tmp, etl.NewSortableBuffer(CollateETLRAM), h.logger).LogLvl(log.LvlTrace)
+	collector := etl.NewCollector(h.filenameBase+".collate.hist", tmpDir, etl.NewSortableBuffer(CollateETLRAM), h.logger).LogLvl(log.LvlTrace)
 	defer collector.Close()
 
 	for txnmb, k, err := keysCursor.Seek(txKey[:]); txnmb != nil; txnmb, k, err = keysCursor.Next() {
@@ -675,7 +709,7 @@ func (h *History) collate(ctx context.Context, step, txFrom, txTo uint64, roTx k
 		defer cd.Close()
 	}
 
-	efComp, err := seg.NewCompressor(ctx, "collate idx "+h.filenameBase, efHistoryPath, h.dirs.Tmp, h.compressCfg, log.LvlTrace, h.logger)
+	efComp, err := seg.NewCompressor(ctx, "collate idx "+h.filenameBase, efHistoryPath, tmpDir, h.compressCfg, log.LvlTrace, h.logger)
 	if err != nil {
 		return HistoryCollation{}, fmt.Errorf("create %s ef history compressor: %w", h.filenameBase, err)
 	}
@@ -691,7 +725,7 @@ func (h *History) collate(ctx context.Context, step, txFrom, txTo uint64, roTx k
 		prevKey     []byte
 		initialized bool
 	)
-	efHistoryComp = seg.NewWriter(efComp, seg.CompressNone) // coll+build must be fast - no compression
+	efHistoryComp = seg.NewWriter(efComp, h.InvertedIndex.efWriterCompression())
 	collector.SortAndFlushInBackground(true)
 	defer bitmapdb.ReturnToPool64(bitmap)
 
@@ -781,6 +815,7 @@ func (h *History) collate(ctx context.Context, step, txFrom, txTo uint64, roTx k
 		historyPath:   historyPath,
 		historyComp:   historyComp,
 		historyCount:  historyComp.Count(),
+		removeTmp:     removeTmp,
 	}, nil
 }
 
@@ -855,6 +890,7 @@ func (h *History) buildFiles(ctx context.Context, step uint64, collation History
 		collation.historyComp.DisableFsync()
 		collation.efHistoryComp.DisableFsync()
 	}
+	efHistorySum, historySum := newChecksum(collation.efHistoryComp), newChecksum(collation.historyComp)
 
 	{
 		ps := background.NewProgressSet()
@@ -877,8 +913,21 @@ func (h *History) buildFiles(ctx context.Context, step uint64, collation History
 		ps.Delete(p)
 	}
 	collation.Close()
+	for _, fPath := range []string{collation.efHistoryPath, collation.historyPath} {
+		if removed, err := removeEmptyFile(fPath, h.logger); err != nil {
+			return HistoryFiles{}, err
+		} else if removed {
+			return HistoryFiles{}, fmt.Errorf("compress %s history: empty file %s", h.filenameBase, filepath.Base(fPath))
+		}
+	}
+	if err = writeChecksum(collation.efHistoryPath, efHistorySum.Sum32()); err != nil {
+		return HistoryFiles{}, err
+	}
+	if err = writeChecksum(collation.historyPath, historySum.Sum32()); err != nil {
+		return HistoryFiles{}, err
+	}
 
-	efHistoryDecomp, err = seg.NewDecompressor(collation.efHistoryPath)
+	efHistoryDecomp, err = seg.NewDecompressorWithAccess(collation.efHistoryPath, h.dataAccess)
 	if err != nil {
 		return HistoryFiles{}, fmt.Errorf("open %s .ef history decompressor: %w", h.filenameBase, err)
 	}
@@ -891,7 +940,7 @@ func (h *History) buildFiles(ctx context.Context, step uint64, collation History
 		}
 	}
 
-	historyDecomp, err = seg.NewDecompressor(collation.historyPath)
+	historyDecomp, err = seg.NewDecompressorWithAccess(collation.historyPath, h.dataAccess)
 	if err != nil {
 		return HistoryFiles{}, fmt.Errorf("open %s v history decompressor: %w", h.filenameBase, err)
 	}
@@ -974,6 +1023,9 @@ type HistoryRoTx struct {
 	valsCDup kv.CursorDupSort
 
 	_bufTs []byte
+
+	check  roTxCheck // not last field: zero-size last field is padded
+	pinned filesPins
 }
 
 func (h *History) BeginFilesRo() *HistoryRoTx {
@@ -989,22 +1041,54 @@ func (h *History) BeginFilesRo() *HistoryRoTx {
 		iit:   h.InvertedIndex.BeginFilesRo(),
 		files: files,
 		trace: false,
+		check: newRoTxCheck(),
+	}
+}
+
+// BeginFilesRoAt - like BeginFilesRo, but sees only files with endTxNum <= txNum
+func (h *History) BeginFilesRoAt(txNum uint64) *HistoryRoTx {
+	files := visibleFilesTo(h._visibleFiles, txNum)
+	for i := 0; i < len(files); i++ {
+		if !files[i].src.frozen {
+			files[i].src.refcount.Add(1)
+		}
+	}
+
+	return &HistoryRoTx{
+		h:     h,
+		iit:   h.InvertedIndex.BeginFilesRoAt(txNum),
+		files: files,
+		trace: false,
+		check: newRoTxCheck(),
 	}
 }
 
-func (ht *HistoryRoTx) statelessGetter(i int) *seg.Reader {
+// openFile - file `i` is open until Close: re-opens it if it was closed by filesLRU
+func (ht *HistoryRoTx) openFile(i int) error {
+	return ht.pinned.pin(ht.h.filesLRU, ht.files, i, ht.h.compression)
+}
+
+// openFileOf - like openFile, but `item` can be not visible in this RoTx (dirty file)
+func (ht *HistoryRoTx) openFileOf(item *filesItem) error {
+	return ht.pinned.pinItem(ht.h.filesLRU, ht.files, item, ht.h.compression)
+}
+
+func (ht *HistoryRoTx) statelessGetter(i int) (*seg.Reader, error) {
 	if ht.getters == nil {
 		ht.getters = make([]*seg.Reader, len(ht.files))
 	}
 	r := ht.getters[i]
 	if r == nil {
+		if err := ht.openFile(i); err != nil {
+			return nil, err
+		}
 		g := ht.files[i].src.decompressor.MakeGetter()
 		r = seg.NewReader(g, ht.h.compression)
 		ht.getters[i] = r
 	}
-	return r
+	return r, nil
 }
-func (ht *HistoryRoTx) statelessIdxReader(i int) *recsplit.IndexReader {
+func (ht *HistoryRoTx) statelessIdxReader(i int) (*recsplit.IndexReader, error) {
 	if ht.readers == nil {
 		ht.readers = make([]*recsplit.IndexReader, len(ht.files))
 	}
@@ -1018,10 +1102,13 @@ func (ht *HistoryRoTx) statelessIdxReader(i int) *recsplit.IndexReader {
 	}
 	r := ht.readers[i]
 	if r == nil {
+		if err := ht.openFile(i); err != nil {
+			return nil, err
+		}
 		r = ht.files[i].src.index.GetReaderFromPool()
 		ht.readers[i] = r
 	}
-	return r
+	return r, nil
 }
 
 func (ht *HistoryRoTx) canPruneUntil(tx kv.Tx, untilTx uint64) (can bool, txTo uint64) {
@@ -1132,7 +1219,9 @@ func (ht *HistoryRoTx) Prune(ctx context.Context, rwTx kv.RwTx, txFrom, txTo, li
 }
 
 func (ht *HistoryRoTx) Close() {
-	if ht.files == nil { // invariant: it's safe to call Close multiple times
+	ht.check.close("HistoryRoTx", ht.h.filenameBase)
+	if ht.files == nil { // invariant: it's safe to call Close multiple times (except `assert` build: roTxCheck)
+		ht.pinned.unpinAll(ht.h.filesLRU, nil) // dirty files pinned by openFileOf
 		return
 	}
 	files := ht.files
@@ -1154,6 +1243,7 @@ func (ht *HistoryRoTx) Close() {
 	for _, r := range ht.readers {
 		r.Close()
 	}
+	ht.pinned.unpinAll(ht.h.filesLRU, files)
 
 	ht.iit.Close()
 }
@@ -1178,15 +1268,23 @@ func (ht *HistoryRoTx) getFile(txNum uint64) (it visibleFile, ok bool) {
 func (ht *HistoryRoTx) historySeekInFiles(key []byte, txNum uint64) ([]byte, bool, error) {
 	// Files list of II and History is different
 	// it means II can't return index of file, but can return TxNum which History will use to find own file
-	ok, histTxNum := ht.iit.seekInFiles(key, txNum)
-	if !ok {
-		return nil, false, nil
+	ok, histTxNum, err := ht.iit.seekInFiles(key, txNum)
+	if err != nil || !ok {
+		return nil, false, err
 	}
+	return ht.historyValueInFiles(key, txNum, histTxNum)
+}
+
+// historyValueInFiles - value of `key` stored at `histTxNum` (found by InvertedIndex) in history files
+func (ht *HistoryRoTx) historyValueInFiles(key []byte, txNum, histTxNum uint64) ([]byte, bool, error) {
 	historyItem, ok := ht.getFile(histTxNum)
 	if !ok {
 		return nil, false, fmt.Errorf("hist file not found: key=%x, %s.%d-%d", key, ht.h.filenameBase, histTxNum/ht.h.aggregationStep, histTxNum/ht.h.aggregationStep)
 	}
-	reader := ht.statelessIdxReader(historyItem.i)
+	reader, err := ht.statelessIdxReader(historyItem.i)
+	if err != nil {
+		return nil, false, err
+	}
 	if reader.Empty() {
 		return nil, false, nil
 	}
@@ -1194,7 +1292,10 @@ func (ht *HistoryRoTx) historySeekInFiles(key []byte, txNum uint64) ([]byte, boo
 	if !ok {
 		return nil, false, nil
 	}
-	g := ht.statelessGetter(historyItem.i)
+	g, err := ht.statelessGetter(historyItem.i)
+	if err != nil {
+		return nil, false, err
+	}
 	g.Reset(offset)
 
 	v, _ := g.Next(nil)
@@ -1204,6 +1305,32 @@ func (ht *HistoryRoTx) historySeekInFiles(key []byte, txNum uint64) ([]byte, boo
 	return v, true, nil
 }
 
+// historyValueLenInFiles - like historyValueInFiles, but value is skipped (not decompressed): returns only its length
+func (ht *HistoryRoTx) historyValueLenInFiles(key []byte, histTxNum uint64) (int, bool, error) {
+	historyItem, ok := ht.getFile(histTxNum)
+	if !ok {
+		return 0, false, fmt.Errorf("hist file not found: key=%x, %s.%d-%d", key, ht.h.filenameBase, histTxNum/ht.h.aggregationStep, histTxNum/ht.h.aggregationStep)
+	}
+	reader, err := ht.statelessIdxReader(historyItem.i)
+	if err != nil {
+		return 0, false, err
+	}
+	if reader.Empty() {
+		return 0, false, nil
+	}
+	offset, ok := reader.Lookup(ht.encodeTs(histTxNum, key))
+	if !ok {
+		return 0, false, nil
+	}
+	g, err := ht.statelessGetter(historyItem.i)
+	if err != nil {
+		return 0, false, err
+	}
+	g.Reset(offset)
+	_, vLen := g.Skip()
+	return vLen, true, nil
+}
+
 func (hs *HistoryStep) GetNoState(key []byte, txNum uint64) ([]byte, bool, uint64) {
 	//fmt.Printf("historySeekInFiles [%x] %d\n", key, txNum)
 	if hs.indexFile.reader.Empty() {
@@ -1213,14 +1340,14 @@ func (hs *HistoryStep) GetNoState(key []byte, txNum uint64) ([]byte, bool, uint6
 	if !ok {
 		return nil, false, txNum
 	}
-	g := hs.indexFile.getter
-	g.Reset(offset)
-	k, _ := g.NextUncompressed()
+	idx := seg.NewReader(hs.indexFile.getter, hs.efCompression)
+	idx.Reset(offset)
+	k, _ := idx.Next(nil)
 	if !bytes.Equal(k, key) {
 		return nil, false, txNum
 	}
 	//fmt.Printf("Found key=%x\n", k)
-	eliasVal, _ := g.NextUncompressed()
+	eliasVal, _ := idx.Next(nil)
 	ef, _ := eliasfano32.ReadEliasFano(eliasVal)
 	n, ok := ef.Search(txNum)
 	if !ok {
@@ -1233,7 +1360,7 @@ func (hs *HistoryStep) GetNoState(key []byte, txNum uint64) ([]byte, bool, uint6
 		return nil, false, txNum
 	}
 	//fmt.Printf("offset = %d, txKey=[%x], key=[%x]\n", offset, txKey[:], key)
-	g = hs.historyFile.getter
+	g := hs.historyFile.getter
 	g.Reset(offset)
 	if hs.compressVals {
 		v, _ := g.Next(nil)
@@ -1251,14 +1378,14 @@ func (hs *HistoryStep) MaxTxNum(key []byte) (bool, uint64) {
 	if !ok {
 		return false, 0
 	}
-	g := hs.indexFile.getter
+	g := seg.NewReader(hs.indexFile.getter, hs.efCompression)
 	g.Reset(offset)
-	k, _ := g.NextUncompressed()
+	k, _ := g.Next(nil)
 	if !bytes.Equal(k, key) {
 		return false, 0
 	}
 	//fmt.Printf("Found key=%x\n", k)
-	eliasVal, _ := g.NextUncompressed()
+	eliasVal, _ := g.Next(nil)
 	return true, eliasfano32.Max(eliasVal)
 }
 
@@ -1271,9 +1398,35 @@ func (ht *HistoryRoTx) encodeTs(txNum uint64, key []byte) []byte {
 	return ht._bufTs[:8+len(key)]
 }
 
+// ErrTxNumPruned - requested txNum is before earliest available history: result is unknown (not "key is absent").
+// Use errors.As with *TxNumPrunedError to get earliest available txNum.
+var ErrTxNumPruned = errors.New("txNum is before earliest available history")
+
+type TxNumPrunedError struct {
+	TxNum         uint64
+	EarliestTxNum uint64 // start of lowest visible history file
+}
+
+func (e *TxNumPrunedError) Error() string {
+	return fmt.Sprintf("%s: txNum=%d, earliest=%d", ErrTxNumPruned, e.TxNum, e.EarliestTxNum)
+}
+func (e *TxNumPrunedError) Unwrap() error { return ErrTxNumPruned }
+
+// checkTxNumAvailable - history of steps before lowest visible file is pruned. No files - nothing was pruned yet:
+// db is pruned only after files are built.
+func (ht *HistoryRoTx) checkTxNumAvailable(txNum uint64) error {
+	if len(ht.files) == 0 || txNum >= ht.files[0].startTxNum {
+		return nil
+	}
+	return &TxNumPrunedError{TxNum: txNum, EarliestTxNum: ht.files[0].startTxNum}
+}
+
 // HistorySeek searches history for a value of specified key before txNum
 // second return value is true if the value is found in the history (even if it is nil)
 func (ht *HistoryRoTx) HistorySeek(key []byte, txNum uint64, roTx kv.Tx) ([]byte, bool, error) {
+	if err := ht.checkTxNumAvailable(txNum); err != nil {
+		return nil, false, err
+	}
 	v, ok, err := ht.historySeekInFiles(key, txNum)
 	if err != nil {
 		return nil, ok, err
@@ -1285,6 +1438,57 @@ func (ht *HistoryRoTx) HistorySeek(key []byte, txNum uint64, roTx kv.Tx) ([]byte
 	return ht.historySeekInDB(key, txNum, roTx)
 }
 
+// historyHas - like HistorySeek, but doesn't read value from files. `exists` is false if key didn't exist before txNum
+// (history has marker of key creation). Second return value is true if the key is found in the history.
+func (ht *HistoryRoTx) historyHas(key []byte, txNum uint64, roTx kv.Tx) (exists, found bool, err error) {
+	if err := ht.checkTxNumAvailable(txNum); err != nil {
+		return false, false, err
+	}
+	ok, histTxNum, err := ht.iit.seekInFiles(key, txNum)
+	if err != nil {
+		return false, false, err
+	}
+	if ok {
+		vLen, ok, err := ht.historyValueLenInFiles(key, histTxNum)
+		if err != nil {
+			return false, false, err
+		}
+		if ok {
+			return vLen > 0, true, nil
+		}
+	}
+	v, ok, err := ht.historySeekInDB(key, txNum, roTx)
+	if err != nil {
+		return false, false, err
+	}
+	return len(v) > 0, ok, nil
+}
+
+// historySeekBatch - HistorySeek for sorted and unique `keys`. vals[i], ok[i] - result for keys[i]
+func (ht *HistoryRoTx) historySeekBatch(keys [][]byte, txNum uint64, roTx kv.Tx) (vals [][]byte, ok []bool, err error) {
+	if err := ht.checkTxNumAvailable(txNum); err != nil {
+		return nil, nil, err
+	}
+	vals, ok = make([][]byte, len(keys)), make([]bool, len(keys))
+	histTxNums := make([]uint64, len(keys))
+	if err := ht.iit.seekInFilesBatch(keys, txNum, ok, histTxNums); err != nil {
+		return nil, nil, err
+	}
+	for i, key := range keys {
+		if ok[i] {
+			if vals[i], ok[i], err = ht.historyValueInFiles(key, txNum, histTxNums[i]); err != nil {
+				return nil, nil, err
+			}
+		}
+		if !ok[i] {
+			if vals[i], ok[i], err = ht.historySeekInDB(key, txNum, roTx); err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+	return vals, ok, nil
+}
+
 func (ht *HistoryRoTx) valsCursor(tx kv.Tx) (c kv.Cursor, err error) {
 	if ht.valsC != nil {
 		return ht.valsC, nil
@@ -1345,16 +1549,21 @@ func (ht *HistoryRoTx) WalkAsOf(ctx context.Context, startTxNum uint64, from, to
 		from: from, to: to, limit: limit,
 
 		hc:         ht,
+		check:      ht.check.iterOpened(),
 		startTxNum: startTxNum,
 
 		ctx: ctx,
 	}
-	for _, item := range ht.iit.files {
+	for i, item := range ht.iit.files {
 		if item.endTxNum <= startTxNum {
 			continue
 		}
 		// TODO: seek(from)
-		g := seg.NewReader(item.src.decompressor.MakeGetter(), ht.h.compression)
+		if err := ht.iit.openFile(i); err != nil {
+			hi.Close()
+			return nil, err
+		}
+		g := seg.NewReader(item.src.decompressor.MakeGetter(), ht.iit.ii.compression)
 		g.Reset(0)
 		if g.HasNext() {
 			key, offset := g.Next(nil)
@@ -1388,6 +1597,7 @@ func (ht *HistoryRoTx) WalkAsOf(ctx context.Context, startTxNum uint64, from, to
 // StateAsOfIter - returns state range at given time in history
 type StateAsOfIterF struct {
 	hc    *HistoryRoTx
+	check roTxIterCheck
 	limit int
 
 	from, to []byte
@@ -1405,6 +1615,7 @@ type StateAsOfIterF struct {
 }
 
 func (hi *StateAsOfIterF) Close() {
+	hi.check.close()
 }
 
 func (hi *StateAsOfIterF) advanceInFiles() error {
@@ -1446,12 +1657,18 @@ func (hi *StateAsOfIterF) advanceInFiles() error {
 		if !ok {
 			return fmt.Errorf("no %s file found for [%x]", hi.hc.h.filenameBase, hi.nextKey)
 		}
-		reader := hi.hc.statelessIdxReader(historyItem.i)
+		reader, err := hi.hc.statelessIdxReader(historyItem.i)
+		if err != nil {
+			return err
+		}
 		offset, ok := reader.Lookup2(hi.txnKey[:], hi.nextKey)
 		if !ok {
 			continue
 		}
-		g := hi.hc.statelessGetter(historyItem.i)
+		g, err := hi.hc.statelessGetter(historyItem.i)
+		if err != nil {
+			return err
+		}
 		g.Reset(offset)
 		hi.nextVal, _ = g.Next(nil)
 		return nil
@@ -1645,6 +1862,7 @@ func (ht *HistoryRoTx) iterateChangedFrozen(fromTxNum, toTxNum int, asc order.By
 
 	s := &HistoryChangesIterFiles{
 		hc:         ht,
+		check:      ht.check.iterOpened(),
 		startTxNum: max(0, uint64(fromTxNum)),
 		endTxNum:   toTxNum,
 		limit:      limit,
@@ -1652,14 +1870,18 @@ func (ht *HistoryRoTx) iterateChangedFrozen(fromTxNum, toTxNum int, asc order.By
 	if fromTxNum >= 0 {
 		binary.BigEndian.PutUint64(s.startTxKey[:], uint64(fromTxNum))
 	}
-	for _, item := range ht.iit.files {
+	for i, item := range ht.iit.files {
 		if fromTxNum >= 0 && item.endTxNum <= uint64(fromTxNum) {
 			continue
 		}
 		if toTxNum >= 0 && item.startTxNum >= uint64(toTxNum) {
 			break
 		}
-		g := seg.NewReader(item.src.decompressor.MakeGetter(), ht.h.compression)
+		if err := ht.iit.openFile(i); err != nil {
+			s.Close()
+			return nil, err
+		}
+		g := seg.NewReader(item.src.decompressor.MakeGetter(), ht.iit.ii.compression)
 		g.Reset(0)
 		if g.HasNext() {
 			key, offset := g.Next(nil)
@@ -1716,19 +1938,20 @@ func (ht *HistoryRoTx) HistoryRange(fromTxNum, toTxNum int, asc order.By, limit
 func (ht *HistoryRoTx) idxRangeRecent(key []byte, startTxNum, endTxNum int, asc order.By, limit int, roTx kv.Tx) (stream.U64, error) {
 	var dbIt stream.U64
 	if ht.h.historyLargeValues {
-		from := make([]byte, len(key)+8)
-		copy(from, key)
-		var fromTxNum uint64
+		keyWithTxNum := func(txNum uint64) []byte {
+			return binary.BigEndian.AppendUint64(common.Copy(key), txNum)
+		}
+		// unbounded: [key+0, key+MaxUint64) for asc, [key+MaxUint64, key) for desc
+		from, to := keyWithTxNum(0), keyWithTxNum(math.MaxUint64)
+		if !asc {
+			from, to = to, common.Copy(key)
+		}
 		if startTxNum >= 0 {
-			fromTxNum = uint64(startTxNum)
+			from = keyWithTxNum(uint64(startTxNum))
 		}
-		binary.BigEndian.PutUint64(from[len(key):], fromTxNum)
-		to := common.Copy(from)
-		toTxNum := uint64(math.MaxUint64)
 		if endTxNum >= 0 {
-			toTxNum = uint64(endTxNum)
+			to = keyWithTxNum(uint64(endTxNum))
 		}
-		binary.BigEndian.PutUint64(to[len(key):], toTxNum)
 		var it stream.KV
 		var err error
 		if asc {
@@ -1783,6 +2006,7 @@ func (ht *HistoryRoTx) IdxRange(key []byte, startTxNum, endTxNum int, asc order.
 
 type HistoryChangesIterFiles struct {
 	hc         *HistoryRoTx
+	check      roTxIterCheck
 	nextVal    []byte
 	nextKey    []byte
 	h          ReconHeap
@@ -1797,6 +2021,7 @@ type HistoryChangesIterFiles struct {
 }
 
 func (hi *HistoryChangesIterFiles) Close() {
+	hi.check.close()
 }
 
 func (hi *HistoryChangesIterFiles) advance() error {
@@ -1835,12 +2060,18 @@ func (hi *HistoryChangesIterFiles) advance() error {
 		if !ok {
 			return fmt.Errorf("HistoryChangesIterFiles: no %s file found for [%x]", hi.hc.h.filenameBase, hi.nextKey)
 		}
-		reader := hi.hc.statelessIdxReader(historyItem.i)
+		reader, err := hi.hc.statelessIdxReader(historyItem.i)
+		if err != nil {
+			return err
+		}
 		offset, ok := reader.Lookup2(hi.txnKey[:], hi.nextKey)
 		if !ok {
 			continue
 		}
-		g := hi.hc.statelessGetter(historyItem.i)
+		g, err := hi.hc.statelessGetter(historyItem.i)
+		if err != nil {
+			return err
+		}
 		g.Reset(offset)
 		hi.nextVal, _ = g.Next(nil)
 		return nil
@@ -2052,25 +2283,33 @@ func (hi *HistoryChangesIterDB) Next() ([]byte, []byte, uint64, error) {
 
 // HistoryStep used for incremental state reconsitution, it isolates only one snapshot interval
 type HistoryStep struct {
-	compressVals bool
-	indexItem    *filesItem
-	indexFile    visibleFile
-	historyItem  *filesItem
-	historyFile  visibleFile
+	compressVals  bool
+	efCompression seg.FileCompression
+	lru           *filesLRU // files of step are pinned in it until Close
+	indexItem     *filesItem
+	indexFile     visibleFile
+	historyItem   *filesItem
+	historyFile   visibleFile
 }
 
-// MakeSteps [0, toTxNum)
-func (h *History) MakeSteps(toTxNum uint64) []*HistoryStep {
+// MakeSteps [0, toTxNum). Steps must be closed by HistoryStep.Close
+func (h *History) MakeSteps(toTxNum uint64) ([]*HistoryStep, error) {
 	var steps []*HistoryStep
+	var err error
 	h.InvertedIndex.dirtyFiles.Walk(func(items []*filesItem) bool {
 		for _, item := range items {
 			if item.index == nil || !item.frozen || item.startTxNum >= toTxNum {
 				continue
 			}
+			if err = h.filesLRU.acquire(item, h.InvertedIndex.compression); err != nil {
+				return false
+			}
 
 			step := &HistoryStep{
-				compressVals: h.compression&seg.CompressVals != 0,
-				indexItem:    item,
+				compressVals:  h.compression&seg.CompressVals != 0,
+				efCompression: h.InvertedIndex.compression,
+				lru:           h.filesLRU,
+				indexItem:     item,
 				indexFile: visibleFile{
 					startTxNum: item.startTxNum,
 					endTxNum:   item.endTxNum,
@@ -2083,29 +2322,42 @@ func (h *History) MakeSteps(toTxNum uint64) []*HistoryStep {
 		return true
 	})
 	i := 0
-	h.dirtyFiles.Walk(func(items []*filesItem) bool {
-		for _, item := range items {
-			if item.index == nil || !item.frozen || item.startTxNum >= toTxNum {
-				continue
-			}
-			steps[i].historyItem = item
-			steps[i].historyFile = visibleFile{
-				startTxNum: item.startTxNum,
-				endTxNum:   item.endTxNum,
-				getter:     item.decompressor.MakeGetter(),
-				reader:     recsplit.NewIndexReader(item.index),
+	if err == nil {
+		h.dirtyFiles.Walk(func(items []*filesItem) bool {
+			for _, item := range items {
+				if item.index == nil || !item.frozen || item.startTxNum >= toTxNum {
+					continue
+				}
+				if err = h.filesLRU.acquire(item, h.compression); err != nil {
+					return false
+				}
+				steps[i].historyItem = item
+				steps[i].historyFile = visibleFile{
+					startTxNum: item.startTxNum,
+					endTxNum:   item.endTxNum,
+					getter:     item.decompressor.MakeGetter(),
+					reader:     recsplit.NewIndexReader(item.index),
+				}
+				i++
 			}
-			i++
+			return true
+		})
+	}
+	if err != nil {
+		for _, step := range steps {
+			step.Close()
 		}
-		return true
-	})
-	return steps
+		return nil, err
+	}
+	return steps, nil
 }
 
+// Clone - uses files pinned by `hs`: must not be used after `hs.Close`
 func (hs *HistoryStep) Clone() *HistoryStep {
 	return &HistoryStep{
-		compressVals: hs.compressVals,
-		indexItem:    hs.indexItem,
+		compressVals:  hs.compressVals,
+		efCompression: hs.efCompression,
+		indexItem:     hs.indexItem,
 		indexFile: visibleFile{
 			startTxNum: hs.indexFile.startTxNum,
 			endTxNum:   hs.indexFile.endTxNum,
@@ -2121,3 +2373,17 @@ func (hs *HistoryStep) Clone() *HistoryStep {
 		},
 	}
 }
+
+// Close - releases files pinned by MakeSteps. Clone has nothing to release
+func (hs *HistoryStep) Close() {
+	if hs.lru == nil {
+		return
+	}
+	if hs.indexItem != nil {
+		hs.lru.release(hs.indexItem)
+	}
+	if hs.historyItem != nil {
+		hs.lru.release(hs.historyItem)
+	}
+	hs.lru, hs.indexItem, hs.historyItem = nil, nil, nil
+}
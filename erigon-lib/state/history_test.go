@@ -968,6 +968,11 @@ func TestHistoryMergeFiles(t *testing.T) {
 		db, h, txs := filledHistory(t, false, logger)
 		test(t, h, db, txs)
 	})
+	t.Run("ef_zstd", func(t *testing.T) {
+		db, h, txs := filledHistory(t, false, logger)
+		h.InvertedIndex.efZstd = true
+		test(t, h, db, txs)
+	})
 }
 
 func TestHistoryScanFiles(t *testing.T) {
@@ -1161,6 +1166,11 @@ func TestIterateChanged(t *testing.T) {
 		db, h, txs := filledHistory(t, false, logger)
 		test(t, h, db, txs)
 	})
+	t.Run("ef_zstd", func(t *testing.T) {
+		db, h, txs := filledHistory(t, false, logger)
+		h.InvertedIndex.efZstd = true
+		test(t, h, db, txs)
+	})
 }
 
 func TestIterateChanged2(t *testing.T) {
@@ -18,20 +18,25 @@ package state
 
 import (
 	"bytes"
+	"cmp"
 	"container/heap"
 	"context"
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"hash"
+	"io/fs"
 	"math"
 	"os"
 	"path"
 	"path/filepath"
 	"reflect"
 	"regexp"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/RoaringBitmap/roaring/roaring64"
@@ -87,17 +92,65 @@ type InvertedIndex struct {
 
 	noFsync bool // fsync is enabled by default, but tests can manually disable
 
-	compression seg.FileCompression
+	compression seg.FileCompression // of .ef readers. Writers use efWriterCompression
 
 	compressCfg seg.Cfg
 	indexList   idxList
+
+	mergeWorkers int // amount of independent ranges merged concurrently by `mergeLoopStep`. see Aggregator.SetMergeWorkers
+
+	ownedByHistory bool // files are merged by History together with .v files
+
+	tempFiler TempFiler // temp files of collation and merge
+
+	mergedKeys atomic.Uint64 // keys read from input files by merges since open: for merge progress
+
+	replacedFrozen []*filesItem // frozen files replaced by replaceFiles: not ref-counted, closed by Close
+
+	filesLRU      *filesLRU      // shared by all Domains/InvertedIndices of Aggregator. nil - files are always open
+	mergeThrottle *mergeThrottle // shared by all Domains/InvertedIndices of Aggregator. nil - merge is not limited
+
+	filesFS    filesFS        // where openFolder reads files from. see Aggregator.SetFilesFS
+	dataAccess seg.FileAccess // mmap or pread of data files (.ef, .v, .kv). see Aggregator.SetDataFileAccess
 }
 
 type iiCfg struct {
 	salt *uint32
 	dirs datadir.Dirs
 	db   kv.RoDB // global db pointer. mostly for background warmup.
+
+	// inMem - index never builds, opens or merges files: all data stays in db (which can be in-memory db).
+	// `dirs` are not required. For tests and small datasets.
+	inMem bool
+
+	accessor recsplitCfg // of .efi, and .vi/.kvi of history/domain. zero - defaultRecsplitCfg
+
+	// efZstd - .ef values of new files are compressed by zstd (see seg.CompressValsZstd). Readers detect compressed
+	// values: can be changed on existing files, merge re-writes values of old files
+	efZstd bool
+}
+
+// recsplitCfg - parameters of recsplit accessors. They are stored in accessor's header: files built with different
+// parameters are readable by any config.
+type recsplitCfg struct {
+	bucketSize int    // bigger - faster build, but slower lookup
+	leafSize   uint16 // bigger - smaller accessor, but slower build
 }
+
+var defaultRecsplitCfg = recsplitCfg{bucketSize: 2000, leafSize: 8}
+
+func (c recsplitCfg) validate() error {
+	if c.bucketSize <= 0 || c.bucketSize > math.MaxUint16 {
+		return fmt.Errorf("recsplit bucket size %d: out of range [1, %d]", c.bucketSize, math.MaxUint16)
+	}
+	if c.leafSize == 0 || c.leafSize > recsplit.MaxLeafSize {
+		return fmt.Errorf("recsplit leaf size %d: out of range [1, %d]", c.leafSize, recsplit.MaxLeafSize)
+	}
+	return nil
+}
+
+var errInMemNoFiles = errors.New("in-memory InvertedIndex has no files")
+
 type iiVisible struct {
 	files  []visibleFile
 	name   string
@@ -105,9 +158,15 @@ type iiVisible struct {
 }
 
 func NewInvertedIndex(cfg iiCfg, aggregationStep uint64, filenameBase, indexKeysTable, indexTable string, integrityCheck func(fromStep uint64, toStep uint64) bool, logger log.Logger) (*InvertedIndex, error) {
-	if cfg.dirs.SnapDomain == "" {
+	if cfg.dirs.SnapDomain == "" && !cfg.inMem {
 		panic("empty `dirs` varialbe")
 	}
+	if cfg.accessor == (recsplitCfg{}) {
+		cfg.accessor = defaultRecsplitCfg
+	}
+	if err := cfg.accessor.validate(); err != nil {
+		return nil, fmt.Errorf("NewInvertedIndex(%s): %w", filenameBase, err)
+	}
 	compressCfg := seg.DefaultCfg
 	compressCfg.Workers = 1
 	ii := InvertedIndex{
@@ -120,7 +179,9 @@ func NewInvertedIndex(cfg iiCfg, aggregationStep uint64, filenameBase, indexKeys
 		compressCfg:     compressCfg,
 		integrityCheck:  integrityCheck,
 		logger:          logger,
-		compression:     seg.CompressNone,
+		compression:     seg.CompressValsZstd, // detects zstd values, files without them are read as is
+		mergeWorkers:    1,
+		tempFiler:       NewTempFiler(cfg.dirs.Tmp),
 	}
 	ii.indexList = withHashMap
 
@@ -129,11 +190,51 @@ func NewInvertedIndex(cfg iiCfg, aggregationStep uint64, filenameBase, indexKeys
 	return &ii, nil
 }
 
+// efWriterCompression - of .ef files written by collation, merge and rewrites
+func (ii *InvertedIndex) efWriterCompression() seg.FileCompression {
+	if ii.efZstd {
+		return ii.compression
+	}
+	return ii.compression &^ seg.CompressValsZstd
+}
+
 func (ii *InvertedIndex) efAccessorFilePath(fromStep, toStep uint64) string {
 	return filepath.Join(ii.dirs.SnapAccessors, fmt.Sprintf("v1-%s.%d-%d.efi", ii.filenameBase, fromStep, toStep))
 }
 func (ii *InvertedIndex) efFilePath(fromStep, toStep uint64) string {
-	return filepath.Join(ii.dirs.SnapIdx, fmt.Sprintf("v1-%s.%d-%d.ef", ii.filenameBase, fromStep, toStep))
+	return filepath.Join(ii.dirs.SnapIdx, efFileName(ii.filenameBase, fromStep, toStep))
+}
+func efFileName(filenameBase string, fromStep, toStep uint64) string {
+	return fmt.Sprintf("v1-%s.%d-%d.ef", filenameBase, fromStep, toStep)
+}
+
+// StepSizes - sizes of all on-disk .ef files and their accessors. Sizes are read from filesystem.
+func (ii *InvertedIndex) StepSizes() []StepSize {
+	var res []StepSize
+	ii.dirtyFiles.Walk(func(items []*filesItem) bool {
+		for _, item := range items {
+			fromStep, toStep := StepOfTxNum(item.startTxNum, ii.aggregationStep), StepOfTxNum(item.endTxNum, ii.aggregationStep)
+			dataPath := ii.efFilePath(fromStep, toStep)
+			res = append(res, StepSize{
+				FromStep:   fromStep,
+				ToStep:     toStep,
+				DataBytes:  filesSizeOnDisk(dataPath, dataPath+checksumFileExt),
+				IndexBytes: filesSizeOnDisk(ii.efAccessorFilePath(fromStep, toStep)),
+			})
+		}
+		return true
+	})
+	return res
+}
+
+// filesSizeOnDisk - sum of sizes of existing files
+func filesSizeOnDisk(paths ...string) (size int64) {
+	for _, fPath := range paths {
+		if st, err := os.Stat(fPath); err == nil {
+			size += st.Size()
+		}
+	}
+	return size
 }
 
 func filesFromDir(dir string) ([]string, error) {
@@ -141,6 +242,10 @@ func filesFromDir(dir string) ([]string, error) {
 	if err != nil {
 		return nil, fmt.Errorf("filesFromDir: %w, %s", err, dir)
 	}
+	return filterFileNames(allFiles), nil
+}
+
+func filterFileNames(allFiles []fs.DirEntry) []string {
 	filtered := make([]string, 0, len(allFiles))
 	for _, f := range allFiles {
 		if f.IsDir() || !f.Type().IsRegular() {
@@ -151,18 +256,18 @@ func filesFromDir(dir string) ([]string, error) {
 		}
 		filtered = append(filtered, f.Name())
 	}
-	return filtered, nil
+	return filtered
 }
 func (ii *InvertedIndex) fileNamesOnDisk() (idx, hist, domain []string, err error) {
-	idx, err = filesFromDir(ii.dirs.SnapIdx)
+	idx, err = ii.filesFS.filesFromDir(ii.dirs.SnapIdx)
 	if err != nil {
 		return
 	}
-	hist, err = filesFromDir(ii.dirs.SnapHistory)
+	hist, err = ii.filesFS.filesFromDir(ii.dirs.SnapHistory)
 	if err != nil {
 		return
 	}
-	domain, err = filesFromDir(ii.dirs.SnapDomain)
+	domain, err = ii.filesFS.filesFromDir(ii.dirs.SnapDomain)
 	if err != nil {
 		return
 	}
@@ -179,6 +284,9 @@ func (ii *InvertedIndex) openList(fNames []string) error {
 }
 
 func (ii *InvertedIndex) openFolder() error {
+	if ii.inMem {
+		return nil
+	}
 	idxFiles, _, _, err := ii.fileNamesOnDisk()
 	if err != nil {
 		return err
@@ -186,6 +294,167 @@ func (ii *InvertedIndex) openFolder() error {
 	return ii.openList(idxFiles)
 }
 
+// Reopen - re-scans directory while files are in use: opens files which appeared on disk (e.g. downloaded),
+// builds their missed accessors and swaps visible files. Files which vanished from disk are not visible
+// for new RoTx, and closed by last RoTx which uses them - RoTx opened before Reopen are not affected.
+func (ii *InvertedIndex) Reopen(ctx context.Context) error {
+	if ii.inMem {
+		return nil
+	}
+	idxFiles, _, _, err := ii.fileNamesOnDisk()
+	if err != nil {
+		return err
+	}
+	onDisk := make(map[string]struct{}, len(idxFiles))
+	for _, fName := range idxFiles {
+		onDisk[fName] = struct{}{}
+	}
+	var vanished []*filesItem
+	ii.dirtyFiles.Walk(func(items []*filesItem) bool {
+		for _, item := range items {
+			if item.decompressor == nil {
+				continue
+			}
+			if _, ok := onDisk[item.decompressor.FileName()]; !ok {
+				vanished = append(vanished, item)
+			}
+		}
+		return true
+	})
+	for _, item := range vanished {
+		ii.dirtyFiles.Delete(item)
+	}
+
+	ii.scanDirtyFiles(idxFiles)
+	if err := ii.openDirtyFiles(); err != nil {
+		return fmt.Errorf("InvertedIndex(%s).Reopen: %w", ii.filenameBase, err)
+	}
+	g, ctx := errgroup.WithContext(ctx)
+	ii.BuildMissedAccessors(ctx, g, background.NewProgressSet())
+	if err := g.Wait(); err != nil {
+		return fmt.Errorf("InvertedIndex(%s).Reopen: %w", ii.filenameBase, err)
+	}
+	if err := ii.openDirtyFiles(); err != nil {
+		return fmt.Errorf("InvertedIndex(%s).Reopen: %w", ii.filenameBase, err)
+	}
+	ii.reCalcVisibleFiles(ii.dirtyFilesEndTxNumMinimax())
+
+	// not visible anymore: close now or by last reader
+	deleteMergeFile(ii.dirtyFiles, vanished, ii.filenameBase, ii.logger)
+	return nil
+}
+
+// replaceFiles - swaps all files by externally rebuilt .ef (and optional .crc32) files from `newDir`, which must
+// cover exactly same txNum range as visible files. New files are verified and indexed (.efi in `newDir` is re-built
+// with salt of `ii`) before old set is touched, then moved into snapshot dirs. Files of old set are unlinked only after
+// new set is opened and visible - they stay opened for already opened RoTx (closed by last reader), new RoTx see only
+// new set. Caller must exclude build/merge of files - see Aggregator.ReplaceFiles.
+func (ii *InvertedIndex) replaceFiles(ctx context.Context, newDir string) error {
+	if ii.inMem {
+		return fmt.Errorf("InvertedIndex(%s).ReplaceFiles: %w", ii.filenameBase, errInMemNoFiles)
+	}
+	names, err := filesFromDir(newDir)
+	if err != nil {
+		return fmt.Errorf("InvertedIndex(%s).ReplaceFiles: %w", ii.filenameBase, err)
+	}
+	re := regexp.MustCompile("^v[0-9]+-" + ii.filenameBase + ".([0-9]+)-([0-9]+).ef$")
+	type stepRange struct{ from, to uint64 }
+	var efNames []string
+	var ranges []stepRange
+	for _, name := range names {
+		subs := re.FindStringSubmatch(name)
+		if len(subs) != 3 {
+			continue
+		}
+		from, err1 := strconv.ParseUint(subs[1], 10, 64)
+		to, err2 := strconv.ParseUint(subs[2], 10, 64)
+		if err1 != nil || err2 != nil || from >= to {
+			return fmt.Errorf("InvertedIndex(%s).ReplaceFiles: invalid file name %s", ii.filenameBase, name)
+		}
+		efNames = append(efNames, name)
+		ranges = append(ranges, stepRange{from, to})
+	}
+	slices.SortFunc(ranges, func(a, b stepRange) int { return cmp.Compare(a.from, b.from) })
+
+	iit := ii.BeginFilesRo()
+	fromStep, toStep := uint64(0), uint64(0)
+	if len(iit.files) > 0 {
+		fromStep, toStep = StepOfTxNum(iit.files[0].startTxNum, ii.aggregationStep), StepOfTxNum(iit.files.EndTxNum(), ii.aggregationStep)
+	}
+	iit.Close()
+	if len(ranges) == 0 || ranges[0].from != fromStep || ranges[len(ranges)-1].to != toStep {
+		return fmt.Errorf("InvertedIndex(%s).ReplaceFiles: files of %s don't cover steps %d-%d", ii.filenameBase, newDir, fromStep, toStep)
+	}
+	for i := 1; i < len(ranges); i++ {
+		if ranges[i-1].to != ranges[i].from {
+			return fmt.Errorf("InvertedIndex(%s).ReplaceFiles: gap or overlap between steps %d-%d and %d-%d", ii.filenameBase, ranges[i-1].from, ranges[i-1].to, ranges[i].from, ranges[i].to)
+		}
+	}
+
+	// new files must be readable before old set is touched
+	ps := background.NewProgressSet()
+	for _, name := range efNames {
+		srcPath := filepath.Join(newDir, name)
+		if err := verifyChecksum(srcPath); err != nil {
+			return fmt.Errorf("InvertedIndex(%s).ReplaceFiles: %w", ii.filenameBase, err)
+		}
+		if err := ii.buildDirAccessor(ctx, srcPath, ps); err != nil {
+			return fmt.Errorf("InvertedIndex(%s).ReplaceFiles: %s: %w", ii.filenameBase, name, err)
+		}
+	}
+
+	// rename over file with same name is atomic and keeps old one readable by opened RoTx
+	for _, name := range efNames {
+		srcPath := filepath.Join(newDir, name)
+		for _, mv := range [][2]string{
+			{srcPath, filepath.Join(ii.dirs.SnapIdx, name)},
+			{srcPath + checksumFileExt, filepath.Join(ii.dirs.SnapIdx, name+checksumFileExt)},
+			{strings.TrimSuffix(srcPath, ".ef") + ".efi", filepath.Join(ii.dirs.SnapAccessors, strings.TrimSuffix(name, ".ef")+".efi")},
+		} {
+			if err := os.Rename(mv[0], mv[1]); err != nil && !errors.Is(err, os.ErrNotExist) {
+				return fmt.Errorf("InvertedIndex(%s).ReplaceFiles: %w", ii.filenameBase, err)
+			}
+		}
+	}
+
+	var old []*filesItem
+	ii.dirtyFiles.Walk(func(items []*filesItem) bool {
+		old = append(old, items...)
+		return true
+	})
+	for _, item := range old {
+		ii.dirtyFiles.Delete(item)
+	}
+	ii.scanDirtyFiles(efNames)
+	if err := ii.openDirtyFiles(); err != nil {
+		return fmt.Errorf("InvertedIndex(%s).ReplaceFiles: %w", ii.filenameBase, err)
+	}
+	ii.reCalcVisibleFiles(ii.dirtyFilesEndTxNumMinimax())
+
+	// old files: unlink now (opened files stay readable), close by last reader
+	for _, item := range old {
+		item.replaced.Store(true)
+		if item.decompressor != nil && slices.Contains(efNames, item.decompressor.FileName()) {
+			// same names now belong to new files: only .torrent of old content goes
+			_ = os.Remove(item.decompressor.FilePath() + ".torrent")
+			if item.index != nil {
+				_ = os.Remove(item.index.FilePath() + ".torrent")
+			}
+		} else {
+			item.removeFromDisk()
+		}
+		if item.frozen { // readers don't ref-count frozen files: keep them opened until Close
+			ii.replacedFrozen = append(ii.replacedFrozen, item)
+			continue
+		}
+		item.canDelete.Store(true)
+		if item.refcount.Load() == 0 {
+			item.closeFiles()
+		}
+	}
+	return nil
+}
+
 func (ii *InvertedIndex) scanDirtyFiles(fileNames []string) (garbageFiles []*filesItem) {
 	re := regexp.MustCompile("^v([0-9]+)-" + ii.filenameBase + ".([0-9]+)-([0-9]+).ef$")
 	var err error
@@ -286,7 +555,7 @@ func (ii *InvertedIndex) openDirtyFiles() error {
 			fromStep, toStep := item.startTxNum/ii.aggregationStep, item.endTxNum/ii.aggregationStep
 			if item.decompressor == nil {
 				fPath := ii.efFilePath(fromStep, toStep)
-				exists, err := dir.FileExist(fPath)
+				exists, err := ii.filesFS.exists(fPath)
 				if err != nil {
 					_, fName := filepath.Split(fPath)
 					ii.logger.Debug("[agg] InvertedIndex.openDirtyFiles: FileExists error", "f", fName, "err", err)
@@ -303,8 +572,26 @@ func (ii *InvertedIndex) openDirtyFiles() error {
 					invalidFileItemsLock.Unlock()
 					continue
 				}
+				if ii.filesFS.isEmpty(fPath) {
+					_, fName := filepath.Split(fPath)
+					ii.logger.Warn("[agg] InvertedIndex.openDirtyFiles: skip empty file", "f", fName)
+					invalidFileItemsLock.Lock()
+					invalidFileItems = append(invalidFileItems, item)
+					invalidFileItemsLock.Unlock()
+					continue
+				}
 
-				if item.decompressor, err = seg.NewDecompressor(fPath); err != nil {
+				if VerifyChecksumOnOpen {
+					if err := ii.filesFS.verifyChecksum(fPath); err != nil {
+						ii.logger.Warn("[agg] InvertedIndex.openDirtyFiles: file excluded", "err", err)
+						invalidFileItemsLock.Lock()
+						invalidFileItems = append(invalidFileItems, item)
+						invalidFileItemsLock.Unlock()
+						continue
+					}
+				}
+				item.fsys = ii.filesFS
+				if item.decompressor, err = ii.filesFS.openDecompressor(fPath, ii.dataAccess); err != nil {
 					_, fName := filepath.Split(fPath)
 					if errors.Is(err, &seg.ErrCompressedFileCorrupted{}) {
 						ii.logger.Debug("[agg] InvertedIndex.openDirtyFiles", "err", err, "f", fName)
@@ -321,14 +608,14 @@ func (ii *InvertedIndex) openDirtyFiles() error {
 
 			if item.index == nil {
 				fPath := ii.efAccessorFilePath(fromStep, toStep)
-				exists, err := dir.FileExist(fPath)
+				exists, err := ii.filesFS.exists(fPath)
 				if err != nil {
 					_, fName := filepath.Split(fPath)
 					ii.logger.Warn("[agg] InvertedIndex.openDirtyFiles", "err", err, "f", fName)
 					// don't interrupt on error. other files may be good
 				}
 				if exists {
-					if item.index, err = recsplit.OpenIndex(fPath); err != nil {
+					if item.index, err = ii.filesFS.openIndex(fPath); err != nil {
 						_, fName := filepath.Split(fPath)
 						ii.logger.Warn("[agg] InvertedIndex.openDirtyFiles", "err", err, "f", fName)
 						// don't interrupt on error. other files may be good
@@ -372,11 +659,17 @@ func (ii *InvertedIndex) Close() {
 		return
 	}
 	ii.closeWhatNotInList([]string{})
+	for _, item := range ii.replacedFrozen {
+		item.closeFiles()
+	}
+	ii.replacedFrozen = nil
 }
 
 // DisableFsync - just for tests
 func (ii *InvertedIndex) DisableFsync() { ii.noFsync = true }
 
+func (ii *InvertedIndex) SetMergeWorkers(i int) { ii.mergeWorkers = max(1, i) }
+
 func (iit *InvertedIndexRoTx) Files() (res []string) {
 	for _, item := range iit.files {
 		if item.src.decompressor != nil {
@@ -492,10 +785,36 @@ func (ii *InvertedIndex) BeginFilesRo() *InvertedIndexRoTx {
 		ii:      ii,
 		visible: ii._visible,
 		files:   files,
+		check:   newRoTxCheck(),
+	}
+}
+
+// BeginFilesRoAt - like BeginFilesRo, but sees only files with endTxNum <= txNum.
+// Files are ref-counted: merge will not remove them until InvertedIndexRoTx.Close
+func (ii *InvertedIndex) BeginFilesRoAt(txNum uint64) *InvertedIndexRoTx {
+	v := ii._visible
+	files := visibleFilesTo(v.files, txNum)
+	if len(files) != len(v.files) {
+		// caches of `v` may point to files which are not in `files`
+		v = &iiVisible{name: v.name, files: files, caches: &sync.Pool{New: NewIISeekInFilesCacheAny}}
+	}
+	for i := 0; i < len(files); i++ {
+		if !files[i].src.frozen {
+			files[i].src.refcount.Add(1)
+		}
+	}
+	return &InvertedIndexRoTx{
+		ii:      ii,
+		visible: v,
+		files:   files,
+		check:   newRoTxCheck(),
 	}
 }
+
 func (iit *InvertedIndexRoTx) Close() {
-	if iit.files == nil { // invariant: it's safe to call Close multiple times
+	iit.check.close("InvertedIndexRoTx", iit.ii.filenameBase)
+	if iit.files == nil { // invariant: it's safe to call Close multiple times (except `assert` build: roTxCheck)
+		iit.pinned.unpinAll(iit.ii.filesLRU, nil) // dirty files pinned by openFileOf
 		return
 	}
 	files := iit.files
@@ -518,6 +837,7 @@ func (iit *InvertedIndexRoTx) Close() {
 	for _, r := range iit.readers {
 		r.Close()
 	}
+	iit.pinned.unpinAll(iit.ii.filesLRU, files)
 
 	iit.visible.returnSeekInFilesCache(iit.seekInFilesCache)
 }
@@ -547,6 +867,11 @@ type InvertedIndexRoTx struct {
 	readers []*recsplit.IndexReader
 
 	seekInFilesCache *IISeekInFilesCache
+
+	filesTouched int // accessors of files read by seekInFiles: for lookupHistogram
+
+	check  roTxCheck // not last field: zero-size last field is padded
+	pinned filesPins
 }
 
 // hashKey - change of salt will require re-gen of indices
@@ -556,36 +881,52 @@ func (iit *InvertedIndexRoTx) hashKey(k []byte) (uint64, uint64) {
 	return murmur3.Sum128WithSeed(k, *iit.ii.salt)
 }
 
-func (iit *InvertedIndexRoTx) statelessGetter(i int) *seg.Reader {
+// openFile - file `i` is open until Close: re-opens it if it was closed by filesLRU
+func (iit *InvertedIndexRoTx) openFile(i int) error {
+	return iit.pinned.pin(iit.ii.filesLRU, iit.files, i, iit.ii.compression)
+}
+
+// openFileOf - like openFile, but `item` can be not visible in this RoTx (dirty file)
+func (iit *InvertedIndexRoTx) openFileOf(item *filesItem) error {
+	return iit.pinned.pinItem(iit.ii.filesLRU, iit.files, item, iit.ii.compression)
+}
+
+func (iit *InvertedIndexRoTx) statelessGetter(i int) (*seg.Reader, error) {
 	if iit.getters == nil {
 		iit.getters = make([]*seg.Reader, len(iit.files))
 	}
 	r := iit.getters[i]
 	if r == nil {
+		if err := iit.openFile(i); err != nil {
+			return nil, err
+		}
 		g := iit.files[i].src.decompressor.MakeGetter()
 		r = seg.NewReader(g, iit.ii.compression)
 		iit.getters[i] = r
 	}
-	return r
+	return r, nil
 }
-func (iit *InvertedIndexRoTx) statelessIdxReader(i int) *recsplit.IndexReader {
+func (iit *InvertedIndexRoTx) statelessIdxReader(i int) (*recsplit.IndexReader, error) {
 	if iit.readers == nil {
 		iit.readers = make([]*recsplit.IndexReader, len(iit.files))
 	}
 	r := iit.readers[i]
 	if r == nil {
+		if err := iit.openFile(i); err != nil {
+			return nil, err
+		}
 		r = iit.files[i].src.index.GetReaderFromPool()
 		iit.readers[i] = r
 	}
-	return r
+	return r, nil
 }
 
-func (iit *InvertedIndexRoTx) seekInFiles(key []byte, txNum uint64) (found bool, equalOrHigherTxNum uint64) {
+func (iit *InvertedIndexRoTx) seekInFiles(key []byte, txNum uint64) (found bool, equalOrHigherTxNum uint64, err error) {
 	if len(iit.files) == 0 {
-		return false, 0
+		return false, 0, nil
 	}
 	if iit.files[len(iit.files)-1].endTxNum <= txNum {
-		return false, 0
+		return false, 0, nil
 	}
 
 	hi, lo := iit.hashKey(key)
@@ -600,10 +941,10 @@ func (iit *InvertedIndexRoTx) seekInFiles(key []byte, txNum uint64) (found bool,
 		if ok && fromCache.requested <= txNum {
 			if txNum <= fromCache.found {
 				iit.seekInFilesCache.hit++
-				return true, fromCache.found
+				return true, fromCache.found, nil
 			} else if fromCache.found == 0 {
 				iit.seekInFilesCache.hit++
-				return false, 0
+				return false, 0, nil
 			}
 		}
 	}
@@ -612,12 +953,20 @@ func (iit *InvertedIndexRoTx) seekInFiles(key []byte, txNum uint64) (found bool,
 		if iit.files[i].endTxNum <= txNum {
 			continue
 		}
-		offset, ok := iit.statelessIdxReader(i).TwoLayerLookupByHash(hi, lo)
+		iit.filesTouched++
+		reader, err := iit.statelessIdxReader(i)
+		if err != nil {
+			return false, 0, err
+		}
+		offset, ok := reader.TwoLayerLookupByHash(hi, lo)
 		if !ok {
 			continue
 		}
 
-		g := iit.statelessGetter(i)
+		g, err := iit.statelessGetter(i)
+		if err != nil {
+			return false, 0, err
+		}
 		g.Reset(offset)
 		k, _ := g.Next(nil)
 		if !bytes.Equal(k, key) {
@@ -630,14 +979,90 @@ func (iit *InvertedIndexRoTx) seekInFiles(key []byte, txNum uint64) (found bool,
 			if iit.seekInFilesCache != nil {
 				iit.seekInFilesCache.Add(hi, iiSeekInFilesCacheItem{requested: txNum, found: equalOrHigherTxNum})
 			}
-			return true, equalOrHigherTxNum
+			return true, equalOrHigherTxNum, nil
 		}
 	}
 
 	if iit.seekInFilesCache != nil {
 		iit.seekInFilesCache.Add(hi, iiSeekInFilesCacheItem{requested: txNum, found: 0})
 	}
-	return false, 0
+	return false, 0, nil
+}
+
+// seekInFilesBatchScanRatio - if `len(keys) * ratio >= keys in file`, then sequential scan of file
+// in key order is cheaper than accessor lookup for each key
+const seekInFilesBatchScanRatio = 16
+
+// seekInFilesBatch - seekInFiles for sorted and unique `keys`. found[i], equalOrHigherTxNum[i] - result for keys[i].
+// Each file is walked at most once, files are walked in same order as by seekInFiles. Doesn't use seekInFilesCache.
+func (iit *InvertedIndexRoTx) seekInFilesBatch(keys [][]byte, txNum uint64, found []bool, equalOrHigherTxNum []uint64) error {
+	pending := make([]int, len(keys)) // indices of keys not found yet, in key order
+	for i := range pending {
+		pending[i] = i
+	}
+
+	var k, v []byte
+	ef := &eliasfano32.EliasFano{}
+	for i := 0; i < len(iit.files) && len(pending) > 0; i++ {
+		if iit.files[i].endTxNum <= txNum {
+			continue
+		}
+		notFound := pending[:0]
+		g, err := iit.statelessGetter(i)
+		if err != nil {
+			return err
+		}
+
+		if uint64(len(pending))*seekInFilesBatchScanRatio < uint64(iit.files[i].src.decompressor.Count()/2) {
+			reader, err := iit.statelessIdxReader(i)
+			if err != nil {
+				return err
+			}
+			for _, j := range pending {
+				hi, lo := iit.hashKey(keys[j])
+				offset, ok := reader.TwoLayerLookupByHash(hi, lo)
+				if !ok {
+					notFound = append(notFound, j)
+					continue
+				}
+				g.Reset(offset)
+				if k, _ = g.Next(k[:0]); !bytes.Equal(k, keys[j]) {
+					notFound = append(notFound, j)
+					continue
+				}
+				v, _ = g.Next(v[:0])
+				ef.Reset(v)
+				if equalOrHigherTxNum[j], found[j] = ef.Search(txNum); !found[j] {
+					notFound = append(notFound, j)
+				}
+			}
+			pending = notFound
+			continue
+		}
+
+		g.Reset(0)
+		n := 0
+		for n < len(pending) && g.HasNext() {
+			k, _ = g.Next(k[:0])
+			for n < len(pending) && bytes.Compare(keys[pending[n]], k) < 0 {
+				notFound = append(notFound, pending[n])
+				n++
+			}
+			if n == len(pending) || !bytes.Equal(keys[pending[n]], k) {
+				g.Skip()
+				continue
+			}
+			j := pending[n]
+			n++
+			v, _ = g.Next(v[:0])
+			ef.Reset(v)
+			if equalOrHigherTxNum[j], found[j] = ef.Search(txNum); !found[j] {
+				notFound = append(notFound, j)
+			}
+		}
+		pending = append(notFound, pending[n:]...)
+	}
+	return nil
 }
 
 // IdxRange - return range of txNums for given `key`
@@ -658,6 +1083,119 @@ func (iit *InvertedIndexRoTx) IdxRange(key []byte, startTxNum, endTxNum int, asc
 	return stream.Union[uint64](frozenIt, recentIt, asc, limit), nil
 }
 
+// TxNumsOf - ascending txNums of `key` in [fromTxNum, toTxNum). Lazy: elias-fano of each file (and db cursor) is decoded
+// while iterating - hot keys are not materialized, and early Close doesn't decode the rest. roTx=nil - only files are read.
+func (iit *InvertedIndexRoTx) TxNumsOf(key []byte, fromTxNum, toTxNum uint64, roTx kv.Tx) (stream.U64, error) {
+	to := -1 // unbounded
+	if toTxNum <= math.MaxInt {
+		to = int(toTxNum)
+	}
+	from := int(min(fromTxNum, math.MaxInt))
+	if roTx == nil {
+		return iit.iterateRangeFrozen(key, from, to, order.Asc, -1)
+	}
+	return iit.IdxRange(key, from, to, order.Asc, -1, roTx)
+}
+
+// IntersectTxNums - txNums in [fromTxNum, toTxNum) at which both `keyA` and `keyB` changed. Ascending.
+// In files: .ef lists of both keys are not decoded - one list seeks (ef.Search) to next value of another.
+// Files where any of keys is absent are skipped.
+func (iit *InvertedIndexRoTx) IntersectTxNums(keyA, keyB []byte, fromTxNum, toTxNum uint64, roTx kv.Tx) (res []uint64, err error) {
+	efA, efB := &eliasfano32.EliasFano{}, &eliasfano32.EliasFano{}
+	var vA, vB []byte
+	var ok bool
+	for i, item := range iit.files {
+		if item.endTxNum <= fromTxNum {
+			continue
+		}
+		if item.startTxNum >= toTxNum {
+			break
+		}
+		if vA, ok, err = iit.efInFile(i, keyA, vA[:0]); err != nil {
+			return nil, err
+		} else if !ok {
+			continue
+		}
+		if vB, ok, err = iit.efInFile(i, keyB, vB[:0]); err != nil {
+			return nil, err
+		} else if !ok {
+			continue
+		}
+		efA.Reset(vA)
+		efB.Reset(vB)
+		res = intersectEfs(efA, efB, max(fromTxNum, item.startTxNum), min(toTxNum, item.endTxNum), res)
+	}
+
+	if toTxNum <= iit.files.EndTxNum() {
+		return res, nil
+	}
+	from := int(max(fromTxNum, iit.files.EndTxNum()))
+	itA, err := iit.recentIterateRange(keyA, from, int(toTxNum), order.Asc, -1, roTx)
+	if err != nil {
+		return nil, err
+	}
+	defer itA.Close()
+	itB, err := iit.recentIterateRange(keyB, from, int(toTxNum), order.Asc, -1, roTx)
+	if err != nil {
+		return nil, err
+	}
+	defer itB.Close()
+	it := stream.Intersect[uint64](itA, itB, -1)
+	for it.HasNext() {
+		txNum, err := it.Next()
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, txNum)
+	}
+	return res, nil
+}
+
+// efInFile - .ef value of `key` in i-th file. Value may point to file data: `buf` is appended only if values are compressed by seg.CompressVals
+func (iit *InvertedIndexRoTx) efInFile(i int, key, buf []byte) ([]byte, bool, error) {
+	reader, err := iit.statelessIdxReader(i)
+	if err != nil {
+		return buf, false, err
+	}
+	hi, lo := iit.hashKey(key)
+	offset, ok := reader.TwoLayerLookupByHash(hi, lo)
+	if !ok {
+		return buf, false, nil
+	}
+	g, err := iit.statelessGetter(i)
+	if err != nil {
+		return buf, false, err
+	}
+	g.Reset(offset)
+	k, _ := g.Next(nil)
+	if !bytes.Equal(k, key) {
+		return buf, false, nil
+	}
+	buf, _ = g.Next(buf)
+	return buf, true, nil
+}
+
+// intersectEfs - appends to `res` values of [from, to) which exist in both lists
+func intersectEfs(a, b *eliasfano32.EliasFano, from, to uint64, res []uint64) []uint64 {
+	for from < to {
+		va, ok := a.Search(from)
+		if !ok || va >= to {
+			break
+		}
+		vb, ok := b.Search(va)
+		if !ok || vb >= to {
+			break
+		}
+		if va == vb {
+			res = append(res, va)
+			from = va + 1
+			continue
+		}
+		from = vb
+	}
+	return res
+}
+
 func (iit *InvertedIndexRoTx) recentIterateRange(key []byte, startTxNum, endTxNum int, asc order.By, limit int, roTx kv.Tx) (stream.U64, error) {
 	//optimization: return empty pre-allocated iterator if range is frozen
 	if asc {
@@ -708,9 +1246,11 @@ func (iit *InvertedIndexRoTx) iterateRangeFrozen(key []byte, startTxNum, endTxNu
 		startTxNum:  startTxNum,
 		endTxNum:    endTxNum,
 		indexTable:  iit.ii.indexTable,
+		compression: iit.ii.compression,
 		orderAscend: asc,
 		limit:       limit,
 		ef:          eliasfano32.NewEliasFano(1, 1),
+		check:       iit.check.iterOpened(),
 	}
 	if asc {
 		for i := len(iit.files) - 1; i >= 0; i-- {
@@ -724,6 +1264,10 @@ func (iit *InvertedIndexRoTx) iterateRangeFrozen(key []byte, startTxNum, endTxNu
 			if iit.files[i].src.index.KeyCount() == 0 {
 				continue
 			}
+			if err := iit.openFile(i); err != nil {
+				it.Close()
+				return nil, err
+			}
 			it.stack = append(it.stack, iit.files[i])
 			it.stack[len(it.stack)-1].getter = it.stack[len(it.stack)-1].src.decompressor.MakeGetter()
 			it.stack[len(it.stack)-1].reader = it.stack[len(it.stack)-1].src.index.GetReaderFromPool()
@@ -745,6 +1289,10 @@ func (iit *InvertedIndexRoTx) iterateRangeFrozen(key []byte, startTxNum, endTxNu
 			if iit.files[i].src.index.KeyCount() == 0 {
 				continue
 			}
+			if err := iit.openFile(i); err != nil {
+				it.Close()
+				return nil, err
+			}
 			it.stack = append(it.stack, iit.files[i])
 			it.stack[len(it.stack)-1].getter = it.stack[len(it.stack)-1].src.decompressor.MakeGetter()
 			it.stack[len(it.stack)-1].reader = it.stack[len(it.stack)-1].src.index.GetReaderFromPool()
@@ -778,8 +1326,8 @@ func (iit *InvertedIndexRoTx) CanPrune(tx kv.Tx) bool {
 }
 
 func (iit *InvertedIndexRoTx) canBuild(dbtx kv.Tx) bool { //nolint
-	maxStepInFiles := iit.files.EndTxNum() / iit.ii.aggregationStep
-	maxStepInDB := iit.ii.maxTxNumInDB(dbtx) / iit.ii.aggregationStep
+	maxStepInFiles := StepOfTxNum(iit.files.EndTxNum(), iit.ii.aggregationStep)
+	maxStepInDB := StepOfTxNum(iit.ii.maxTxNumInDB(dbtx), iit.ii.aggregationStep)
 	return maxStepInFiles < maxStepInDB
 }
 
@@ -788,6 +1336,8 @@ type InvertedIndexPruneStat struct {
 	MaxTxNum         uint64
 	PruneCountTx     uint64
 	PruneCountValues uint64
+	PruneCountKeys   uint64 // distinct keys touched by prune
+	PruneSize        uint64 // estimated size of removed records in bytes: key+txNum in both tables
 }
 
 func (is *InvertedIndexPruneStat) PrunedNothing() bool {
@@ -800,7 +1350,7 @@ func (is *InvertedIndexPruneStat) String() string {
 	}
 	vstr := ""
 	if is.PruneCountValues > 0 {
-		vstr = fmt.Sprintf("values: %s,", common.PrettyCounter(is.PruneCountValues))
+		vstr = fmt.Sprintf("values: %s, keys: %s, size: %s,", common.PrettyCounter(is.PruneCountValues), common.PrettyCounter(is.PruneCountKeys), common.ByteCount(is.PruneSize))
 	}
 	return fmt.Sprintf("%s txns: %d from %s-%s",
 		vstr, is.PruneCountTx, common.PrettyCounter(is.MinTxNum), common.PrettyCounter(is.MaxTxNum))
@@ -814,6 +1364,8 @@ func (is *InvertedIndexPruneStat) Accumulate(other *InvertedIndexPruneStat) {
 	is.MaxTxNum = max(is.MaxTxNum, other.MaxTxNum)
 	is.PruneCountTx += other.PruneCountTx
 	is.PruneCountValues += other.PruneCountValues
+	is.PruneCountKeys += other.PruneCountKeys
+	is.PruneSize += other.PruneSize
 }
 
 func (iit *InvertedIndexRoTx) Unwind(ctx context.Context, rwTx kv.RwTx, txFrom, txTo, limit uint64, logEvery *time.Ticker, forced bool, fn func(key []byte, txnum []byte) error) error {
@@ -824,6 +1376,33 @@ func (iit *InvertedIndexRoTx) Unwind(ctx context.Context, rwTx kv.RwTx, txFrom,
 	return nil
 }
 
+// PruneTo - prune [0; txTo) if it's already in files. Stat reports how much was removed
+func (iit *InvertedIndexRoTx) PruneTo(ctx context.Context, rwTx kv.RwTx, txTo, limit uint64, logEvery *time.Ticker) (*InvertedIndexPruneStat, error) {
+	return iit.Prune(ctx, rwTx, 0, txTo, limit, logEvery, false, nil)
+}
+
+// pruneBudgetBatchTxs - amount of txNums pruned by 1 Prune call of PruneWithBudget. Budget is checked between calls.
+const pruneBudgetBatchTxs = 1_000
+
+// PruneWithBudget - prune [0; txTo) by batches until it's done or `budget` is spent - then returns done=false and caller
+// must call it again later. Every batch preserves invariant: if some `txNum=N` pruned - it's pruned Fully.
+// At least 1 batch is pruned per call.
+func (iit *InvertedIndexRoTx) PruneWithBudget(ctx context.Context, rwTx kv.RwTx, txTo uint64, budget time.Duration, logEvery *time.Ticker) (done bool, err error) {
+	deadline := time.Now().Add(budget)
+	for {
+		stat, err := iit.Prune(ctx, rwTx, 0, txTo, pruneBudgetBatchTxs, logEvery, false, nil)
+		if err != nil {
+			return false, err
+		}
+		if stat.PruneCountTx < pruneBudgetBatchTxs {
+			return true, nil
+		}
+		if time.Now().After(deadline) {
+			return iit.ii.minTxNumInDB(rwTx) >= txTo, nil
+		}
+	}
+}
+
 // [txFrom; txTo)
 // forced - prune even if CanPrune returns false, so its true only when we do Unwind.
 func (iit *InvertedIndexRoTx) Prune(ctx context.Context, rwTx kv.RwTx, txFrom, txTo, limit uint64, logEvery *time.Ticker, forced bool, fn func(key []byte, txnum []byte) error) (stat *InvertedIndexPruneStat, err error) {
@@ -902,6 +1481,7 @@ func (iit *InvertedIndexRoTx) Prune(ctx context.Context, rwTx kv.RwTx, txFrom, t
 		}
 	}
 
+	var prevKey []byte
 	err = collector.Load(nil, "", func(key, txnm []byte, table etl.CurrentTableReader, next etl.LoadNextFunc) error {
 		if fn != nil {
 			if err = fn(key, txnm); err != nil {
@@ -913,6 +1493,11 @@ func (iit *InvertedIndexRoTx) Prune(ctx context.Context, rwTx kv.RwTx, txFrom, t
 		}
 		mxPruneSizeIndex.Inc()
 		stat.PruneCountValues++
+		stat.PruneSize += 2 * uint64(len(key)+len(txnm))
+		if stat.PruneCountKeys == 0 || !bytes.Equal(prevKey, key) {
+			stat.PruneCountKeys++
+			prevKey = append(prevKey[:0], key...)
+		}
 
 		select {
 		case <-logEvery.C:
@@ -948,16 +1533,16 @@ func (iit *InvertedIndexRoTx) Prune(ctx context.Context, rwTx kv.RwTx, txFrom, t
 func (iit *InvertedIndexRoTx) DebugEFAllValuesAreInRange(ctx context.Context, failFast bool, fromStep uint64) error {
 	logEvery := time.NewTicker(30 * time.Second)
 	defer logEvery.Stop()
-	fromTxNum := fromStep * iit.ii.aggregationStep
+	fromTxNum, _ := TxNumRangeOfStep(fromStep, iit.ii.aggregationStep)
 	iterStep := func(item visibleFile) error {
-		g := item.src.decompressor.MakeGetter()
+		g := seg.NewReader(item.src.decompressor.MakeGetter(), iit.ii.compression)
 		g.Reset(0)
 		defer item.src.decompressor.EnableReadAhead().DisableReadAhead()
 
+		var k, eliasVal []byte
 		for g.HasNext() {
-			k, _ := g.NextUncompressed()
-			_ = k
-			eliasVal, _ := g.NextUncompressed()
+			k, _ = g.Next(k[:0])
+			eliasVal, _ = g.Next(eliasVal[:0])
 			ef, _ := eliasfano32.ReadEliasFano(eliasVal)
 			if ef.Count() == 0 {
 				continue
@@ -990,13 +1575,16 @@ func (iit *InvertedIndexRoTx) DebugEFAllValuesAreInRange(ctx context.Context, fa
 		return nil
 	}
 
-	for _, item := range iit.files {
+	for i, item := range iit.files {
 		if item.src.decompressor == nil {
 			continue
 		}
 		if item.endTxNum <= fromTxNum {
 			continue
 		}
+		if err := iit.openFile(i); err != nil {
+			return err
+		}
 		if err := iterStep(item); err != nil {
 			return err
 		}
@@ -1010,14 +1598,16 @@ func (iit *InvertedIndexRoTx) DebugEFAllValuesAreInRange(ctx context.Context, fa
 // a requirement for interators to be composable (for example, to implement AND and OR for indices)
 // FrozenInvertedIdxIter must be closed after use to prevent leaking of resources like cursor
 type FrozenInvertedIdxIter struct {
+	check                roTxIterCheck
 	key                  []byte
 	startTxNum, endTxNum int
 	limit                int
 	orderAscend          order.By
 
-	efIt       stream.Uno[uint64]
-	indexTable string
-	stack      []visibleFile
+	efIt        stream.Uno[uint64]
+	indexTable  string
+	stack       []visibleFile
+	compression seg.FileCompression // of .ef files in `stack`
 
 	nextN   uint64
 	hasNext bool
@@ -1027,6 +1617,7 @@ type FrozenInvertedIdxIter struct {
 }
 
 func (it *FrozenInvertedIdxIter) Close() {
+	it.check.close()
 	for _, item := range it.stack {
 		item.reader.Close()
 	}
@@ -1070,11 +1661,11 @@ func (it *FrozenInvertedIdxIter) advanceInFiles() {
 			if !ok {
 				continue
 			}
-			g := item.getter
+			g := seg.NewReader(item.getter, it.compression)
 			g.Reset(offset)
-			k, _ := g.NextUncompressed()
+			k, _ := g.Next(nil)
 			if bytes.Equal(k, it.key) {
-				eliasVal, _ := g.NextUncompressed()
+				eliasVal, _ := g.Next(nil)
 				it.ef.Reset(eliasVal)
 				var efiter *eliasfano32.EliasFanoIter
 				if it.orderAscend {
@@ -1296,6 +1887,7 @@ type InvertedIterator1 struct {
 	startTxKey     [8]byte
 	hasNextInDb    bool
 	hasNextInFiles bool
+	err            error // sticky: iteration stops on first error
 }
 
 func (it *InvertedIterator1) Close() {
@@ -1314,10 +1906,14 @@ func (it *InvertedIterator1) advanceInFiles() {
 			heap.Push(&it.h, top)
 		}
 		if !bytes.Equal(key, it.key) {
+			if err := eliasfano32.Check(val); err != nil {
+				it.err = fmt.Errorf("%s: key %x: %w", top.g.FileName(), key, err)
+				it.hasNextInFiles = false
+				return
+			}
 			ef, _ := eliasfano32.ReadEliasFano(val)
-			min := ef.Get(0)
-			max := ef.Max()
-			if min < it.endTxNum && max >= it.startTxNum { // Intersection of [min; max) and [it.startTxNum; it.endTxNum)
+			// ef may have gaps: [min; max] intersecting [it.startTxNum; it.endTxNum) is not enough
+			if txNum, ok := ef.Search(it.startTxNum); ok && txNum < it.endTxNum {
 				it.key = key
 				it.nextFileKey = key
 				return
@@ -1332,21 +1928,23 @@ func (it *InvertedIterator1) advanceInDb() {
 	var err error
 	if it.cursor == nil {
 		if it.cursor, err = it.roTx.CursorDupSort(it.indexTable); err != nil {
-			// TODO pass error properly around
-			panic(err)
+			it.setDbErr(err)
+			return
 		}
 		if k, _, err = it.cursor.First(); err != nil {
-			// TODO pass error properly around
-			panic(err)
+			it.setDbErr(err)
+			return
 		}
 	} else {
 		if k, _, err = it.cursor.NextNoDup(); err != nil {
-			panic(err)
+			it.setDbErr(err)
+			return
 		}
 	}
 	for k != nil {
 		if v, err = it.cursor.SeekBothRange(k, it.startTxKey[:]); err != nil {
-			panic(err)
+			it.setDbErr(err)
+			return
 		}
 		if v != nil {
 			txNum := binary.BigEndian.Uint64(v)
@@ -1356,7 +1954,8 @@ func (it *InvertedIterator1) advanceInDb() {
 			}
 		}
 		if k, _, err = it.cursor.NextNoDup(); err != nil {
-			panic(err)
+			it.setDbErr(err)
+			return
 		}
 	}
 	it.cursor.Close()
@@ -1364,6 +1963,11 @@ func (it *InvertedIterator1) advanceInDb() {
 	it.hasNextInDb = false
 }
 
+func (it *InvertedIterator1) setDbErr(err error) {
+	it.err = fmt.Errorf("%s: %w", it.indexTable, err)
+	it.hasNextInDb = false
+}
+
 func (it *InvertedIterator1) advance() {
 	if it.hasNextInFiles {
 		if it.hasNextInDb {
@@ -1391,10 +1995,17 @@ func (it *InvertedIterator1) advance() {
 	}
 }
 
+// HasNext - returns false after error. Check `Err` after the loop
 func (it *InvertedIterator1) HasNext() bool {
+	if it.err != nil {
+		return false
+	}
 	return it.hasNextInFiles || it.hasNextInDb || it.nextKey != nil
 }
 
+// Err - returns first error happened during iteration (corrupted .ef value, DB error)
+func (it *InvertedIterator1) Err() error { return it.err }
+
 func (it *InvertedIterator1) Next(keyBuf []byte) []byte {
 	result := append(keyBuf, it.nextKey...)
 	it.advance()
@@ -1406,7 +2017,7 @@ func (iit *InvertedIndexRoTx) IterateChangedKeys(startTxNum, endTxNum uint64, ro
 	ii1.hasNextInDb = true
 	ii1.roTx = roTx
 	ii1.indexTable = iit.ii.indexTable
-	for _, item := range iit.files {
+	for i, item := range iit.files {
 		if item.endTxNum <= startTxNum {
 			continue
 		}
@@ -1416,6 +2027,10 @@ func (iit *InvertedIndexRoTx) IterateChangedKeys(startTxNum, endTxNum uint64, ro
 		if item.endTxNum >= endTxNum {
 			ii1.hasNextInDb = false
 		}
+		if err := iit.openFile(i); err != nil {
+			ii1.err = err
+			return ii1
+		}
 		g := seg.NewReader(item.src.decompressor.MakeGetter(), iit.ii.compression)
 		if g.HasNext() {
 			key, _ := g.Next(nil)
@@ -1432,20 +2047,165 @@ func (iit *InvertedIndexRoTx) IterateChangedKeys(startTxNum, endTxNum uint64, ro
 	return ii1
 }
 
+// SingleStepKeys - keys which are present in only 1 visible file (locality of such keys is trivial), with steps
+// range [fromStep, toStep) of this file. Ascending by key. Streaming: files are merged by heap, only current key of
+// each file is kept. DB is not read.
+func (iit *InvertedIndexRoTx) SingleStepKeys(ctx context.Context) stream.Trio[[]byte, uint64, uint64] {
+	it := &singleStepKeysIter{ctx: ctx, aggregationStep: iit.ii.aggregationStep, check: iit.check.iterOpened()}
+	for i, item := range iit.files {
+		if err := iit.openFile(i); err != nil {
+			it.err = err
+			return it
+		}
+		g := seg.NewReader(item.src.decompressor.MakeGetter(), iit.ii.compression)
+		if g.HasNext() {
+			key, _ := g.Next(nil)
+			heap.Push(&it.h, &ReconItem{startTxNum: item.startTxNum, endTxNum: item.endTxNum, g: g, txNum: item.startTxNum, key: key})
+		}
+	}
+	it.advance()
+	return it
+}
+
+type singleStepKeysIter struct {
+	check           roTxIterCheck
+	ctx             context.Context
+	h               ReconHeap
+	aggregationStep uint64
+
+	hasNext          bool
+	key              []byte
+	fromStep, toStep uint64
+	err              error
+}
+
+// pop - current key of top file, and move this file to next key
+func (it *singleStepKeysIter) pop() *ReconItem {
+	top := heap.Pop(&it.h).(*ReconItem)
+	key := top.key
+	top.g.Skip() // .ef of key
+	if top.g.HasNext() {
+		next := *top
+		next.key, _ = next.g.Next(nil)
+		heap.Push(&it.h, &next)
+	}
+	top.key = key
+	return top
+}
+
+func (it *singleStepKeysIter) advance() {
+	for it.h.Len() > 0 {
+		if err := it.ctx.Err(); err != nil {
+			it.err = err
+			return
+		}
+		top := it.pop()
+		single := true
+		for it.h.Len() > 0 && bytes.Equal(it.h[0].key, top.key) {
+			it.pop()
+			single = false
+		}
+		if single {
+			it.hasNext = true
+			it.key, it.fromStep, it.toStep = top.key, StepOfTxNum(top.startTxNum, it.aggregationStep), StepOfTxNum(top.endTxNum, it.aggregationStep)
+			return
+		}
+	}
+	it.hasNext = false
+}
+
+func (it *singleStepKeysIter) HasNext() bool { return it.err != nil || it.hasNext }
+func (it *singleStepKeysIter) Close()        { it.check.close() }
+func (it *singleStepKeysIter) Next() ([]byte, uint64, uint64, error) {
+	if it.err != nil {
+		return nil, 0, 0, it.err
+	}
+	key, fromStep, toStep := it.key, it.fromStep, it.toStep
+	it.advance()
+	return key, fromStep, toStep, nil
+}
+
+// KeyCount - amount of distinct keys in visible files (keys which are only in DB are not counted). Sum of accessors
+// key counts is not enough: key present in many files is counted by each of them. So if there are 2+ files - keys
+// of files are merged by heap (reads keys only, .ef values are skipped, not decoded).
+func (iit *InvertedIndexRoTx) KeyCount() (uint64, error) {
+	if len(iit.files) == 0 {
+		return 0, nil
+	}
+	if len(iit.files) == 1 {
+		if err := iit.openFile(0); err != nil {
+			return 0, err
+		}
+		if iit.files[0].src.index == nil {
+			return 0, fmt.Errorf("InvertedIndex(%s).KeyCount: file %s has no accessor", iit.ii.filenameBase, iit.files[0].src.decompressor.FileName())
+		}
+		return iit.files[0].src.index.KeyCount(), nil
+	}
+
+	var h ReconHeap
+	for i, item := range iit.files {
+		if err := iit.openFile(i); err != nil {
+			return 0, err
+		}
+		g := seg.NewReader(item.src.decompressor.MakeGetter(), iit.ii.compression)
+		if g.HasNext() {
+			key, _ := g.Next(nil)
+			heap.Push(&h, &ReconItem{startTxNum: item.startTxNum, g: g, txNum: item.startTxNum, key: key})
+		}
+	}
+	var count uint64
+	var lastKey []byte
+	for h.Len() > 0 {
+		top := h[0]
+		if count == 0 || !bytes.Equal(top.key, lastKey) {
+			count++
+			lastKey = append(lastKey[:0], top.key...)
+		}
+		top.g.Skip() // .ef of key
+		if top.g.HasNext() {
+			top.key, _ = top.g.Next(top.key[:0])
+			heap.Fix(&h, 0)
+		} else {
+			heap.Pop(&h)
+		}
+	}
+	return count, nil
+}
+
 // collate [stepFrom, stepTo)
 func (ii *InvertedIndex) collate(ctx context.Context, step uint64, roTx kv.Tx) (InvertedIndexCollation, error) {
+	return ii.collateKeyRange(ctx, step, nil, nil, roTx)
+}
+
+// collateKeyRange - collate only keys in [keyFrom, keyTo) (raw key bytes, nil - unbounded). Allows build partial
+// files of same step on different machines: concatenation of partial files in keys order equals to full collation.
+func (ii *InvertedIndex) collateKeyRange(ctx context.Context, step uint64, keyFrom, keyTo []byte, roTx kv.Tx) (InvertedIndexCollation, error) {
+	if ii.inMem {
+		return InvertedIndexCollation{}, fmt.Errorf("InvertedIndex(%s).collate: %w", ii.filenameBase, errInMemNoFiles)
+	}
 	stepTo := step + 1
-	txFrom, txTo := step*ii.aggregationStep, stepTo*ii.aggregationStep
+	txFrom, txTo := TxNumRangeOfStep(step, ii.aggregationStep)
 	start := time.Now()
 	defer mxCollateTookIndex.ObserveDuration(start)
 
+	tmpDir, removeTmp, err := ii.createTmpDir(ii.filenameBase + ".collate.ii")
+	if err != nil {
+		return InvertedIndexCollation{}, fmt.Errorf("create %s tmp dir: %w", ii.filenameBase, err)
+	}
+	keepTmp := false
+	defer func() {
+		if !keepTmp {
+			removeTmp()
+		}
+	}()
+
 	keysCursor, err := roTx.CursorDupSort(ii.indexKeysTable)
 	if err != nil {
 		return InvertedIndexCollation{}, fmt.Errorf("create %s keys cursor: %w", ii.filenameBase, err)
 	}
 	defer keysCursor.Close()
 
-	collector := etl.NewCollector(ii.filenameBase+".collate.ii", ii.iiCfg.dirs.Tmp, etl.NewSortableBuffer(CollateETLRAM), ii.logger)
+	collector := etl.NewCollector(ii.filenameBase+".collate.ii", tmpDir, etl.NewSortableBuffer(CollateETLRAM), ii.logger)
 	defer collector.Close()
 	collector.LogLvl(log.LvlTrace)
 
@@ -1460,6 +2220,9 @@ func (ii *InvertedIndex) collate(ctx context.Context, step uint64, roTx kv.Tx) (
 		if txNum >= txTo { // [txFrom; txTo)
 			break
 		}
+		if (keyFrom != nil && bytes.Compare(v, keyFrom) < 0) || (keyTo != nil && bytes.Compare(v, keyTo) >= 0) {
+			continue
+		}
 		if err := collector.Collect(v, k); err != nil {
 			return InvertedIndexCollation{}, fmt.Errorf("collect %s history key [%x]=>txn %d [%x]: %w", ii.filenameBase, k, txNum, k, err)
 		}
@@ -1472,7 +2235,8 @@ func (ii *InvertedIndex) collate(ctx context.Context, step uint64, roTx kv.Tx) (
 
 	var (
 		coll = InvertedIndexCollation{
-			iiPath: ii.efFilePath(step, stepTo),
+			iiPath:    ii.efFilePath(step, stepTo),
+			removeTmp: removeTmp,
 		}
 		closeComp bool
 	)
@@ -1482,11 +2246,15 @@ func (ii *InvertedIndex) collate(ctx context.Context, step uint64, roTx kv.Tx) (
 		}
 	}()
 
-	comp, err := seg.NewCompressor(ctx, "collate idx "+ii.filenameBase, coll.iiPath, ii.dirs.Tmp, ii.compressCfg, log.LvlTrace, ii.logger)
+	if _, err := removeEmptyFile(coll.iiPath, ii.logger); err != nil {
+		return InvertedIndexCollation{}, fmt.Errorf("remove %s empty file: %w", ii.filenameBase, err)
+	}
+
+	comp, err := seg.NewCompressor(ctx, "collate idx "+ii.filenameBase, coll.iiPath, tmpDir, ii.compressCfg, log.LvlTrace, ii.logger)
 	if err != nil {
 		return InvertedIndexCollation{}, fmt.Errorf("create %s compressor: %w", ii.filenameBase, err)
 	}
-	coll.writer = seg.NewWriter(comp, ii.compression)
+	coll.writer = seg.NewWriter(comp, ii.efWriterCompression())
 
 	var (
 		prevEf      []byte
@@ -1543,7 +2311,7 @@ func (ii *InvertedIndex) collate(ctx context.Context, step uint64, roTx kv.Tx) (
 		}
 	}
 
-	closeComp = false
+	closeComp, keepTmp = false, true
 	return coll, nil
 }
 
@@ -1563,14 +2331,18 @@ func (sf InvertedFiles) CleanupOnError() {
 }
 
 type InvertedIndexCollation struct {
-	iiPath string
-	writer *seg.Writer
+	iiPath    string
+	writer    *seg.Writer
+	removeTmp func() // temp files of `writer`
 }
 
 func (ic InvertedIndexCollation) Close() {
 	if ic.writer != nil {
 		ic.writer.Close()
 	}
+	if ic.removeTmp != nil {
+		ic.removeTmp()
+	}
 }
 
 // buildFiles - `step=N` means build file `[N:N+1)` which is equal to [N:N+1)
@@ -1579,6 +2351,7 @@ func (ii *InvertedIndex) buildFiles(ctx context.Context, step uint64, coll Inver
 		decomp    *seg.Decompressor
 		index     *recsplit.Index
 		existence *ExistenceFilter
+		iiSum     hash.Hash32
 		err       error
 	)
 	mxRunningFilesBuilding.Inc()
@@ -1607,6 +2380,7 @@ func (ii *InvertedIndex) buildFiles(ctx context.Context, step uint64, coll Inver
 
 	{
 		p := ps.AddNew(path.Base(coll.iiPath), 1)
+		iiSum = newChecksum(coll.writer)
 		if err = coll.writer.Compress(); err != nil {
 			ps.Delete(p)
 			return InvertedFiles{}, fmt.Errorf("compress %s: %w", ii.filenameBase, err)
@@ -1614,8 +2388,16 @@ func (ii *InvertedIndex) buildFiles(ctx context.Context, step uint64, coll Inver
 		coll.Close()
 		ps.Delete(p)
 	}
+	if removed, err := removeEmptyFile(coll.iiPath, ii.logger); err != nil {
+		return InvertedFiles{}, err
+	} else if removed {
+		return InvertedFiles{}, fmt.Errorf("compress %s: empty file %s", ii.filenameBase, filepath.Base(coll.iiPath))
+	}
+	if err = writeChecksum(coll.iiPath, iiSum.Sum32()); err != nil {
+		return InvertedFiles{}, err
+	}
 
-	if decomp, err = seg.NewDecompressor(coll.iiPath); err != nil {
+	if decomp, err = seg.NewDecompressorWithAccess(coll.iiPath, ii.dataAccess); err != nil {
 		return InvertedFiles{}, fmt.Errorf("open %s decompressor: %w", ii.filenameBase, err)
 	}
 
@@ -1631,13 +2413,16 @@ func (ii *InvertedIndex) buildFiles(ctx context.Context, step uint64, coll Inver
 }
 
 func (ii *InvertedIndex) buildMapAccessor(ctx context.Context, fromStep, toStep uint64, data *seg.Decompressor, ps *background.ProgressSet) error {
-	idxPath := ii.efAccessorFilePath(fromStep, toStep)
+	return ii.buildMapAccessorTo(ctx, data, ii.efAccessorFilePath(fromStep, toStep), ps)
+}
+
+func (ii *InvertedIndex) buildMapAccessorTo(ctx context.Context, data *seg.Decompressor, idxPath string, ps *background.ProgressSet) error {
 	cfg := recsplit.RecSplitArgs{
 		Enums:              true,
 		LessFalsePositives: true,
 
-		BucketSize: 2000,
-		LeafSize:   8,
+		BucketSize: ii.accessor.bucketSize,
+		LeafSize:   ii.accessor.leafSize,
 		TmpDir:     ii.dirs.Tmp,
 		IndexFile:  idxPath,
 		Salt:       ii.salt,
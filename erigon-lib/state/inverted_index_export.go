@@ -0,0 +1,273 @@
+// Copyright 2024 The Erigon Authors
+// This file is part of Erigon.
+//
+// Erigon is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Erigon is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with Erigon. If not, see <http://www.gnu.org/licenses/>.
+
+package state
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"regexp"
+
+	"github.com/erigontech/erigon-lib/log/v3"
+	"github.com/erigontech/erigon-lib/recsplit/eliasfano32"
+	"github.com/erigontech/erigon-lib/seg"
+)
+
+// Export format of InvertedIndex (all integers are uvarint):
+//
+//	header:  magic, version, len(filenameBase), filenameBase, aggregationStep, compression
+//	file:    1, startTxNum, endTxNum, records..., 0
+//	record:  len(key)+1, key, len(ef), ef
+//	trailer: 0
+//
+// `ef` is the eliasfano32 encoding of txNums list - same bytes as in .ef files, but never compressed by zstd.
+// `compression` is of writers of exported index: files written by import are compressed same way.
+// Accessors (.efi) are not exported: they are derivative and rebuilt by BuildMissedAccessors.
+const (
+	iiExportMagic   = "erigon-ii"
+	iiExportVersion = 1
+
+	// limits of lengths read from stream: it's untrusted input
+	iiExportMaxNameLen  = 64
+	iiExportMaxKeyLen   = 4096
+	iiExportMaxValueLen = 1 << 30
+)
+
+var iiExportNameRe = regexp.MustCompile(`^[a-z0-9_]+$`)
+
+// readExportBytes - reads `l` bytes of stream into `buf`. Memory is allocated while data is read: `l` of hostile or
+// corrupted stream can't force allocation bigger than the stream itself.
+func readExportBytes(r io.Reader, buf []byte, l, maxLen uint64) ([]byte, error) {
+	if l > maxLen {
+		return buf, fmt.Errorf("length %d exceeds limit %d", l, maxLen)
+	}
+	b := bytes.NewBuffer(buf[:0])
+	n, err := b.ReadFrom(io.LimitReader(r, int64(l)))
+	if err != nil {
+		return b.Bytes(), err
+	}
+	if uint64(n) != l {
+		return b.Bytes(), io.ErrUnexpectedEOF
+	}
+	return b.Bytes(), nil
+}
+
+// Export - streams all visible files of InvertedIndex to `w`
+func (iit *InvertedIndexRoTx) Export(ctx context.Context, w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	var buf []byte
+	putUvarint := func(v uint64) error {
+		buf = binary.AppendUvarint(buf[:0], v)
+		_, err := bw.Write(buf)
+		return err
+	}
+	putBytes := func(v []byte) error {
+		if err := putUvarint(uint64(len(v))); err != nil {
+			return err
+		}
+		_, err := bw.Write(v)
+		return err
+	}
+
+	if _, err := bw.WriteString(iiExportMagic); err != nil {
+		return err
+	}
+	if err := putUvarint(iiExportVersion); err != nil {
+		return err
+	}
+	if err := putBytes([]byte(iit.ii.filenameBase)); err != nil {
+		return err
+	}
+	if err := putUvarint(iit.ii.aggregationStep); err != nil {
+		return err
+	}
+	if err := putUvarint(uint64(iit.ii.efWriterCompression())); err != nil {
+		return err
+	}
+
+	for i, item := range iit.files {
+		if err := putUvarint(1); err != nil {
+			return err
+		}
+		if err := putUvarint(item.startTxNum); err != nil {
+			return err
+		}
+		if err := putUvarint(item.endTxNum); err != nil {
+			return err
+		}
+		g, err := iit.statelessGetter(i)
+		if err != nil {
+			return err
+		}
+		g.Reset(0)
+		var k, v []byte
+		for g.HasNext() {
+			k, _ = g.Next(k[:0])
+			if !g.HasNext() {
+				return fmt.Errorf("export %s: key without value in %s", iit.ii.filenameBase, g.FileName())
+			}
+			v, _ = g.Next(v[:0])
+			if err := putUvarint(uint64(len(k)) + 1); err != nil {
+				return err
+			}
+			if _, err := bw.Write(k); err != nil {
+				return err
+			}
+			if err := putBytes(v); err != nil {
+				return err
+			}
+
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			default:
+			}
+		}
+		if err := putUvarint(0); err != nil {
+			return err
+		}
+	}
+	if err := putUvarint(0); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// ImportInvertedIndex - reads stream produced by `Export` and writes .ef files into `dir`.
+// Returns names of created files. Accessors must be built by the InvertedIndex which opens them.
+func ImportInvertedIndex(ctx context.Context, r io.Reader, dir string, logger log.Logger) (fileNames []string, err error) {
+	br := bufio.NewReader(r)
+
+	magic := make([]byte, len(iiExportMagic))
+	if _, err = io.ReadFull(br, magic); err != nil {
+		return nil, fmt.Errorf("import: read magic: %w", err)
+	}
+	if string(magic) != iiExportMagic {
+		return nil, fmt.Errorf("import: not an inverted index export: magic=%q", magic)
+	}
+	version, err := binary.ReadUvarint(br)
+	if err != nil {
+		return nil, fmt.Errorf("import: read version: %w", err)
+	}
+	if version != iiExportVersion {
+		return nil, fmt.Errorf("import: unsupported version %d, expected %d", version, iiExportVersion)
+	}
+	nameLen, err := binary.ReadUvarint(br)
+	if err != nil {
+		return nil, fmt.Errorf("import: read name: %w", err)
+	}
+	filenameBase, err := readExportBytes(br, nil, nameLen, iiExportMaxNameLen)
+	if err != nil {
+		return nil, fmt.Errorf("import: read name: %w", err)
+	}
+	if !iiExportNameRe.Match(filenameBase) {
+		return nil, fmt.Errorf("import: invalid name %q", filenameBase)
+	}
+	aggregationStep, err := binary.ReadUvarint(br)
+	if err != nil {
+		return nil, fmt.Errorf("import: read aggregationStep: %w", err)
+	}
+	if aggregationStep == 0 {
+		return nil, errors.New("import: aggregationStep is 0")
+	}
+	compression, err := binary.ReadUvarint(br)
+	if err != nil {
+		return nil, fmt.Errorf("import: read compression: %w", err)
+	}
+
+	compressCfg := seg.DefaultCfg
+	compressCfg.Workers = 1
+	for {
+		hasFile, err := binary.ReadUvarint(br)
+		if err != nil {
+			return fileNames, fmt.Errorf("import %s: %w", filenameBase, err)
+		}
+		if hasFile == 0 {
+			break
+		}
+		startTxNum, err := binary.ReadUvarint(br)
+		if err != nil {
+			return fileNames, fmt.Errorf("import %s: read startTxNum: %w", filenameBase, err)
+		}
+		endTxNum, err := binary.ReadUvarint(br)
+		if err != nil {
+			return fileNames, fmt.Errorf("import %s: read endTxNum: %w", filenameBase, err)
+		}
+		if startTxNum%aggregationStep != 0 || endTxNum%aggregationStep != 0 || startTxNum >= endTxNum {
+			return fileNames, fmt.Errorf("import %s: invalid file range %d-%d", filenameBase, startTxNum, endTxNum)
+		}
+		fName := efFileName(string(filenameBase), StepOfTxNum(startTxNum, aggregationStep), StepOfTxNum(endTxNum, aggregationStep))
+		if err := importInvertedIndexFile(ctx, br, filepath.Join(dir, fName), startTxNum, endTxNum, compressCfg, seg.FileCompression(compression), logger); err != nil {
+			return fileNames, fmt.Errorf("import %s: %w", fName, err)
+		}
+		fileNames = append(fileNames, fName)
+	}
+	return fileNames, nil
+}
+
+func importInvertedIndexFile(ctx context.Context, br *bufio.Reader, fPath string, startTxNum, endTxNum uint64, compressCfg seg.Cfg, compression seg.FileCompression, logger log.Logger) error {
+	comp, err := seg.NewCompressor(ctx, "import "+filepath.Base(fPath), fPath, filepath.Dir(fPath), compressCfg, log.LvlTrace, logger)
+	if err != nil {
+		return err
+	}
+	defer comp.Close()
+	w := seg.NewWriter(comp, compression)
+	sum := newChecksum(w)
+
+	var k, v []byte
+	for {
+		kl, err := binary.ReadUvarint(br)
+		if err != nil {
+			return err
+		}
+		if kl == 0 {
+			break
+		}
+		if k, err = readExportBytes(br, k, kl-1, iiExportMaxKeyLen); err != nil {
+			return fmt.Errorf("read key: %w", err)
+		}
+		vl, err := binary.ReadUvarint(br)
+		if err != nil {
+			return err
+		}
+		if v, err = readExportBytes(br, v, vl, iiExportMaxValueLen); err != nil {
+			return fmt.Errorf("read value of key %x: %w", k, err)
+		}
+		if err = eliasfano32.Check(v); err != nil {
+			return fmt.Errorf("value of key %x: %w", k, err)
+		}
+		ef, _ := eliasfano32.ReadEliasFano(v)
+		if ef.Count() > 0 && (ef.Min() < startTxNum || ef.Max() >= endTxNum) {
+			return fmt.Errorf("key %x has txNums [%d, %d] out of file range [%d, %d)", k, ef.Min(), ef.Max(), startTxNum, endTxNum)
+		}
+		if err = w.AddWord(k); err != nil {
+			return err
+		}
+		if err = w.AddWord(v); err != nil {
+			return err
+		}
+	}
+	if err = w.Compress(); err != nil {
+		return err
+	}
+	return writeChecksum(fPath, sum.Sum32())
+}
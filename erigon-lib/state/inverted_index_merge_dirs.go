@@ -0,0 +1,264 @@
+// Copyright 2024 The Erigon Authors
+// This file is part of Erigon.
+//
+// Erigon is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Erigon is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with Erigon. If not, see <http://www.gnu.org/licenses/>.
+
+package state
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/erigontech/erigon-lib/common/background"
+	"github.com/erigontech/erigon-lib/log/v3"
+	"github.com/erigontech/erigon-lib/recsplit/eliasfano32"
+	"github.com/erigontech/erigon-lib/seg"
+)
+
+// dirFile - .ef file of flat directory (.ef, .ef.crc32 and .efi are side-by-side, like in ReplaceFiles)
+type dirFile struct {
+	name     string
+	from, to uint64 // steps
+}
+
+// MergeIndexDirs - moves .ef files of `srcDir` into `dstDir`. `srcDir` is newer: on overlapping steps it's data wins.
+// Files of `dstDir` partially covered by `srcDir` are re-written without covered steps (may produce several files),
+// fully covered files are removed. Accessors (.efi) of all moved and re-written files are re-built with salt of `ii`.
+// Result doesn't depend on files order in directories: only on step ranges in file names.
+// Covered files of `dstDir` are removed after all new files and accessors are in place: on error they are kept.
+//
+// Directories are flat: .ef, .ef.crc32 and .efi are side-by-side. Files of `ii` itself are not touched.
+func (ii *InvertedIndex) MergeIndexDirs(ctx context.Context, dstDir, srcDir string) error {
+	if ii.inMem {
+		return fmt.Errorf("InvertedIndex(%s).MergeIndexDirs: %w", ii.filenameBase, errInMemNoFiles)
+	}
+	dst, dstGarbage, err := ii.dirFiles(dstDir)
+	if err != nil {
+		return fmt.Errorf("InvertedIndex(%s).MergeIndexDirs: %w", ii.filenameBase, err)
+	}
+	src, srcGarbage, err := ii.dirFiles(srcDir)
+	if err != nil {
+		return fmt.Errorf("InvertedIndex(%s).MergeIndexDirs: %w", ii.filenameBase, err)
+	}
+
+	remove := func(fPath string) {
+		removeFilesAndTorrents(fPath, fPath+checksumFileExt, strings.TrimSuffix(fPath, ".ef")+".efi")
+	}
+	// sub-sets of other files: their data is in super-set. Removed first - pieces may have same names
+	for _, f := range dstGarbage {
+		remove(filepath.Join(dstDir, f.name))
+	}
+	for _, f := range srcGarbage {
+		remove(filepath.Join(srcDir, f.name))
+	}
+
+	// dst files covered by src: re-write uncovered pieces. Until covered files are removed (last step), pieces
+	// are sub-sets of them: error (or crash) leaves old data in dst, and pieces are garbage for next call
+	ps := background.NewProgressSet()
+	var superseded []string
+	for _, f := range dst {
+		pieces := subtractRanges(f, src)
+		if len(pieces) == 1 && pieces[0].from == f.from && pieces[0].to == f.to {
+			continue
+		}
+		for _, p := range pieces {
+			piecePath := filepath.Join(dstDir, filepath.Base(ii.efFilePath(p.from, p.to)))
+			if err := ii.writeEfPiece(ctx, filepath.Join(dstDir, f.name), piecePath, p.from, p.to); err != nil {
+				return fmt.Errorf("InvertedIndex(%s).MergeIndexDirs: %w", ii.filenameBase, err)
+			}
+			if err := ii.buildDirAccessor(ctx, piecePath, ps); err != nil {
+				return fmt.Errorf("InvertedIndex(%s).MergeIndexDirs: %w", ii.filenameBase, err)
+			}
+		}
+		superseded = append(superseded, filepath.Join(dstDir, f.name))
+	}
+
+	// accessors of src files are built before any of them is moved: salt of src may differ
+	for _, f := range src {
+		srcPath := filepath.Join(srcDir, f.name)
+		_ = os.Remove(strings.TrimSuffix(srcPath, ".ef") + ".efi")
+		if err := ii.buildDirAccessor(ctx, srcPath, ps); err != nil {
+			return fmt.Errorf("InvertedIndex(%s).MergeIndexDirs: %w", ii.filenameBase, err)
+		}
+	}
+	var moved []string
+	for _, f := range src {
+		srcPath, dstPath := filepath.Join(srcDir, f.name), filepath.Join(dstDir, f.name)
+		srcEfi, dstEfi := strings.TrimSuffix(srcPath, ".ef")+".efi", strings.TrimSuffix(dstPath, ".ef")+".efi"
+		for _, mv := range [][2]string{
+			{srcPath, dstPath},
+			{srcPath + checksumFileExt, dstPath + checksumFileExt},
+			{srcPath + ".torrent", dstPath + ".torrent"},
+			{srcEfi, dstEfi},
+		} {
+			if err := os.Rename(mv[0], mv[1]); err != nil && !errors.Is(err, os.ErrNotExist) {
+				return fmt.Errorf("InvertedIndex(%s).MergeIndexDirs: %w", ii.filenameBase, err)
+			}
+		}
+		moved = append(moved, dstPath)
+	}
+
+	for _, fPath := range superseded {
+		if slices.Contains(moved, fPath) { // replaced by src file of same steps
+			continue
+		}
+		remove(fPath)
+	}
+	return nil
+}
+
+// dirFiles - .ef files of `dir` sorted by steps. Files which are sub-set of other file are returned as `garbage`.
+// Partial overlap of 2 files - is error: unclear which data is newer.
+func (ii *InvertedIndex) dirFiles(dir string) (files, garbage []dirFile, err error) {
+	names, err := filesFromDir(dir)
+	if err != nil {
+		return nil, nil, err
+	}
+	re := regexp.MustCompile("^v[0-9]+-" + ii.filenameBase + ".([0-9]+)-([0-9]+).ef$")
+	var all []dirFile
+	for _, name := range names {
+		subs := re.FindStringSubmatch(name)
+		if len(subs) != 3 {
+			continue
+		}
+		from, err1 := strconv.ParseUint(subs[1], 10, 64)
+		to, err2 := strconv.ParseUint(subs[2], 10, 64)
+		if err1 != nil || err2 != nil || from >= to {
+			return nil, nil, fmt.Errorf("invalid file name %s", filepath.Join(dir, name))
+		}
+		all = append(all, dirFile{name: name, from: from, to: to})
+	}
+	// bigger files first: then sub-sets are always after their super-set
+	slices.SortFunc(all, func(a, b dirFile) int {
+		if c := cmp.Compare(a.from, b.from); c != 0 {
+			return c
+		}
+		if c := cmp.Compare(b.to, a.to); c != 0 {
+			return c
+		}
+		return cmp.Compare(a.name, b.name)
+	})
+	for _, f := range all {
+		if len(files) > 0 {
+			last := files[len(files)-1]
+			if f.to <= last.to {
+				garbage = append(garbage, f)
+				continue
+			}
+			if f.from < last.to {
+				return nil, nil, fmt.Errorf("overlap of %s and %s in %s", last.name, f.name, dir)
+			}
+		}
+		files = append(files, f)
+	}
+	return files, garbage, nil
+}
+
+// subtractRanges - steps of `f` not covered by `by`. `by` is sorted and has no overlaps.
+func subtractRanges(f dirFile, by []dirFile) (res []dirFile) {
+	from := f.from
+	for _, b := range by {
+		if b.to <= from || b.from >= f.to {
+			continue
+		}
+		if b.from > from {
+			res = append(res, dirFile{from: from, to: b.from})
+		}
+		from = b.to
+	}
+	if from < f.to {
+		res = append(res, dirFile{from: from, to: f.to})
+	}
+	return res
+}
+
+// writeEfPiece - writes to `to` txNums of `from` file which belong to steps [fromStep, toStep). Keys without such txNums are skipped.
+func (ii *InvertedIndex) writeEfPiece(ctx context.Context, from, to string, fromStep, toStep uint64) error {
+	d, err := seg.NewDecompressor(from)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	comp, err := seg.NewCompressor(ctx, "merge dirs", to, ii.dirs.Tmp, ii.compressCfg, log.LvlTrace, ii.logger)
+	if err != nil {
+		return err
+	}
+	defer comp.Close()
+	w := seg.NewWriter(comp, ii.efWriterCompression())
+	sum := newChecksum(w)
+	r := seg.NewReader(d.MakeGetter(), ii.compression)
+
+	fromTxNum, _ := TxNumRangeOfStep(fromStep, ii.aggregationStep)
+	toTxNum, _ := TxNumRangeOfStep(toStep, ii.aggregationStep)
+	var k, v, buf []byte
+	var txNums []uint64
+	for r.HasNext() {
+		k, _ = r.Next(k[:0])
+		v, _ = r.Next(v[:0])
+		txNums = txNums[:0]
+		ef, _ := eliasfano32.ReadEliasFano(v)
+		for it := ef.Iterator(); it.HasNext(); {
+			txNum, err := it.Next()
+			if err != nil {
+				return err
+			}
+			if txNum >= fromTxNum && txNum < toTxNum {
+				txNums = append(txNums, txNum)
+			}
+		}
+		if len(txNums) == 0 {
+			continue
+		}
+		newEf := eliasfano32.NewEliasFano(uint64(len(txNums)), txNums[len(txNums)-1])
+		for _, txNum := range txNums {
+			newEf.AddOffset(txNum)
+		}
+		newEf.Build()
+		buf = newEf.AppendBytes(buf[:0])
+		if err = w.AddWord(k); err != nil {
+			return err
+		}
+		if err = w.AddWord(buf); err != nil {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+		}
+	}
+	if err = w.Compress(); err != nil {
+		return err
+	}
+	return writeChecksum(to, sum.Sum32())
+}
+
+// buildDirAccessor - builds .efi next to .ef file `fPath`
+func (ii *InvertedIndex) buildDirAccessor(ctx context.Context, fPath string, ps *background.ProgressSet) error {
+	d, err := seg.NewDecompressor(fPath)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return ii.buildMapAccessorTo(ctx, d, strings.TrimSuffix(fPath, ".ef")+".efi", ps)
+}
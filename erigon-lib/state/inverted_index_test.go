@@ -21,13 +21,18 @@ import (
 	"context"
 	"encoding/binary"
 	"fmt"
+	"io"
 	"math"
 	"os"
+	"path/filepath"
+	"slices"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"golang.org/x/sync/errgroup"
 
 	"github.com/erigontech/erigon-lib/common/background"
 	"github.com/erigontech/erigon-lib/common/datadir"
@@ -42,6 +47,11 @@ import (
 )
 
 func testDbAndInvertedIndex(tb testing.TB, aggStep uint64, logger log.Logger) (kv.RwDB, *InvertedIndex) {
+	tb.Helper()
+	return testDbAndInvertedIndexOpts(tb, aggStep, false, logger)
+}
+
+func testDbAndInvertedIndexOpts(tb testing.TB, aggStep uint64, inMem bool, logger log.Logger) (kv.RwDB, *InvertedIndex) {
 	tb.Helper()
 	dirs := datadir.New(tb.TempDir())
 	keysTable := "Keys"
@@ -55,7 +65,10 @@ func testDbAndInvertedIndex(tb testing.TB, aggStep uint64, logger log.Logger) (k
 	}).MustOpen()
 	tb.Cleanup(db.Close)
 	salt := uint32(1)
-	cfg := iiCfg{salt: &salt, dirs: dirs, db: db}
+	cfg := iiCfg{salt: &salt, dirs: dirs, db: db, inMem: inMem}
+	if inMem {
+		cfg.dirs = datadir.Dirs{}
+	}
 	ii, err := NewInvertedIndex(cfg, aggStep, "inv", keysTable, indexTable, nil, logger)
 	require.NoError(tb, err)
 	ii.DisableFsync()
@@ -153,6 +166,125 @@ func TestInvIndexPruningCorrectness(t *testing.T) {
 	icc.Close()
 }
 
+func TestInvIndexPruneTo(t *testing.T) {
+	t.Parallel()
+
+	logger, require := log.New(), require.New(t)
+	db, ii, _ := filledInvIndexOfSize(t, 1000, 16, 31, logger)
+	ctx := context.Background()
+	logEvery := time.NewTicker(30 * time.Second)
+	defer logEvery.Stop()
+
+	rwTx, err := db.BeginRw(ctx)
+	require.NoError(err)
+	defer rwTx.Rollback()
+
+	for step := uint64(0); step < 2; step++ {
+		bs, err := ii.collate(ctx, step, rwTx)
+		require.NoError(err)
+		sf, err := ii.buildFiles(ctx, step, bs, background.NewProgressSet())
+		require.NoError(err)
+		ii.integrateDirtyFiles(sf, step*ii.aggregationStep, (step+1)*ii.aggregationStep)
+	}
+	ii.reCalcVisibleFiles(ii.dirtyFilesEndTxNumMinimax())
+
+	ic := ii.BeginFilesRo()
+	defer ic.Close()
+
+	// txNums [1; 31] are pruned, every key `k` is written at each txNum multiple of `k`
+	var expectValues uint64
+	for k := uint64(1); k <= 31; k++ {
+		expectValues += 31 / k
+	}
+
+	stat, err := ic.PruneTo(ctx, rwTx, 2*ii.aggregationStep, math.MaxUint64, logEvery)
+	require.NoError(err)
+	require.Equal(uint64(31), stat.PruneCountTx)
+	require.Equal(expectValues, stat.PruneCountValues)
+	require.Equal(uint64(31), stat.PruneCountKeys)
+	require.Equal(expectValues*(8+8)*2, stat.PruneSize)
+	require.Equal(uint64(1), stat.MinTxNum)
+	require.Equal(uint64(31), stat.MaxTxNum)
+
+	// nothing left to prune in this range
+	stat, err = ic.PruneTo(ctx, rwTx, 2*ii.aggregationStep, math.MaxUint64, logEvery)
+	require.NoError(err)
+	require.True(stat.PrunedNothing())
+	require.Zero(stat.PruneSize)
+}
+
+func TestInvIndexPruneWithBudget(t *testing.T) {
+	t.Parallel()
+
+	logger, require := log.New(), require.New(t)
+	ctx := context.Background()
+	logEvery := time.NewTicker(30 * time.Second)
+	defer logEvery.Stop()
+
+	const txs, aggStep = 3_000, 1_000
+	buildSteps := func(db kv.RwDB, ii *InvertedIndex) {
+		rwTx, err := db.BeginRw(ctx)
+		require.NoError(err)
+		defer rwTx.Rollback()
+		for step := uint64(0); step < 2; step++ {
+			bs, err := ii.collate(ctx, step, rwTx)
+			require.NoError(err)
+			sf, err := ii.buildFiles(ctx, step, bs, background.NewProgressSet())
+			require.NoError(err)
+			ii.integrateDirtyFiles(sf, step*ii.aggregationStep, (step+1)*ii.aggregationStep)
+		}
+		ii.reCalcVisibleFiles(ii.dirtyFilesEndTxNumMinimax())
+	}
+	dump := func(tx kv.Tx, table string) (res []string) {
+		require.NoError(tx.ForEach(table, nil, func(k, v []byte) error {
+			res = append(res, fmt.Sprintf("%x:%x", k, v))
+			return nil
+		}))
+		return res
+	}
+
+	// single full prune
+	db, ii, _ := filledInvIndexOfSize(t, txs, aggStep, 31, logger)
+	buildSteps(db, ii)
+	rwTx, err := db.BeginRw(ctx)
+	require.NoError(err)
+	defer rwTx.Rollback()
+	ic := ii.BeginFilesRo()
+	defer ic.Close()
+	_, err = ic.PruneTo(ctx, rwTx, ic.files.EndTxNum(), math.MaxUint64, logEvery)
+	require.NoError(err)
+	expectKeys, expectIdx := dump(rwTx, ii.indexKeysTable), dump(rwTx, ii.indexTable)
+
+	// prune with tiny budget: 1 batch per call
+	db2, ii2, _ := filledInvIndexOfSize(t, txs, aggStep, 31, logger)
+	buildSteps(db2, ii2)
+	rwTx2, err := db2.BeginRw(ctx)
+	require.NoError(err)
+	defer rwTx2.Rollback()
+	ic2 := ii2.BeginFilesRo()
+	defer ic2.Close()
+
+	calls := 0
+	for done := false; !done; calls++ {
+		done, err = ic2.PruneWithBudget(ctx, rwTx2, ic2.files.EndTxNum(), time.Nanosecond, logEvery)
+		require.NoError(err)
+
+		// consistent after each call: both tables have same pairs
+		keysCnt, err := rwTx2.Count(ii2.indexKeysTable)
+		require.NoError(err)
+		idxCnt, err := rwTx2.Count(ii2.indexTable)
+		require.NoError(err)
+		require.Equal(keysCnt, idxCnt)
+	}
+	require.Greater(calls, 1)
+	require.Equal(expectKeys, dump(rwTx2, ii2.indexKeysTable))
+	require.Equal(expectIdx, dump(rwTx2, ii2.indexTable))
+
+	done, err := ic2.PruneWithBudget(ctx, rwTx2, ic2.files.EndTxNum(), time.Nanosecond, logEvery)
+	require.NoError(err)
+	require.True(done)
+}
+
 func TestInvIndexCollationBuild(t *testing.T) {
 	t.Parallel()
 
@@ -231,6 +363,45 @@ func TestInvIndexCollationBuild(t *testing.T) {
 	}
 }
 
+func TestInvIndexCollateKeyRange(t *testing.T) {
+	t.Parallel()
+
+	logger, require := log.New(), require.New(t)
+	db, ii, _ := filledInvIndexOfSize(t, 1000, 16, 31, logger)
+	ctx := context.Background()
+	roTx, err := db.BeginRo(ctx)
+	require.NoError(err)
+	defer roTx.Rollback()
+
+	collateWords := func(keyFrom, keyTo []byte) (words [][]byte) {
+		t.Helper()
+		coll, err := ii.collateKeyRange(ctx, 0, keyFrom, keyTo, roTx)
+		require.NoError(err)
+		sf, err := ii.buildFiles(ctx, 0, coll, background.NewProgressSet())
+		require.NoError(err)
+		defer sf.CleanupOnError()
+		g := sf.decomp.MakeGetter()
+		for g.HasNext() {
+			w, _ := g.Next(nil)
+			words = append(words, w)
+		}
+		return words
+	}
+
+	full := collateWords(nil, nil)
+	require.Greater(len(full), 4)
+	mid := full[len(full)/4*2] // keys and values are interleaved: key is at even position
+
+	left, right := collateWords(nil, mid), collateWords(mid, nil)
+	require.NotEmpty(left)
+	require.NotEmpty(right)
+	require.Equal(mid, right[0]) // keyFrom is inclusive
+	for i := 0; i < len(left); i += 2 {
+		require.Negative(bytes.Compare(left[i], mid)) // keyTo is exclusive
+	}
+	require.Equal(full, append(left, right...))
+}
+
 func TestInvIndexAfterPrune(t *testing.T) {
 	t.Parallel()
 
@@ -331,9 +502,15 @@ func filledInvIndex(tb testing.TB, logger log.Logger) (kv.RwDB, *InvertedIndex,
 func filledInvIndexOfSize(tb testing.TB, txs, aggStep, module uint64, logger log.Logger) (kv.RwDB, *InvertedIndex, uint64) {
 	tb.Helper()
 	db, ii := testDbAndInvertedIndex(tb, aggStep, logger)
-	ctx, require := context.Background(), require.New(tb)
 	tb.Cleanup(db.Close)
+	fillInvIndex(tb, db, ii, txs, module)
+	return db, ii, txs
+}
 
+// fillInvIndex - keys are encodings of numbers 1..module, each key changes value on every txNum which is multiple of the key
+func fillInvIndex(tb testing.TB, db kv.RwDB, ii *InvertedIndex, txs, module uint64) {
+	tb.Helper()
+	ctx, require := context.Background(), require.New(tb)
 	err := db.Update(ctx, func(tx kv.RwTx) error {
 		ic := ii.BeginFilesRo()
 		defer ic.Close()
@@ -341,9 +518,6 @@ func filledInvIndexOfSize(tb testing.TB, txs, aggStep, module uint64, logger log
 		defer writer.close()
 
 		var flusher flusher
-
-		// keys are encodings of numbers 1..31
-		// each key changes value on every txNum which is multiple of the key
 		for txNum := uint64(1); txNum <= txs; txNum++ {
 			writer.SetTxNum(txNum)
 			for keyNum := uint64(1); keyNum <= module; keyNum++ {
@@ -368,7 +542,6 @@ func filledInvIndexOfSize(tb testing.TB, txs, aggStep, module uint64, logger log
 		return writer.Flush(ctx, tx)
 	})
 	require.NoError(err)
-	return db, ii, txs
 }
 
 func checkRanges(t *testing.T, db kv.RwDB, ii *InvertedIndex, txs uint64) {
@@ -489,7 +662,8 @@ func mergeInverted(tb testing.TB, db kv.RwDB, ii *InvertedIndex, txs uint64) {
 					if !found {
 						return true
 					}
-					outs := ic.staticFilesInRange(startTxNum, endTxNum)
+					outs, err := ic.staticFilesInRange(startTxNum, endTxNum)
+					require.NoError(tb, err)
 					in, err := ic.mergeFiles(ctx, outs, startTxNum, endTxNum, background.NewProgressSet())
 					require.NoError(tb, err)
 					ii.integrateMergedDirtyFiles(outs, in)
@@ -546,6 +720,153 @@ func TestInvIndexMerge(t *testing.T) {
 	checkRanges(t, db, ii, txs)
 }
 
+func TestInvIndexMergeParallel(t *testing.T) {
+	t.Parallel()
+
+	logger, require := log.New(), require.New(t)
+	ctx := context.Background()
+	aggStep, steps := uint64(16), uint64(4)
+	maxSpan := 2 * aggStep // 0-1,1-2,2-3,3-4: merge 0-2 and 2-4 independently
+
+	buildSteps := func(db kv.RwDB, ii *InvertedIndex) {
+		tx, err := db.BeginRo(ctx)
+		require.NoError(err)
+		defer tx.Rollback()
+		for step := uint64(0); step < steps; step++ {
+			bs, err := ii.collate(ctx, step, tx)
+			require.NoError(err)
+			sf, err := ii.buildFiles(ctx, step, bs, background.NewProgressSet())
+			require.NoError(err)
+			ii.integrateDirtyFiles(sf, step*ii.aggregationStep, (step+1)*ii.aggregationStep)
+		}
+		ii.reCalcVisibleFiles(ii.dirtyFilesEndTxNumMinimax())
+	}
+
+	dbSeq, iiSeq, _ := filledInvIndexOfSize(t, aggStep*steps, aggStep, 31, logger)
+	buildSteps(dbSeq, iiSeq)
+	for {
+		if stop := func() bool {
+			ic := iiSeq.BeginFilesRo()
+			defer ic.Close()
+			mr := ic.findMergeRange(iiSeq.dirtyFilesEndTxNumMinimax(), maxSpan)
+			if !mr.needMerge {
+				return true
+			}
+			outs, err := ic.staticFilesInRange(mr.from, mr.to)
+			require.NoError(err)
+			in, err := ic.mergeFiles(ctx, outs, mr.from, mr.to, background.NewProgressSet())
+			require.NoError(err)
+			iiSeq.integrateMergedDirtyFiles(outs, in)
+			iiSeq.reCalcVisibleFiles(iiSeq.dirtyFilesEndTxNumMinimax())
+			return false
+		}(); stop {
+			break
+		}
+	}
+
+	dbPar, iiPar, _ := filledInvIndexOfSize(t, aggStep*steps, aggStep, 31, logger)
+	buildSteps(dbPar, iiPar)
+	iiPar.SetMergeWorkers(2)
+
+	ic := iiPar.BeginFilesRo()
+	ranges := ic.findMergeRanges(iiPar.dirtyFilesEndTxNumMinimax(), maxSpan)
+	ic.Close()
+	require.Equal([]*MergeRange{{true, 0, 2 * aggStep}, {true, 2 * aggStep, 4 * aggStep}}, ranges)
+
+	merged, err := iiPar.mergeLoopStep(ctx, iiPar.dirtyFilesEndTxNumMinimax(), maxSpan, background.NewProgressSet())
+	require.NoError(err)
+	require.True(merged)
+	merged, err = iiPar.mergeLoopStep(ctx, iiPar.dirtyFilesEndTxNumMinimax(), maxSpan, background.NewProgressSet())
+	require.NoError(err)
+	require.False(merged)
+
+	icSeq, icPar := iiSeq.BeginFilesRo(), iiPar.BeginFilesRo()
+	defer icSeq.Close()
+	defer icPar.Close()
+	require.Equal([]string{"v1-inv.0-2.ef", "v1-inv.2-4.ef"}, icPar.Files())
+	require.Equal(icSeq.Files(), icPar.Files())
+	for _, r := range ranges {
+		fromStep, toStep := r.from/aggStep, r.to/aggStep
+		seqData, err := os.ReadFile(iiSeq.efFilePath(fromStep, toStep))
+		require.NoError(err)
+		parData, err := os.ReadFile(iiPar.efFilePath(fromStep, toStep))
+		require.NoError(err)
+		require.Equal(seqData, parData)
+	}
+}
+
+func TestInvIndexCompactSmallFiles(t *testing.T) {
+	t.Parallel()
+
+	logger, require := log.New(), require.New(t)
+	ctx := context.Background()
+	db, ii, txs := filledInvIndexOfSize(t, 160, 16, 31, logger)
+
+	// 1 file per step, no merge
+	tx, err := db.BeginRw(ctx)
+	require.NoError(err)
+	defer tx.Rollback()
+	for step := uint64(0); step < txs/ii.aggregationStep; step++ {
+		bs, err := ii.collate(ctx, step, tx)
+		require.NoError(err)
+		sf, err := ii.buildFiles(ctx, step, bs, background.NewProgressSet())
+		require.NoError(err)
+		ii.integrateDirtyFiles(sf, step*ii.aggregationStep, (step+1)*ii.aggregationStep)
+	}
+	ii.reCalcVisibleFiles(ii.dirtyFilesEndTxNumMinimax())
+	require.NoError(tx.Commit())
+
+	readAll := func() (res [][]uint64) {
+		ic := ii.BeginFilesRo()
+		defer ic.Close()
+		for keyNum := uint64(1); keyNum <= 32; keyNum++ {
+			var k [8]byte
+			binary.BigEndian.PutUint64(k[:], keyNum)
+			it, err := ic.IdxRange(k[:], 0, int(txs), order.Asc, -1, nil)
+			require.NoError(err)
+			res = append(res, stream.ToArrU64Must(it))
+		}
+		return res
+	}
+	ic := ii.BeginFilesRo()
+	require.Len(ic.files, int(txs/ii.aggregationStep))
+	ic.Close()
+	before := readAll()
+
+	// threshold is less than any file: nothing to compact
+	require.NoError(ii.CompactSmallFiles(ctx, 1))
+	ic = ii.BeginFilesRo()
+	require.Len(ic.files, int(txs/ii.aggregationStep))
+	ic.Close()
+
+	// aligned to power of 2, like regular merge
+	require.NoError(ii.CompactSmallFiles(ctx, 1<<20))
+	ic = ii.BeginFilesRo()
+	require.Equal([]string{"v1-inv.0-8.ef", "v1-inv.8-10.ef"}, ic.Files())
+	ic.Close()
+	require.Equal(before, readAll())
+
+	// after restart compacted file is used
+	ii.Close()
+	ii, err = NewInvertedIndex(ii.iiCfg, ii.aggregationStep, ii.filenameBase, ii.indexKeysTable, ii.indexTable, nil, logger)
+	require.NoError(err)
+	defer ii.Close()
+	require.NoError(ii.openFolder())
+	ii.reCalcVisibleFiles(ii.dirtyFilesEndTxNumMinimax())
+	ic = ii.BeginFilesRo()
+	require.Equal([]string{"v1-inv.0-8.ef", "v1-inv.8-10.ef"}, ic.Files())
+	ic.Close()
+	require.Equal(before, readAll())
+
+	// regular merge continues from compacted files
+	ic = ii.BeginFilesRo()
+	require.False(ic.findMergeRange(txs, 32*ii.aggregationStep).needMerge)
+	ic.Close()
+
+	_, h := testDbAndHistory(t, false, logger)
+	require.ErrorContains(h.InvertedIndex.CompactSmallFiles(ctx, 1<<20), "index of History")
+}
+
 func TestInvIndexScanFiles(t *testing.T) {
 	logger, require := log.New(), require.New(t)
 	db, ii, txs := filledInvIndex(t, logger)
@@ -628,6 +949,59 @@ func TestChangedKeysIterator(t *testing.T) {
 	}, keys)
 }
 
+func TestChangedKeysIterator_CorruptedFile(t *testing.T) {
+	t.Parallel()
+
+	logger, require := log.New(), require.New(t)
+	ctx := context.Background()
+	db, ii := testDbAndInvertedIndex(t, 16, logger)
+
+	// key 2 has corrupted value: header declares more data than it has
+	comp, err := seg.NewCompressor(ctx, "test", ii.efFilePath(0, 1), ii.dirs.Tmp, ii.compressCfg, log.LvlTrace, logger)
+	require.NoError(err)
+	defer comp.Close()
+	w := seg.NewWriter(comp, ii.compression)
+	var k [8]byte
+	for keyNum := uint64(1); keyNum <= 3; keyNum++ {
+		ef := eliasfano32.NewEliasFano(2, 15)
+		ef.AddOffset(keyNum)
+		ef.AddOffset(15)
+		ef.Build()
+		v := ef.AppendBytes(nil)
+		if keyNum == 2 {
+			v = v[:len(v)-8]
+		}
+		binary.BigEndian.PutUint64(k[:], keyNum)
+		require.NoError(w.AddWord(k[:]))
+		require.NoError(w.AddWord(v))
+	}
+	require.NoError(w.Compress())
+	comp.Close()
+
+	require.NoError(ii.openFolder())
+	g := &errgroup.Group{}
+	ii.BuildMissedAccessors(ctx, g, background.NewProgressSet())
+	require.NoError(g.Wait())
+	require.NoError(ii.openFolder())
+	ii.reCalcVisibleFiles(ii.dirtyFilesEndTxNumMinimax())
+
+	roTx, err := db.BeginRo(ctx)
+	require.NoError(err)
+	defer roTx.Rollback()
+	ic := ii.BeginFilesRo()
+	defer ic.Close()
+	require.Len(ic.files, 1)
+
+	it := ic.IterateChangedKeys(0, 16, roTx)
+	defer it.Close()
+	var keys []string
+	for it.HasNext() {
+		keys = append(keys, fmt.Sprintf("%x", it.Next(nil)))
+	}
+	require.Error(it.Err())
+	require.NotContains(keys, "0000000000000003")
+}
+
 func TestScanStaticFiles(t *testing.T) {
 	t.Parallel()
 
@@ -746,3 +1120,748 @@ func TestInvIndex_OpenFolder(t *testing.T) {
 	require.NoError(t, err)
 	ii.Close()
 }
+
+func TestInvIndexExportImport(t *testing.T) {
+	t.Parallel()
+
+	logger, require := log.New(), require.New(t)
+	ctx := context.Background()
+	db, ii, txs := filledInvIndexOfSize(t, 1000, 16, 31, logger)
+	mergeInverted(t, db, ii, txs)
+
+	ic := ii.BeginFilesRo()
+	defer ic.Close()
+	require.NotEmpty(ic.files)
+	var buf bytes.Buffer
+	require.NoError(ic.Export(ctx, &buf))
+
+	_, ii2 := testDbAndInvertedIndex(t, ii.aggregationStep, logger)
+	fileNames, err := ImportInvertedIndex(ctx, &buf, ii2.dirs.SnapIdx, logger)
+	require.NoError(err)
+	require.Equal(ic.Files(), fileNames)
+
+	require.NoError(ii2.openFolder())
+	g := &errgroup.Group{}
+	ii2.BuildMissedAccessors(ctx, g, background.NewProgressSet())
+	require.NoError(g.Wait())
+	require.NoError(ii2.openFolder())
+	ii2.reCalcVisibleFiles(ii2.dirtyFilesEndTxNumMinimax())
+
+	ic2 := ii2.BeginFilesRo()
+	defer ic2.Close()
+	require.Equal(len(ic.files), len(ic2.files))
+	for i := range ic.files {
+		require.Equal(ic.files[i].startTxNum, ic2.files[i].startTxNum)
+		require.Equal(ic.files[i].endTxNum, ic2.files[i].endTxNum)
+		g1, err := ic.statelessGetter(i)
+		require.NoError(err)
+		g2, err := ic2.statelessGetter(i)
+		require.NoError(err)
+		g1.Reset(0)
+		g2.Reset(0)
+		for g1.HasNext() {
+			require.True(g2.HasNext())
+			k1, _ := g1.Next(nil)
+			k2, _ := g2.Next(nil)
+			require.Equal(k1, k2)
+			v1, _ := g1.Next(nil)
+			v2, _ := g2.Next(nil)
+			require.Equal(v1, v2, "key %x", k1)
+		}
+		require.False(g2.HasNext())
+	}
+
+	frozenTo := int(ic.files.EndTxNum())
+	for keyNum := uint64(1); keyNum <= 31; keyNum++ {
+		var k [8]byte
+		binary.BigEndian.PutUint64(k[:], keyNum)
+		it, err := ic.IdxRange(k[:], 0, frozenTo, order.Asc, -1, nil)
+		require.NoError(err)
+		it2, err := ic2.IdxRange(k[:], 0, frozenTo, order.Asc, -1, nil)
+		require.NoError(err)
+		expect, err := stream.ToArrayU64(it)
+		require.NoError(err)
+		require.NotEmpty(expect)
+		stream.ExpectEqualU64(t, stream.Array(expect), it2)
+	}
+
+	_, err = ImportInvertedIndex(ctx, bytes.NewReader([]byte("not-an-export")), t.TempDir(), logger)
+	require.Error(err)
+
+	// hostile streams
+	header := func(name string) []byte {
+		b := append([]byte(iiExportMagic), iiExportVersion)
+		b = binary.AppendUvarint(b, uint64(len(name)))
+		b = append(b, name...)
+		b = binary.AppendUvarint(b, 16)
+		return binary.AppendUvarint(b, uint64(seg.CompressNone))
+	}
+	fileHeader := func(b []byte) []byte {
+		b = binary.AppendUvarint(b, 1)
+		b = binary.AppendUvarint(b, 0)
+		return binary.AppendUvarint(b, 16)
+	}
+	dir := t.TempDir()
+	_, err = ImportInvertedIndex(ctx, bytes.NewReader(header("../../evil")), dir, logger)
+	require.ErrorContains(err, "invalid name")
+	_, err = ImportInvertedIndex(ctx, bytes.NewReader(binary.AppendUvarint(append([]byte(iiExportMagic), iiExportVersion), math.MaxUint64)), dir, logger)
+	require.ErrorContains(err, "exceeds limit")
+	huge := binary.AppendUvarint(fileHeader(header("logaddrs")), 9)
+	huge = binary.AppendUvarint(append(huge, make([]byte, 8)...), iiExportMaxValueLen)
+	_, err = ImportInvertedIndex(ctx, bytes.NewReader(huge), dir, logger)
+	require.ErrorIs(err, io.ErrUnexpectedEOF)
+	badEf := binary.AppendUvarint(fileHeader(header("logaddrs")), 9)
+	badEf = binary.AppendUvarint(append(badEf, make([]byte, 8)...), 16)
+	badEf = append(badEf, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0, 0, 0, 0, 0, 0, 0, 16)
+	_, err = ImportInvertedIndex(ctx, bytes.NewReader(badEf), dir, logger)
+	require.ErrorContains(err, "eliasfano32")
+}
+
+func TestInvIndexReopen(t *testing.T) {
+	t.Parallel()
+
+	logger, require := log.New(), require.New(t)
+	ctx := context.Background()
+	db, ii, _ := filledInvIndexOfSize(t, 64, 16, 31, logger)
+	tx, err := db.BeginRo(ctx)
+	require.NoError(err)
+	defer tx.Rollback()
+
+	buildStep := func(step uint64) InvertedFiles {
+		coll, err := ii.collate(ctx, step, tx)
+		require.NoError(err)
+		sf, err := ii.buildFiles(ctx, step, coll, background.NewProgressSet())
+		require.NoError(err)
+		return sf
+	}
+	sf := buildStep(0)
+	ii.integrateDirtyFiles(sf, 0, ii.aggregationStep)
+	ii.reCalcVisibleFiles(ii.dirtyFilesEndTxNumMinimax())
+
+	ic0 := ii.BeginFilesRo()
+	defer ic0.Close()
+	require.Equal(ii.aggregationStep, ic0.files.EndTxNum())
+
+	// files of step 1 are added by external tool
+	sf = buildStep(1)
+	sf.decomp.Close()
+	sf.index.Close()
+	if sf.existence != nil {
+		sf.existence.Close()
+	}
+	require.NoError(ii.Reopen(ctx))
+
+	ic := ii.BeginFilesRo()
+	require.Equal(2*ii.aggregationStep, ic.files.EndTxNum())
+	var k [8]byte
+	binary.BigEndian.PutUint64(k[:], 1)
+	it, err := ic.IdxRange(k[:], int(ii.aggregationStep), int(2*ii.aggregationStep), order.Asc, -1, nil)
+	require.NoError(err)
+	txNums, err := stream.ToArrayU64(it)
+	require.NoError(err)
+	require.Len(txNums, int(ii.aggregationStep))
+	ic.Close()
+
+	// file of step 0 is removed by external tool: not visible for new RoTx, but still readable by old one
+	require.NoError(os.Remove(ii.efFilePath(0, 1)))
+	require.NoError(ii.Reopen(ctx))
+	ic = ii.BeginFilesRo()
+	require.Len(ic.files, 1)
+	require.Equal(ii.aggregationStep, ic.files[0].startTxNum)
+	ic.Close()
+
+	require.Equal(ii.aggregationStep, ic0.files.EndTxNum())
+	it, err = ic0.IdxRange(k[:], 0, int(ii.aggregationStep), order.Asc, -1, nil)
+	require.NoError(err)
+	txNums, err = stream.ToArrayU64(it)
+	require.NoError(err)
+	require.Len(txNums, int(ii.aggregationStep)-1) // txNum 0 is not written
+	src := ic0.files[0].src
+	ic0.Close()
+	require.Nil(src.decompressor) // closed by last reader
+}
+
+func TestInvIndexReplaceFiles(t *testing.T) {
+	t.Parallel()
+
+	logger, require := log.New(), require.New(t)
+	ctx := context.Background()
+	db, ii, txs := filledInvIndexOfSize(t, 1000, 16, 31, logger)
+	mergeInverted(t, db, ii, txs)
+	// rebuilt offline: same steps but only keys 1..15
+	rebuiltDb, rebuilt, _ := filledInvIndexOfSize(t, 1000, 16, 15, logger)
+	mergeInverted(t, rebuiltDb, rebuilt, txs)
+
+	newDir := t.TempDir()
+	copyFiles := func(pattern string) {
+		matches, err := filepath.Glob(pattern)
+		require.NoError(err)
+		for _, fPath := range matches {
+			data, err := os.ReadFile(fPath)
+			require.NoError(err)
+			require.NoError(os.WriteFile(filepath.Join(newDir, filepath.Base(fPath)), data, 0644))
+		}
+	}
+	copyFiles(filepath.Join(rebuilt.dirs.SnapIdx, "*.ef*"))
+	copyFiles(filepath.Join(rebuilt.dirs.SnapAccessors, "*.efi"))
+
+	var k [8]byte
+	binary.BigEndian.PutUint64(k[:], 20)
+	key20 := func(ic *InvertedIndexRoTx) []uint64 {
+		it, err := ic.IdxRange(k[:], 0, int(ic.files.EndTxNum()), order.Asc, -1, nil)
+		require.NoError(err)
+		return stream.ToArrU64Must(it)
+	}
+
+	// incomplete set is rejected: nothing changes
+	incompleteDir := t.TempDir()
+	require.NoError(os.Link(filepath.Join(newDir, "v1-inv.0-32.ef"), filepath.Join(incompleteDir, "v1-inv.0-32.ef")))
+	require.Error(ii.replaceFiles(ctx, incompleteDir))
+
+	// corrupted new file is rejected before old files are touched
+	corruptDir := t.TempDir()
+	copyTo := func(dir, name string, corrupt bool) {
+		data, err := os.ReadFile(filepath.Join(newDir, name))
+		require.NoError(err)
+		if corrupt {
+			data = slices.Clone(data)
+			data[len(data)/2] ^= 0xff
+		}
+		require.NoError(os.WriteFile(filepath.Join(dir, name), data, 0644))
+	}
+	newNames, err := filesFromDir(newDir)
+	require.NoError(err)
+	for _, name := range newNames {
+		copyTo(corruptDir, name, name == "v1-inv.0-32.ef")
+	}
+	require.ErrorContains(ii.replaceFiles(ctx, corruptDir), "mismatch")
+	require.FileExists(ii.efFilePath(0, 32))
+	require.FileExists(ii.efAccessorFilePath(0, 32))
+
+	oldIc := ii.BeginFilesRo()
+	defer oldIc.Close()
+	require.NotEmpty(key20(oldIc))
+	oldFiles := oldIc.Files()
+
+	require.NoError(ii.replaceFiles(ctx, newDir))
+
+	// old RoTx still sees old files, new RoTx - new ones
+	require.NotEmpty(key20(oldIc))
+	newIc := ii.BeginFilesRo()
+	require.Equal(oldFiles, newIc.Files())
+	require.Empty(key20(newIc))
+	newIc.Close()
+
+	src := oldIc.files[0].src
+	oldIc.Close()
+	require.Nil(src.decompressor) // closed by last reader, but new file with same name stays on disk
+	require.FileExists(ii.efFilePath(0, 32))
+	newIc = ii.BeginFilesRo()
+	defer newIc.Close()
+	require.Empty(key20(newIc))
+	binary.BigEndian.PutUint64(k[:], 3)
+	require.Len(key20(newIc), int(newIc.files.EndTxNum()-1)/3)
+}
+
+func TestInvIndexIntersectTxNums(t *testing.T) {
+	t.Parallel()
+
+	logger, require := log.New(), require.New(t)
+	db, ii, txs := filledInvIndexOfSize(t, 1000, 16, 31, logger)
+	mergeInverted(t, db, ii, txs)
+
+	roTx, err := db.BeginRo(context.Background())
+	require.NoError(err)
+	defer roTx.Rollback()
+	ic := ii.BeginFilesRo()
+	defer ic.Close()
+	require.Less(ic.files.EndTxNum(), txs)
+
+	naive := func(keyA, keyB []byte, fromTxNum, toTxNum uint64) []uint64 {
+		itA, err := ic.IdxRange(keyA, int(fromTxNum), int(toTxNum), order.Asc, -1, roTx)
+		require.NoError(err)
+		a, err := stream.ToArrayU64(itA)
+		require.NoError(err)
+		itB, err := ic.IdxRange(keyB, int(fromTxNum), int(toTxNum), order.Asc, -1, roTx)
+		require.NoError(err)
+		b, err := stream.ToArrayU64(itB)
+		require.NoError(err)
+		var res []uint64
+		for _, txNum := range a {
+			if slices.Contains(b, txNum) {
+				res = append(res, txNum)
+			}
+		}
+		return res
+	}
+
+	key := func(n uint64) []byte {
+		var k [8]byte
+		binary.BigEndian.PutUint64(k[:], n)
+		return k[:]
+	}
+	for _, pair := range [][2]uint64{{2, 3}, {4, 6}, {5, 7}, {1, 31}, {31, 31}, {3, 100}} {
+		for _, r := range [][2]uint64{{0, txs + 1}, {100, 517}, {ic.files.EndTxNum() - 5, ic.files.EndTxNum() + 5}, {990, txs + 1}} {
+			label := fmt.Sprintf("keys=%d,%d range=[%d,%d)", pair[0], pair[1], r[0], r[1])
+			got, err := ic.IntersectTxNums(key(pair[0]), key(pair[1]), r[0], r[1], roTx)
+			require.NoError(err, label)
+			require.Equal(naive(key(pair[0]), key(pair[1]), r[0], r[1]), got, label)
+		}
+	}
+
+	got, err := ic.IntersectTxNums(key(2), key(3), 0, txs+1, roTx)
+	require.NoError(err)
+	require.Len(got, int(txs/6))
+	got, err = ic.IntersectTxNums(key(3), key(100), 0, txs+1, roTx)
+	require.NoError(err)
+	require.Empty(got)
+}
+
+func TestInvIndexTxNumsOf(t *testing.T) {
+	t.Parallel()
+
+	logger, require := log.New(), require.New(t)
+	db, ii, txs := filledInvIndexOfSize(t, 1000, 16, 31, logger)
+	mergeInverted(t, db, ii, txs)
+
+	roTx, err := db.BeginRo(context.Background())
+	require.NoError(err)
+	defer roTx.Rollback()
+	ic := ii.BeginFilesRo()
+	defer ic.Close()
+	filesEnd := ic.files.EndTxNum()
+
+	// key 1 is dense: changes on every txNum
+	var k [8]byte
+	binary.BigEndian.PutUint64(k[:], 1)
+	materialized := func(from, to uint64) (res []uint64) {
+		for txNum := max(from, 1); txNum < to && txNum <= txs; txNum++ {
+			res = append(res, txNum)
+		}
+		return res
+	}
+	for _, r := range [][2]uint64{{0, math.MaxUint64}, {100, 517}, {filesEnd - 5, filesEnd + 5}, {990, txs + 1}, {7, 7}} {
+		it, err := ic.TxNumsOf(k[:], r[0], r[1], roTx)
+		require.NoError(err)
+		got, err := stream.ToArrayU64(it)
+		require.NoError(err)
+		require.Equal(materialized(r[0], r[1]), got, "range=[%d,%d)", r[0], r[1])
+	}
+
+	// files only
+	it, err := ic.TxNumsOf(k[:], 0, math.MaxUint64, nil)
+	require.NoError(err)
+	got, err := stream.ToArrayU64(it)
+	require.NoError(err)
+	require.Equal(materialized(0, filesEnd), got)
+
+	// early termination
+	it, err = ic.TxNumsOf(k[:], 100, math.MaxUint64, roTx)
+	require.NoError(err)
+	for want := uint64(100); want < 103; want++ {
+		require.True(it.HasNext())
+		n, err := it.Next()
+		require.NoError(err)
+		require.Equal(want, n)
+	}
+	it.Close()
+}
+
+func TestInvIndexSingleStepKeys(t *testing.T) {
+	t.Parallel()
+
+	logger, require := log.New(), require.New(t)
+	// key k changes on txNums k, 2k, ...: big keys are present in few files
+	db, ii, txs := filledInvIndexOfSize(t, 1000, 16, 700, logger)
+	mergeInverted(t, db, ii, txs)
+
+	ic := ii.BeginFilesRo()
+	defer ic.Close()
+	require.Greater(len(ic.files), 1)
+
+	filesOfKey := map[string][]int{}
+	for i, item := range ic.files {
+		g := seg.NewReader(item.src.decompressor.MakeGetter(), ii.compression)
+		for g.HasNext() {
+			key, _ := g.Next(nil)
+			filesOfKey[string(key)] = append(filesOfKey[string(key)], i)
+			g.Skip()
+		}
+	}
+
+	it := ic.SingleStepKeys(context.Background())
+	defer it.Close()
+	var prev []byte
+	yielded := map[string]struct{}{}
+	for it.HasNext() {
+		key, fromStep, toStep, err := it.Next()
+		require.NoError(err)
+		require.Less(bytes.Compare(prev, key), 0)
+		prev = key
+		files := filesOfKey[string(key)]
+		require.Len(files, 1, "key=%x", key)
+		item := ic.files[files[0]]
+		require.Equal(item.startTxNum/ii.aggregationStep, fromStep)
+		require.Equal(item.endTxNum/ii.aggregationStep, toStep)
+		yielded[string(key)] = struct{}{}
+	}
+	require.NotEmpty(yielded)
+	for key, files := range filesOfKey {
+		if len(files) == 1 {
+			require.Contains(yielded, key)
+		}
+	}
+
+	// cancelled context
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	it = ic.SingleStepKeys(ctx)
+	require.True(it.HasNext())
+	_, _, _, err := it.Next()
+	require.ErrorIs(err, context.Canceled)
+}
+
+func TestInvIndexInMem(t *testing.T) {
+	t.Parallel()
+
+	logger, require := log.New(), require.New(t)
+	ctx := context.Background()
+	db, ii, txs := filledInvIndexOfSize(t, 1000, 16, 31, logger)
+	mergeInverted(t, db, ii, txs)
+
+	memDb, memII := testDbAndInvertedIndexOpts(t, 16, true, logger)
+	fillInvIndex(t, memDb, memII, txs, 31)
+	require.NoError(memII.openFolder())
+
+	roTx, err := db.BeginRo(ctx)
+	require.NoError(err)
+	defer roTx.Rollback()
+	memTx, err := memDb.BeginRw(ctx)
+	require.NoError(err)
+	defer memTx.Rollback()
+
+	ic, memIc := ii.BeginFilesRo(), memII.BeginFilesRo()
+	defer ic.Close()
+	defer memIc.Close()
+	require.NotEmpty(ic.files)
+	require.Empty(memIc.files)
+
+	for keyNum := uint64(1); keyNum <= 32; keyNum++ {
+		var k [8]byte
+		binary.BigEndian.PutUint64(k[:], keyNum)
+		for _, r := range [][2]int{{0, 976}, {400, 1000}, {100, 102}} {
+			label := fmt.Sprintf("keyNum=%d, range=[%d,%d)", keyNum, r[0], r[1])
+			want, err := ic.IdxRange(k[:], r[0], r[1], order.Asc, -1, roTx)
+			require.NoError(err, label)
+			got, err := memIc.IdxRange(k[:], r[0], r[1], order.Asc, -1, memTx)
+			require.NoError(err, label)
+			require.Equal(stream.ToArrU64Must(want), stream.ToArrU64Must(got), label)
+
+			want, err = ic.IdxRange(k[:], r[1]-1, r[0]-1, order.Desc, 2, roTx)
+			require.NoError(err, label)
+			got, err = memIc.IdxRange(k[:], r[1]-1, r[0]-1, order.Desc, 2, memTx)
+			require.NoError(err, label)
+			require.Equal(stream.ToArrU64Must(want), stream.ToArrU64Must(got), label)
+		}
+	}
+
+	var a, b [8]byte
+	binary.BigEndian.PutUint64(a[:], 2)
+	binary.BigEndian.PutUint64(b[:], 3)
+	want, err := ic.IntersectTxNums(a[:], b[:], 0, txs+1, roTx)
+	require.NoError(err)
+	got, err := memIc.IntersectTxNums(a[:], b[:], 0, txs+1, memTx)
+	require.NoError(err)
+	require.Equal(want, got)
+
+	changedKeys := func(ic *InvertedIndexRoTx, tx kv.Tx) (keys []string) {
+		it := ic.IterateChangedKeys(990, 1000, tx)
+		defer it.Close()
+		for it.HasNext() {
+			keys = append(keys, fmt.Sprintf("%x", it.Next(nil)))
+		}
+		return keys
+	}
+	require.Equal(changedKeys(ic, roTx), changedKeys(memIc, memTx))
+
+	// no files - nothing to collate, and nothing can be pruned
+	_, err = memII.collate(ctx, 0, memTx)
+	require.ErrorIs(err, errInMemNoFiles)
+	stat, err := memIc.Prune(ctx, memTx, 0, txs, math.MaxUint64, nil, false, nil)
+	require.NoError(err)
+	require.True(stat.PrunedNothing())
+}
+
+func TestInvIndexStepSizes(t *testing.T) {
+	t.Parallel()
+	logger, require := log.New(), require.New(t)
+	db, ii, txs := filledInvIndexOfSize(t, 1000, 16, 31, logger)
+	mergeInverted(t, db, ii, txs)
+
+	sizes := ii.StepSizes()
+	require.NotEmpty(sizes)
+	var total int64
+	for _, st := range sizes {
+		require.Less(st.FromStep, st.ToStep)
+		require.Positive(st.DataBytes)
+		require.Positive(st.IndexBytes)
+		total += st.DataBytes + st.IndexBytes
+	}
+
+	var dirSize int64
+	for _, dir := range []string{ii.dirs.SnapIdx, ii.dirs.SnapAccessors} {
+		entries, err := os.ReadDir(dir)
+		require.NoError(err)
+		for _, e := range entries {
+			if !strings.HasPrefix(e.Name(), "v1-"+ii.filenameBase+".") {
+				continue
+			}
+			info, err := e.Info()
+			require.NoError(err)
+			dirSize += info.Size()
+		}
+	}
+	require.Equal(dirSize, total)
+}
+
+func TestInvIndex_Checksum(t *testing.T) { // not parallel: changes VerifyChecksumOnOpen
+	logger, require := log.New(), require.New(t)
+	db, ii, txs := filledInvIndexOfSize(t, 1000, 16, 31, logger)
+	mergeInverted(t, db, ii, txs)
+
+	ic := ii.BeginFilesRo()
+	var efPaths []string
+	for _, item := range ic.files {
+		efPaths = append(efPaths, item.src.decompressor.FilePath())
+	}
+	ic.Close()
+	require.Greater(len(efPaths), 1)
+	for _, fPath := range efPaths {
+		require.FileExists(fPath + checksumFileExt)
+		require.NoFileExists(fPath + checksumFileExt + ".tmp")
+		require.NoError(verifyChecksum(fPath))
+	}
+
+	// flip 1 byte of first file
+	data, err := os.ReadFile(efPaths[0])
+	require.NoError(err)
+	data[len(data)-1] ^= 0xff
+	require.NoError(os.WriteFile(efPaths[0], data, 0644))
+	require.ErrorContains(verifyChecksum(efPaths[0]), filepath.Base(efPaths[0]))
+
+	reopen := func() (fileNames []string) {
+		ii.Close()
+		require.NoError(ii.openFolder())
+		ii.reCalcVisibleFiles(ii.dirtyFilesEndTxNumMinimax())
+		ic := ii.BeginFilesRo()
+		defer ic.Close()
+		for _, item := range ic.files {
+			fileNames = append(fileNames, item.src.decompressor.FilePath())
+		}
+		return fileNames
+	}
+	require.Equal(efPaths, reopen()) // verification is disabled by default
+
+	defer func(v bool) { VerifyChecksumOnOpen = v }(VerifyChecksumOnOpen)
+	VerifyChecksumOnOpen = true
+	require.Equal(efPaths[1:], reopen())
+}
+
+func TestInvIndexKeyCount(t *testing.T) {
+	t.Parallel()
+
+	logger, require := log.New(), require.New(t)
+	// key k is added on txNums k, 2k, ...: keys 1..filesEnd-1 are in files, bigger keys only in DB
+	db, ii, txs := filledInvIndexOfSize(t, 1000, 16, 1200, logger)
+
+	ic := ii.BeginFilesRo()
+	count, err := ic.KeyCount()
+	require.NoError(err)
+	require.Zero(count)
+	ic.Close()
+
+	mergeInverted(t, db, ii, txs)
+	ic = ii.BeginFilesRo()
+	defer ic.Close()
+	require.Greater(len(ic.files), 1)
+	filesEnd := ic.files.EndTxNum()
+
+	var accessorsSum uint64
+	for _, item := range ic.files {
+		accessorsSum += item.src.index.KeyCount()
+	}
+	count, err = ic.KeyCount()
+	require.NoError(err)
+	require.Equal(filesEnd-1, count)
+	require.Greater(accessorsSum, count)
+}
+
+func TestInvIndexMergeIndexDirs(t *testing.T) {
+	t.Parallel()
+
+	logger, require := log.New(), require.New(t)
+	ctx := context.Background()
+	// older: merged files 0-32, 32-48, 48-56, 56-60, 60-61
+	db, ii, txs := filledInvIndexOfSize(t, 1000, 16, 31, logger)
+	mergeInverted(t, db, ii, txs)
+
+	// newer: steps 20-40 only, other keys and txNums
+	newer := func(keyNum, txNum uint64) bool { return keyNum <= 8 && (txNum+keyNum)%7 == 0 }
+	newDb, newII := testDbAndInvertedIndex(t, 16, logger)
+	t.Cleanup(newDb.Close)
+	tx, err := newDb.BeginRw(ctx)
+	require.NoError(err)
+	defer tx.Rollback()
+	ic := newII.BeginFilesRo()
+	writer := ic.NewWriter()
+	for txNum := 20 * newII.aggregationStep; txNum < 40*newII.aggregationStep; txNum++ {
+		writer.SetTxNum(txNum)
+		for keyNum := uint64(1); keyNum <= 31; keyNum++ {
+			if newer(keyNum, txNum) {
+				var k [8]byte
+				binary.BigEndian.PutUint64(k[:], keyNum)
+				require.NoError(writer.Add(k[:]))
+			}
+		}
+	}
+	require.NoError(writer.Flush(ctx, tx))
+	writer.close()
+	ic.Close()
+	for step := uint64(20); step < 40; step++ {
+		bs, err := newII.collate(ctx, step, tx)
+		require.NoError(err)
+		sf, err := newII.buildFiles(ctx, step, bs, background.NewProgressSet())
+		require.NoError(err)
+		newII.integrateDirtyFiles(sf, step*newII.aggregationStep, (step+1)*newII.aggregationStep)
+	}
+
+	copyFiles := func(dir, pattern string) {
+		matches, err := filepath.Glob(pattern)
+		require.NoError(err)
+		for _, fPath := range matches {
+			data, err := os.ReadFile(fPath)
+			require.NoError(err)
+			require.NoError(os.WriteFile(filepath.Join(dir, filepath.Base(fPath)), data, 0644))
+		}
+	}
+	dstDir, srcDir := t.TempDir(), t.TempDir()
+	copyFiles(dstDir, filepath.Join(ii.dirs.SnapIdx, "*.ef*"))
+	copyFiles(dstDir, filepath.Join(ii.dirs.SnapAccessors, "*.efi"))
+	copyFiles(srcDir, filepath.Join(newII.dirs.SnapIdx, "*.ef*"))
+	copyFiles(srcDir, filepath.Join(newII.dirs.SnapAccessors, "*.efi"))
+	// sub-set of 0-32 with name of piece 0-20: garbage is removed, not the piece
+	require.NoError(os.WriteFile(filepath.Join(dstDir, "v1-inv.0-20.ef"), []byte("garbage"), 0644))
+
+	// src file which can't be opened: accessors build fails after pieces are written, old files are kept
+	brokenDir := t.TempDir()
+	require.NoError(os.WriteFile(filepath.Join(brokenDir, "v1-inv.20-40.ef"), []byte("broken"), 0644))
+	require.Error(ii.MergeIndexDirs(ctx, dstDir, brokenDir))
+	require.FileExists(filepath.Join(dstDir, "v1-inv.0-32.ef"))
+	require.FileExists(filepath.Join(dstDir, "v1-inv.32-48.ef"))
+	require.FileExists(filepath.Join(dstDir, "v1-inv.0-32.efi"))
+
+	require.NoError(ii.MergeIndexDirs(ctx, dstDir, srcDir))
+
+	names, err := filesFromDir(srcDir)
+	require.NoError(err)
+	require.Empty(names)
+	efs, err := filepath.Glob(filepath.Join(dstDir, "*.ef"))
+	require.NoError(err)
+	require.Len(efs, 5+20)
+	for _, name := range []string{"v1-inv.0-20.ef", "v1-inv.20-21.ef", "v1-inv.39-40.ef", "v1-inv.40-48.ef", "v1-inv.60-61.ef"} {
+		require.FileExists(filepath.Join(dstDir, name))
+		require.FileExists(filepath.Join(dstDir, name+checksumFileExt))
+		require.FileExists(filepath.Join(dstDir, strings.TrimSuffix(name, ".ef")+".efi"))
+	}
+	require.NoFileExists(filepath.Join(dstDir, "v1-inv.0-32.ef"))
+	require.NoFileExists(filepath.Join(dstDir, "v1-inv.0-32.efi"))
+
+	// open result by fresh InvertedIndex
+	resDb, res := testDbAndInvertedIndex(t, 16, logger)
+	t.Cleanup(resDb.Close)
+	copyFiles(res.dirs.SnapIdx, filepath.Join(dstDir, "*.ef*"))
+	copyFiles(res.dirs.SnapAccessors, filepath.Join(dstDir, "*.efi"))
+	require.NoError(res.openFolder())
+	res.reCalcVisibleFiles(res.dirtyFilesEndTxNumMinimax())
+	resIc := res.BeginFilesRo()
+	defer resIc.Close()
+	endTxNum := resIc.files.EndTxNum()
+	require.Equal(61*res.aggregationStep, endTxNum)
+	for keyNum := uint64(1); keyNum <= 31; keyNum++ {
+		var k [8]byte
+		binary.BigEndian.PutUint64(k[:], keyNum)
+		var expect []uint64
+		for txNum := uint64(1); txNum < endTxNum; txNum++ {
+			if step := txNum / res.aggregationStep; step >= 20 && step < 40 {
+				if newer(keyNum, txNum) {
+					expect = append(expect, txNum)
+				}
+			} else if txNum%keyNum == 0 {
+				expect = append(expect, txNum)
+			}
+		}
+		it, err := resIc.IdxRange(k[:], 0, int(endTxNum), order.Asc, -1, nil)
+		require.NoError(err)
+		require.Equal(expect, stream.ToArrU64Must(it), keyNum)
+	}
+}
+
+func TestInvIndexEfZstd(t *testing.T) {
+	t.Parallel()
+
+	logger, require := log.New(), require.New(t)
+	ctx := context.Background()
+	logEvery := time.NewTicker(30 * time.Second)
+	defer logEvery.Stop()
+	filesSize := func(ii *InvertedIndex) (size int64) {
+		ic := ii.BeginFilesRo()
+		defer ic.Close()
+		for _, item := range ic.files {
+			size += item.src.decompressor.Size()
+		}
+		return size
+	}
+
+	plainDb, plainII, txs := filledInvIndex(t, logger)
+	mergeInverted(t, plainDb, plainII, txs)
+
+	// first half of steps is collated without zstd: readers and merge see both kinds of files
+	db, ii, _ := filledInvIndex(t, logger)
+	tx, err := db.BeginRw(ctx)
+	require.NoError(err)
+	defer tx.Rollback()
+	lastStep := txs/ii.aggregationStep - 1
+	for step := uint64(0); step < lastStep; step++ {
+		ii.efZstd = step >= lastStep/2
+		bs, err := ii.collate(ctx, step, tx)
+		require.NoError(err)
+		sf, err := ii.buildFiles(ctx, step, bs, background.NewProgressSet())
+		require.NoError(err)
+		ii.integrateDirtyFiles(sf, step*ii.aggregationStep, (step+1)*ii.aggregationStep)
+		ii.reCalcVisibleFiles(ii.dirtyFilesEndTxNumMinimax())
+		ic := ii.BeginFilesRo()
+		_, err = ic.Prune(ctx, tx, step*ii.aggregationStep, (step+1)*ii.aggregationStep, math.MaxUint64, logEvery, false, nil)
+		ic.Close()
+		require.NoError(err)
+	}
+	require.NoError(tx.Commit())
+	checkRanges(t, db, ii, txs)
+
+	for {
+		ic := ii.BeginFilesRo()
+		mr := ic.findMergeRange(ii.dirtyFilesEndTxNumMinimax(), ii.aggregationStep*StepsInColdFile)
+		if !mr.needMerge {
+			ic.Close()
+			break
+		}
+		outs, err := ic.staticFilesInRange(mr.from, mr.to)
+		require.NoError(err)
+		in, err := ic.mergeFiles(ctx, outs, mr.from, mr.to, background.NewProgressSet())
+		require.NoError(err)
+		ii.integrateMergedDirtyFiles(outs, in)
+		ii.reCalcVisibleFiles(ii.dirtyFilesEndTxNumMinimax())
+		ic.Close()
+	}
+	checkRanges(t, db, ii, txs)
+	require.Less(filesSize(ii), filesSize(plainII))
+}
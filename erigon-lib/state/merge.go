@@ -28,6 +28,7 @@ import (
 	"strings"
 
 	"github.com/tidwall/btree"
+	"golang.org/x/sync/errgroup"
 
 	"github.com/erigontech/erigon-lib/common"
 	"github.com/erigontech/erigon-lib/common/background"
@@ -97,12 +98,14 @@ func (r DomainRanges) String() string {
 
 func (r DomainRanges) any() bool { return r.values.needMerge || r.history.any() }
 
-func (dt *DomainRoTx) FirstStepNotInFiles() uint64 { return dt.files.EndTxNum() / dt.d.aggregationStep }
+func (dt *DomainRoTx) FirstStepNotInFiles() uint64 {
+	return StepOfTxNum(dt.files.EndTxNum(), dt.d.aggregationStep)
+}
 func (ht *HistoryRoTx) FirstStepNotInFiles() uint64 {
-	return ht.files.EndTxNum() / ht.h.aggregationStep
+	return StepOfTxNum(ht.files.EndTxNum(), ht.h.aggregationStep)
 }
 func (iit *InvertedIndexRoTx) FirstStepNotInFiles() uint64 {
-	return iit.files.EndTxNum() / iit.ii.aggregationStep
+	return StepOfTxNum(iit.files.EndTxNum(), iit.ii.aggregationStep)
 }
 
 // findMergeRange
@@ -214,6 +217,32 @@ func (iit *InvertedIndexRoTx) findMergeRange(maxEndTxNum, maxSpan uint64) *Merge
 	return &MergeRange{minFound, startTxNum, endTxNum}
 }
 
+// findMergeRanges - like findMergeRange, but returns all ranges which can be merged now.
+// Merge ranges are aligned to power of 2 - so they are either nested or don't overlap:
+// only biggest ranges are returned - they don't share files and can be merged concurrently.
+//
+// 0-1,1-2,2-3,3-4 maxSpan=2: allow merge 0-2 and 2-4
+func (iit *InvertedIndexRoTx) findMergeRanges(maxEndTxNum, maxSpan uint64) (res []*MergeRange) {
+	for _, item := range iit.files {
+		if item.endTxNum > maxEndTxNum {
+			continue
+		}
+		endStep := StepOfTxNum(item.endTxNum, iit.ii.aggregationStep)
+		spanStep := endStep & -endStep // Extract rightmost bit in the binary representation of endStep, this corresponds to size of maximally possible merge ending at endStep
+		span := min(spanStep*iit.ii.aggregationStep, maxSpan)
+		start := item.endTxNum - span
+		if start >= item.startTxNum {
+			continue
+		}
+		// new range covers all previous ranges which start inside it
+		for len(res) > 0 && res[len(res)-1].from >= start {
+			res = res[:len(res)-1]
+		}
+		res = append(res, &MergeRange{true, start, item.endTxNum})
+	}
+	return res
+}
+
 type HistoryRanges struct {
 	history MergeRange
 	index   MergeRange
@@ -249,22 +278,24 @@ func (iit *InvertedIndexRoTx) BuildOptionalMissedIndices(ctx context.Context, ps
 
 // staticFilesInRange returns list of static files with txNum in specified range [startTxNum; endTxNum)
 // files are in the descending order of endTxNum
-func (dt *DomainRoTx) staticFilesInRange(r DomainRanges) (valuesFiles, indexFiles, historyFiles []*filesItem) {
+func (dt *DomainRoTx) staticFilesInRange(r DomainRanges) (valuesFiles, indexFiles, historyFiles []*filesItem, err error) {
 	if r.history.any() {
-		var err error
 		indexFiles, historyFiles, err = dt.ht.staticFilesInRange(r.history)
 		if err != nil {
-			panic(err)
+			return nil, nil, nil, err
 		}
 	}
 	if r.values.needMerge {
-		for _, item := range dt.files {
+		for i, item := range dt.files {
 			if item.startTxNum < r.values.from {
 				continue
 			}
 			if item.endTxNum > r.values.to {
 				break
 			}
+			if err = dt.openFile(i); err != nil {
+				return nil, nil, nil, err
+			}
 			valuesFiles = append(valuesFiles, item.src)
 		}
 		for _, f := range valuesFiles {
@@ -276,16 +307,19 @@ func (dt *DomainRoTx) staticFilesInRange(r DomainRanges) (valuesFiles, indexFile
 	return
 }
 
-func (iit *InvertedIndexRoTx) staticFilesInRange(startTxNum, endTxNum uint64) []*filesItem {
+func (iit *InvertedIndexRoTx) staticFilesInRange(startTxNum, endTxNum uint64) ([]*filesItem, error) {
 	files := make([]*filesItem, 0, len(iit.files))
 
-	for _, item := range iit.files {
+	for i, item := range iit.files {
 		if item.startTxNum < startTxNum {
 			continue
 		}
 		if item.endTxNum > endTxNum {
 			break
 		}
+		if err := iit.openFile(i); err != nil {
+			return nil, err
+		}
 		files = append(files, item.src)
 	}
 	for _, f := range files {
@@ -294,19 +328,19 @@ func (iit *InvertedIndexRoTx) staticFilesInRange(startTxNum, endTxNum uint64) []
 		}
 	}
 
-	return files
+	return files, nil
 }
 
 func (ht *HistoryRoTx) staticFilesInRange(r HistoryRanges) (indexFiles, historyFiles []*filesItem, err error) {
 	if !r.history.needMerge && r.index.needMerge {
-		indexFiles = ht.iit.staticFilesInRange(r.index.from, r.index.to)
-		return indexFiles, historyFiles, nil
+		indexFiles, err = ht.iit.staticFilesInRange(r.index.from, r.index.to)
+		return indexFiles, historyFiles, err
 	}
 
 	if r.history.needMerge {
 		// Get history files from HistoryRoTx (no "garbage/overalps"), but index files not from InvertedIndexRoTx
 		// because index files may already be merged (before `kill -9`) and it means not visible in InvertedIndexRoTx
-		for _, item := range ht.files {
+		for i, item := range ht.files {
 			if item.startTxNum < r.history.from {
 				continue
 			}
@@ -314,9 +348,15 @@ func (ht *HistoryRoTx) staticFilesInRange(r HistoryRanges) (indexFiles, historyF
 				break
 			}
 
+			if err = ht.openFile(i); err != nil {
+				return nil, nil, err
+			}
 			historyFiles = append(historyFiles, item.src)
 			idxFile, ok := ht.h.InvertedIndex.dirtyFiles.Get(item.src)
 			if ok {
+				if err = ht.iit.openFileOf(idxFile); err != nil {
+					return nil, nil, err
+				}
 				indexFiles = append(indexFiles, idxFile)
 			} else {
 				walkErr := fmt.Errorf("History.staticFilesInRange: required file not found: v1-%s.%d-%d.efi", ht.h.filenameBase, item.startTxNum/ht.h.aggregationStep, item.endTxNum/ht.h.aggregationStep)
@@ -417,7 +457,14 @@ func (dt *DomainRoTx) mergeFiles(ctx context.Context, domainFiles, indexFiles, h
 	fromStep, toStep := r.values.from/r.aggStep, r.values.to/r.aggStep
 	kvFilePath := dt.d.kvFilePath(fromStep, toStep)
 
-	kvFile, err := seg.NewCompressor(ctx, "merge domain "+dt.d.filenameBase, kvFilePath, dt.d.dirs.Tmp, dt.d.compressCfg, log.LvlTrace, dt.d.logger)
+	tmpDir, removeTmp, err := dt.d.createTmpDir(dt.d.filenameBase + ".domain.merge")
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("merge %s tmp dir: %w", dt.d.filenameBase, err)
+	}
+	defer removeTmp()
+
+	compressCfg := dt.d.compressCfgOfRange(r.values.from, max(r.values.to, dt.files.EndTxNum()))
+	kvFile, err := seg.NewCompressor(ctx, "merge domain "+dt.d.filenameBase, kvFilePath, tmpDir, compressCfg, log.LvlTrace, dt.d.logger)
 	if err != nil {
 		return nil, nil, nil, fmt.Errorf("merge %s compressor: %w", dt.d.filenameBase, err)
 	}
@@ -430,9 +477,11 @@ func (dt *DomainRoTx) mergeFiles(ctx context.Context, domainFiles, indexFiles, h
 	if dt.d.noFsync {
 		kvWriter.DisableFsync()
 	}
+	kvSum := newChecksum(kvWriter)
 	p := ps.AddNew("merge "+path.Base(kvFilePath), 1)
 	defer ps.Delete(p)
 
+	charge := mergeReadCharge{t: dt.d.mergeThrottle}
 	var cp CursorHeap
 	heap.Init(&cp)
 	for _, item := range domainFiles {
@@ -441,6 +490,9 @@ func (dt *DomainRoTx) mergeFiles(ctx context.Context, domainFiles, indexFiles, h
 		if g.HasNext() {
 			key, _ := g.Next(nil)
 			val, _ := g.Next(nil)
+			if err = charge.read(ctx, key, val); err != nil {
+				return nil, nil, nil, err
+			}
 			heap.Push(&cp, &CursorItem{
 				t:          FILE_CURSOR,
 				dg:         g,
@@ -466,15 +518,19 @@ func (dt *DomainRoTx) mergeFiles(ctx context.Context, domainFiles, indexFiles, h
 		// Advance all the items that have this key (including the top)
 		for cp.Len() > 0 && bytes.Equal(cp[0].key, lastKey) {
 			ci1 := heap.Pop(&cp).(*CursorItem)
+			dt.d.mergedKeys.Add(1)
 			if ci1.dg.HasNext() {
 				ci1.key, _ = ci1.dg.Next(nil)
 				ci1.val, _ = ci1.dg.Next(nil)
+				if err = charge.read(ctx, ci1.key, ci1.val); err != nil {
+					return nil, nil, nil, err
+				}
 				heap.Push(&cp, ci1)
 			}
 		}
 
 		// For the rest of types, empty value means deletion
-		deleted := r.values.from == 0 && len(lastVal) == 0
+		deleted := r.values.from == 0 && !dt.d.noSquashDeletions && len(lastVal) == 0
 		if !deleted {
 			if keyBuf != nil {
 				if vt != nil {
@@ -513,22 +569,28 @@ func (dt *DomainRoTx) mergeFiles(ctx context.Context, domainFiles, indexFiles, h
 			return nil, nil, nil, err
 		}
 	}
+	if err = charge.flush(ctx); err != nil {
+		return nil, nil, nil, err
+	}
 	if err = kvWriter.Compress(); err != nil {
 		return nil, nil, nil, err
 	}
 	kvWriter.Close()
 	kvWriter = nil
+	if err = writeChecksum(kvFilePath, kvSum.Sum32()); err != nil {
+		return nil, nil, nil, err
+	}
 	ps.Delete(p)
 
 	valuesIn = newFilesItem(r.values.from, r.values.to, dt.d.aggregationStep)
 	valuesIn.frozen = false
-	if valuesIn.decompressor, err = seg.NewDecompressor(kvFilePath); err != nil {
+	if valuesIn.decompressor, err = seg.NewDecompressorWithAccess(kvFilePath, dt.d.dataAccess); err != nil {
 		return nil, nil, nil, fmt.Errorf("merge %s decompressor [%d-%d]: %w", dt.d.filenameBase, r.values.from, r.values.to, err)
 	}
 
 	if UseBpsTree {
 		btPath := dt.d.kvBtFilePath(fromStep, toStep)
-		valuesIn.bindex, err = CreateBtreeIndexWithDecompressor(btPath, DefaultBtreeM, valuesIn.decompressor, dt.d.compression, *dt.d.salt, ps, dt.d.dirs.Tmp, dt.d.logger, dt.d.noFsync)
+		valuesIn.bindex, err = CreateBtreeIndexWithDecompressor(btPath, DefaultBtreeM, valuesIn.decompressor, dt.d.compression, *dt.d.salt, ps, tmpDir, dt.d.logger, dt.d.noFsync)
 		if err != nil {
 			return nil, nil, nil, fmt.Errorf("merge %s btindex [%d-%d]: %w", dt.d.filenameBase, r.values.from, r.values.to, err)
 		}
@@ -588,17 +650,25 @@ func (iit *InvertedIndexRoTx) mergeFiles(ctx context.Context, files []*filesItem
 	}
 	fromStep, toStep := startTxNum/iit.ii.aggregationStep, endTxNum/iit.ii.aggregationStep
 
+	tmpDir, removeTmp, err := iit.ii.createTmpDir(iit.ii.filenameBase + ".merge.ii")
+	if err != nil {
+		return nil, fmt.Errorf("merge %s tmp dir: %w", iit.ii.filenameBase, err)
+	}
+	defer removeTmp()
+
 	datPath := iit.ii.efFilePath(fromStep, toStep)
-	if comp, err = seg.NewCompressor(ctx, "merge idx "+iit.ii.filenameBase, datPath, iit.ii.dirs.Tmp, iit.ii.compressCfg, log.LvlTrace, iit.ii.logger); err != nil {
+	if comp, err = seg.NewCompressor(ctx, "merge idx "+iit.ii.filenameBase, datPath, tmpDir, iit.ii.compressCfg, log.LvlTrace, iit.ii.logger); err != nil {
 		return nil, fmt.Errorf("merge %s inverted index compressor: %w", iit.ii.filenameBase, err)
 	}
 	if iit.ii.noFsync {
 		comp.DisableFsync()
 	}
-	write := seg.NewWriter(comp, iit.ii.compression)
+	write := seg.NewWriter(comp, iit.ii.efWriterCompression())
+	sum := newChecksum(write)
 	p := ps.AddNew(path.Base(datPath), 1)
 	defer ps.Delete(p)
 
+	charge := mergeReadCharge{t: iit.ii.mergeThrottle}
 	var cp CursorHeap
 	heap.Init(&cp)
 
@@ -608,6 +678,9 @@ func (iit *InvertedIndexRoTx) mergeFiles(ctx context.Context, files []*filesItem
 		if g.HasNext() {
 			key, _ := g.Next(nil)
 			val, _ := g.Next(nil)
+			if err = charge.read(ctx, key, val); err != nil {
+				return nil, err
+			}
 			//fmt.Printf("heap push %s [%d] %x\n", item.decompressor.FilePath(), item.endTxNum, key)
 			heap.Push(&cp, &CursorItem{
 				t:        FILE_CURSOR,
@@ -634,6 +707,7 @@ func (iit *InvertedIndexRoTx) mergeFiles(ctx context.Context, files []*filesItem
 		// Advance all the items that have this key (including the top)
 		for cp.Len() > 0 && bytes.Equal(cp[0].key, lastKey) {
 			ci1 := heap.Pop(&cp).(*CursorItem)
+			iit.ii.mergedKeys.Add(1)
 			if mergedOnce {
 				if lastVal, err = mergeEfs(ci1.val, lastVal, nil); err != nil {
 					return nil, fmt.Errorf("merge %s inverted index: %w", iit.ii.filenameBase, err)
@@ -645,6 +719,9 @@ func (iit *InvertedIndexRoTx) mergeFiles(ctx context.Context, files []*filesItem
 			if ci1.dg.HasNext() {
 				ci1.key, _ = ci1.dg.Next(nil)
 				ci1.val, _ = ci1.dg.Next(nil)
+				if err = charge.read(ctx, ci1.key, ci1.val); err != nil {
+					return nil, err
+				}
 				// fmt.Printf("heap next push %s [%d] %x\n", ii.indexKeysTable, ci1.endTxNum, ci1.key)
 				heap.Push(&cp, ci1)
 			}
@@ -673,14 +750,20 @@ func (iit *InvertedIndexRoTx) mergeFiles(ctx context.Context, files []*filesItem
 			return nil, err
 		}
 	}
+	if err = charge.flush(ctx); err != nil {
+		return nil, err
+	}
 	if err = write.Compress(); err != nil {
 		return nil, err
 	}
 	comp.Close()
 	comp = nil
+	if err = writeChecksum(datPath, sum.Sum32()); err != nil {
+		return nil, err
+	}
 
 	outItem = newFilesItem(startTxNum, endTxNum, iit.ii.aggregationStep)
-	if outItem.decompressor, err = seg.NewDecompressor(datPath); err != nil {
+	if outItem.decompressor, err = seg.NewDecompressorWithAccess(datPath, iit.ii.dataAccess); err != nil {
 		return nil, fmt.Errorf("merge %s decompressor [%d-%d]: %w", iit.ii.filenameBase, startTxNum, endTxNum, err)
 	}
 	ps.Delete(p)
@@ -696,6 +779,150 @@ func (iit *InvertedIndexRoTx) mergeFiles(ctx context.Context, files []*filesItem
 	return outItem, nil
 }
 
+// mergeLoopStep - merges all independent ranges found by `findMergeRanges`: see `mergeIndependentRanges`.
+// Used standalone: in Aggregator dirtyFiles are integrated under it's lock - see Aggregator.mergeInvertedIndex.
+func (ii *InvertedIndex) mergeLoopStep(ctx context.Context, maxEndTxNum, maxSpan uint64, ps *background.ProgressSet) (somethingMerged bool, err error) {
+	iit := ii.BeginFilesRo()
+	defer iit.Close()
+	outs, ins, err := iit.mergeIndependentRanges(ctx, maxEndTxNum, maxSpan, ps)
+	if err != nil {
+		return true, err
+	}
+	if len(ins) == 0 {
+		return false, nil
+	}
+
+	for i := range ins {
+		ii.integrateMergedDirtyFiles(outs[i], ins[i])
+	}
+	ii.reCalcVisibleFiles(ii.dirtyFilesEndTxNumMinimax())
+
+	after := ii.BeginFilesRo()
+	defer after.Close()
+	for _, in := range ins {
+		after.cleanAfterMerge(in)
+	}
+	return true, nil
+}
+
+// mergeIndependentRanges - merges all independent ranges found by `findMergeRanges`, at most `ii.mergeWorkers` ranges
+// at a time. First error cancels other merges. Files of `outs[i]` are merged into `ins[i]`, caller integrates them.
+func (iit *InvertedIndexRoTx) mergeIndependentRanges(ctx context.Context, maxEndTxNum, maxSpan uint64, ps *background.ProgressSet) (outs [][]*filesItem, ins []*filesItem, err error) {
+	ranges := iit.findMergeRanges(maxEndTxNum, maxSpan)
+	if len(ranges) == 0 {
+		return nil, nil, nil
+	}
+
+	outs = make([][]*filesItem, len(ranges))
+	ins = make([]*filesItem, len(ranges))
+	g, gCtx := errgroup.WithContext(ctx)
+	g.SetLimit(iit.ii.mergeWorkers)
+	for i, r := range ranges {
+		if outs[i], err = iit.staticFilesInRange(r.from, r.to); err != nil {
+			return nil, nil, err
+		}
+	}
+	for i, r := range ranges {
+		i, r := i, r
+		g.Go(func() (err error) {
+			ins[i], err = iit.mergeFiles(gCtx, outs[i], r.from, r.to, ps)
+			return err
+		})
+	}
+	if err = g.Wait(); err != nil {
+		for _, in := range ins {
+			if in != nil {
+				in.closeFilesAndRemove()
+			}
+		}
+		return nil, nil, err
+	}
+	return outs, ins, nil
+}
+
+// findSmallFilesRanges - in runs of adjacent non-frozen files, each smaller than `maxInputSize` bytes, biggest ranges
+// of 2+ files aligned to power of 2 (same grid as `findMergeRange`: regular merge can continue from compacted files).
+//
+// 0-1,1-2,2-3,3-4,4-5,5-6,6-7: compact 0-4 and 4-6
+func (iit *InvertedIndexRoTx) findSmallFilesRanges(maxInputSize uint64) (res []*MergeRange) {
+	var run []visibleFile
+	flush := func() {
+		for i := 0; i < len(run); {
+			fromStep := StepOfTxNum(run[i].startTxNum, iit.ii.aggregationStep)
+			last := i
+			for j := i + 1; j < len(run); j++ {
+				span := StepOfTxNum(run[j].endTxNum, iit.ii.aggregationStep) - fromStep
+				if span&(span-1) == 0 && fromStep%span == 0 {
+					last = j
+				}
+			}
+			if last > i {
+				res = append(res, &MergeRange{true, run[i].startTxNum, run[last].endTxNum})
+			}
+			i = last + 1
+		}
+		run = run[:0]
+	}
+	for _, item := range iit.files {
+		small := !item.src.frozen && uint64(item.src.decompressor.Size()) < maxInputSize
+		if !small || (len(run) > 0 && run[len(run)-1].endTxNum != item.startTxNum) {
+			flush()
+		}
+		if small {
+			run = append(run, item)
+		}
+	}
+	flush()
+	return res
+}
+
+// CompactSmallFiles - merges small adjacent files into bigger ones (see `findSmallFilesRanges`), not waiting for
+// step-doubling rules of regular merge (for example after catch-up: many tiny files which regular merge will not touch soon).
+// Not supported for InvertedIndex of History: its .ef and .v files must be merged in same ranges.
+// Must not run concurrently with regular merge of same InvertedIndex.
+func (ii *InvertedIndex) CompactSmallFiles(ctx context.Context, maxInputSize uint64) error {
+	if ii.ownedByHistory {
+		return fmt.Errorf("InvertedIndex(%s).CompactSmallFiles: index of History", ii.filenameBase)
+	}
+	iit := ii.BeginFilesRo()
+	defer iit.Close()
+	ranges := iit.findSmallFilesRanges(maxInputSize)
+	if len(ranges) == 0 {
+		return nil
+	}
+
+	ps := background.NewProgressSet()
+	outs := make([][]*filesItem, len(ranges))
+	ins := make([]*filesItem, len(ranges))
+	for i, r := range ranges {
+		var err error
+		if outs[i], err = iit.staticFilesInRange(r.from, r.to); err != nil {
+			for _, in := range ins[:i] {
+				in.closeFilesAndRemove()
+			}
+			return fmt.Errorf("InvertedIndex(%s).CompactSmallFiles: %w", ii.filenameBase, err)
+		}
+		if ins[i], err = iit.mergeFiles(ctx, outs[i], r.from, r.to, ps); err != nil {
+			for _, in := range ins[:i] {
+				in.closeFilesAndRemove()
+			}
+			return fmt.Errorf("InvertedIndex(%s).CompactSmallFiles: %w", ii.filenameBase, err)
+		}
+	}
+
+	for i := range ranges {
+		ii.integrateMergedDirtyFiles(outs[i], ins[i])
+	}
+	ii.reCalcVisibleFiles(ii.dirtyFilesEndTxNumMinimax())
+
+	after := ii.BeginFilesRo()
+	defer after.Close()
+	for _, in := range ins {
+		after.cleanAfterMerge(in)
+	}
+	return nil
+}
+
 func (ht *HistoryRoTx) mergeFiles(ctx context.Context, indexFiles, historyFiles []*filesItem, r HistoryRanges, ps *background.ProgressSet) (indexIn, historyIn *filesItem, err error) {
 	if !r.any() {
 		return nil, nil, nil
@@ -746,20 +973,28 @@ func (ht *HistoryRoTx) mergeFiles(ctx context.Context, indexFiles, historyFiles
 		fromStep, toStep := r.history.from/ht.h.aggregationStep, r.history.to/ht.h.aggregationStep
 		datPath := ht.h.vFilePath(fromStep, toStep)
 		idxPath := ht.h.vAccessorFilePath(fromStep, toStep)
-		if comp, err = seg.NewCompressor(ctx, "merge hist "+ht.h.filenameBase, datPath, ht.h.dirs.Tmp, ht.h.compressCfg, log.LvlTrace, ht.h.logger); err != nil {
+		var tmpDir string
+		var removeTmp func()
+		if tmpDir, removeTmp, err = ht.h.createTmpDir(ht.h.filenameBase + ".merge.hist"); err != nil {
+			return nil, nil, fmt.Errorf("merge %s tmp dir: %w", ht.h.filenameBase, err)
+		}
+		defer removeTmp()
+		if comp, err = seg.NewCompressor(ctx, "merge hist "+ht.h.filenameBase, datPath, tmpDir, ht.h.compressCfg, log.LvlTrace, ht.h.logger); err != nil {
 			return nil, nil, fmt.Errorf("merge %s history compressor: %w", ht.h.filenameBase, err)
 		}
 		compr := seg.NewWriter(comp, ht.h.compression)
 		if ht.h.noFsync {
 			compr.DisableFsync()
 		}
+		sum := newChecksum(compr)
 		p := ps.AddNew(path.Base(datPath), 1)
 		defer ps.Delete(p)
 
+		charge := mergeReadCharge{t: ht.h.mergeThrottle}
 		var cp CursorHeap
 		heap.Init(&cp)
 		for _, item := range indexFiles {
-			g := seg.NewReader(item.decompressor.MakeGetter(), ht.h.compression)
+			g := seg.NewReader(item.decompressor.MakeGetter(), ht.h.InvertedIndex.compression)
 			g.Reset(0)
 			if g.HasNext() {
 				var g2 *seg.Reader
@@ -774,6 +1009,9 @@ func (ht *HistoryRoTx) mergeFiles(ctx context.Context, indexFiles, historyFiles
 				}
 				key, _ := g.Next(nil)
 				val, _ := g.Next(nil)
+				if err = charge.read(ctx, key, val); err != nil {
+					return nil, nil, err
+				}
 				heap.Push(&cp, &CursorItem{
 					t:        FILE_CURSOR,
 					dg:       g,
@@ -804,6 +1042,9 @@ func (ht *HistoryRoTx) mergeFiles(ctx context.Context, indexFiles, historyFiles
 					}
 
 					valBuf, _ = ci1.dg2.Next(valBuf[:0])
+					if err = charge.read(ctx, valBuf); err != nil {
+						return nil, nil, err
+					}
 					if err = compr.AddWord(valBuf); err != nil {
 						return nil, nil, err
 					}
@@ -813,16 +1054,25 @@ func (ht *HistoryRoTx) mergeFiles(ctx context.Context, indexFiles, historyFiles
 				if ci1.dg.HasNext() {
 					ci1.key, _ = ci1.dg.Next(nil)
 					ci1.val, _ = ci1.dg.Next(nil)
+					if err = charge.read(ctx, ci1.key, ci1.val); err != nil {
+						return nil, nil, err
+					}
 					heap.Push(&cp, ci1)
 				}
 			}
 		}
+		if err = charge.flush(ctx); err != nil {
+			return nil, nil, err
+		}
 		if err = compr.Compress(); err != nil {
 			return nil, nil, err
 		}
 		compr.Close()
 		comp = nil
-		if decomp, err = seg.NewDecompressor(datPath); err != nil {
+		if err = writeChecksum(datPath, sum.Sum32()); err != nil {
+			return nil, nil, err
+		}
+		if decomp, err = seg.NewDecompressorWithAccess(datPath, ht.h.dataAccess); err != nil {
 			return nil, nil, err
 		}
 		ps.Delete(p)
@@ -832,9 +1082,9 @@ func (ht *HistoryRoTx) mergeFiles(ctx context.Context, indexFiles, historyFiles
 		if rs, err = recsplit.NewRecSplit(recsplit.RecSplitArgs{
 			KeyCount:   keyCount,
 			Enums:      false,
-			BucketSize: 2000,
-			LeafSize:   8,
-			TmpDir:     ht.h.dirs.Tmp,
+			BucketSize: ht.h.accessor.bucketSize,
+			LeafSize:   ht.h.accessor.leafSize,
+			TmpDir:     tmpDir,
 			IndexFile:  idxPath,
 			Salt:       ht.h.salt,
 			NoFsync:    ht.h.noFsync,
@@ -0,0 +1,92 @@
+// Copyright 2024 The Erigon Authors
+// This file is part of Erigon.
+//
+// Erigon is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Erigon is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with Erigon. If not, see <http://www.gnu.org/licenses/>.
+
+package state
+
+import (
+	"cmp"
+	"path/filepath"
+	"slices"
+)
+
+// mergePlanKVOverlap - rough share of .kv keys which are present in more than 1 merged file (only latest value is kept).
+// .ef and .v files have no overlap: every txNum belongs to 1 file.
+const mergePlanKVOverlap = 0.1
+
+// MergePlan - one merge which merge loop would do: input files -> output file
+type MergePlan struct {
+	Inputs           []string
+	Output           string
+	FromStep, ToStep uint64
+	EstimatedSize    int64 // sum of inputs sizes minus overlap
+}
+
+// PlanMerge - dry-run of merge loop (findMergeRange -> mergeFiles -> until nothing to merge) over visible files:
+// returns .kv/.v/.ef merges in order they will happen. Nothing is written. Outputs of planned merges are used as
+// inputs of next planned merges - their size is also estimated.
+func (dt *DomainRoTx) PlanMerge(maxEndTxNum, maxSpan uint64) (plan []MergePlan) {
+	d, h := dt.d, dt.ht.h
+	// shadow RoTx: only files ranges are used by findMergeRange. Not refcounted - must not be closed.
+	sim := &DomainRoTx{d: d, files: slices.Clone(dt.files),
+		ht: &HistoryRoTx{h: h, files: slices.Clone(dt.ht.files),
+			iit: &InvertedIndexRoTx{ii: h.InvertedIndex, files: slices.Clone(dt.ht.iit.files)}}}
+	sizes := map[*filesItem]int64{}
+	for {
+		r := sim.findMergeRange(maxEndTxNum, maxSpan)
+		if !r.any() {
+			return plan
+		}
+		if r.values.needMerge {
+			var p MergePlan
+			sim.files, p = planMergeFiles(sim.files, r.values, d.aggregationStep, mergePlanKVOverlap, sizes, d.kvFilePath)
+			plan = append(plan, p)
+		}
+		if r.history.history.needMerge {
+			var p MergePlan
+			sim.ht.files, p = planMergeFiles(sim.ht.files, r.history.history, d.aggregationStep, 0, sizes, h.vFilePath)
+			plan = append(plan, p)
+		}
+		if r.history.index.needMerge {
+			var p MergePlan
+			sim.ht.iit.files, p = planMergeFiles(sim.ht.iit.files, r.history.index, d.aggregationStep, 0, sizes, h.efFilePath)
+			plan = append(plan, p)
+		}
+	}
+}
+
+// planMergeFiles - replaces `files` in range `r` by 1 planned file. `sizes` has estimated sizes of planned files.
+func planMergeFiles(files visibleFiles, r MergeRange, aggStep uint64, overlap float64, sizes map[*filesItem]int64, filePath func(fromStep, toStep uint64) string) (visibleFiles, MergePlan) {
+	p := MergePlan{FromStep: r.from / aggStep, ToStep: r.to / aggStep, Output: filepath.Base(filePath(r.from/aggStep, r.to/aggStep))}
+	out := &filesItem{startTxNum: r.from, endTxNum: r.to}
+	res := make(visibleFiles, 0, len(files))
+	for _, item := range files {
+		if item.startTxNum < r.from || item.endTxNum > r.to {
+			res = append(res, item)
+			continue
+		}
+		p.Inputs = append(p.Inputs, filepath.Base(filePath(item.startTxNum/aggStep, item.endTxNum/aggStep)))
+		if size, ok := sizes[item.src]; ok {
+			p.EstimatedSize += size
+		} else if item.src.decompressor != nil {
+			p.EstimatedSize += item.src.decompressor.Size()
+		}
+	}
+	p.EstimatedSize = int64(float64(p.EstimatedSize) * (1 - overlap))
+	sizes[out] = p.EstimatedSize
+	i, _ := slices.BinarySearchFunc(res, r.from, func(item visibleFile, from uint64) int { return cmp.Compare(item.startTxNum, from) })
+	res = slices.Insert(res, i, visibleFile{startTxNum: r.from, endTxNum: r.to, src: out})
+	return res, p
+}
@@ -63,7 +63,8 @@ func TestFindMergeRangeCornerCases(t *testing.T) {
 		assert.Equal(t, 0, int(mr.from))
 		assert.Equal(t, 4, int(mr.to))
 
-		idxF := ic.staticFilesInRange(mr.from, mr.to)
+		idxF, err := ic.staticFilesInRange(mr.from, mr.to)
+		require.NoError(t, err)
 		assert.Equal(t, 3, len(idxF))
 	})
 	t.Run("hist: > 2 unmerged files", func(t *testing.T) {
@@ -430,7 +431,8 @@ func TestFindMergeRangeCornerCases(t *testing.T) {
 		assert.True(t, mr.needMerge)
 		require.Equal(t, 0, int(mr.from))
 		require.Equal(t, 4, int(mr.to))
-		idxFiles := ic.staticFilesInRange(mr.from, mr.to)
+		idxFiles, err := ic.staticFilesInRange(mr.from, mr.to)
+		require.NoError(t, err)
 		require.Equal(t, 3, len(idxFiles))
 	})
 }
@@ -18,13 +18,29 @@ type AggregatorStep struct {
 }
 
 func (a *Aggregator) StepSize() uint64 { return a.aggregationStep }
+
+// MakeSteps - steps must be closed by AggregatorStep.Close
 func (a *Aggregator) MakeSteps() ([]*AggregatorStep, error) {
 	frozenAndIndexed := a.DirtyFilesEndTxNumMinimax()
-	accountSteps := a.d[kv.AccountsDomain].MakeSteps(frozenAndIndexed)
-	codeSteps := a.d[kv.CodeDomain].MakeSteps(frozenAndIndexed)
-	storageSteps := a.d[kv.StorageDomain].MakeSteps(frozenAndIndexed)
-	commitmentSteps := a.d[kv.CommitmentDomain].MakeSteps(frozenAndIndexed)
+	var domainSteps [kv.DomainLen][]*HistoryStep
+	closeSteps := func() {
+		for _, steps := range domainSteps {
+			for _, step := range steps {
+				step.Close()
+			}
+		}
+	}
+	for _, d := range []kv.Domain{kv.AccountsDomain, kv.CodeDomain, kv.StorageDomain, kv.CommitmentDomain} {
+		steps, err := a.d[d].MakeSteps(frozenAndIndexed)
+		if err != nil {
+			closeSteps()
+			return nil, err
+		}
+		domainSteps[d] = steps
+	}
+	accountSteps, codeSteps, storageSteps, commitmentSteps := domainSteps[kv.AccountsDomain], domainSteps[kv.CodeDomain], domainSteps[kv.StorageDomain], domainSteps[kv.CommitmentDomain]
 	if len(accountSteps) != len(storageSteps) || len(storageSteps) != len(codeSteps) {
+		closeSteps()
 		return nil, fmt.Errorf("different limit of steps (try merge snapshots): accountSteps=%d, storageSteps=%d, codeSteps=%d", len(accountSteps), len(storageSteps), len(codeSteps))
 	}
 	steps := make([]*AggregatorStep, len(accountSteps))
@@ -119,3 +135,13 @@ func (as *AggregatorStep) Clone() *AggregatorStep {
 		code:     as.code.Clone(),
 	}
 }
+
+// Close - releases files of step. Clones of step must not be used after Close
+func (as *AggregatorStep) Close() {
+	as.accounts.Close()
+	as.storage.Close()
+	as.code.Close()
+	if as.commitment != nil {
+		as.commitment.Close()
+	}
+}
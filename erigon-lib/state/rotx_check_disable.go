@@ -0,0 +1,29 @@
+// Copyright 2024 The Erigon Authors
+// This file is part of Erigon.
+//
+// Erigon is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Erigon is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with Erigon. If not, see <http://www.gnu.org/licenses/>.
+
+//go:build !assert
+
+package state
+
+// roTxCheck - see rotx_check_enable.go. Zero-size no-op without `assert` build tag
+type roTxCheck struct{}
+
+func newRoTxCheck() roTxCheck               { return roTxCheck{} }
+func (roTxCheck) close(kind, name string)   {}
+func (roTxCheck) iterOpened() roTxIterCheck { return roTxIterCheck{} }
+func (*roTxIterCheck) close()               {}
+
+type roTxIterCheck struct{}
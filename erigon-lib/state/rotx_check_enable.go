@@ -0,0 +1,65 @@
+// Copyright 2024 The Erigon Authors
+// This file is part of Erigon.
+//
+// Erigon is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Erigon is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with Erigon. If not, see <http://www.gnu.org/licenses/>.
+
+//go:build assert
+
+package state
+
+import (
+	"fmt"
+	"sync/atomic"
+)
+
+// roTxCheck - life-cycle checks of RoTx (only with `assert` build tag): panic on double Close
+// and on Close while iterator over it's files is still open. Because files refcount is decremented by Close.
+type roTxCheck struct{ state *roTxCheckState }
+
+type roTxCheckState struct {
+	closed    atomic.Bool
+	openIters atomic.Int32
+}
+
+func newRoTxCheck() roTxCheck { return roTxCheck{state: &roTxCheckState{}} }
+
+func (c roTxCheck) close(kind, name string) {
+	if c.state == nil {
+		return
+	}
+	if c.state.closed.Swap(true) {
+		panic(fmt.Sprintf("assert: double Close of %s(%s)", kind, name))
+	}
+	if n := c.state.openIters.Load(); n > 0 {
+		panic(fmt.Sprintf("assert: Close of %s(%s) while %d iterators are open", kind, name, n))
+	}
+}
+
+func (c roTxCheck) iterOpened() roTxIterCheck {
+	if c.state == nil {
+		return roTxIterCheck{}
+	}
+	c.state.openIters.Add(1)
+	return roTxIterCheck{state: c.state}
+}
+
+// roTxIterCheck - iterator side of roTxCheck. Iterator's Close may be called multiple times
+type roTxIterCheck struct{ state *roTxCheckState }
+
+func (c *roTxIterCheck) close() {
+	if c.state != nil {
+		c.state.openIters.Add(-1)
+		c.state = nil
+	}
+}
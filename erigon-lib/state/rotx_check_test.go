@@ -0,0 +1,62 @@
+// Copyright 2024 The Erigon Authors
+// This file is part of Erigon.
+//
+// Erigon is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Erigon is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with Erigon. If not, see <http://www.gnu.org/licenses/>.
+
+//go:build assert
+
+package state
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/erigontech/erigon-lib/kv/order"
+	"github.com/erigontech/erigon-lib/log/v3"
+)
+
+func TestRoTxCheck(t *testing.T) {
+	t.Parallel()
+
+	// no files: recsplit accessors can't be built with `assert` tag yet
+	db, ii := testDbAndInvertedIndex(t, 16, log.New())
+	fillInvIndex(t, db, ii, 100, 31)
+	roTx, err := db.BeginRo(context.Background())
+	require.NoError(t, err)
+	defer roTx.Rollback()
+
+	t.Run("double Close", func(t *testing.T) {
+		ic := ii.BeginFilesRo()
+		ic.Close()
+		require.PanicsWithValue(t, "assert: double Close of InvertedIndexRoTx(inv)", ic.Close)
+	})
+	t.Run("Close with open iterator", func(t *testing.T) {
+		ic := ii.BeginFilesRo()
+		it := ic.SingleStepKeys(context.Background())
+		require.PanicsWithValue(t, "assert: Close of InvertedIndexRoTx(inv) while 1 iterators are open", ic.Close)
+		it.Close()
+		it.Close() // iterator's Close is idempotent
+	})
+	t.Run("Close after iterators", func(t *testing.T) {
+		ic := ii.BeginFilesRo()
+		// frozen part is empty: dropped (and closed) by stream.Union
+		it, err := ic.IdxRange([]byte{0, 0, 0, 0, 0, 0, 0, 1}, 0, -1, order.Asc, -1, roTx)
+		require.NoError(t, err)
+		require.True(t, it.HasNext())
+		it.Close()
+		ic.Close()
+	})
+}
@@ -74,14 +74,18 @@ func (a *Aggregator) sqeezeDomainFile(ctx context.Context, domain kv.Domain, fro
 	}
 	defer c.Close()
 	w := seg.NewWriter(c, compression)
+	sum := newChecksum(w)
 	if err := w.ReadFrom(r); err != nil {
 		return err
 	}
+	if err := removeChecksum(to); err != nil {
+		return err
+	}
 	if err := c.Compress(); err != nil {
 		return err
 	}
 
-	return nil
+	return writeChecksum(to, sum.Sum32())
 }
 
 // SqueezeCommitmentFiles should be called only when NO EXECUTION is running.
@@ -100,6 +104,13 @@ func (ac *AggregatorRoTx) SqueezeCommitmentFiles(mergedAgg *AggregatorRoTx) erro
 	mergedStorageFiles := mergedAgg.d[kv.StorageDomain].d.dirtyFiles.Items()
 	mergedCommitFiles := mergedAgg.d[kv.CommitmentDomain].d.dirtyFiles.Items()
 
+	for _, dt := range []*DomainRoTx{accounts, storage, commitment} {
+		for i := range dt.files {
+			if err := dt.openFile(i); err != nil {
+				return err
+			}
+		}
+	}
 	for _, f := range accounts.files {
 		f.src.decompressor.EnableMadvNormal()
 	}
@@ -156,6 +167,7 @@ func (ac *AggregatorRoTx) SqueezeCommitmentFiles(mergedAgg *AggregatorRoTx) erro
 	var (
 		obsoleteFiles  []string
 		temporalFiles  []string
+		checksums      = map[string]uint32{} // of temporalFiles
 		processedFiles int
 		ai, si         int
 		sizeDelta      = datasize.B
@@ -206,6 +218,7 @@ func (ac *AggregatorRoTx) SqueezeCommitmentFiles(mergedAgg *AggregatorRoTx) erro
 			reader.Reset(0)
 
 			writer := seg.NewWriter(squeezedCompr, commitment.d.compression)
+			sum := newChecksum(writer)
 			rng := MergeRange{needMerge: true, from: af.startTxNum, to: af.endTxNum}
 			vt, err := commitment.commitmentValTransformDomain(rng, accounts, storage, af, sf)
 			if err != nil {
@@ -255,6 +268,7 @@ func (ac *AggregatorRoTx) SqueezeCommitmentFiles(mergedAgg *AggregatorRoTx) erro
 				return err
 			}
 			temporalFiles = append(temporalFiles, squeezedPath)
+			checksums[squeezedPath] = sum.Sum32()
 
 			delta, deltaP, err := getSizeDelta(originalPath, squeezedPath)
 			if err != nil {
@@ -293,9 +307,15 @@ func (ac *AggregatorRoTx) SqueezeCommitmentFiles(mergedAgg *AggregatorRoTx) erro
 	ac.a.logger.Info("[sqeeze_migration] indices removed, renaming temporal files ")
 
 	for _, path := range temporalFiles {
+		if err := removeChecksum(strings.TrimSuffix(path, sqExt)); err != nil {
+			return err
+		}
 		if err := os.Rename(path, strings.TrimSuffix(path, sqExt)); err != nil {
 			return err
 		}
+		if err := writeChecksum(strings.TrimSuffix(path, sqExt), checksums[path]); err != nil {
+			return err
+		}
 		ac.a.logger.Debug("[sqeeze_migration] temporal file renaming", "path", path)
 	}
 	ac.a.logger.Info("[sqeeze_migration] done", "sizeDelta", sizeDelta.HR(), "files", len(mergedAccountFiles))
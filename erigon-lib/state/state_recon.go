@@ -92,7 +92,7 @@ func (rh ReconHeapOlderFirst) Less(i, j int) bool {
 }
 
 type ScanIteratorInc struct {
-	g         *seg.Getter
+	g         *seg.Reader
 	key       []byte
 	nextTxNum uint64
 	hasNext   bool
@@ -106,11 +106,11 @@ func (sii *ScanIteratorInc) advance() {
 		sii.hasNext = false
 		return
 	}
-	val, _ := sii.g.NextUncompressed()
+	val, _ := sii.g.Next(nil)
 	max := eliasfano32.Max(val)
 	sii.nextTxNum = max
 	if sii.g.HasNext() {
-		sii.key, _ = sii.g.NextUncompressed()
+		sii.key, _ = sii.g.Next(nil)
 	} else {
 		sii.key = nil
 	}
@@ -128,10 +128,10 @@ func (sii *ScanIteratorInc) Next() (uint64, error) {
 
 func (hs *HistoryStep) iterateTxs() *ScanIteratorInc {
 	var sii ScanIteratorInc
-	sii.g = hs.indexFile.getter
+	sii.g = seg.NewReader(hs.indexFile.getter, hs.efCompression)
 	sii.g.Reset(0)
 	if sii.g.HasNext() {
-		sii.key, _ = sii.g.NextUncompressed()
+		sii.key, _ = sii.g.Next(nil)
 		sii.hasNext = true
 	} else {
 		sii.hasNext = false
@@ -142,7 +142,7 @@ func (hs *HistoryStep) iterateTxs() *ScanIteratorInc {
 
 type HistoryIteratorInc struct {
 	uptoTxNum    uint64
-	indexG       *seg.Getter
+	indexG       *seg.Reader
 	historyG     *seg.Getter
 	r            *recsplit.IndexReader
 	key          []byte
@@ -154,13 +154,13 @@ type HistoryIteratorInc struct {
 
 func (hs *HistoryStep) interateHistoryBeforeTxNum(txNum uint64) *HistoryIteratorInc {
 	var hii HistoryIteratorInc
-	hii.indexG = hs.indexFile.getter
+	hii.indexG = seg.NewReader(hs.indexFile.getter, hs.efCompression)
 	hii.historyG = hs.historyFile.getter
 	hii.r = hs.historyFile.reader
 	hii.compressVals = hs.compressVals
 	hii.indexG.Reset(0)
 	if hii.indexG.HasNext() {
-		hii.key, _ = hii.indexG.NextUncompressed()
+		hii.key, _ = hii.indexG.Next(nil)
 		hii.uptoTxNum = txNum
 		hii.hasNext = true
 	} else {
@@ -180,7 +180,7 @@ func (hii *HistoryIteratorInc) advance() {
 	}
 	hii.nextKey = nil
 	for hii.nextKey == nil && hii.key != nil {
-		val, _ := hii.indexG.NextUncompressed()
+		val, _ := hii.indexG.Next(nil)
 		n, ok := eliasfano32.Seek(val, hii.uptoTxNum)
 		if ok {
 			var txKey [8]byte
@@ -197,7 +197,7 @@ func (hii *HistoryIteratorInc) advance() {
 			}
 		}
 		if hii.indexG.HasNext() {
-			hii.key, _ = hii.indexG.NextUncompressed()
+			hii.key, _ = hii.indexG.Next(nil)
 		} else {
 			hii.key = nil
 		}
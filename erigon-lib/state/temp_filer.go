@@ -0,0 +1,58 @@
+// Copyright 2024 The Erigon Authors
+// This file is part of Erigon.
+//
+// Erigon is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Erigon is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with Erigon. If not, see <http://www.gnu.org/licenses/>.
+
+package state
+
+import (
+	"os"
+	"sync"
+)
+
+// TempFiler - allocates space for temporary files of collation and merge. Default implementation `NewTempFiler(dirs.Tmp)`.
+// Allows put temp files to separated fast disk, RAM-disk, shard them by name, etc...
+type TempFiler interface {
+	// Create - creates empty directory for temporary files of 1 collation/merge of file `name`
+	Create(name string) (dir string, err error)
+	// Remove - removes directory created by `Create` with all files inside
+	Remove(dir string) error
+}
+
+type tmpDirFiler struct{ tmpdir string }
+
+func NewTempFiler(tmpdir string) TempFiler { return tmpDirFiler{tmpdir: tmpdir} }
+
+func (t tmpDirFiler) Create(name string) (string, error) {
+	if err := os.MkdirAll(t.tmpdir, 0755); err != nil {
+		return "", err
+	}
+	return os.MkdirTemp(t.tmpdir, name+"-")
+}
+func (t tmpDirFiler) Remove(dir string) error { return os.RemoveAll(dir) }
+
+// createTmpDir - `remove` can be called many times: only first call removes directory
+func (ii *InvertedIndex) createTmpDir(name string) (dir string, remove func(), err error) {
+	if dir, err = ii.tempFiler.Create(name); err != nil {
+		return "", nil, err
+	}
+	var once sync.Once
+	return dir, func() {
+		once.Do(func() {
+			if err := ii.tempFiler.Remove(dir); err != nil {
+				ii.logger.Warn("[agg] remove tmp dir", "dir", dir, "err", err)
+			}
+		})
+	}, nil
+}
@@ -1884,6 +1884,11 @@ func ReconstituteState(ctx context.Context, s *StageState, dirs datadir.Dirs, wo
 	if err != nil {
 		return err
 	}
+	defer func() {
+		for _, as := range aggSteps {
+			as.Close()
+		}
+	}()
 	if len(aggSteps) == 0 {
 		return nil
 	}